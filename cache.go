@@ -0,0 +1,239 @@
+package nakama
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Cache is a response cache for read-mostly endpoints, used as a client
+// interceptor (see WithCache).
+//
+// Responses to GET requests for endpoints with a TTL are cached, keyed by the
+// session's user id, endpoint and query. Cached responses are served until
+// their TTL expires. Expired responses are served for a further stale
+// duration, while the response is refreshed in the background. Identical
+// in-flight requests are coalesced into a single request, which runs
+// detached from the cancellation of its callers, with the context values
+// (such as headers) of the caller that started it.
+//
+// Successful mutating requests (any method other than GET) invalidate the
+// cached responses of the endpoints registered for the request's path (see
+// WithInvalidation).
+type Cache struct {
+	ttls          map[string]time.Duration
+	stale         time.Duration
+	invalidations map[string][]string
+	entries       map[string]*cacheEntry
+	calls         map[string]*cacheCall
+	gen           uint64
+	mu            sync.Mutex
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	endpoint string
+	res      proto.Message
+	created  time.Time
+}
+
+// cacheCall is an in-flight request.
+type cacheCall struct {
+	done chan struct{}
+	res  proto.Message
+	err  error
+}
+
+// NewCache creates a response cache, caching the Account, Users,
+// UsersUsernames, UserGroups and Groups endpoints for ttl. Mutating account
+// requests invalidate the account and user endpoints, and mutating group
+// requests invalidate the group and user group endpoints.
+//
+// Endpoints are paths, where a * segment matches any single path segment.
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{
+		ttls: map[string]time.Duration{
+			"v2/account":      ttl,
+			"v2/user":         ttl,
+			"v2/user/*/group": ttl,
+			"v2/group":        ttl,
+		},
+		invalidations: map[string][]string{
+			"v2/account": {"v2/account", "v2/user"},
+			"v2/group":   {"v2/group", "v2/user/*/group"},
+		},
+		entries: make(map[string]*cacheEntry),
+		calls:   make(map[string]*cacheCall),
+	}
+}
+
+// WithTTL sets the TTL for the endpoint. A TTL of 0 disables caching the
+// endpoint.
+func (c *Cache) WithTTL(endpoint string, ttl time.Duration) *Cache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttls[endpoint] = ttl
+	return c
+}
+
+// WithStale sets the duration expired responses are served for, while the
+// response is refreshed in the background.
+func (c *Cache) WithStale(stale time.Duration) *Cache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = stale
+	return c
+}
+
+// WithInvalidation sets the endpoints invalidated by successful mutating
+// requests with a path starting with prefix.
+func (c *Cache) WithInvalidation(prefix string, endpoints ...string) *Cache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations[prefix] = endpoints
+	return c
+}
+
+// Invalidate removes the cached responses for the endpoints.
+func (c *Cache) Invalidate(endpoints ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(endpoints)
+}
+
+// Clear removes all cached responses.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+	c.gen++
+}
+
+// invalidate removes the cached responses for the endpoints.
+func (c *Cache) invalidate(endpoints []string) {
+	for key, entry := range c.entries {
+		for _, endpoint := range endpoints {
+			if entry.endpoint == endpoint {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+	c.gen++
+}
+
+// endpoint returns the endpoint matching the path, and its TTL.
+func (c *Cache) endpoint(path string) (string, time.Duration) {
+	for endpoint, ttl := range c.ttls {
+		if matchEndpoint(endpoint, path) {
+			return endpoint, ttl
+		}
+	}
+	return "", 0
+}
+
+// interceptor returns the cache's interceptor for the client.
+func (c *Cache) interceptor(cl *Client) Interceptor {
+	return func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}, next InterceptorFunc) error {
+		if method != "GET" {
+			if err := next(ctx, method, typ, query, msg, v); err != nil {
+				return err
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for prefix, endpoints := range c.invalidations {
+				if strings.HasPrefix(typ, prefix) {
+					c.invalidate(endpoints)
+				}
+			}
+			return nil
+		}
+		dst, ok := v.(proto.Message)
+		if !ok {
+			return next(ctx, method, typ, query, msg, v)
+		}
+		c.mu.Lock()
+		endpoint, ttl := c.endpoint(typ)
+		if ttl <= 0 {
+			c.mu.Unlock()
+			return next(ctx, method, typ, query, msg, v)
+		}
+		key := cl.SessionUserId() + " " + typ + "?" + query.Encode()
+		// fetch starts the shared request, detached from the caller's
+		// cancellation, and bounded by the shared timeout
+		fetch := func(ctx context.Context) *cacheCall {
+			call := c.calls[key]
+			if call != nil {
+				return call
+			}
+			call = &cacheCall{
+				done: make(chan struct{}),
+			}
+			c.calls[key] = call
+			gen := c.gen
+			go func() {
+				ctx, cancel := context.WithTimeout(detachedContext{ctx}, sharedTimeout)
+				defer cancel()
+				res := dst.ProtoReflect().New().Interface()
+				err := next(ctx, method, typ, query, msg, res)
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				delete(c.calls, key)
+				if err == nil && gen == c.gen {
+					c.entries[key] = &cacheEntry{
+						endpoint: endpoint,
+						res:      res,
+						created:  time.Now(),
+					}
+				}
+				call.res, call.err = res, err
+				close(call.done)
+			}()
+			return call
+		}
+		if entry := c.entries[key]; entry != nil {
+			age := time.Since(entry.created)
+			if age < ttl+c.stale {
+				if ttl <= age {
+					fetch(ctx)
+				}
+				c.mu.Unlock()
+				proto.Reset(dst)
+				proto.Merge(dst, entry.res)
+				return nil
+			}
+			delete(c.entries, key)
+		}
+		call := fetch(ctx)
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-call.done:
+		}
+		if call.err != nil {
+			return call.err
+		}
+		proto.Reset(dst)
+		proto.Merge(dst, call.res)
+		return nil
+	}
+}
+
+// matchEndpoint returns true when the endpoint matches the path.
+func matchEndpoint(endpoint, path string) bool {
+	a, b := strings.Split(endpoint, "/"), strings.Split(path, "/")
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != "*" && a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,376 @@
+package nakama
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChannelCode is a channel message code.
+type ChannelCode int32
+
+// Channel message codes.
+const (
+	ChannelCodeChat         ChannelCode = 0
+	ChannelCodeUpdate       ChannelCode = 1
+	ChannelCodeRemove       ChannelCode = 2
+	ChannelCodeGroupJoin    ChannelCode = 3
+	ChannelCodeGroupAdd     ChannelCode = 4
+	ChannelCodeGroupLeave   ChannelCode = 5
+	ChannelCodeGroupKick    ChannelCode = 6
+	ChannelCodeGroupPromote ChannelCode = 7
+	ChannelCodeGroupBan     ChannelCode = 8
+	ChannelCodeGroupDemote  ChannelCode = 9
+)
+
+// ChannelHandler is an empty interface for channel handlers, as used by
+// Conn.JoinChannel. A type that supports any of the following smuggled
+// interfaces:
+//
+//	ChannelMessageHandler(context.Context, *nakama.ChannelMessage)
+//	ChannelMessageUpdateHandler(context.Context, *nakama.ChannelMessage)
+//	ChannelMessageRemoveHandler(context.Context, *nakama.ChannelMessage)
+//	ChannelPresenceEventHandler(context.Context, *nakama.ChannelPresenceEventMsg)
+//
+// Will have its methods called for the channel's messages, message updates,
+// message removals and presence events, respectively.
+type ChannelHandler interface{}
+
+// Channel is a joined realtime chat channel, created with Conn.JoinChannel.
+//
+// A channel tracks its live presences and message history, routing only the
+// channel's messages and presence events to its handlers. When the
+// connection's client is available, the most recent messages are retrieved
+// when joined, and messages missed while disconnected are retrieved after the
+// channel is rejoined following a reconnect, back to the most recent message
+// known before the reconnect. Messages received while joining are dispatched
+// to the handlers after the most recent messages are retrieved. Message
+// updates and removals are applied to the history in place.
+type Channel struct {
+	conn      *Conn
+	cl        *Client
+	id        string
+	res       *ChannelMsg
+	presences map[string]*UserPresenceMsg
+	messages  []*ChannelMessage
+	ids       map[string]bool
+	newest    time.Time
+	pending   []*Envelope
+	joined    bool
+	remove    func()
+
+	messageHandlers  []func(context.Context, *ChannelMessage)
+	updateHandlers   []func(context.Context, *ChannelMessage)
+	removeHandlers   []func(context.Context, *ChannelMessage)
+	presenceHandlers []func(context.Context, *ChannelPresenceEventMsg)
+
+	rw sync.RWMutex
+}
+
+// JoinChannel joins a realtime chat channel, returning a channel handle.
+// See ChannelHandler for the handlers that can be passed.
+func (conn *Conn) JoinChannel(ctx context.Context, msg *ChannelJoinMsg, handlers ...ChannelHandler) (*Channel, error) {
+	ch := &Channel{
+		conn:      conn,
+		presences: make(map[string]*UserPresenceMsg),
+		ids:       make(map[string]bool),
+	}
+	ch.cl, _ = conn.h.(*Client)
+	for _, handler := range handlers {
+		ch.addHandler(handler)
+	}
+	// listen before joining, buffering messages until the channel id is known
+	ch.remove = conn.listen(&connListener{
+		notify:    ch.notify,
+		reconnect: ch.reconnect,
+	})
+	res, err := msg.Send(ctx, conn)
+	if err != nil {
+		ch.remove()
+		return nil, err
+	}
+	ch.rw.Lock()
+	ch.id, ch.res = res.Id, res
+	ch.setPresences(res)
+	ch.rw.Unlock()
+	// retrieve the history before applying the buffered messages
+	if err := ch.backfill(ctx, time.Time{}, false); err != nil {
+		_ = ch.Close(ctx)
+		return nil, err
+	}
+	ch.rw.Lock()
+	ch.joined = true
+	pending := ch.pending
+	ch.pending = nil
+	ch.rw.Unlock()
+	for _, env := range pending {
+		ch.notify(ctx, env)
+	}
+	return ch, nil
+}
+
+// addHandler adds the handler's smuggled interfaces.
+func (ch *Channel) addHandler(handler ChannelHandler) {
+	if x, ok := handler.(interface {
+		ChannelMessageHandler(context.Context, *ChannelMessage)
+	}); ok {
+		ch.messageHandlers = append(ch.messageHandlers, x.ChannelMessageHandler)
+	}
+	if x, ok := handler.(interface {
+		ChannelMessageUpdateHandler(context.Context, *ChannelMessage)
+	}); ok {
+		ch.updateHandlers = append(ch.updateHandlers, x.ChannelMessageUpdateHandler)
+	}
+	if x, ok := handler.(interface {
+		ChannelMessageRemoveHandler(context.Context, *ChannelMessage)
+	}); ok {
+		ch.removeHandlers = append(ch.removeHandlers, x.ChannelMessageRemoveHandler)
+	}
+	if x, ok := handler.(interface {
+		ChannelPresenceEventHandler(context.Context, *ChannelPresenceEventMsg)
+	}); ok {
+		ch.presenceHandlers = append(ch.presenceHandlers, x.ChannelPresenceEventHandler)
+	}
+}
+
+// Id returns the channel id.
+func (ch *Channel) Id() string {
+	ch.rw.RLock()
+	defer ch.rw.RUnlock()
+	return ch.id
+}
+
+// Self returns the user's presence in the channel.
+func (ch *Channel) Self() *UserPresenceMsg {
+	ch.rw.RLock()
+	defer ch.rw.RUnlock()
+	return ch.res.Self
+}
+
+// RoomName returns the channel's room name, for room channels.
+func (ch *Channel) RoomName() string {
+	ch.rw.RLock()
+	defer ch.rw.RUnlock()
+	return ch.res.RoomName
+}
+
+// GroupId returns the channel's group id, for group channels.
+func (ch *Channel) GroupId() string {
+	ch.rw.RLock()
+	defer ch.rw.RUnlock()
+	return ch.res.GroupId
+}
+
+// Presences returns the channel's current presences, ordered by user id and
+// session id.
+func (ch *Channel) Presences() []*UserPresenceMsg {
+	ch.rw.RLock()
+	defer ch.rw.RUnlock()
+	return sortPresences(ch.presences)
+}
+
+// Messages returns the channel's known messages, ordered oldest first.
+func (ch *Channel) Messages() []*ChannelMessage {
+	ch.rw.RLock()
+	defer ch.rw.RUnlock()
+	return append([]*ChannelMessage(nil), ch.messages...)
+}
+
+// Send sends a message to the channel, marshaling v as JSON.
+func (ch *Channel) Send(ctx context.Context, v interface{}) (*ChannelMessageAckMsg, error) {
+	return ch.conn.ChannelMessageSend(ctx, ch.Id(), v)
+}
+
+// SendRaw sends a message with the raw content to the channel.
+func (ch *Channel) SendRaw(ctx context.Context, content string) (*ChannelMessageAckMsg, error) {
+	return ch.conn.ChannelMessageSendRaw(ctx, ch.Id(), content)
+}
+
+// Update updates a message in the channel, marshaling v as JSON.
+func (ch *Channel) Update(ctx context.Context, messageId string, v interface{}) (*ChannelMessageAckMsg, error) {
+	return ch.conn.ChannelMessageUpdate(ctx, ch.Id(), messageId, v)
+}
+
+// Remove removes a message from the channel.
+func (ch *Channel) Remove(ctx context.Context, messageId string) (*ChannelMessageAckMsg, error) {
+	return ch.conn.ChannelMessageRemove(ctx, ch.Id(), messageId)
+}
+
+// Close leaves the channel, and stops routing the channel's messages to its
+// handlers.
+func (ch *Channel) Close(ctx context.Context) error {
+	ch.remove()
+	return ch.conn.ChannelLeave(ctx, ch.Id())
+}
+
+// notify handles a connection notification.
+func (ch *Channel) notify(ctx context.Context, env *Envelope) {
+	switch v := env.Message.(type) {
+	case *Envelope_ChannelMessage:
+		if ch.buffer(env, v.ChannelMessage.ChannelId) {
+			return
+		}
+		ch.apply(ctx, v.ChannelMessage)
+	case *Envelope_ChannelPresenceEvent:
+		if ch.buffer(env, v.ChannelPresenceEvent.ChannelId) {
+			return
+		}
+		ch.rw.Lock()
+		for _, p := range v.ChannelPresenceEvent.Leaves {
+			delete(ch.presences, p.SessionId)
+		}
+		for _, p := range v.ChannelPresenceEvent.Joins {
+			ch.presences[p.SessionId] = p
+		}
+		ch.rw.Unlock()
+		for _, f := range ch.presenceHandlers {
+			go f(ctx, v.ChannelPresenceEvent)
+		}
+	}
+}
+
+// buffered returns true when the message is buffered until the channel is
+// joined. Must be called with the lock held.
+func (ch *Channel) buffered(messageId string) bool {
+	for _, env := range ch.pending {
+		if env.GetChannelMessage().GetMessageId() == messageId {
+			return true
+		}
+	}
+	return false
+}
+
+// buffer buffers the envelope when the channel has not been joined, returning
+// true when the envelope was buffered or is not for the channel.
+func (ch *Channel) buffer(env *Envelope, channelId string) bool {
+	ch.rw.Lock()
+	defer ch.rw.Unlock()
+	if !ch.joined {
+		ch.pending = append(ch.pending, env)
+		return true
+	}
+	return channelId != ch.id
+}
+
+// apply applies a message to the history, dispatching it to the handlers.
+func (ch *Channel) apply(ctx context.Context, msg *ChannelMessage) {
+	var handlers []func(context.Context, *ChannelMessage)
+	ch.rw.Lock()
+	switch ChannelCode(msg.Code.GetValue()) {
+	case ChannelCodeUpdate:
+		for i, m := range ch.messages {
+			if m.MessageId == msg.MessageId {
+				ch.messages[i] = msg
+			}
+		}
+		handlers = ch.updateHandlers
+	case ChannelCodeRemove:
+		for i, m := range ch.messages {
+			if m.MessageId == msg.MessageId {
+				ch.messages = append(ch.messages[:i:i], ch.messages[i+1:]...)
+				break
+			}
+		}
+		delete(ch.ids, msg.MessageId)
+		handlers = ch.removeHandlers
+	default:
+		if !ch.insert(msg) {
+			ch.rw.Unlock()
+			return
+		}
+		handlers = ch.messageHandlers
+	}
+	ch.rw.Unlock()
+	for _, f := range handlers {
+		go f(ctx, msg)
+	}
+}
+
+// insert inserts the message into the history, ordered by create time.
+// Returns false when the message is already known. Must be called with the
+// lock held.
+func (ch *Channel) insert(msg *ChannelMessage) bool {
+	if ch.ids[msg.MessageId] {
+		return false
+	}
+	ch.ids[msg.MessageId] = true
+	t := msg.CreateTime.AsTime()
+	if ch.newest.Before(t) {
+		ch.newest = t
+	}
+	i := sort.Search(len(ch.messages), func(i int) bool {
+		return t.Before(ch.messages[i].CreateTime.AsTime())
+	})
+	ch.messages = append(ch.messages, nil)
+	copy(ch.messages[i+1:], ch.messages[i:])
+	ch.messages[i] = msg
+	return true
+}
+
+// setPresences sets the presences from a channel join response. Must be
+// called with the lock held.
+func (ch *Channel) setPresences(res *ChannelMsg) {
+	ch.presences = make(map[string]*UserPresenceMsg)
+	for _, p := range res.Presences {
+		ch.presences[p.SessionId] = p
+	}
+	if res.Self != nil {
+		ch.presences[res.Self.SessionId] = res.Self
+	}
+}
+
+// reconnect handles a connection reconnect result, backfilling messages
+// missed while disconnected when the channel was rejoined.
+func (ch *Channel) reconnect(ctx context.Context, res *ReconnectResult) {
+	if res.Type != ReconnectChannel || res.Id != ch.Id() || res.State != ReconnectRejoined {
+		return
+	}
+	ch.rw.Lock()
+	if msg, ok := res.Res.(*ChannelMsg); ok {
+		ch.id, ch.res = msg.Id, msg
+		ch.setPresences(msg)
+	}
+	since := ch.newest
+	ch.rw.Unlock()
+	go func() {
+		if err := ch.backfill(ctx, since, true); err != nil {
+			ch.conn.h.Errf("unable to backfill channel %s: %v", ch.Id(), err)
+		}
+	}()
+}
+
+// backfill retrieves the channel's most recent messages. When since is zero,
+// up to a page of messages is retrieved, otherwise messages are retrieved
+// until a message created before since is reached. When gap is true, the
+// retrieved messages are dispatched to the handlers. Messages buffered until
+// the channel is joined are skipped, and are dispatched when applied.
+func (ch *Channel) backfill(ctx context.Context, since time.Time, gap bool) error {
+	if ch.cl == nil {
+		return nil
+	}
+	it := ChannelMessages(ch.Id()).WithForward(false).Iter(ctx, ch.cl)
+	defer it.Close()
+	var msgs []*ChannelMessage
+	for (len(msgs) < 100 || !since.IsZero()) && it.Next() {
+		msg := it.Value()
+		if !since.IsZero() && msg.CreateTime.AsTime().Before(since) {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		ch.rw.Lock()
+		ok := !ch.buffered(msgs[i].MessageId) && ch.insert(msgs[i])
+		ch.rw.Unlock()
+		if ok && gap {
+			for _, f := range ch.messageHandlers {
+				go f(ctx, msgs[i])
+			}
+		}
+	}
+	return nil
+}
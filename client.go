@@ -37,6 +37,31 @@ var DefaultWsPath = "/ws"
 // https://utcc.utoronto.ca/~cks/space/blog/programming/GoInterfaceSmuggling
 type AuthHandler interface{}
 
+// sharedTimeout is the timeout for requests shared by several callers, which
+// run detached from any one caller's context.
+const sharedTimeout = 30 * time.Second
+
+// detachedContext is a context with the values of its parent context, but
+// without the parent's deadline and cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+// Deadline satisfies the context.Context interface.
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done satisfies the context.Context interface.
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err satisfies the context.Context interface.
+func (detachedContext) Err() error {
+	return nil
+}
+
 // Client is a nakama client.
 type Client struct {
 	cl          *http.Client
@@ -46,12 +71,19 @@ type Client struct {
 	password    string
 	refreshAuto bool
 	expiryGrace time.Duration
+	store       SessionStore
+	retry       *RetryPolicy
+	grpc        *grpcClient
+
+	interceptors []Interceptor
 
 	session             *SessionResponse
 	expiry              time.Time
 	expiryGraced        time.Time
 	expiryRefresh       time.Time
 	expiryRefreshGraced time.Time
+	refresh             *refreshCall
+	timer               *time.Timer
 
 	marshaler   *protojson.MarshalOptions
 	unmarshaler *protojson.UnmarshalOptions
@@ -87,6 +119,17 @@ func New(opts ...Option) *Client {
 		o(cl)
 	}
 	cl.url = strings.TrimSuffix(cl.url, "/")
+	// restore session
+	if cl.store != nil {
+		switch session, err := cl.store.Load(); {
+		case err != nil:
+			cl.Errf("unable to restore session: %v", err)
+		case session != nil:
+			if err := cl.sessionRestore(session); err != nil {
+				cl.Errf("unable to restore session: %v", err)
+			}
+		}
+	}
 	return cl
 }
 
@@ -126,7 +169,7 @@ func (cl *Client) SocketURL() (string, error) {
 
 // Token returns the current session token. Satisfies the Handler interface.
 func (cl *Client) Token(ctx context.Context) (string, error) {
-	if cl.session == nil && cl.AuthHandler != nil {
+	if cl.SessionToken() == "" && cl.AuthHandler != nil {
 		if err := cl.AuthHandler(ctx, cl); err != nil {
 			return "", err
 		}
@@ -134,7 +177,7 @@ func (cl *Client) Token(ctx context.Context) (string, error) {
 	if err := cl.SessionRefresh(ctx); err != nil {
 		return "", err
 	}
-	return cl.session.Token, nil
+	return cl.SessionToken(), nil
 }
 
 // BuildRequest builds a http request.
@@ -150,6 +193,23 @@ func (cl *Client) BuildRequest(ctx context.Context, method, typ string, query ur
 		return nil, err
 	}
 	req.Header.Add("Accept", "application/json")
+	cl.addHeaders(ctx, req.Header, typ)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// addHeaders adds the headers from the context, and the basic auth for the
+// type, to header.
+func (cl *Client) addHeaders(ctx context.Context, header http.Header, typ string) {
+	if h, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		for k, v := range h {
+			for _, s := range v {
+				header.Add(k, s)
+			}
+		}
+	}
 	var auth *url.Userinfo
 	switch {
 	case cl.serverKey != "" && (strings.Contains(typ, "authenticate") || strings.Contains(typ, "refresh")):
@@ -158,12 +218,36 @@ func (cl *Client) BuildRequest(ctx context.Context, method, typ string, query ur
 		auth = url.UserPassword(cl.username, cl.password)
 	}
 	if auth != nil {
-		req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth.String())))
+		header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth.String())))
 	}
-	if body != nil {
-		req.Header.Add("Content-Type", "application/json")
+}
+
+// Interceptor is a http request interceptor, wrapping Client.Do. An
+// interceptor can inspect or modify the request message, call next to
+// continue the request, inspect or modify the decoded response v, or
+// short-circuit the request by not calling next.
+type Interceptor func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}, next InterceptorFunc) error
+
+// InterceptorFunc is the func passed to an interceptor to continue a request.
+type InterceptorFunc func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}) error
+
+// headerKey is the context key for request headers.
+type headerKey struct{}
+
+// HeaderContext returns a context that adds the header values to http
+// requests built with the context. Allows interceptors to add headers to a
+// request.
+func HeaderContext(ctx context.Context, header http.Header) context.Context {
+	if prev, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		merged := prev.Clone()
+		for k, v := range header {
+			for _, s := range v {
+				merged.Add(k, s)
+			}
+		}
+		header = merged
 	}
-	return req, nil
+	return context.WithValue(ctx, headerKey{}, header)
 }
 
 // Exec executes the request http request.
@@ -183,7 +267,10 @@ func (cl *Client) Exec(req *http.Request) (*http.Response, error) {
 // Do executes a http request with method, type and url query values, passing
 // msg as the request body (when not nil), and decoding the response body to v
 // (when not nil). Will attempt to refresh the session token if the session is
-// expired and refresh is true.
+// expired and refresh is true. Failed requests are retried per the client's
+// retry policy. Requests pass through the client's interceptors, in the order
+// added. When the client has a gRPC transport (see WithGrpc), the request is
+// executed as the equivalent gRPC call.
 //
 // Uses Protobuf's google.golang.org/protobuf/encoding/protojson package to
 // encode/decode msg and v when msg/v are a proto.Message. Otherwise uses Go's
@@ -191,18 +278,35 @@ func (cl *Client) Exec(req *http.Request) (*http.Response, error) {
 //
 // See: Marshal and Unmarshal.
 func (cl *Client) Do(ctx context.Context, method, typ string, auth bool, query url.Values, msg, v interface{}) error {
+	next := func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}) error {
+		return cl.do(ctx, method, typ, auth, query, msg, v)
+	}
+	for i := len(cl.interceptors) - 1; i >= 0; i-- {
+		f, n := cl.interceptors[i], next
+		next = func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}) error {
+			return f(ctx, method, typ, query, msg, v, n)
+		}
+	}
+	return next(ctx, method, typ, query, msg, v)
+}
+
+// do executes a http request.
+func (cl *Client) do(ctx context.Context, method, typ string, auth bool, query url.Values, msg, v interface{}) error {
+	if cl.grpc != nil {
+		return cl.doGrpc(ctx, method, typ, auth, query, msg, v)
+	}
 	// marshal
-	var body io.Reader
+	var buf []byte
 	if msg != nil {
-		var err error
-		if body, err = cl.Marshal(msg); err != nil {
+		body, err := cl.Marshal(msg)
+		if err != nil {
 			return err
 		}
-	}
-	// build request
-	req, err := cl.BuildRequest(ctx, method, typ, query, body)
-	if err != nil {
-		return err
+		if body != nil {
+			if buf, err = io.ReadAll(body); err != nil {
+				return err
+			}
+		}
 	}
 	// refresh
 	if auth && cl.refreshAuto {
@@ -210,16 +314,29 @@ func (cl *Client) Do(ctx context.Context, method, typ string, auth bool, query u
 			return err
 		}
 	}
-	// check active session
-	switch session := cl.session != nil; {
-	case auth && !session:
-		// error here ?
-	case auth && session:
-		// add auth token
-		req.Header.Set("Authorization", "Bearer "+cl.session.Token)
-	}
 	// exec
-	res, err := cl.Exec(req)
+	var res *http.Response
+	err := cl.retry.do(ctx, method, func() error {
+		var body io.Reader
+		if buf != nil {
+			body = bytes.NewReader(buf)
+		}
+		// build request
+		req, err := cl.BuildRequest(ctx, method, typ, query, body)
+		if err != nil {
+			return err
+		}
+		// check active session
+		switch token := cl.SessionToken(); {
+		case auth && token == "":
+			// error here ?
+		case auth:
+			// add auth token
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err = cl.Exec(req)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -233,8 +350,13 @@ func (cl *Client) Do(ctx context.Context, method, typ string, auth bool, query u
 
 // Marshal marshals v. If v is a proto.Message, will use Protobuf's
 // google.golang.org/protobuf/encoding/protojson package to encode the message,
-// otherwise uses Go's encoding/json package.
+// if v is an io.Reader, it is used as-is, otherwise uses Go's encoding/json
+// package.
 func (cl *Client) Marshal(v interface{}) (io.Reader, error) {
+	// raw
+	if r, ok := v.(io.Reader); ok {
+		return r, nil
+	}
 	// protojson encode
 	msg, ok := v.(proto.Message)
 	if ok {
@@ -257,8 +379,14 @@ func (cl *Client) Marshal(v interface{}) (io.Reader, error) {
 
 // Unmarshal unmarshals r to v. If v is a proto.Message, will use Protobuf's
 // google.golang.org/protobuf/encoding/protojson package to decode the message,
-// otherwise uses Go's encoding/json package.
+// if v is an io.Writer, r is copied to v, otherwise uses Go's encoding/json
+// package.
 func (cl *Client) Unmarshal(r io.Reader, v interface{}) error {
+	// raw
+	if w, ok := v.(io.Writer); ok {
+		_, err := io.Copy(w, r)
+		return err
+	}
 	// protojson decode
 	if msg, ok := v.(proto.Message); ok {
 		buf, err := io.ReadAll(r)
@@ -308,7 +436,8 @@ func (cl *Client) UnmarshalBytes(buf []byte, v interface{}) error {
 }
 */
 
-// SessionStart starts a session.
+// SessionStart starts a session. When the client has a session store, the
+// session is saved to the store.
 func (cl *Client) SessionStart(session *SessionResponse) error {
 	expiry, expiryGraced, err := ParseTokenExpiry(session.Token, "session", cl.expiryGrace)
 	if err != nil {
@@ -320,48 +449,157 @@ func (cl *Client) SessionStart(session *SessionResponse) error {
 	}
 	cl.rw.Lock()
 	defer cl.rw.Unlock()
-	cl.session, cl.expiry, cl.expiryGraced, cl.expiryRefresh, cl.expiryRefreshGraced = session, expiry, expiryGraced, expiryRefresh, expiryRefreshGraced
+	cl.sessionSet(session, expiry, expiryGraced, expiryRefresh, expiryRefreshGraced)
+	if cl.store != nil {
+		if err := cl.store.Save(session); err != nil {
+			return fmt.Errorf("unable to start session: %w", err)
+		}
+	}
+	return nil
+}
+
+// sessionRestore restores a session loaded from the session store. A session
+// whose token has expired is restored when its refresh token has not, and will
+// be refreshed on first use.
+func (cl *Client) sessionRestore(session *SessionResponse) error {
+	expiryRefresh, expiryRefreshGraced, err := ParseTokenExpiry(session.RefreshToken, "refresh", cl.expiryGrace)
+	if err != nil {
+		return err
+	}
+	expiry, expiryGraced, _ := ParseTokenExpiry(session.Token, "session", cl.expiryGrace)
+	cl.rw.Lock()
+	defer cl.rw.Unlock()
+	cl.sessionSet(session, expiry, expiryGraced, expiryRefresh, expiryRefreshGraced)
 	return nil
 }
 
+// sessionSet sets the session, and schedules its proactive refresh when
+// refresh auto is enabled. Must be called with the lock held.
+func (cl *Client) sessionSet(session *SessionResponse, expiry, expiryGraced, expiryRefresh, expiryRefreshGraced time.Time) {
+	cl.session, cl.expiry, cl.expiryGraced, cl.expiryRefresh, cl.expiryRefreshGraced = session, expiry, expiryGraced, expiryRefresh, expiryRefreshGraced
+	if cl.timer != nil {
+		cl.timer.Stop()
+		cl.timer = nil
+	}
+	d := time.Until(expiryGraced)
+	if session == nil || !cl.refreshAuto || d <= 0 {
+		return
+	}
+	// refresh one expiry grace before the graced expiry, or halfway there for
+	// short lived tokens
+	ahead := cl.expiryGrace
+	if ahead == 0 || d/2 < ahead {
+		ahead = d / 2
+	}
+	cl.timer = time.AfterFunc(d-ahead, func() {
+		ctx, cancel := context.WithDeadline(context.Background(), expiryGraced)
+		defer cancel()
+		if err := cl.sessionRefresh(ctx, session); err != nil {
+			cl.Errf("unable to refresh session: %v", err)
+		}
+	})
+}
+
 // SessionEnd ends a session without logging out. Use SessionLogout to perform a logout on the server.
 func (cl *Client) SessionEnd() {
 	cl.rw.Lock()
 	defer cl.rw.Unlock()
-	cl.session, cl.expiry, cl.expiryGraced, cl.expiryRefresh, cl.expiryRefreshGraced = nil, time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	cl.sessionSet(nil, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+	cl.sessionClear()
+}
+
+// sessionClear clears the session from the session store.
+func (cl *Client) sessionClear() {
+	if cl.store != nil {
+		if err := cl.store.Clear(); err != nil {
+			cl.Errf("unable to clear session: %v", err)
+		}
+	}
 }
 
-// SessionRefresh refreshes auth token for the session.
+// SessionRefresh refreshes auth token for the session. Concurrent refreshes
+// share a single request to the server.
 func (cl *Client) SessionRefresh(ctx context.Context) error {
+	return cl.sessionRefresh(ctx, nil)
+}
+
+// sessionRefresh refreshes the session when it is expired, or, when prev is
+// not nil, when prev is still the active session. Concurrent refreshes are
+// coalesced into a single in-flight refresh, whose result is shared by all
+// callers. The in-flight refresh runs detached from the callers' contexts, so
+// that a caller's cancellation does not fail the refresh for the others.
+func (cl *Client) sessionRefresh(ctx context.Context, prev *SessionResponse) error {
+	cl.rw.Lock()
 	switch {
 	case cl.session == nil:
+		cl.rw.Unlock()
 		return fmt.Errorf("unable to refresh session: %w", NewClientError(0, CodeUnauthenticated, "no active session"))
-	case !cl.SessionExpired():
+	case prev == nil && !cl.sessionExpired(),
+		prev != nil && prev != cl.session:
+		cl.rw.Unlock()
 		return nil
-	case cl.SessionRefreshExpired() && cl.AuthHandler != nil:
-		return cl.AuthHandler(ctx, cl)
-	case cl.SessionRefreshExpired():
-		return fmt.Errorf("unable to refresh session: %w", NewClientError(0, CodeUnauthenticated, "refresh token expired"))
 	}
-	res, err := SessionRefresh(cl.session.RefreshToken).Do(ctx, cl)
-	if err != nil {
-		return fmt.Errorf("unable to refresh session: %w", err)
+	call := cl.refresh
+	if call == nil {
+		call = &refreshCall{
+			done: make(chan struct{}),
+		}
+		cl.refresh = call
+		go cl.refreshRun(call, cl.session, cl.sessionRefreshExpired())
 	}
-	if err := cl.SessionStart(res); err != nil {
-		return fmt.Errorf("unable to refresh session: %w", err)
+	cl.rw.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.done:
+		return call.err
 	}
-	return nil
+}
+
+// refreshRun runs the in-flight session refresh, bounded by sharedTimeout.
+func (cl *Client) refreshRun(call *refreshCall, session *SessionResponse, refreshExpired bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	switch {
+	case refreshExpired && cl.AuthHandler != nil:
+		call.err = cl.AuthHandler(ctx, cl)
+	case refreshExpired:
+		call.err = fmt.Errorf("unable to refresh session: %w", NewClientError(0, CodeUnauthenticated, "refresh token expired"))
+	default:
+		res, err := SessionRefresh(session.RefreshToken).Do(ctx, cl)
+		if err == nil {
+			err = cl.SessionStart(res)
+		}
+		if err != nil {
+			call.err = fmt.Errorf("unable to refresh session: %w", err)
+		}
+	}
+	cl.rw.Lock()
+	cl.refresh = nil
+	cl.rw.Unlock()
+	close(call.done)
+}
+
+// refreshCall is an in-flight session refresh.
+type refreshCall struct {
+	done chan struct{}
+	err  error
 }
 
 // SessionLogout logs out the session.
 func (cl *Client) SessionLogout(ctx context.Context) error {
-	cl.rw.Lock()
-	defer cl.rw.Unlock()
-	if cl.session == nil {
+	cl.rw.RLock()
+	session := cl.session
+	cl.rw.RUnlock()
+	if session == nil {
 		return nil
 	}
-	_ = SessionLogout(cl.session.Token, cl.session.RefreshToken).Do(ctx, cl)
-	cl.session, cl.expiry, cl.expiryGraced, cl.expiryRefresh, cl.expiryRefreshGraced = nil, time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	_ = SessionLogout(session.Token, session.RefreshToken).Do(ctx, cl)
+	cl.rw.Lock()
+	defer cl.rw.Unlock()
+	// clear the session, even when refreshed by the logout request
+	cl.sessionSet(nil, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+	cl.sessionClear()
 	return nil
 }
 
@@ -377,6 +615,8 @@ func (cl *Client) SessionToken() string {
 
 // SessionRefreshToken returns the session refresh token.
 func (cl *Client) SessionRefreshToken() string {
+	cl.rw.RLock()
+	defer cl.rw.RUnlock()
 	if cl.session != nil {
 		return cl.session.RefreshToken
 	}
@@ -385,29 +625,63 @@ func (cl *Client) SessionRefreshToken() string {
 
 // SessionExpiry returns the session expiry time.
 func (cl *Client) SessionExpiry() time.Time {
+	cl.rw.RLock()
+	defer cl.rw.RUnlock()
 	return cl.expiry
 }
 
 // SessionRefreshExpiry returns the session refresh expiry time.
 func (cl *Client) SessionRefreshExpiry() time.Time {
+	cl.rw.RLock()
+	defer cl.rw.RUnlock()
 	return cl.expiryRefresh
 }
 
 // SessionExpired returns whether or not the session is expired.
 func (cl *Client) SessionExpired() bool {
+	cl.rw.RLock()
+	defer cl.rw.RUnlock()
+	return cl.sessionExpired()
+}
+
+// sessionExpired returns whether or not the session is expired. Must be called
+// with the lock held.
+func (cl *Client) sessionExpired() bool {
 	return cl.session == nil || cl.expiry.IsZero() || time.Now().After(cl.expiryGraced)
 }
 
 // SessionRefreshExpired returns whether or not the session refresh token is expired.
 func (cl *Client) SessionRefreshExpired() bool {
+	cl.rw.RLock()
+	defer cl.rw.RUnlock()
+	return cl.sessionRefreshExpired()
+}
+
+// sessionRefreshExpired returns whether or not the session refresh token is
+// expired. Must be called with the lock held.
+func (cl *Client) sessionRefreshExpired() bool {
 	return cl.session == nil || cl.expiryRefresh.IsZero() || time.Now().After(cl.expiryRefreshGraced)
 }
 
 // SessionWasCreated returns whether or not the account was newly created at the beginning of the session.
 func (cl *Client) SessionWasCreated() bool {
+	cl.rw.RLock()
+	defer cl.rw.RUnlock()
 	return cl.session != nil && cl.session.Created
 }
 
+// SessionUserId returns the user id of the session, as contained in the
+// session token.
+func (cl *Client) SessionUserId() string {
+	return ParseTokenClaims(cl.SessionToken()).UserId
+}
+
+// SessionUsername returns the username of the session, as contained in the
+// session token.
+func (cl *Client) SessionUsername() string {
+	return ParseTokenClaims(cl.SessionToken()).Username
+}
+
 // NewConn creates a new a nakama realtime websocket connection, and runs until
 // the context is closed.
 func (cl *Client) NewConn(ctx context.Context, opts ...ConnOption) (*Conn, error) {
@@ -1366,6 +1640,26 @@ func (cl *Client) WriteTournamentRecordAsync(ctx context.Context, req *WriteTour
 	req.Async(ctx, cl, f)
 }
 
+// TokenClaims are the claims of a session token.
+type TokenClaims struct {
+	UserId   string            `json:"uid"`
+	Username string            `json:"usn"`
+	Vars     map[string]string `json:"vrs"`
+	Exp      int64             `json:"exp"`
+}
+
+// ParseTokenClaims parses the claims of a session token, without verifying
+// the token. Returns empty claims when the token cannot be parsed.
+func ParseTokenClaims(tokenstr string) TokenClaims {
+	var v TokenClaims
+	if token := strings.Split(tokenstr, "."); len(token) == 3 {
+		if buf, err := base64.RawURLEncoding.DecodeString(token[1]); err == nil {
+			_ = json.Unmarshal(buf, &v)
+		}
+	}
+	return v
+}
+
 // ParseTokenExpiry parse the exp field on a jwt token.
 func ParseTokenExpiry(tokenstr, typ string, grace time.Duration) (time.Time, time.Time, error) {
 	if tokenstr == "" {
@@ -1377,7 +1671,7 @@ func ParseTokenExpiry(tokenstr, typ string, grace time.Duration) (time.Time, tim
 		return time.Time{}, time.Time{}, fmt.Errorf("invalid %s token jwt encoding", typ)
 	}
 	// decode
-	buf, err := base64.RawStdEncoding.DecodeString(token[1])
+	buf, err := base64.RawURLEncoding.DecodeString(token[1])
 	if err != nil {
 		return time.Time{}, time.Time{}, fmt.Errorf("invalid %s token encoding: %w", typ, err)
 	}
@@ -1409,6 +1703,8 @@ type ClientError struct {
 	StatusCode int
 	Code       Code   `json:"code"`
 	Message    string `json:"message"`
+	// Attempts is the number of attempts made for the request.
+	Attempts int `json:"-"`
 }
 
 // NewClientError creates a client error.
@@ -1689,6 +1985,49 @@ func WithLogger(f func(string, ...interface{})) Option {
 	}
 }
 
+// WithSessionStore is a nakama client option to set a session store used to
+// persist the client's session. The session is restored from the store when
+// the client is created.
+func WithSessionStore(store SessionStore) Option {
+	return func(cl *Client) {
+		cl.store = store
+	}
+}
+
+// WithRetryPolicy is a nakama client option to set the retry policy used for
+// failed requests.
+func WithRetryPolicy(policy *RetryPolicy) Option {
+	return func(cl *Client) {
+		cl.retry = policy
+	}
+}
+
+// WithInterceptor is a nakama client option to add interceptors wrapping
+// requests. The first interceptor added is the outermost.
+func WithInterceptor(interceptors ...Interceptor) Option {
+	return func(cl *Client) {
+		cl.interceptors = append(cl.interceptors, interceptors...)
+	}
+}
+
+// WithCache is a nakama client option to cache responses for read-mostly
+// endpoints, added as an interceptor.
+func WithCache(cache *Cache) Option {
+	return func(cl *Client) {
+		cl.interceptors = append(cl.interceptors, cache.interceptor(cl))
+	}
+}
+
+// WithGrpc is a nakama client option to execute requests over gRPC, using
+// protobuf encoding, against the Nakama gRPC server at urlstr (by default,
+// port 7349). When transport is nil, a HTTP/2 transport is used, connecting
+// with cleartext HTTP/2 when the url's scheme is http.
+func WithGrpc(urlstr string, transport http.RoundTripper) Option {
+	return func(cl *Client) {
+		cl.grpc = newGrpcClient(urlstr, transport)
+	}
+}
+
 // WithAuthHandler is a nakama client option to set a auth hanndler.
 func WithAuthHandler(handler AuthHandler) Option {
 	return func(cl *Client) {
@@ -0,0 +1,304 @@
+package nakama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ReadPermission is a storage object read permission.
+type ReadPermission int32
+
+// Read permissions.
+const (
+	// PermissionNoRead allows only the server to read the object.
+	PermissionNoRead ReadPermission = 0
+	// PermissionOwnerRead allows the owner to read the object.
+	PermissionOwnerRead ReadPermission = 1
+	// PermissionPublicRead allows any user to read the object.
+	PermissionPublicRead ReadPermission = 2
+)
+
+// WritePermission is a storage object write permission.
+type WritePermission int32
+
+// Write permissions.
+const (
+	// PermissionNoWrite allows only the server to write the object.
+	PermissionNoWrite WritePermission = 0
+	// PermissionOwnerWrite allows the owner to write the object.
+	PermissionOwnerWrite WritePermission = 1
+)
+
+// Object is a typed storage object.
+type Object[T any] struct {
+	Key     string
+	UserId  string
+	Value   T
+	Version string
+	Read    ReadPermission
+	Write   WritePermission
+}
+
+// Collection is a typed storage collection, encoding values of type T as
+// JSON (or as Protobuf JSON, when T is a proto.Message).
+//
+// The version of each object read or written is tracked by user id and key,
+// and used for subsequent writes and deletes of the object, so that a write fails when
+// the object was changed by another writer since it was last read. An object
+// that was not found when read may only be created.
+type Collection[T any] struct {
+	cl       *Client
+	name     string
+	userId   string
+	read     *ReadPermission
+	write    *WritePermission
+	retries  int
+	versions map[objectKey]string
+	mu       sync.Mutex
+}
+
+// objectKey identifies a storage object in a collection.
+type objectKey struct {
+	userId string
+	key    string
+}
+
+// NewCollection creates a typed storage collection.
+func NewCollection[T any](cl *Client, name string) *Collection[T] {
+	return &Collection[T]{
+		cl:       cl,
+		name:     name,
+		retries:  5,
+		versions: make(map[objectKey]string),
+	}
+}
+
+// WithUserId sets the user id of the objects read and listed. Defaults to the
+// session's user id.
+func (c *Collection[T]) WithUserId(userId string) *Collection[T] {
+	c.userId = userId
+	return c
+}
+
+// WithPermission sets the permissions of the objects written.
+func (c *Collection[T]) WithPermission(read ReadPermission, write WritePermission) *Collection[T] {
+	c.read, c.write = &read, &write
+	return c
+}
+
+// WithRetries sets the number of retries made by Update on a version
+// conflict.
+func (c *Collection[T]) WithRetries(retries int) *Collection[T] {
+	c.retries = retries
+	return c
+}
+
+// Name returns the collection name.
+func (c *Collection[T]) Name() string {
+	return c.name
+}
+
+// Version returns the tracked version of the user's object with the key.
+// Returns "*" when the object was not found when last read, or empty when the
+// object has not been read or written.
+func (c *Collection[T]) Version(key string) string {
+	return c.version(c.user(), key)
+}
+
+// version returns the tracked version of the object with the user id and key.
+func (c *Collection[T]) version(userId, key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.versions[objectKey{userId, key}]
+}
+
+// track tracks the version of the object with the user id and key.
+func (c *Collection[T]) track(userId, key, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version == "" {
+		delete(c.versions, objectKey{userId, key})
+		return
+	}
+	c.versions[objectKey{userId, key}] = version
+}
+
+// user returns the user id of the objects read.
+func (c *Collection[T]) user() string {
+	if c.userId != "" {
+		return c.userId
+	}
+	return c.cl.SessionUserId()
+}
+
+// Get retrieves the object value with the key. Returns false when the object
+// does not exist.
+func (c *Collection[T]) Get(ctx context.Context, key string) (T, bool, error) {
+	var zero T
+	obj, err := c.GetObject(ctx, key)
+	switch {
+	case err != nil:
+		return zero, false, err
+	case obj == nil:
+		return zero, false, nil
+	}
+	return obj.Value, true, nil
+}
+
+// GetObject retrieves the object with the key. Returns nil when the object
+// does not exist.
+func (c *Collection[T]) GetObject(ctx context.Context, key string) (*Object[T], error) {
+	res, err := ReadStorageObjects().WithObjectId(c.name, key, c.user()).Do(ctx, c.cl)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range res.Objects {
+		if obj.Collection == c.name && obj.Key == key {
+			return c.object(obj)
+		}
+	}
+	c.track(c.user(), key, "*")
+	return nil, nil
+}
+
+// Put writes the session user's object value with the key, using the tracked
+// version of the object.
+func (c *Collection[T]) Put(ctx context.Context, key string, v T) error {
+	userId := c.cl.SessionUserId()
+	value, err := marshalValue(v)
+	if err != nil {
+		return err
+	}
+	obj := &WriteStorageObject{
+		Collection: c.name,
+		Key:        key,
+		Value:      value,
+		Version:    c.version(userId, key),
+	}
+	if c.read != nil {
+		obj.PermissionRead = wrapperspb.Int32(int32(*c.read))
+	}
+	if c.write != nil {
+		obj.PermissionWrite = wrapperspb.Int32(int32(*c.write))
+	}
+	res, err := WriteStorageObjects().WithObject(obj).Do(ctx, c.cl)
+	if err != nil {
+		return err
+	}
+	for _, ack := range res.Acks {
+		if ack.Collection == c.name && ack.Key == key {
+			c.track(userId, key, ack.Version)
+		}
+	}
+	return nil
+}
+
+// Delete deletes the session user's object with the key, using the tracked
+// version of the object.
+func (c *Collection[T]) Delete(ctx context.Context, key string) error {
+	userId := c.cl.SessionUserId()
+	version := c.version(userId, key)
+	if version == "*" {
+		version = ""
+	}
+	if err := DeleteStorageObjects().WithObjectId(c.name, key, version).Do(ctx, c.cl); err != nil {
+		return err
+	}
+	c.track(userId, key, "*")
+	return nil
+}
+
+// Update reads the object value with the key, calls f to modify the value,
+// and writes the modified value. The read, modify and write is retried when
+// the write fails due to a version conflict. When the object does not exist,
+// f is passed the zero value.
+func (c *Collection[T]) Update(ctx context.Context, key string, f func(*T) error) (T, error) {
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		var v T
+		if v, _, err = c.Get(ctx, key); err != nil {
+			return v, err
+		}
+		if err = f(&v); err != nil {
+			return v, err
+		}
+		switch err = c.Put(ctx, key, v); {
+		case err == nil:
+			return v, nil
+		case !IsVersionConflict(err):
+			return v, err
+		}
+	}
+	var zero T
+	return zero, err
+}
+
+// List returns an iterator over the objects in the collection, retrieving
+// limit objects per page.
+func (c *Collection[T]) List(ctx context.Context, limit int) *Iterator[*Object[T]] {
+	userId := c.user()
+	return NewIterator(ctx, "", func(ctx context.Context, cursor string) ([]*Object[T], string, error) {
+		res, err := StorageObjects(c.name).WithUserId(userId).WithLimit(limit).WithCursor(cursor).Do(ctx, c.cl)
+		if err != nil {
+			return nil, "", err
+		}
+		var objects []*Object[T]
+		for _, obj := range res.Objects {
+			o, err := c.object(obj)
+			if err != nil {
+				return nil, "", err
+			}
+			objects = append(objects, o)
+		}
+		return objects, res.Cursor, nil
+	})
+}
+
+// object decodes a storage object, tracking its version.
+func (c *Collection[T]) object(obj *StorageObject) (*Object[T], error) {
+	v, target := newTarget[T]()
+	if err := unmarshalValue(obj.Value, target); err != nil {
+		return nil, err
+	}
+	c.track(obj.UserId, obj.Key, obj.Version)
+	return &Object[T]{
+		Key:     obj.Key,
+		UserId:  obj.UserId,
+		Value:   fromTarget(v, target),
+		Version: obj.Version,
+		Read:    ReadPermission(obj.PermissionRead),
+		Write:   WritePermission(obj.PermissionWrite),
+	}, nil
+}
+
+// IsVersionConflict returns true when err is a storage write or delete
+// rejected due to a version check.
+func IsVersionConflict(err error) bool {
+	var e *ClientError
+	return errors.As(err, &e) && e.Code == CodeInvalidArgument && strings.Contains(e.Message, "version check failed")
+}
+
+// marshalValue marshals v as a storage object value.
+func marshalValue(v interface{}) (string, error) {
+	if msg, ok := v.(proto.Message); ok {
+		buf, err := protojson.Marshal(msg)
+		return string(buf), err
+	}
+	buf, err := json.Marshal(v)
+	return string(buf), err
+}
+
+// unmarshalValue unmarshals a storage object value to v.
+func unmarshalValue(value string, v interface{}) error {
+	if msg, ok := v.(proto.Message); ok {
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal([]byte(value), msg)
+	}
+	return json.Unmarshal([]byte(value), v)
+}
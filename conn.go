@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,6 +36,7 @@ type ConnClientHandler interface {
 //
 //	ConnectHandler(context.Context)
 //	DisconnectHandler(context.Context, error)
+//	ReconnectHandler(context.Context, *nakama.ReconnectResult)
 //	ErrorHandler(context.Context, *nakama.ErrorMsg)
 //	ChannelMessageHandler(context.Context, *nakama.ChannelMessageMsg)
 //	ChannelPresenceEventHandler(context.Context, *nakama.ChannelPresenceEventMsg)
@@ -42,6 +44,13 @@ type ConnClientHandler interface {
 //	MatchPresenceEventHandler(context.Context, *nakama.MatchPresenceEventMsg)
 //	MatchmakerMatchedHandler(context.Context, *nakama.MatchmakerMatchedMsg)
 //	NotificationsHandler(context.Context, *nakama.NotificationsMsg)
+//	PartyHandler(context.Context, *nakama.PartyMsg)
+//	PartyCloseHandler(context.Context, *nakama.PartyCloseMsg)
+//	PartyDataHandler(context.Context, *nakama.PartyDataMsg)
+//	PartyJoinRequestHandler(context.Context, *nakama.PartyJoinRequestMsg)
+//	PartyLeaderHandler(context.Context, *nakama.PartyLeaderMsg)
+//	PartyMatchmakerTicketHandler(context.Context, *nakama.PartyMatchmakerTicketMsg)
+//	PartyPresenceEventHandler(context.Context, *nakama.PartyPresenceEventMsg)
 //	StatusPresenceEventHandler(context.Context, *nakama.StatusPresenceEventMsg)
 //	StreamDataHandler(context.Context, *nakama.StreamDataMsg)
 //	StreamPresenceEventHandler(context.Context, *nakama.StreamPresenceEventMsg)
@@ -70,23 +79,39 @@ type Conn struct {
 	ws     *websocket.Conn
 	cancel func()
 	stop   bool
+	opened bool
+	state  *connState
+
+	outbound []ConnInterceptor
+	inbound  []ConnInterceptor
 
 	id  uint64
 	out chan *res
 	m   map[string]*res
 
-	ConnectHandler              func(context.Context)
-	DisconnectHandler           func(context.Context, error)
-	ErrorHandler                func(context.Context, *ErrorMsg)
-	ChannelMessageHandler       func(context.Context, *ChannelMessageMsg)
-	ChannelPresenceEventHandler func(context.Context, *ChannelPresenceEventMsg)
-	MatchDataHandler            func(context.Context, *MatchDataMsg)
-	MatchPresenceEventHandler   func(context.Context, *MatchPresenceEventMsg)
-	MatchmakerMatchedHandler    func(context.Context, *MatchmakerMatchedMsg)
-	NotificationsHandler        func(context.Context, *NotificationsMsg)
-	StatusPresenceEventHandler  func(context.Context, *StatusPresenceEventMsg)
-	StreamDataHandler           func(context.Context, *StreamDataMsg)
-	StreamPresenceEventHandler  func(context.Context, *StreamPresenceEventMsg)
+	listenerId uint64
+	listeners  map[uint64]*connListener
+
+	ConnectHandler               func(context.Context)
+	DisconnectHandler            func(context.Context, error)
+	ReconnectHandler             func(context.Context, *ReconnectResult)
+	ErrorHandler                 func(context.Context, *ErrorMsg)
+	ChannelMessageHandler        func(context.Context, *ChannelMessageMsg)
+	ChannelPresenceEventHandler  func(context.Context, *ChannelPresenceEventMsg)
+	MatchDataHandler             func(context.Context, *MatchDataMsg)
+	MatchPresenceEventHandler    func(context.Context, *MatchPresenceEventMsg)
+	MatchmakerMatchedHandler     func(context.Context, *MatchmakerMatchedMsg)
+	NotificationsHandler         func(context.Context, *NotificationsMsg)
+	PartyHandler                 func(context.Context, *PartyMsg)
+	PartyCloseHandler            func(context.Context, *PartyCloseMsg)
+	PartyDataHandler             func(context.Context, *PartyDataMsg)
+	PartyJoinRequestHandler      func(context.Context, *PartyJoinRequestMsg)
+	PartyLeaderHandler           func(context.Context, *PartyLeaderMsg)
+	PartyMatchmakerTicketHandler func(context.Context, *PartyMatchmakerTicketMsg)
+	PartyPresenceEventHandler    func(context.Context, *PartyPresenceEventMsg)
+	StatusPresenceEventHandler   func(context.Context, *StatusPresenceEventMsg)
+	StreamDataHandler            func(context.Context, *StreamDataMsg)
+	StreamPresenceEventHandler   func(context.Context, *StreamPresenceEventMsg)
 
 	rw sync.RWMutex
 }
@@ -102,7 +127,9 @@ func NewConn(ctx context.Context, opts ...ConnOption) (*Conn, error) {
 		backoffRand:   rand.New(rand.NewSource(time.Now().UnixNano())),
 		out:           make(chan *res),
 		m:             make(map[string]*res),
+		listeners:     make(map[uint64]*connListener),
 		stop:          true,
+		state:         newConnState(),
 	}
 	for _, o := range opts {
 		o(conn)
@@ -130,9 +157,15 @@ func (conn *Conn) Open(ctx context.Context) error {
 // run keeps open the websocket connection to the Nakama server when persist is
 // enabled.
 func (conn *Conn) run(ctx context.Context) {
-	d, jitter, connected, last := conn.backoffMin, time.Duration(0), false, false
-	for !conn.stop {
-		if connected = conn.ws != nil; !connected {
+	d, jitter, last := conn.backoffMin, time.Duration(0), false
+	for {
+		conn.rw.RLock()
+		stop, connected := conn.stop, conn.ws != nil
+		conn.rw.RUnlock()
+		if stop {
+			return
+		}
+		if !connected {
 			if err := conn.open(ctx); err != nil {
 				conn.h.Logf("unable to open websocket: %v", err)
 			}
@@ -180,6 +213,16 @@ func (conn *Conn) open(ctx context.Context) error {
 	if conn.ConnectHandler != nil {
 		go conn.ConnectHandler(conn.ctx)
 	}
+	for _, l := range conn.listeners {
+		if l.connect != nil {
+			go l.connect(conn.ctx)
+		}
+	}
+	// restore state on reconnect
+	if conn.opened {
+		go conn.restore(ctx)
+	}
+	conn.opened = true
 	// incoming
 	go func() {
 		for {
@@ -218,7 +261,12 @@ func (conn *Conn) open(ctx context.Context) error {
 					close(m.err)
 					continue
 				}
-				if m.v == nil || id == "" {
+				switch {
+				case id == "" && m.v != nil:
+					m.err <- ErrEnvelopeDropped
+					close(m.err)
+					continue
+				case id == "" || m.v == nil:
 					close(m.err)
 					continue
 				}
@@ -231,39 +279,76 @@ func (conn *Conn) open(ctx context.Context) error {
 	return nil
 }
 
-// send marshals the message and writes it to the websocket connection.
+// send marshals the message and writes it to the websocket connection,
+// passing it through the outbound interceptors. Returns an empty id when the
+// message was dropped by an interceptor.
 func (conn *Conn) send(ctx context.Context, ws *websocket.Conn, msg EnvelopeBuilder) (string, error) {
 	env := msg.BuildEnvelope()
 	env.Cid = strconv.FormatUint(atomic.AddUint64(&conn.id, 1), 10)
-	buf, err := conn.marshal(env)
+	var id string
+	err := intercept(ctx, conn.outbound, env, func(ctx context.Context, env *Envelope) error {
+		buf, err := conn.marshal(env)
+		if err != nil {
+			return err
+		}
+		typ := websocket.MessageBinary
+		if !conn.binary {
+			typ = websocket.MessageText
+		}
+		if err := ws.Write(ctx, typ, buf); err != nil {
+			_ = conn.CloseWithStopErr(!conn.persist, false, err)
+			return err
+		}
+		id = env.Cid
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
-	typ := websocket.MessageBinary
-	if !conn.binary {
-		typ = websocket.MessageText
-	}
-	if err := ws.Write(ctx, typ, buf); err != nil {
-		_ = conn.CloseWithStopErr(!conn.persist, false, err)
-		return "", err
-	}
-	return env.Cid, nil
+	return id, nil
 }
 
-// recv unmarshals buf, dispatching the message.
+// recv unmarshals buf, passing the message through the inbound interceptors
+// before dispatching it.
 func (conn *Conn) recv(ctx context.Context, buf []byte) error {
 	env, err := conn.unmarshal(buf)
-	switch {
-	case err != nil:
+	if err != nil {
 		return fmt.Errorf("unable to unmarshal: %w", err)
-	case env.Cid == "":
-		return conn.recvNotify(ctx, env)
 	}
-	return conn.recvResponse(ctx, env)
+	var dispatched bool
+	err = intercept(ctx, conn.inbound, env, func(ctx context.Context, env *Envelope) error {
+		dispatched = true
+		if env.Cid == "" {
+			return conn.recvNotify(ctx, env)
+		}
+		return conn.recvResponse(ctx, env)
+	})
+	if !dispatched && env.Cid != "" {
+		conn.recvDropped(env.Cid)
+	}
+	return err
+}
+
+// recvDropped fails the request whose response was dropped by an inbound
+// interceptor.
+func (conn *Conn) recvDropped(cid string) {
+	conn.rw.Lock()
+	m, ok := conn.m[cid]
+	delete(conn.m, cid)
+	conn.rw.Unlock()
+	if ok && m != nil {
+		m.err <- ErrEnvelopeDropped
+		close(m.err)
+	}
 }
 
 // recvNotify dispaches events and received updates.
 func (conn *Conn) recvNotify(ctx context.Context, env *Envelope) error {
+	for _, l := range conn.snapshotListeners() {
+		if l.notify != nil {
+			l.notify(ctx, env)
+		}
+	}
 	switch v := env.Message.(type) {
 	case *Envelope_Error:
 		if conn.ErrorHandler != nil {
@@ -291,6 +376,7 @@ func (conn *Conn) recvNotify(ctx context.Context, env *Envelope) error {
 		}
 		return nil
 	case *Envelope_MatchmakerMatched:
+		conn.state.remove(ReconnectMatchmaker, v.MatchmakerMatched.Ticket)
 		if conn.MatchmakerMatchedHandler != nil {
 			go conn.MatchmakerMatchedHandler(ctx, v.MatchmakerMatched)
 		}
@@ -300,6 +386,43 @@ func (conn *Conn) recvNotify(ctx context.Context, env *Envelope) error {
 			go conn.NotificationsHandler(ctx, v.Notifications)
 		}
 		return nil
+	case *Envelope_Party:
+		conn.state.joined(v.Party.PartyId)
+		if conn.PartyHandler != nil {
+			go conn.PartyHandler(ctx, v.Party)
+		}
+		return nil
+	case *Envelope_PartyClose:
+		conn.state.remove(ReconnectParty, v.PartyClose.PartyId)
+		if conn.PartyCloseHandler != nil {
+			go conn.PartyCloseHandler(ctx, v.PartyClose)
+		}
+		return nil
+	case *Envelope_PartyData:
+		if conn.PartyDataHandler != nil {
+			go conn.PartyDataHandler(ctx, v.PartyData)
+		}
+		return nil
+	case *Envelope_PartyJoinRequest:
+		if conn.PartyJoinRequestHandler != nil {
+			go conn.PartyJoinRequestHandler(ctx, v.PartyJoinRequest)
+		}
+		return nil
+	case *Envelope_PartyLeader:
+		if conn.PartyLeaderHandler != nil {
+			go conn.PartyLeaderHandler(ctx, v.PartyLeader)
+		}
+		return nil
+	case *Envelope_PartyMatchmakerTicket:
+		if conn.PartyMatchmakerTicketHandler != nil {
+			go conn.PartyMatchmakerTicketHandler(ctx, v.PartyMatchmakerTicket)
+		}
+		return nil
+	case *Envelope_PartyPresenceEvent:
+		if conn.PartyPresenceEventHandler != nil {
+			go conn.PartyPresenceEventHandler(ctx, v.PartyPresenceEvent)
+		}
+		return nil
 	case *Envelope_StatusPresenceEvent:
 		if conn.StatusPresenceEventHandler != nil {
 			go conn.StatusPresenceEventHandler(ctx, v.StatusPresenceEvent)
@@ -367,7 +490,30 @@ func (conn *Conn) Send(ctx context.Context, msg, v EnvelopeBuilder) error {
 		return ctx.Err()
 	case err = <-m.err:
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	conn.state.track(msg, v)
+	return nil
+}
+
+// resolveUsernames resolves the user ids of users followed by username, when
+// the connection's client handler can retrieve users by username, so that
+// follows removed by StatusUnfollow are not restored.
+func (conn *Conn) resolveUsernames(ctx context.Context) {
+	h, ok := conn.h.(interface {
+		UsersUsernames(context.Context, ...string) (*UsersResponse, error)
+	})
+	usernames := conn.state.unresolved()
+	if !ok || len(usernames) == 0 {
+		return
+	}
+	res, err := h.UsersUsernames(ctx, usernames...)
+	if err != nil {
+		conn.h.Errf("unable to resolve followed usernames: %v", err)
+		return
+	}
+	conn.state.resolve(res.Users)
 }
 
 // Connected returns true when the websocket connection is connected to the
@@ -393,6 +539,9 @@ func (conn *Conn) CloseWithStopErr(stop, force bool, err error) error {
 		if conn.DisconnectHandler != nil {
 			go conn.DisconnectHandler(conn.ctx, err)
 		}
+		if stop {
+			conn.state.reset()
+		}
 		conn.stop, conn.ctx, conn.ws, conn.cancel = stop, nil, nil, nil
 	}
 	return nil
@@ -830,6 +979,381 @@ type res struct {
 	err chan error
 }
 
+// restore restores the tracked realtime state after a reconnect, reporting
+// the result for each item to the reconnect handler.
+func (conn *Conn) restore(ctx context.Context) {
+	conn.resolveUsernames(ctx)
+	for _, item := range conn.state.snapshot() {
+		res := &ReconnectResult{
+			Type:  item.typ,
+			Id:    item.id,
+			State: ReconnectRejoined,
+			Msg:   item.msg,
+			Res:   item.res,
+		}
+		// matchmaker tickets do not survive a disconnect
+		if item.typ == ReconnectMatchmaker {
+			conn.state.remove(item.typ, item.id)
+		}
+		if err := conn.Send(ctx, item.msg, item.res); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			res.State, res.Err = ReconnectFailed, err
+			if isNotFound(err) {
+				res.State = ReconnectExpired
+			}
+			conn.state.remove(item.typ, item.id)
+		}
+		for _, l := range conn.snapshotListeners() {
+			if l.reconnect != nil {
+				l.reconnect(ctx, res)
+			}
+		}
+		if conn.ReconnectHandler != nil {
+			go conn.ReconnectHandler(ctx, res)
+		}
+	}
+}
+
+// connListener is an internal listener for a connection's notifications and
+// reconnect results, used by realtime handles (such as Channel) to track
+// their state. Listeners are called synchronously, in the order received, and
+// must not block.
+//
+// The connect func is the exception, and is called in its own goroutine when
+// the listener is added to an open connection, and each time the connection
+// is established.
+type connListener struct {
+	connect   func(context.Context)
+	notify    func(context.Context, *Envelope)
+	reconnect func(context.Context, *ReconnectResult)
+}
+
+// listen adds the listener, returning a func that removes the listener.
+func (conn *Conn) listen(l *connListener) func() {
+	conn.rw.Lock()
+	defer conn.rw.Unlock()
+	conn.listenerId++
+	id := conn.listenerId
+	conn.listeners[id] = l
+	if l.connect != nil && conn.ws != nil {
+		go l.connect(conn.ctx)
+	}
+	return func() {
+		conn.rw.Lock()
+		defer conn.rw.Unlock()
+		delete(conn.listeners, id)
+	}
+}
+
+// snapshotListeners returns the listeners, ordered by when they were added.
+func (conn *Conn) snapshotListeners() []*connListener {
+	conn.rw.RLock()
+	defer conn.rw.RUnlock()
+	ids := make([]uint64, 0, len(conn.listeners))
+	for id := range conn.listeners {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	listeners := make([]*connListener, len(ids))
+	for i, id := range ids {
+		listeners[i] = conn.listeners[id]
+	}
+	return listeners
+}
+
+// isNotFound returns true when the error is a realtime error indicating the
+// match no longer exists.
+func isNotFound(err error) bool {
+	var e *ErrorMsg
+	return errors.As(err, &e) && ErrorCode(e.Code) == ErrorCode_MATCH_NOT_FOUND
+}
+
+// ReconnectType is the type of a realtime state item restored after a
+// reconnect.
+type ReconnectType string
+
+// Reconnect types.
+const (
+	ReconnectChannel    ReconnectType = "channel"
+	ReconnectMatch      ReconnectType = "match"
+	ReconnectStatus     ReconnectType = "status"
+	ReconnectParty      ReconnectType = "party"
+	ReconnectMatchmaker ReconnectType = "matchmaker"
+)
+
+// ReconnectState is the state of a realtime state item after a reconnect.
+type ReconnectState string
+
+// Reconnect states.
+const (
+	// ReconnectRejoined indicates the item was restored.
+	ReconnectRejoined ReconnectState = "rejoined"
+	// ReconnectFailed indicates the item could not be restored.
+	ReconnectFailed ReconnectState = "failed"
+	// ReconnectExpired indicates the item no longer exists on the server, as
+	// reported by the server's error code.
+	ReconnectExpired ReconnectState = "expired"
+)
+
+// ReconnectResult is the result of restoring a realtime state item after a
+// reconnect.
+type ReconnectResult struct {
+	// Type is the item type.
+	Type ReconnectType
+	// Id is the channel, match, party id, or matchmaker ticket prior to the
+	// reconnect. Empty for status follows.
+	Id string
+	// State is the item's state.
+	State ReconnectState
+	// Msg is the message sent to restore the item.
+	Msg EnvelopeBuilder
+	// Res is the server's response to the message, when any. For matchmaker
+	// items, contains the new ticket.
+	Res EnvelopeBuilder
+	// Err is the error, when not rejoined.
+	Err error
+}
+
+// connState is the realtime state tracked by a connection, restored after a
+// reconnect.
+//
+// Follows by username are tracked by username only until the user id is
+// known, and are then tracked by user id. User ids unfollowed while follows
+// by username are not resolved are tracked, and the user ids of the follows
+// by username are resolved before restoring, so that unfollowed users are not
+// followed again. Parties are tracked once the party is received, as a join
+// to a closed party is only a request to join.
+type connState struct {
+	mu        sync.Mutex
+	seq       uint64
+	channels  map[string]*ChannelJoinMsg
+	matches   map[string]*MatchJoinMsg
+	follows   map[string]bool
+	usernames map[string]uint64
+	unfollows map[string]uint64
+	parties   map[string]bool
+	tickets   map[string]*MatchmakerAddMsg
+}
+
+// newConnState creates a new connection state.
+func newConnState() *connState {
+	state := new(connState)
+	state.reset()
+	return state
+}
+
+// reset clears the state.
+func (state *connState) reset() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.channels = make(map[string]*ChannelJoinMsg)
+	state.matches = make(map[string]*MatchJoinMsg)
+	state.follows = make(map[string]bool)
+	state.usernames = make(map[string]uint64)
+	state.unfollows = make(map[string]uint64)
+	state.parties = make(map[string]bool)
+	state.tickets = make(map[string]*MatchmakerAddMsg)
+}
+
+// track updates the state for a successfully sent message and its response.
+func (state *connState) track(msg, v EnvelopeBuilder) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	switch m := msg.(type) {
+	case *ChannelJoinMsg:
+		if res, ok := v.(*ChannelMsg); ok && res.Id != "" {
+			state.channels[res.Id] = m
+		}
+	case *ChannelLeaveMsg:
+		delete(state.channels, m.ChannelId)
+	case *MatchCreateMsg:
+		if res, ok := v.(*MatchMsg); ok && res.MatchId != "" {
+			state.matches[res.MatchId] = MatchJoin(res.MatchId)
+		}
+	case *MatchJoinMsg:
+		if res, ok := v.(*MatchMsg); ok && res.MatchId != "" {
+			state.matches[res.MatchId] = MatchJoin(res.MatchId).WithMetadata(m.Metadata)
+		}
+	case *MatchLeaveMsg:
+		delete(state.matches, m.MatchId)
+	case *StatusFollowMsg:
+		state.seq++
+		for _, id := range m.UserIds {
+			state.follows[id] = true
+			delete(state.unfollows, id)
+		}
+		for _, username := range m.Usernames {
+			state.usernames[username] = state.seq
+		}
+		if res, ok := v.(*StatusMsg); ok {
+			for _, p := range res.Presences {
+				if _, ok := state.usernames[p.Username]; ok {
+					delete(state.usernames, p.Username)
+					delete(state.unfollows, p.UserId)
+					state.follows[p.UserId] = true
+				}
+			}
+		}
+	case *StatusUnfollowMsg:
+		state.seq++
+		for _, id := range m.UserIds {
+			delete(state.follows, id)
+			if len(state.usernames) != 0 {
+				state.unfollows[id] = state.seq
+			}
+		}
+	case *PartyCreateMsg:
+		if res, ok := v.(*PartyMsg); ok && res.PartyId != "" {
+			state.parties[res.PartyId] = true
+		}
+	case *PartyLeaveMsg:
+		delete(state.parties, m.PartyId)
+	case *PartyCloseMsg:
+		delete(state.parties, m.PartyId)
+	case *MatchmakerAddMsg:
+		if res, ok := v.(*MatchmakerTicketMsg); ok && res.Ticket != "" {
+			state.tickets[res.Ticket] = m
+		}
+	case *MatchmakerRemoveMsg:
+		delete(state.tickets, m.Ticket)
+	}
+}
+
+// joined tracks a party, when the party is received after joining or
+// creating the party.
+func (state *connState) joined(partyId string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if partyId != "" {
+		state.parties[partyId] = true
+	}
+}
+
+// unresolved returns the usernames of follows by username whose user ids are
+// not known.
+func (state *connState) unresolved() []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return sortedKeys(state.usernames)
+}
+
+// resolve tracks follows by username of the users by user id, dropping the
+// follows of users unfollowed after being followed by username.
+func (state *connState) resolve(users []*User) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, u := range users {
+		seq, ok := state.usernames[u.Username]
+		if !ok {
+			continue
+		}
+		delete(state.usernames, u.Username)
+		if state.unfollows[u.Id] < seq {
+			state.follows[u.Id] = true
+		}
+	}
+	if len(state.usernames) == 0 {
+		state.unfollows = make(map[string]uint64)
+	}
+}
+
+// remove removes an item from the state.
+func (state *connState) remove(typ ReconnectType, id string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	switch typ {
+	case ReconnectChannel:
+		delete(state.channels, id)
+	case ReconnectMatch:
+		delete(state.matches, id)
+	case ReconnectStatus:
+		state.follows = make(map[string]bool)
+		state.usernames = make(map[string]uint64)
+		state.unfollows = make(map[string]uint64)
+	case ReconnectParty:
+		delete(state.parties, id)
+	case ReconnectMatchmaker:
+		delete(state.tickets, id)
+	}
+}
+
+// stateItem is a tracked item to restore.
+type stateItem struct {
+	typ ReconnectType
+	id  string
+	msg EnvelopeBuilder
+	res EnvelopeBuilder
+}
+
+// snapshot returns the items to restore.
+func (state *connState) snapshot() []stateItem {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var items []stateItem
+	for id, msg := range state.channels {
+		items = append(items, stateItem{ReconnectChannel, id, msg, new(ChannelMsg)})
+	}
+	for id, msg := range state.matches {
+		items = append(items, stateItem{ReconnectMatch, id, msg, new(MatchMsg)})
+	}
+	if len(state.follows) != 0 || len(state.usernames) != 0 {
+		msg := StatusFollow(sortedKeys(state.follows)...).WithUsernames(sortedKeys(state.usernames)...)
+		items = append(items, stateItem{ReconnectStatus, "", msg, new(StatusMsg)})
+	}
+	for id := range state.parties {
+		items = append(items, stateItem{ReconnectParty, id, PartyJoin(id), empty()})
+	}
+	for ticket, msg := range state.tickets {
+		items = append(items, stateItem{ReconnectMatchmaker, ticket, msg, new(MatchmakerTicketMsg)})
+	}
+	return items
+}
+
+// sortedKeys returns the sorted keys of m.
+func sortedKeys[T any](m map[string]T) []string {
+	var v []string
+	for k := range m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// ConnInterceptor is a realtime envelope interceptor. An interceptor can
+// inspect or modify the envelope before calling next to continue, drop the
+// envelope by not calling next, or delay the envelope by waiting before
+// calling next. Interceptors are called sequentially, in the order envelopes
+// are sent or received.
+//
+// Sending a dropped envelope that expects a response (or dropping its
+// response) returns ErrEnvelopeDropped. Sending a dropped envelope that does
+// not expect a response, such as MatchDataSendMsg, returns no error.
+//
+// Interceptors are called on the connection's single send and receive
+// goroutines, and an interceptor that blocks or delays an envelope delays all
+// envelopes sent or received after it. Interceptors must not send on the
+// connection, and should hand off slow work to another goroutine.
+type ConnInterceptor func(ctx context.Context, env *Envelope, next ConnInterceptorFunc) error
+
+// ConnInterceptorFunc is the func passed to a realtime envelope interceptor to
+// continue sending or dispatching the envelope.
+type ConnInterceptorFunc func(ctx context.Context, env *Envelope) error
+
+// intercept passes the envelope through the interceptors, ending with f.
+func intercept(ctx context.Context, interceptors []ConnInterceptor, env *Envelope, f ConnInterceptorFunc) error {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		g, next := interceptors[i], f
+		f = func(ctx context.Context, env *Envelope) error {
+			return g(ctx, env, next)
+		}
+	}
+	return f(ctx, env)
+}
+
 // ConnOption is a nakama realtime websocket connection option.
 type ConnOption func(*Conn)
 
@@ -901,7 +1425,9 @@ func WithConnCreateStatus(status bool) ConnOption {
 }
 
 // WithConnPersist is a nakama websocket connection option to enable keeping
-// open a persistent connection to the Nakama server.
+// open a persistent connection to the Nakama server. Joined channels, matches,
+// parties, status follows, and matchmaker tickets are restored after a
+// reconnect, with the results sent to the connection's ReconnectHandler.
 func WithConnPersist(persist bool) ConnOption {
 	return func(conn *Conn) {
 		conn.persist = persist
@@ -924,6 +1450,20 @@ func WithConnBackoffRand(backoffRand *rand.Rand) ConnOption {
 	}
 }
 
+// WithConnInterceptor is a nakama websocket connection option to add
+// interceptors for outbound (sent) and inbound (received) envelopes. Either
+// interceptor may be nil. The first interceptor added is the outermost.
+func WithConnInterceptor(outbound, inbound ConnInterceptor) ConnOption {
+	return func(conn *Conn) {
+		if outbound != nil {
+			conn.outbound = append(conn.outbound, outbound)
+		}
+		if inbound != nil {
+			conn.inbound = append(conn.inbound, inbound)
+		}
+	}
+}
+
 // WithConnHandler is a nakama websocket connection option to set the
 // connection's message handlers. See the ConnHandler type for documentation on
 // supported interfaces.
@@ -974,6 +1514,11 @@ func WithConnHandler(handler ConnHandler) ConnOption {
 		}); ok {
 			conn.DisconnectHandler = x.DisconnectHandler
 		}
+		if x, ok := handler.(interface {
+			ReconnectHandler(context.Context, *ReconnectResult)
+		}); ok {
+			conn.ReconnectHandler = x.ReconnectHandler
+		}
 		if x, ok := handler.(interface {
 			ErrorHandler(context.Context, *ErrorMsg)
 		}); ok {
@@ -1009,6 +1554,41 @@ func WithConnHandler(handler ConnHandler) ConnOption {
 		}); ok {
 			conn.NotificationsHandler = x.NotificationsHandler
 		}
+		if x, ok := handler.(interface {
+			PartyHandler(context.Context, *PartyMsg)
+		}); ok {
+			conn.PartyHandler = x.PartyHandler
+		}
+		if x, ok := handler.(interface {
+			PartyCloseHandler(context.Context, *PartyCloseMsg)
+		}); ok {
+			conn.PartyCloseHandler = x.PartyCloseHandler
+		}
+		if x, ok := handler.(interface {
+			PartyDataHandler(context.Context, *PartyDataMsg)
+		}); ok {
+			conn.PartyDataHandler = x.PartyDataHandler
+		}
+		if x, ok := handler.(interface {
+			PartyJoinRequestHandler(context.Context, *PartyJoinRequestMsg)
+		}); ok {
+			conn.PartyJoinRequestHandler = x.PartyJoinRequestHandler
+		}
+		if x, ok := handler.(interface {
+			PartyLeaderHandler(context.Context, *PartyLeaderMsg)
+		}); ok {
+			conn.PartyLeaderHandler = x.PartyLeaderHandler
+		}
+		if x, ok := handler.(interface {
+			PartyMatchmakerTicketHandler(context.Context, *PartyMatchmakerTicketMsg)
+		}); ok {
+			conn.PartyMatchmakerTicketHandler = x.PartyMatchmakerTicketHandler
+		}
+		if x, ok := handler.(interface {
+			PartyPresenceEventHandler(context.Context, *PartyPresenceEventMsg)
+		}); ok {
+			conn.PartyPresenceEventHandler = x.PartyPresenceEventHandler
+		}
 		if x, ok := handler.(interface {
 			StatusPresenceEventHandler(context.Context, *StatusPresenceEventMsg)
 		}); ok {
@@ -1035,6 +1615,14 @@ const (
 	ErrConnAlreadyOpen ConnError = "conn already open"
 	// ErrConnReadEmptyMessage is the conn read empty message error.
 	ErrConnReadEmptyMessage ConnError = "conn read empty message"
+	// ErrEnvelopeDropped is the envelope dropped error.
+	ErrEnvelopeDropped ConnError = "envelope dropped"
+	// ErrPartyNotLeader is the party not leader error.
+	ErrPartyNotLeader ConnError = "party not leader"
+	// ErrPartyNotMember is the party not member error.
+	ErrPartyNotMember ConnError = "party not member"
+	// ErrPartyClosed is the party closed error.
+	ErrPartyClosed ConnError = "party closed"
 )
 
 // Error satisfies the error interface.
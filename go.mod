@@ -6,6 +6,7 @@ require (
 	github.com/ascii8/nktest v0.12.3
 	github.com/google/uuid v1.6.0
 	github.com/heroiclabs/nakama-common v1.31.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/net v0.19.0
 	google.golang.org/protobuf v1.31.0
 	nhooyr.io/websocket v1.8.10
@@ -120,6 +121,7 @@ require (
 	github.com/ulikunitz/xz v0.5.11 // indirect
 	github.com/vbatts/tar-split v0.11.5 // indirect
 	github.com/vbauerster/mpb/v8 v8.6.2 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	github.com/yookoala/realpath v1.0.0 // indirect
 	go.mongodb.org/mongo-driver v1.11.3 // indirect
 	go.mozilla.org/pkcs7 v0.0.0-20210826202110-33d05740a352 // indirect
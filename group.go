@@ -0,0 +1,365 @@
+package nakama
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// GroupHandle is a handle to a group, caching the group's members and their
+// roles.
+//
+// Moderation actions check the user's role locally before being sent. A user
+// must be an admin or superadmin to moderate the group, and can only moderate
+// users with a lesser role, unless the user is a superadmin.
+type GroupHandle struct {
+	cl      *Client
+	group   *Group
+	members map[string]*GroupUser
+	rw      sync.RWMutex
+}
+
+// NewGroupHandle creates a group handle for the group. Use Load to load the
+// group's members.
+func NewGroupHandle(cl *Client, group *Group) *GroupHandle {
+	return &GroupHandle{
+		cl:      cl,
+		group:   group,
+		members: make(map[string]*GroupUser),
+	}
+}
+
+// CreateGroupHandle creates a group, returning a group handle with the user
+// as the group's superadmin.
+func (cl *Client) CreateGroupHandle(ctx context.Context, req *CreateGroupRequest) (*GroupHandle, error) {
+	group, err := req.Do(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	g := NewGroupHandle(cl, group)
+	if err := g.Load(ctx); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Id returns the group id.
+func (g *GroupHandle) Id() string {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	return g.group.Id
+}
+
+// Group returns the group.
+func (g *GroupHandle) Group() *Group {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	return g.group
+}
+
+// Load loads all of the group's members and join requests, replacing the
+// cached members.
+func (g *GroupHandle) Load(ctx context.Context) error {
+	users, err := GroupUsers(g.Id()).Iter(ctx, g.cl).All(0)
+	if err != nil {
+		return err
+	}
+	members := make(map[string]*GroupUser, len(users))
+	for _, u := range users {
+		members[u.User.GetId()] = u
+	}
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	g.members = members
+	return nil
+}
+
+// Role returns the user's role in the group, and whether the user is a member
+// of the group or has requested to join the group.
+func (g *GroupHandle) Role(userId string) (UserRoleState, bool) {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	return g.role(userId)
+}
+
+// role returns the user's role. Must be called with the lock held.
+func (g *GroupHandle) role(userId string) (UserRoleState, bool) {
+	if u, ok := g.members[userId]; ok {
+		return UserRoleState(u.State.GetValue()), true
+	}
+	return 0, false
+}
+
+// SelfRole returns the user's own role in the group.
+func (g *GroupHandle) SelfRole() (UserRoleState, bool) {
+	return g.Role(g.cl.SessionUserId())
+}
+
+// Members returns the group's members, ordered by role and username.
+func (g *GroupHandle) Members() []*GroupUser {
+	return g.users(func(state UserRoleState) bool {
+		return state != UserRoleState_JOIN_REQUEST
+	})
+}
+
+// Requests returns the group's pending join requests, ordered by username.
+func (g *GroupHandle) Requests() []*GroupUser {
+	return g.users(func(state UserRoleState) bool {
+		return state == UserRoleState_JOIN_REQUEST
+	})
+}
+
+// users returns the users with a matching role, ordered by role and
+// username.
+func (g *GroupHandle) users(f func(UserRoleState) bool) []*GroupUser {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	var users []*GroupUser
+	for _, u := range g.members {
+		if f(UserRoleState(u.State.GetValue())) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if a, b := users[i].State.GetValue(), users[j].State.GetValue(); a != b {
+			return a < b
+		}
+		return users[i].User.GetUsername() < users[j].User.GetUsername()
+	})
+	return users
+}
+
+// Join joins the group. For closed groups, a join request is sent to the
+// group's admins.
+func (g *GroupHandle) Join(ctx context.Context) error {
+	if err := JoinGroup(g.Id()).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	return g.Load(ctx)
+}
+
+// Leave leaves the group.
+func (g *GroupHandle) Leave(ctx context.Context) error {
+	if err := LeaveGroup(g.Id()).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	delete(g.members, g.cl.SessionUserId())
+	return nil
+}
+
+// Update updates the group, applying the update to the cached group. The user
+// must be an admin or superadmin.
+func (g *GroupHandle) Update(ctx context.Context, req *UpdateGroupRequest) error {
+	if err := g.check(UserRoleState_ADMIN); err != nil {
+		return err
+	}
+	req.GroupId = g.Id()
+	if err := req.Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	group := proto.Clone(g.group).(*Group)
+	if req.Name != nil {
+		group.Name = req.Name.Value
+	}
+	if req.Description != nil {
+		group.Description = req.Description.Value
+	}
+	if req.LangTag != nil {
+		group.LangTag = req.LangTag.Value
+	}
+	if req.AvatarUrl != nil {
+		group.AvatarUrl = req.AvatarUrl.Value
+	}
+	if req.Open != nil {
+		group.Open = wrapperspb.Bool(req.Open.Value)
+	}
+	group.UpdateTime = timestamppb.Now()
+	g.group = group
+	return nil
+}
+
+// Delete deletes the group. The user must be a superadmin.
+func (g *GroupHandle) Delete(ctx context.Context) error {
+	if err := g.check(UserRoleState_SUPERADMIN); err != nil {
+		return err
+	}
+	return DeleteGroup(g.Id()).Do(ctx, g.cl)
+}
+
+// Accept accepts the users' join requests.
+func (g *GroupHandle) Accept(ctx context.Context, userIds ...string) error {
+	if err := g.moderate(userIds, true); err != nil {
+		return err
+	}
+	if err := AddGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.setRoles(userIds, 0, UserRoleState_MEMBER)
+	return nil
+}
+
+// Decline declines the users' join requests.
+func (g *GroupHandle) Decline(ctx context.Context, userIds ...string) error {
+	if err := g.moderate(userIds, true); err != nil {
+		return err
+	}
+	if err := KickGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.remove(userIds)
+	return nil
+}
+
+// Add adds the users to the group. The user must be an admin or superadmin.
+func (g *GroupHandle) Add(ctx context.Context, userIds ...string) error {
+	if err := g.check(UserRoleState_ADMIN); err != nil {
+		return err
+	}
+	if err := AddGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	return g.Load(ctx)
+}
+
+// Kick kicks the users from the group.
+func (g *GroupHandle) Kick(ctx context.Context, userIds ...string) error {
+	if err := g.moderate(userIds, false); err != nil {
+		return err
+	}
+	if err := KickGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.remove(userIds)
+	return nil
+}
+
+// Ban bans the users from the group.
+func (g *GroupHandle) Ban(ctx context.Context, userIds ...string) error {
+	if err := g.moderate(userIds, false); err != nil {
+		return err
+	}
+	if err := BanGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.remove(userIds)
+	return nil
+}
+
+// Promote promotes the users to the next greater role.
+func (g *GroupHandle) Promote(ctx context.Context, userIds ...string) error {
+	if err := g.moderate(userIds, false); err != nil {
+		return err
+	}
+	if err := PromoteGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.setRoles(userIds, -1, UserRoleState_SUPERADMIN)
+	return nil
+}
+
+// Demote demotes the users to the next lesser role.
+func (g *GroupHandle) Demote(ctx context.Context, userIds ...string) error {
+	if err := g.moderate(userIds, false); err != nil {
+		return err
+	}
+	if err := DemoteGroupUsers(g.Id(), userIds...).Do(ctx, g.cl); err != nil {
+		return err
+	}
+	g.setRoles(userIds, 1, UserRoleState_MEMBER)
+	return nil
+}
+
+// JoinChannel joins the group's chat channel, returning a channel handle. See
+// ChannelHandler for the handlers that can be passed.
+func (g *GroupHandle) JoinChannel(ctx context.Context, conn *Conn, handlers ...ChannelHandler) (*Channel, error) {
+	if err := g.check(UserRoleState_MEMBER); err != nil {
+		return nil, err
+	}
+	return conn.JoinChannel(ctx, ChannelJoin(g.Id(), ChannelType_GROUP).WithPersistence(true), handlers...)
+}
+
+// check returns an error when the user's role is lesser than role.
+func (g *GroupHandle) check(role UserRoleState) error {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	switch self, ok := g.role(g.cl.SessionUserId()); {
+	case !ok || self == UserRoleState_JOIN_REQUEST:
+		return ErrGroupNotMember
+	case role < self:
+		return ErrGroupPermissionDenied
+	}
+	return nil
+}
+
+// moderate returns an error when the user cannot moderate the users. When
+// requests is true, the users must have requested to join the group.
+func (g *GroupHandle) moderate(userIds []string, requests bool) error {
+	if err := g.check(UserRoleState_ADMIN); err != nil {
+		return err
+	}
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	self, _ := g.role(g.cl.SessionUserId())
+	for _, id := range userIds {
+		switch role, ok := g.role(id); {
+		case !ok || requests != (role == UserRoleState_JOIN_REQUEST):
+			return ErrGroupNotMember
+		case self != UserRoleState_SUPERADMIN && role <= self:
+			return ErrGroupPermissionDenied
+		}
+	}
+	return nil
+}
+
+// setRoles changes the users' roles by delta, limited to limit. A delta of 0
+// sets the users' roles to limit.
+func (g *GroupHandle) setRoles(userIds []string, delta int32, limit UserRoleState) {
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	for _, id := range userIds {
+		u, ok := g.members[id]
+		if !ok {
+			continue
+		}
+		state := u.State.GetValue() + delta
+		if delta == 0 || (delta < 0 && state < int32(limit)) || (delta > 0 && int32(limit) < state) {
+			state = int32(limit)
+		}
+		g.members[id] = &GroupUser{
+			User:  u.User,
+			State: wrapperspb.Int32(state),
+		}
+	}
+}
+
+// remove removes the users.
+func (g *GroupHandle) remove(userIds []string) {
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	for _, id := range userIds {
+		delete(g.members, id)
+	}
+}
+
+// GroupError is a group handle error.
+type GroupError string
+
+const (
+	// ErrGroupNotMember is the group not member error.
+	ErrGroupNotMember GroupError = "group not member"
+	// ErrGroupPermissionDenied is the group permission denied error.
+	ErrGroupPermissionDenied GroupError = "group permission denied"
+)
+
+// Error satisfies the error interface.
+func (err GroupError) Error() string {
+	return string(err)
+}
@@ -0,0 +1,427 @@
+package nakama
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ascii8/nakama-go/internal/grpcapi"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// grpcClient is a gRPC transport, executing unary calls over HTTP/2.
+type grpcClient struct {
+	url string
+	cl  *http.Client
+}
+
+// newGrpcClient creates a new gRPC transport for the url.
+func newGrpcClient(urlstr string, transport http.RoundTripper) *grpcClient {
+	urlstr = strings.TrimSuffix(urlstr, "/")
+	if transport == nil {
+		t := new(http2.Transport)
+		if u, err := url.Parse(urlstr); err == nil && strings.ToLower(u.Scheme) == "http" {
+			t.AllowHTTP = true
+			t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, addr)
+			}
+		}
+		transport = t
+	}
+	return &grpcClient{
+		url: urlstr,
+		cl: &http.Client{
+			Transport: transport,
+		},
+	}
+}
+
+// invoke invokes the named gRPC method, sending the encoded request message
+// buf, and decoding the response message to v (when not nil).
+func (g *grpcClient) invoke(ctx context.Context, name string, header http.Header, buf []byte, v proto.Message) error {
+	body := new(bytes.Buffer)
+	if err := grpcapi.WriteMessage(body, buf); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", g.url+"/"+grpcapi.Service+"/"+name, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	res, err := g.cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &ClientError{
+			StatusCode: res.StatusCode,
+			Code:       grpcHttpCode(res.StatusCode),
+			Message:    "unexpected http status",
+		}
+	}
+	// trailers-only response
+	if ok, err := grpcStatus(res.Header); ok {
+		return err
+	}
+	msg, err := grpcapi.ReadMessage(res.Body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		return err
+	}
+	switch ok, err := grpcStatus(res.Trailer); {
+	case !ok:
+		return &ClientError{
+			Code:    CodeInternal,
+			Message: "missing grpc status",
+		}
+	case err != nil:
+		return err
+	case msg == nil:
+		return &ClientError{
+			Code:    CodeInternal,
+			Message: "missing grpc response message",
+		}
+	case v == nil:
+		return nil
+	}
+	return proto.Unmarshal(msg, v)
+}
+
+// doGrpc executes a request as the equivalent gRPC call.
+func (cl *Client) doGrpc(ctx context.Context, method, typ string, auth bool, query url.Values, msg, v interface{}) error {
+	rt, params, ok := findGrpcRoute(method, typ)
+	if !ok {
+		return fmt.Errorf("no grpc method for %s %s", method, typ)
+	}
+	// build request message
+	req, err := rt.build(cl, params, query, msg)
+	if err != nil {
+		return err
+	}
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// response message
+	var res proto.Message
+	var rpc *RpcMsg
+	switch x := v.(type) {
+	case nil:
+	case proto.Message:
+		res = x
+	default:
+		if rt.body != "payload" {
+			return fmt.Errorf("unable to decode grpc response to %T", v)
+		}
+		rpc = new(RpcMsg)
+		res = rpc
+	}
+	// refresh
+	if auth && cl.refreshAuto {
+		if err := cl.SessionRefresh(ctx); err != nil {
+			return err
+		}
+	}
+	// exec
+	if err := cl.retry.do(ctx, method, func() error {
+		header := make(http.Header)
+		cl.addHeaders(ctx, header, typ)
+		if token := cl.SessionToken(); auth && token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		return cl.grpc.invoke(ctx, rt.name, header, buf, res)
+	}); err != nil {
+		return err
+	}
+	if rpc == nil {
+		return nil
+	}
+	// unwrap rpc payload
+	return cl.Unmarshal(strings.NewReader(rpc.Payload), v)
+}
+
+// grpcRoute maps a http route to its gRPC method.
+type grpcRoute struct {
+	method string
+	path   []string
+	name   string
+	typ    protoreflect.FullName
+	body   string
+}
+
+// newGrpcRoute creates a new gRPC route for the shared route definition.
+func newGrpcRoute(rt grpcapi.Route) grpcRoute {
+	return grpcRoute{
+		method: rt.Method,
+		path:   strings.Split(rt.Pattern, "/"),
+		name:   rt.Name,
+		typ:    protoreflect.FullName(grpcapi.Package + "." + rt.Message),
+		body:   rt.Body,
+	}
+}
+
+// match matches the route against the method and path, returning the path
+// parameters.
+func (rt grpcRoute) match(method string, path []string) (map[string]string, bool) {
+	if rt.method != method || len(rt.path) != len(path) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, s := range rt.path {
+		switch {
+		case strings.HasPrefix(s, "{"):
+			params[strings.Trim(s, "{}")] = path[i]
+		case s != path[i]:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// build builds the gRPC request message from the path parameters, url query
+// values, and http request message, as the grpc-gateway would.
+func (rt grpcRoute) build(cl *Client, params map[string]string, query url.Values, msg interface{}) (proto.Message, error) {
+	typ, err := protoregistry.GlobalTypes.FindMessageByName(rt.typ)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grpc request message %s: %w", rt.typ, err)
+	}
+	m := typ.New()
+	fields := m.Descriptor().Fields()
+	// body
+	switch rt.body {
+	case "":
+	case "payload":
+		fd := fields.ByName("payload")
+		body, err := cl.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			buf, err := io.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			m.Set(fd, protoreflect.ValueOfString(string(buf)))
+		}
+	default:
+		src, ok := msg.(proto.Message)
+		if msg != nil && !ok {
+			return nil, fmt.Errorf("unable to encode %T as grpc message", msg)
+		}
+		dst := m
+		if rt.body != "*" {
+			fd := fields.ByName(protoreflect.Name(rt.body))
+			if fd == nil || fd.Message() == nil {
+				return nil, fmt.Errorf("invalid grpc body field %q", rt.body)
+			}
+			dst = m.Mutable(fd).Message()
+		}
+		if src != nil {
+			buf, err := proto.Marshal(src)
+			if err != nil {
+				return nil, err
+			}
+			if err := (proto.UnmarshalOptions{Merge: true}).Unmarshal(buf, dst.Interface()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// path parameters
+	for k, s := range params {
+		fd := fields.ByName(protoreflect.Name(k))
+		if fd == nil {
+			return nil, fmt.Errorf("invalid grpc path parameter %q", k)
+		}
+		if err := grpcSet(m, fd, []string{s}); err != nil {
+			return nil, err
+		}
+	}
+	// query
+	if rt.body == "*" {
+		return m.Interface(), nil
+	}
+	for k, v := range query {
+		fd := fields.ByJSONName(k)
+		if fd == nil {
+			fd = fields.ByName(protoreflect.Name(k))
+		}
+		if fd == nil || params[string(fd.Name())] != "" || len(v) == 0 {
+			continue
+		}
+		if err := grpcSet(m, fd, v); err != nil {
+			return nil, err
+		}
+	}
+	return m.Interface(), nil
+}
+
+// findGrpcRoute finds the gRPC route for the http method and type.
+func findGrpcRoute(method, typ string) (grpcRoute, map[string]string, bool) {
+	path := strings.Split(strings.Trim(typ, "/"), "/")
+	for _, rt := range grpcRoutes {
+		if params, ok := rt.match(method, path); ok {
+			return rt, params, true
+		}
+	}
+	return grpcRoute{}, nil, false
+}
+
+// grpcRoutes are the gRPC routes, in the order matched.
+var grpcRoutes = func() []grpcRoute {
+	routes := make([]grpcRoute, len(grpcapi.Routes))
+	for i, rt := range grpcapi.Routes {
+		routes[i] = newGrpcRoute(rt)
+	}
+	return routes
+}()
+
+// grpcSet sets the field on m from the string values. Wrapper message fields
+// (ie, google.protobuf.Int32Value) are set via their value field.
+func grpcSet(m protoreflect.Message, fd protoreflect.FieldDescriptor, v []string) error {
+	switch {
+	case fd.IsList():
+		l := m.Mutable(fd).List()
+		for _, s := range v {
+			val, err := grpcValue(fd, s)
+			if err != nil {
+				return err
+			}
+			l.Append(val)
+		}
+		return nil
+	case fd.Message() != nil:
+		inner := m.Mutable(fd).Message()
+		vfd := inner.Descriptor().Fields().ByName("value")
+		if vfd == nil {
+			return fmt.Errorf("unable to set grpc field %s", fd.Name())
+		}
+		return grpcSet(inner, vfd, v[len(v)-1:])
+	}
+	val, err := grpcValue(fd, v[len(v)-1])
+	if err != nil {
+		return err
+	}
+	m.Set(fd, val)
+	return nil
+}
+
+// grpcValue parses the string value for the field.
+func grpcValue(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	var val protoreflect.Value
+	var err error
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		val = protoreflect.ValueOfString(s)
+	case protoreflect.BoolKind:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		val = protoreflect.ValueOfBool(b)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, 32)
+		val = protoreflect.ValueOfInt32(int32(i))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, 64)
+		val = protoreflect.ValueOfInt64(i)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var i uint64
+		i, err = strconv.ParseUint(s, 10, 32)
+		val = protoreflect.ValueOfUint32(uint32(i))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var i uint64
+		i, err = strconv.ParseUint(s, 10, 64)
+		val = protoreflect.ValueOfUint64(i)
+	case protoreflect.FloatKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		val = protoreflect.ValueOfFloat32(float32(f))
+	case protoreflect.DoubleKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		val = protoreflect.ValueOfFloat64(f)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		var i int64
+		i, err = strconv.ParseInt(s, 10, 32)
+		val = protoreflect.ValueOfEnum(protoreflect.EnumNumber(i))
+	case protoreflect.BytesKind:
+		var buf []byte
+		buf, err = base64.StdEncoding.DecodeString(s)
+		val = protoreflect.ValueOfBytes(buf)
+	default:
+		return val, fmt.Errorf("unable to set grpc field %s", fd.Name())
+	}
+	if err != nil {
+		return val, fmt.Errorf("invalid %s value %q: %w", fd.Name(), s, err)
+	}
+	return val, nil
+}
+
+// grpcStatus returns the client error for the grpc-status and grpc-message
+// in the header, if any. Returns false when the header does not contain a
+// grpc-status.
+func grpcStatus(header http.Header) (bool, error) {
+	s := header.Get("Grpc-Status")
+	if s == "" {
+		return false, nil
+	}
+	code, err := strconv.Atoi(s)
+	switch {
+	case err != nil:
+		return true, &ClientError{
+			Code:    CodeInternal,
+			Message: "invalid grpc status " + strconv.Quote(s),
+		}
+	case code == 0:
+		return true, nil
+	}
+	msg := header.Get("Grpc-Message")
+	if m, err := url.PathUnescape(msg); err == nil {
+		msg = m
+	}
+	return true, &ClientError{
+		Code:    Code(code),
+		Message: msg,
+	}
+}
+
+// grpcHttpCode returns the code for a non-200 http status in a gRPC response.
+//
+// See: https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcHttpCode(statusCode int) Code {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return CodeInternal
+	case http.StatusUnauthorized:
+		return CodeUnauthenticated
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	return CodeUnknown
+}
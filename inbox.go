@@ -0,0 +1,528 @@
+package nakama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// InboxItem is a notification held by an inbox.
+type InboxItem struct {
+	// Notification is the notification.
+	Notification *Notification
+	// Read is true when the notification was marked read.
+	Read bool
+}
+
+// inboxItemJSON is the JSON encoding of an inbox item.
+type inboxItemJSON struct {
+	Notification json.RawMessage `json:"notification"`
+	Read         bool            `json:"read,omitempty"`
+}
+
+// MarshalJSON satisfies the json.Marshaler interface.
+func (item *InboxItem) MarshalJSON() ([]byte, error) {
+	buf, err := protojson.Marshal(item.Notification)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(inboxItemJSON{
+		Notification: buf,
+		Read:         item.Read,
+	})
+}
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface.
+func (item *InboxItem) UnmarshalJSON(buf []byte) error {
+	var v inboxItemJSON
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+	n := new(Notification)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(v.Notification, n); err != nil {
+		return err
+	}
+	item.Notification, item.Read = n, v.Read
+	return nil
+}
+
+// InboxState is the state of an inbox, persisted in an inbox store.
+type InboxState struct {
+	// Cursor is the cacheable cursor of the last retrieved notification.
+	Cursor string `json:"cursor,omitempty"`
+	// Items are the notifications held by the inbox, ordered by create time.
+	Items []*InboxItem `json:"items,omitempty"`
+	// Deleted are the ids of deleted notifications not yet deleted on the
+	// server.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// clone returns a deep copy of the state.
+func (state *InboxState) clone() *InboxState {
+	v := &InboxState{
+		Cursor:  state.Cursor,
+		Deleted: append([]string(nil), state.Deleted...),
+	}
+	for _, item := range state.Items {
+		v.Items = append(v.Items, &InboxItem{
+			Notification: proto.Clone(item.Notification).(*Notification),
+			Read:         item.Read,
+		})
+	}
+	return v
+}
+
+// InboxStore is the interface for inbox stores, used to persist an inbox's
+// notifications and cacheable cursor across process restarts.
+//
+// Load returns a nil state and no error when no state has been saved.
+type InboxStore interface {
+	Load() (*InboxState, error)
+	Save(*InboxState) error
+}
+
+// MemoryInboxStore is an in-memory inbox store.
+type MemoryInboxStore struct {
+	state *InboxState
+	rw    sync.RWMutex
+}
+
+// NewMemoryInboxStore creates a new in-memory inbox store.
+func NewMemoryInboxStore() *MemoryInboxStore {
+	return new(MemoryInboxStore)
+}
+
+// Load satisfies the InboxStore interface.
+func (store *MemoryInboxStore) Load() (*InboxState, error) {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	if store.state == nil {
+		return nil, nil
+	}
+	return store.state.clone(), nil
+}
+
+// Save satisfies the InboxStore interface.
+func (store *MemoryInboxStore) Save(state *InboxState) error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	store.state = state.clone()
+	return nil
+}
+
+// FileInboxStore is a file-backed inbox store. The state is written as JSON,
+// readable only by the current user.
+type FileInboxStore struct {
+	path string
+	rw   sync.RWMutex
+}
+
+// NewFileInboxStore creates a new file-backed inbox store, saving the state
+// to the file at path.
+func NewFileInboxStore(path string) *FileInboxStore {
+	return &FileInboxStore{
+		path: path,
+	}
+}
+
+// Load satisfies the InboxStore interface.
+func (store *FileInboxStore) Load() (*InboxState, error) {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	buf, err := os.ReadFile(store.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to load inbox: %w", err)
+	}
+	state := new(InboxState)
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("unable to load inbox: %w", err)
+	}
+	return state, nil
+}
+
+// Save satisfies the InboxStore interface.
+func (store *FileInboxStore) Save(state *InboxState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to save inbox: %w", err)
+	}
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	if err := writeFile(store.path, buf); err != nil {
+		return fmt.Errorf("unable to save inbox: %w", err)
+	}
+	return nil
+}
+
+// Inbox is a notification inbox, reconciling notifications delivered live to
+// a connection with the notifications retrieved from the server, persisted in
+// an inbox store.
+//
+// Sync retrieves the notifications missed since the inbox's cacheable cursor.
+// An Inbox can be attached to a Conn (see Attach), to receive live
+// notifications and to sync each time the connection is established,
+// including after a reconnect. Notifications are de-duplicated by id, and the
+// inbox's handlers are called once for each new notification, one at a time
+// in the order added.
+//
+// Deletes are batched, and sent to the server after the batch delay, or by
+// Flush. Deletes not yet sent are persisted, and sent by the next Sync.
+type Inbox struct {
+	cl       *Client
+	store    InboxStore
+	delay    time.Duration
+	handlers []func(context.Context, *Notification)
+	loaded   bool
+	cursor   string
+	items    []*InboxItem
+	ids      map[string]*InboxItem
+	deleted  map[string]bool
+	timer    *time.Timer
+	queue    dispatcher
+	mu       sync.Mutex
+	syncMu   sync.Mutex
+}
+
+// NewInbox creates a notification inbox, persisted in the store. Uses an
+// in-memory inbox store when store is nil.
+func NewInbox(cl *Client, store InboxStore) *Inbox {
+	if store == nil {
+		store = NewMemoryInboxStore()
+	}
+	return &Inbox{
+		cl:      cl,
+		store:   store,
+		delay:   time.Second,
+		ids:     make(map[string]*InboxItem),
+		deleted: make(map[string]bool),
+	}
+}
+
+// WithHandler adds a handler called for each new notification.
+func (in *Inbox) WithHandler(f func(context.Context, *Notification)) *Inbox {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.handlers = append(in.handlers, f)
+	return in
+}
+
+// WithBatchDelay sets the delay before deletes are sent to the server.
+func (in *Inbox) WithBatchDelay(delay time.Duration) *Inbox {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.delay = delay
+	return in
+}
+
+// Load loads the inbox from the store, when not already loaded.
+func (in *Inbox) Load() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.load()
+}
+
+// load loads the inbox from the store. Must be called with the lock held.
+func (in *Inbox) load() error {
+	if in.loaded {
+		return nil
+	}
+	state, err := in.store.Load()
+	switch {
+	case err != nil:
+		return err
+	case state != nil:
+		in.cursor = state.Cursor
+		for _, item := range state.Items {
+			if item.Notification != nil && in.ids[item.Notification.Id] == nil {
+				in.items = append(in.items, item)
+				in.ids[item.Notification.Id] = item
+			}
+		}
+		for _, id := range state.Deleted {
+			in.deleted[id] = true
+		}
+	}
+	in.loaded = true
+	return nil
+}
+
+// save saves the inbox to the store. Must be called with the lock held.
+func (in *Inbox) save() error {
+	state := &InboxState{
+		Cursor:  in.cursor,
+		Items:   in.items,
+		Deleted: sortedKeys(in.deleted),
+	}
+	return in.store.Save(state)
+}
+
+// Sync sends deletes not yet sent, and retrieves the notifications missed
+// since the inbox's cacheable cursor.
+func (in *Inbox) Sync(ctx context.Context) error {
+	in.syncMu.Lock()
+	defer in.syncMu.Unlock()
+	if err := in.Load(); err != nil {
+		return err
+	}
+	if err := in.Flush(ctx); err != nil {
+		return err
+	}
+	in.mu.Lock()
+	cursor := in.cursor
+	in.mu.Unlock()
+	for {
+		res, err := Notifications().WithLimit(100).WithCacheableCursor(cursor).Do(ctx, in.cl)
+		if err != nil {
+			return err
+		}
+		if err := in.add(ctx, res.Notifications, res.CacheableCursor); err != nil {
+			return err
+		}
+		if len(res.Notifications) < 100 || res.CacheableCursor == "" || res.CacheableCursor == cursor {
+			return nil
+		}
+		cursor = res.CacheableCursor
+	}
+}
+
+// add adds the notifications not already held by the inbox, updating the
+// cacheable cursor when not empty, and queues the added notifications to
+// the inbox's handlers.
+func (in *Inbox) add(ctx context.Context, notifications []*Notification, cursor string) error {
+	in.mu.Lock()
+	if err := in.load(); err != nil {
+		in.mu.Unlock()
+		return err
+	}
+	var added []*Notification
+	for _, n := range notifications {
+		if in.ids[n.Id] != nil || in.deleted[n.Id] {
+			continue
+		}
+		item := &InboxItem{
+			Notification: n,
+		}
+		in.items = append(in.items, item)
+		in.ids[n.Id] = item
+		added = append(added, n)
+	}
+	sort.SliceStable(in.items, func(i, j int) bool {
+		return in.items[i].Notification.CreateTime.AsTime().Before(in.items[j].Notification.CreateTime.AsTime())
+	})
+	changed := len(added) != 0 || (cursor != "" && cursor != in.cursor)
+	if cursor != "" {
+		in.cursor = cursor
+	}
+	var err error
+	if changed {
+		err = in.save()
+	}
+	if handlers := in.handlers; len(added) != 0 && len(handlers) != 0 {
+		in.queue.push(func() {
+			for _, n := range added {
+				for _, f := range handlers {
+					f(ctx, n)
+				}
+			}
+		})
+	}
+	in.mu.Unlock()
+	return err
+}
+
+// Notifications returns the notifications held by the inbox, most recent
+// first.
+func (in *Inbox) Notifications() []*Notification {
+	return in.notifications(func(*InboxItem) bool {
+		return true
+	})
+}
+
+// Unread returns the unread notifications held by the inbox, most recent
+// first.
+func (in *Inbox) Unread() []*Notification {
+	return in.notifications(func(item *InboxItem) bool {
+		return !item.Read
+	})
+}
+
+// notifications returns the matching notifications, most recent first.
+func (in *Inbox) notifications(f func(*InboxItem) bool) []*Notification {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var v []*Notification
+	for i := len(in.items) - 1; 0 <= i; i-- {
+		if f(in.items[i]) {
+			v = append(v, in.items[i].Notification)
+		}
+	}
+	return v
+}
+
+// UnreadCount returns the number of unread notifications.
+func (in *Inbox) UnreadCount() int {
+	return len(in.Unread())
+}
+
+// IsRead returns true when the notification was marked read.
+func (in *Inbox) IsRead(id string) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	item, ok := in.ids[id]
+	return ok && item.Read
+}
+
+// MarkRead marks the notifications read.
+func (in *Inbox) MarkRead(ids ...string) error {
+	return in.mark(ids, true)
+}
+
+// MarkUnread marks the notifications unread.
+func (in *Inbox) MarkUnread(ids ...string) error {
+	return in.mark(ids, false)
+}
+
+// MarkAllRead marks all notifications read.
+func (in *Inbox) MarkAllRead() error {
+	var ids []string
+	for _, n := range in.Unread() {
+		ids = append(ids, n.Id)
+	}
+	return in.mark(ids, true)
+}
+
+// mark sets the notifications' read state.
+func (in *Inbox) mark(ids []string, read bool) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err := in.load(); err != nil {
+		return err
+	}
+	var changed bool
+	for _, id := range ids {
+		if item, ok := in.ids[id]; ok && item.Read != read {
+			item.Read, changed = read, true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return in.save()
+}
+
+// Delete removes the notifications from the inbox, and queues their delete
+// on the server. Queued deletes are sent after the batch delay.
+func (in *Inbox) Delete(ids ...string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err := in.load(); err != nil {
+		return err
+	}
+	var items []*InboxItem
+	for _, item := range in.items {
+		id := item.Notification.Id
+		if !contains(ids, id) {
+			items = append(items, item)
+			continue
+		}
+		delete(in.ids, id)
+		if item.Notification.Persistent {
+			in.deleted[id] = true
+		}
+	}
+	in.items = items
+	if err := in.save(); err != nil {
+		return err
+	}
+	if len(in.deleted) != 0 && in.timer == nil {
+		in.timer = time.AfterFunc(in.delay, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := in.Flush(ctx); err != nil {
+				in.cl.Errf("unable to delete notifications: %v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// Flush sends the queued deletes to the server.
+func (in *Inbox) Flush(ctx context.Context) error {
+	in.mu.Lock()
+	if in.timer != nil {
+		in.timer.Stop()
+		in.timer = nil
+	}
+	ids := sortedKeys(in.deleted)
+	in.mu.Unlock()
+	for i := 0; i < len(ids); i += 100 {
+		j := i + 100
+		if len(ids) < j {
+			j = len(ids)
+		}
+		if err := DeleteNotifications(ids[i:j]...).Do(ctx, in.cl); err != nil {
+			return err
+		}
+		in.mu.Lock()
+		for _, id := range ids[i:j] {
+			delete(in.deleted, id)
+		}
+		err := in.save()
+		in.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attach attaches the inbox to the connection, adding the connection's live
+// notifications to the inbox, and syncing the inbox when attached to an open
+// connection and each time the connection is established. Returns a func
+// that detaches the inbox from the connection.
+func (in *Inbox) Attach(conn *Conn) func() {
+	return conn.listen(&connListener{
+		connect: in.connect,
+		notify:  in.notify,
+	})
+}
+
+// connect syncs the inbox when the connection is established.
+func (in *Inbox) connect(ctx context.Context) {
+	if err := in.Sync(ctx); err != nil {
+		in.cl.Errf("unable to sync inbox: %v", err)
+	}
+}
+
+// notify handles a connection notification, adding live notifications to the
+// inbox.
+func (in *Inbox) notify(ctx context.Context, env *Envelope) {
+	msg := env.GetNotifications()
+	if msg == nil {
+		return
+	}
+	if err := in.add(ctx, msg.Notifications, ""); err != nil {
+		in.cl.Errf("unable to add notifications: %v", err)
+	}
+}
+
+// contains returns true when v contains s.
+func contains(v []string, s string) bool {
+	for _, x := range v {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
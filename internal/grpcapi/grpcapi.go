@@ -0,0 +1,146 @@
+// Package grpcapi contains the Nakama gRPC service definitions shared by the
+// client's gRPC transport and the nakamatest server.
+package grpcapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Service is the Nakama gRPC service name.
+const Service = "nakama.api.Nakama"
+
+// Package is the proto package of the request messages.
+const Package = "nakama"
+
+// Route maps a gRPC method to its v2 http route.
+type Route struct {
+	// Method is the http method.
+	Method string
+	// Pattern is the http path. Path parameters are enclosed in braces, and
+	// are the name of the request message field.
+	Pattern string
+	// Name is the gRPC method name.
+	Name string
+	// Message is the request message name, in the proto package.
+	Message string
+	// Body is the request message field the http body is decoded to, "*" for
+	// the whole request message, or empty when the route has no body.
+	Body string
+}
+
+// Routes are the gRPC routes, in the order matched. Routes with literal path
+// segments precede routes with path parameters in the same position.
+var Routes = []Route{
+	{"GET", "healthcheck", "Healthcheck", "HealthcheckRequest", ""},
+	{"GET", "v2/account", "GetAccount", "HealthcheckRequest", ""},
+	{"PUT", "v2/account", "UpdateAccount", "UpdateAccountRequest", "*"},
+	{"POST", "v2/account/authenticate/apple", "AuthenticateApple", "AuthenticateAppleRequest", "account"},
+	{"POST", "v2/account/authenticate/custom", "AuthenticateCustom", "AuthenticateCustomRequest", "account"},
+	{"POST", "v2/account/authenticate/device", "AuthenticateDevice", "AuthenticateDeviceRequest", "account"},
+	{"POST", "v2/account/authenticate/email", "AuthenticateEmail", "AuthenticateEmailRequest", "account"},
+	{"POST", "v2/account/authenticate/facebook", "AuthenticateFacebook", "AuthenticateFacebookRequest", "account"},
+	{"POST", "v2/account/authenticate/facebookinstantgame", "AuthenticateFacebookInstantGame", "AuthenticateFacebookInstantGameRequest", "account"},
+	{"POST", "v2/account/authenticate/gamecenter", "AuthenticateGameCenter", "AuthenticateGameCenterRequest", "account"},
+	{"POST", "v2/account/authenticate/google", "AuthenticateGoogle", "AuthenticateGoogleRequest", "account"},
+	{"POST", "v2/account/authenticate/steam", "AuthenticateSteam", "AuthenticateSteamRequest", "account"},
+	{"POST", "v2/account/link/apple", "LinkApple", "AccountApple", "*"},
+	{"POST", "v2/account/link/custom", "LinkCustom", "AccountCustom", "*"},
+	{"POST", "v2/account/link/device", "LinkDevice", "AccountDevice", "*"},
+	{"POST", "v2/account/link/email", "LinkEmail", "AccountEmail", "*"},
+	{"POST", "v2/account/link/facebook", "LinkFacebook", "LinkFacebookRequest", "account"},
+	{"POST", "v2/account/link/facebookinstantgame", "LinkFacebookInstantGame", "AccountFacebookInstantGame", "*"},
+	{"POST", "v2/account/link/gamecenter", "LinkGameCenter", "AccountGameCenter", "*"},
+	{"POST", "v2/account/link/google", "LinkGoogle", "AccountGoogle", "*"},
+	{"POST", "v2/account/link/steam", "LinkSteam", "LinkSteamRequest", "account"},
+	{"POST", "v2/account/session/refresh", "SessionRefresh", "SessionRefreshRequest", "*"},
+	{"POST", "v2/account/unlink/apple", "UnlinkApple", "AccountApple", "*"},
+	{"POST", "v2/account/unlink/custom", "UnlinkCustom", "AccountCustom", "*"},
+	{"POST", "v2/account/unlink/device", "UnlinkDevice", "AccountDevice", "*"},
+	{"POST", "v2/account/unlink/email", "UnlinkEmail", "AccountEmail", "*"},
+	{"POST", "v2/account/unlink/facebook", "UnlinkFacebook", "AccountFacebook", "*"},
+	{"POST", "v2/account/unlink/facebookinstantgame", "UnlinkFacebookInstantGame", "AccountFacebookInstantGame", "*"},
+	{"POST", "v2/account/unlink/gamecenter", "UnlinkGameCenter", "AccountGameCenter", "*"},
+	{"POST", "v2/account/unlink/google", "UnlinkGoogle", "AccountGoogle", "*"},
+	{"POST", "v2/account/unlink/steam", "UnlinkSteam", "AccountSteam", "*"},
+	{"GET", "v2/channel/{channel_id}", "ListChannelMessages", "ChannelMessagesRequest", ""},
+	{"POST", "v2/event", "Event", "EventRequest", "*"},
+	{"GET", "v2/friend", "ListFriends", "FriendsRequest", ""},
+	{"DELETE", "v2/friend", "DeleteFriends", "DeleteFriendsRequest", "*"},
+	{"POST", "v2/friend", "AddFriends", "AddFriendsRequest", "*"},
+	{"POST", "v2/friend/block", "BlockFriends", "BlockFriendsRequest", "*"},
+	{"POST", "v2/friend/facebook", "ImportFacebookFriends", "ImportFacebookFriendsRequest", "account"},
+	{"POST", "v2/friend/steam", "ImportSteamFriends", "ImportSteamFriendsRequest", "account"},
+	{"GET", "v2/group", "ListGroups", "GroupsRequest", ""},
+	{"POST", "v2/group", "CreateGroup", "CreateGroupRequest", "*"},
+	{"DELETE", "v2/group/{group_id}", "DeleteGroup", "DeleteGroupRequest", ""},
+	{"PUT", "v2/group/{group_id}", "UpdateGroup", "UpdateGroupRequest", "*"},
+	{"POST", "v2/group/{group_id}/add", "AddGroupUsers", "AddGroupUsersRequest", "*"},
+	{"POST", "v2/group/{group_id}/ban", "BanGroupUsers", "BanGroupUsersRequest", "*"},
+	{"POST", "v2/group/{group_id}/demote", "DemoteGroupUsers", "DemoteGroupUsersRequest", "*"},
+	{"POST", "v2/group/{group_id}/join", "JoinGroup", "JoinGroupRequest", ""},
+	{"POST", "v2/group/{group_id}/kick", "KickGroupUsers", "KickGroupUsersRequest", "*"},
+	{"POST", "v2/group/{group_id}/leave", "LeaveGroup", "LeaveGroupRequest", ""},
+	{"POST", "v2/group/{group_id}/promote", "PromoteGroupUsers", "PromoteGroupUsersRequest", "*"},
+	{"GET", "v2/group/{group_id}/user", "ListGroupUsers", "GroupUsersRequest", ""},
+	{"POST", "v2/iap/purchase/apple", "ValidatePurchaseApple", "ValidatePurchaseAppleRequest", "*"},
+	{"POST", "v2/iap/purchase/google", "ValidatePurchaseGoogle", "ValidatePurchaseGoogleRequest", "*"},
+	{"POST", "v2/iap/purchase/huawei", "ValidatePurchaseHuawei", "ValidatePurchaseHuaweiRequest", "*"},
+	{"GET", "v2/iap/subscription", "ListSubscriptions", "SubscriptionsRequest", "*"},
+	{"POST", "v2/iap/subscription/apple", "ValidateSubscriptionApple", "ValidateSubscriptionAppleRequest", "*"},
+	{"POST", "v2/iap/subscription/google", "ValidateSubscriptionGoogle", "ValidateSubscriptionGoogleRequest", "*"},
+	{"GET", "v2/iap/subscription/{product_id}", "GetSubscription", "SubscriptionRequest", ""},
+	{"GET", "v2/leaderboard/{leaderboard_id}", "ListLeaderboardRecords", "LeaderboardRecordsRequest", ""},
+	{"DELETE", "v2/leaderboard/{leaderboard_id}", "DeleteLeaderboardRecord", "DeleteLeaderboardRecordRequest", ""},
+	{"POST", "v2/leaderboard/{leaderboard_id}", "WriteLeaderboardRecord", "WriteLeaderboardRecordRequest", "record"},
+	{"GET", "v2/leaderboard/{leaderboard_id}/owner/{owner_id}", "ListLeaderboardRecordsAroundOwner", "LeaderboardRecordsAroundOwnerRequest", ""},
+	{"GET", "v2/match", "ListMatches", "MatchesRequest", ""},
+	{"GET", "v2/notification", "ListNotifications", "NotificationsRequest", ""},
+	{"DELETE", "v2/notification", "DeleteNotifications", "DeleteNotificationsRequest", "*"},
+	{"POST", "v2/rpc/{id}", "RpcFunc", "RpcMsg", "payload"},
+	{"POST", "v2/session/logout", "SessionLogout", "SessionLogoutRequest", "*"},
+	{"POST", "v2/storage", "ReadStorageObjects", "ReadStorageObjectsRequest", "*"},
+	{"PUT", "v2/storage", "WriteStorageObjects", "WriteStorageObjectsRequest", "*"},
+	{"PUT", "v2/storage/delete", "DeleteStorageObjects", "DeleteStorageObjectsRequest", "*"},
+	{"GET", "v2/storage/{collection}", "ListStorageObjects", "StorageObjectsRequest", ""},
+	{"GET", "v2/tournament", "ListTournaments", "TournamentsRequest", ""},
+	{"GET", "v2/tournament/{tournament_id}", "ListTournamentRecords", "TournamentRecordsRequest", ""},
+	{"POST", "v2/tournament/{tournament_id}", "WriteTournamentRecord", "WriteTournamentRecordRequest", "record"},
+	{"DELETE", "v2/tournament/{tournament_id}", "DeleteTournamentRecord", "DeleteTournamentRecordRequest", "*"},
+	{"POST", "v2/tournament/{tournament_id}/join", "JoinTournament", "JoinTournamentRequest", ""},
+	{"GET", "v2/tournament/{tournament_id}/owner/{owner_id}", "ListTournamentRecordsAroundOwner", "TournamentRecordsAroundOwnerRequest", ""},
+	{"GET", "v2/user", "GetUsers", "UsersRequest", ""},
+	{"GET", "v2/user/{user_id}/group", "ListUserGroups", "UserGroupsRequest", ""},
+}
+
+// ReadMessage reads a length-prefixed gRPC message from r. Returns io.EOF when
+// r contains no further messages. Compressed messages are not supported.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	switch _, err := io.ReadFull(r, hdr[:]); {
+	case errors.Is(err, io.EOF):
+		return nil, io.EOF
+	case err != nil:
+		return nil, fmt.Errorf("unable to read grpc message: %w", err)
+	case hdr[0] != 0:
+		return nil, errors.New("unable to read grpc message: compressed messages are not supported")
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("unable to read grpc message: %w", err)
+	}
+	return buf, nil
+}
+
+// WriteMessage writes buf to w as a length-prefixed gRPC message.
+func WriteMessage(w io.Writer, buf []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(buf)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,308 @@
+package nakama
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Iterator iterates over the items of a paginated list request, following
+// the response cursors. The next page is prefetched while the current page is
+// consumed. An iterator is not safe for concurrent use.
+type Iterator[T any] struct {
+	fetch   func(context.Context, string) ([]T, string, error)
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending chan iteratorPage[T]
+	items   []T
+	cursor  string
+	v       T
+	err     error
+}
+
+// iteratorPage is a fetched page.
+type iteratorPage[T any] struct {
+	items  []T
+	cursor string
+	next   string
+	err    error
+}
+
+// NewIterator creates a new iterator, starting at cursor. The fetch func
+// retrieves the page at a cursor, returning the page's items and the cursor of
+// the following page. Iteration stops when the following cursor is empty or
+// unchanged, or when a page has no items. The first page is fetched
+// immediately.
+func NewIterator[T any](ctx context.Context, cursor string, fetch func(context.Context, string) ([]T, string, error)) *Iterator[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	it := &Iterator[T]{
+		fetch:  fetch,
+		ctx:    ctx,
+		cancel: cancel,
+		cursor: cursor,
+	}
+	it.prefetch(cursor)
+	return it
+}
+
+// prefetch fetches the page at the cursor in the background.
+func (it *Iterator[T]) prefetch(cursor string) {
+	ch := make(chan iteratorPage[T], 1)
+	it.pending = ch
+	go func() {
+		items, next, err := it.fetch(it.ctx, cursor)
+		ch <- iteratorPage[T]{
+			items:  items,
+			cursor: cursor,
+			next:   next,
+			err:    err,
+		}
+	}()
+}
+
+// Next advances the iterator to the next item, returning false when there
+// are no more items or an error was encountered.
+func (it *Iterator[T]) Next() bool {
+	for len(it.items) == 0 {
+		if it.pending == nil || it.err != nil {
+			it.cancel()
+			return false
+		}
+		page := <-it.pending
+		it.pending = nil
+		if page.err != nil {
+			it.err = page.err
+			it.cancel()
+			return false
+		}
+		it.items, it.cursor = page.items, page.next
+		if page.next != "" && page.next != page.cursor && len(page.items) != 0 {
+			it.prefetch(page.next)
+		}
+	}
+	it.v, it.items = it.items[0], it.items[1:]
+	return true
+}
+
+// Value returns the current item.
+func (it *Iterator[T]) Value() T {
+	return it.v
+}
+
+// Err returns the error encountered during iteration, if any.
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Cursor returns the cursor of the page following the last fetched page.
+func (it *Iterator[T]) Cursor() string {
+	return it.cursor
+}
+
+// Close stops the iterator, canceling any prefetch in progress.
+func (it *Iterator[T]) Close() {
+	it.cancel()
+	it.items, it.pending = nil, nil
+}
+
+// All collects the remaining items, up to max items (when max > 0), and
+// closes the iterator.
+func (it *Iterator[T]) All(max int) ([]T, error) {
+	defer it.Close()
+	var v []T
+	for (max <= 0 || len(v) < max) && it.Next() {
+		v = append(v, it.Value())
+	}
+	return v, it.Err()
+}
+
+// Iter returns an iterator over the channel messages, following the next
+// cursor.
+func (req *ChannelMessagesRequest) Iter(ctx context.Context, cl *Client) *Iterator[*ChannelMessage] {
+	return req.iter(ctx, cl, false)
+}
+
+// IterPrev returns an iterator over the channel messages, following the
+// previous cursor.
+func (req *ChannelMessagesRequest) IterPrev(ctx context.Context, cl *Client) *Iterator[*ChannelMessage] {
+	return req.iter(ctx, cl, true)
+}
+
+// iter returns an iterator over the channel messages.
+func (req *ChannelMessagesRequest) iter(ctx context.Context, cl *Client, prev bool) *Iterator[*ChannelMessage] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*ChannelMessage, string, error) {
+		r := proto.Clone(req).(*ChannelMessagesRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		switch {
+		case err != nil:
+			return nil, "", err
+		case prev:
+			return res.Messages, res.PrevCursor, nil
+		}
+		return res.Messages, res.NextCursor, nil
+	})
+}
+
+// Iter returns an iterator over the friends.
+func (req *FriendsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*Friend] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*Friend, string, error) {
+		r := proto.Clone(req).(*FriendsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		if err != nil {
+			return nil, "", err
+		}
+		return res.Friends, res.Cursor, nil
+	})
+}
+
+// Iter returns an iterator over the groups.
+func (req *GroupsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*Group] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*Group, string, error) {
+		r := proto.Clone(req).(*GroupsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		if err != nil {
+			return nil, "", err
+		}
+		return res.Groups, res.Cursor, nil
+	})
+}
+
+// Iter returns an iterator over the group users.
+func (req *GroupUsersRequest) Iter(ctx context.Context, cl *Client) *Iterator[*GroupUser] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*GroupUser, string, error) {
+		r := proto.Clone(req).(*GroupUsersRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		if err != nil {
+			return nil, "", err
+		}
+		return res.GroupUsers, res.Cursor, nil
+	})
+}
+
+// Iter returns an iterator over the subscriptions, following the next
+// cursor.
+func (req *SubscriptionsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*ValidatedSubscription] {
+	return req.iter(ctx, cl, false)
+}
+
+// IterPrev returns an iterator over the subscriptions, following the previous
+// cursor.
+func (req *SubscriptionsRequest) IterPrev(ctx context.Context, cl *Client) *Iterator[*ValidatedSubscription] {
+	return req.iter(ctx, cl, true)
+}
+
+// iter returns an iterator over the subscriptions.
+func (req *SubscriptionsRequest) iter(ctx context.Context, cl *Client, prev bool) *Iterator[*ValidatedSubscription] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*ValidatedSubscription, string, error) {
+		r := proto.Clone(req).(*SubscriptionsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		switch {
+		case err != nil:
+			return nil, "", err
+		case prev:
+			return res.ValidatedSubscriptions, res.PrevCursor, nil
+		}
+		return res.ValidatedSubscriptions, res.Cursor, nil
+	})
+}
+
+// Iter returns an iterator over the leaderboard records, following the next
+// cursor. Owner records are not included.
+func (req *LeaderboardRecordsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*LeaderboardRecord] {
+	return req.iter(ctx, cl, false)
+}
+
+// IterPrev returns an iterator over the leaderboard records, following the
+// previous cursor. Owner records are not included.
+func (req *LeaderboardRecordsRequest) IterPrev(ctx context.Context, cl *Client) *Iterator[*LeaderboardRecord] {
+	return req.iter(ctx, cl, true)
+}
+
+// iter returns an iterator over the leaderboard records.
+func (req *LeaderboardRecordsRequest) iter(ctx context.Context, cl *Client, prev bool) *Iterator[*LeaderboardRecord] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*LeaderboardRecord, string, error) {
+		r := proto.Clone(req).(*LeaderboardRecordsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		switch {
+		case err != nil:
+			return nil, "", err
+		case prev:
+			return res.Records, res.PrevCursor, nil
+		}
+		return res.Records, res.NextCursor, nil
+	})
+}
+
+// Iter returns an iterator over the notifications, following the cacheable
+// cursor. Iteration stops at the first empty page.
+func (req *NotificationsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*Notification] {
+	return NewIterator(ctx, req.CacheableCursor, func(ctx context.Context, cursor string) ([]*Notification, string, error) {
+		r := proto.Clone(req).(*NotificationsRequest)
+		r.CacheableCursor = cursor
+		res, err := r.Do(ctx, cl)
+		if err != nil {
+			return nil, "", err
+		}
+		return res.Notifications, res.CacheableCursor, nil
+	})
+}
+
+// Iter returns an iterator over the storage objects.
+func (req *StorageObjectsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*StorageObject] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*StorageObject, string, error) {
+		r := proto.Clone(req).(*StorageObjectsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		if err != nil {
+			return nil, "", err
+		}
+		return res.Objects, res.Cursor, nil
+	})
+}
+
+// Iter returns an iterator over the tournaments.
+func (req *TournamentsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*Tournament] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*Tournament, string, error) {
+		r := proto.Clone(req).(*TournamentsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		if err != nil {
+			return nil, "", err
+		}
+		return res.Tournaments, res.Cursor, nil
+	})
+}
+
+// Iter returns an iterator over the tournament records, following the next
+// cursor. Owner records are not included.
+func (req *TournamentRecordsRequest) Iter(ctx context.Context, cl *Client) *Iterator[*LeaderboardRecord] {
+	return req.iter(ctx, cl, false)
+}
+
+// IterPrev returns an iterator over the tournament records, following the
+// previous cursor. Owner records are not included.
+func (req *TournamentRecordsRequest) IterPrev(ctx context.Context, cl *Client) *Iterator[*LeaderboardRecord] {
+	return req.iter(ctx, cl, true)
+}
+
+// iter returns an iterator over the tournament records.
+func (req *TournamentRecordsRequest) iter(ctx context.Context, cl *Client, prev bool) *Iterator[*LeaderboardRecord] {
+	return NewIterator(ctx, req.Cursor, func(ctx context.Context, cursor string) ([]*LeaderboardRecord, string, error) {
+		r := proto.Clone(req).(*TournamentRecordsRequest)
+		r.Cursor = cursor
+		res, err := r.Do(ctx, cl)
+		switch {
+		case err != nil:
+			return nil, "", err
+		case prev:
+			return res.Records, res.PrevCursor, nil
+		}
+		return res.Records, res.NextCursor, nil
+	})
+}
@@ -0,0 +1,259 @@
+package nakama
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MatchHandler is an empty interface for match handlers, as used by
+// Conn.CreateMatch and Conn.JoinMatch. A type that supports any of the
+// following smuggled interfaces:
+//
+//	MatchDataHandler(context.Context, *nakama.MatchDataMsg)
+//	MatchPresenceEventHandler(context.Context, *nakama.MatchPresenceEventMsg)
+//
+// Will have its methods called for the match's data and presence events,
+// respectively.
+type MatchHandler interface{}
+
+// MatchHandle is a handle to a joined realtime multiplayer match, created with
+// Conn.CreateMatch or Conn.JoinMatch.
+//
+// A match handle tracks its live presences, routing only the match's data and
+// presence events to its handlers. The match is left when closed, or when the
+// context passed to WithLeaveOnCancel is closed. The context passed when
+// creating or joining the match bounds only the create or join request.
+type MatchHandle struct {
+	conn      *Conn
+	id        string
+	res       *MatchMsg
+	presences map[string]*UserPresenceMsg
+	pending   []*Envelope
+	joined    bool
+	remove    func()
+	done      chan struct{}
+	once      sync.Once
+
+	dataHandlers     []func(context.Context, *MatchDataMsg)
+	presenceHandlers []func(context.Context, *MatchPresenceEventMsg)
+
+	rw sync.RWMutex
+}
+
+// CreateMatch creates a realtime multiplayer match, returning a match handle.
+// See MatchHandler for the handlers that can be passed.
+func (conn *Conn) CreateMatch(ctx context.Context, name string, handlers ...MatchHandler) (*MatchHandle, error) {
+	return conn.match(ctx, MatchCreate(name), handlers)
+}
+
+// JoinMatch joins a realtime multiplayer match, returning a match handle. See
+// MatchHandler for the handlers that can be passed.
+func (conn *Conn) JoinMatch(ctx context.Context, msg *MatchJoinMsg, handlers ...MatchHandler) (*MatchHandle, error) {
+	return conn.match(ctx, msg, handlers)
+}
+
+// match sends the match create or join message, returning a match handle.
+func (conn *Conn) match(ctx context.Context, msg EnvelopeBuilder, handlers []MatchHandler) (*MatchHandle, error) {
+	m := &MatchHandle{
+		conn:      conn,
+		presences: make(map[string]*UserPresenceMsg),
+		done:      make(chan struct{}),
+	}
+	for _, handler := range handlers {
+		m.addHandler(handler)
+	}
+	// listen before joining, buffering messages until the match id is known
+	m.remove = conn.listen(&connListener{
+		notify:    m.notify,
+		reconnect: m.reconnect,
+	})
+	res := new(MatchMsg)
+	if err := conn.Send(ctx, msg, res); err != nil {
+		m.remove()
+		return nil, err
+	}
+	m.rw.Lock()
+	m.id, m.joined = res.MatchId, true
+	m.setPresences(res)
+	pending := m.pending
+	m.pending = nil
+	m.rw.Unlock()
+	for _, env := range pending {
+		m.notify(ctx, env)
+	}
+	return m, nil
+}
+
+// addHandler adds the handler's smuggled interfaces.
+func (m *MatchHandle) addHandler(handler MatchHandler) {
+	if x, ok := handler.(interface {
+		MatchDataHandler(context.Context, *MatchDataMsg)
+	}); ok {
+		m.dataHandlers = append(m.dataHandlers, x.MatchDataHandler)
+	}
+	if x, ok := handler.(interface {
+		MatchPresenceEventHandler(context.Context, *MatchPresenceEventMsg)
+	}); ok {
+		m.presenceHandlers = append(m.presenceHandlers, x.MatchPresenceEventHandler)
+	}
+}
+
+// WithLeaveOnCancel leaves the match when the context is closed.
+func (m *MatchHandle) WithLeaveOnCancel(ctx context.Context) *MatchHandle {
+	go func() {
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := m.Close(ctx); err != nil {
+				m.conn.h.Errf("unable to leave match %s: %v", m.Id(), err)
+			}
+		}
+	}()
+	return m
+}
+
+// Id returns the match id.
+func (m *MatchHandle) Id() string {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return m.id
+}
+
+// Authoritative returns true when the match is an authoritative match.
+func (m *MatchHandle) Authoritative() bool {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return m.res.Authoritative
+}
+
+// Label returns the match label.
+func (m *MatchHandle) Label() string {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return m.res.Label.GetValue()
+}
+
+// Self returns the user's presence in the match.
+func (m *MatchHandle) Self() *UserPresenceMsg {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return m.res.Self
+}
+
+// Presences returns the match's current presences, ordered by user id and
+// session id.
+func (m *MatchHandle) Presences() []*UserPresenceMsg {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return sortPresences(m.presences)
+}
+
+// Presence returns the presence for the session id, or nil when the session
+// is not in the match.
+func (m *MatchHandle) Presence(sessionId string) *UserPresenceMsg {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return m.presences[sessionId]
+}
+
+// Send sends data to all presences in the match.
+func (m *MatchHandle) Send(ctx context.Context, opCode int64, data []byte, reliable bool) error {
+	return m.conn.MatchDataSend(ctx, m.Id(), opCode, data, reliable)
+}
+
+// SendTo sends data to the presences in the match.
+func (m *MatchHandle) SendTo(ctx context.Context, opCode int64, data []byte, reliable bool, presences ...*UserPresenceMsg) error {
+	return m.conn.MatchDataSend(ctx, m.Id(), opCode, data, reliable, presences...)
+}
+
+// Done returns a channel that is closed when the match is closed.
+func (m *MatchHandle) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close leaves the match, and stops routing the match's data and presence
+// events to its handlers.
+func (m *MatchHandle) Close(ctx context.Context) error {
+	var err error
+	m.once.Do(func() {
+		m.remove()
+		close(m.done)
+		err = m.conn.MatchLeave(ctx, m.Id())
+	})
+	return err
+}
+
+// notify handles a connection notification.
+func (m *MatchHandle) notify(ctx context.Context, env *Envelope) {
+	switch v := env.Message.(type) {
+	case *Envelope_MatchData:
+		if m.buffer(env, v.MatchData.MatchId) {
+			return
+		}
+		for _, f := range m.dataHandlers {
+			go f(ctx, v.MatchData)
+		}
+	case *Envelope_MatchPresenceEvent:
+		if m.buffer(env, v.MatchPresenceEvent.MatchId) {
+			return
+		}
+		m.rw.Lock()
+		for _, p := range v.MatchPresenceEvent.Leaves {
+			delete(m.presences, p.SessionId)
+		}
+		for _, p := range v.MatchPresenceEvent.Joins {
+			m.presences[p.SessionId] = p
+		}
+		m.rw.Unlock()
+		for _, f := range m.presenceHandlers {
+			go f(ctx, v.MatchPresenceEvent)
+		}
+	}
+}
+
+// buffer buffers the envelope when the match has not been joined, returning
+// true when the envelope was buffered or is not for the match.
+func (m *MatchHandle) buffer(env *Envelope, matchId string) bool {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	if !m.joined {
+		m.pending = append(m.pending, env)
+		return true
+	}
+	return matchId != m.id
+}
+
+// setPresences sets the presences from a match response. Must be called with
+// the lock held.
+func (m *MatchHandle) setPresences(res *MatchMsg) {
+	m.res = res
+	m.presences = make(map[string]*UserPresenceMsg)
+	for _, p := range res.Presences {
+		m.presences[p.SessionId] = p
+	}
+	if res.Self != nil {
+		m.presences[res.Self.SessionId] = res.Self
+	}
+}
+
+// reconnect handles a connection reconnect result, resetting the presences
+// when the match was rejoined, or closing the match when it could not be
+// rejoined.
+func (m *MatchHandle) reconnect(ctx context.Context, res *ReconnectResult) {
+	if res.Type != ReconnectMatch || res.Id != m.Id() {
+		return
+	}
+	if msg, ok := res.Res.(*MatchMsg); ok && res.State == ReconnectRejoined {
+		m.rw.Lock()
+		m.setPresences(msg)
+		m.rw.Unlock()
+		return
+	}
+	m.once.Do(func() {
+		m.remove()
+		close(m.done)
+	})
+}
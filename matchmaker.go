@@ -0,0 +1,250 @@
+package nakama
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Matchmaker manages the lifecycle of matchmaker tickets on a connection,
+// correlating matched messages to their tickets.
+type Matchmaker struct {
+	conn          *Conn
+	partyId       string
+	countMultiple int
+}
+
+// NewMatchmaker creates a matchmaker for the connection.
+func NewMatchmaker(conn *Conn) *Matchmaker {
+	return &Matchmaker{
+		conn: conn,
+	}
+}
+
+// WithParty sets the party to matchmake as. The connection's user must be
+// the party leader.
+func (mm *Matchmaker) WithParty(partyId string) *Matchmaker {
+	mm.partyId = partyId
+	return mm
+}
+
+// WithCountMultiple sets the count multiple of matched users.
+func (mm *Matchmaker) WithCountMultiple(countMultiple int) *Matchmaker {
+	mm.countMultiple = countMultiple
+	return mm
+}
+
+// Find adds a matchmaker ticket, and blocks until the ticket is matched. The
+// ticket is removed when the context is closed before the ticket is matched.
+//
+// Properties must be strings or numbers, and are sent as the ticket's string
+// and numeric properties, respectively.
+func (mm *Matchmaker) Find(ctx context.Context, query string, minCount, maxCount int, props map[string]interface{}) (*MatchmakerMatchedMsg, error) {
+	stringProps, numericProps, err := matchmakerProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	// listen before adding, buffering matched messages until the ticket is
+	// known
+	f := &matchmakerFind{
+		matched: make(map[string]*MatchmakerMatchedMsg),
+		done:    make(chan struct{}),
+	}
+	remove := mm.conn.listen(&connListener{
+		notify:    f.notify,
+		reconnect: f.reconnect,
+	})
+	defer remove()
+	ticket, err := mm.add(ctx, query, minCount, maxCount, stringProps, numericProps)
+	if err != nil {
+		return nil, err
+	}
+	f.setTicket(ticket)
+	select {
+	case <-f.done:
+		return f.msg, f.err
+	case <-ctx.Done():
+	}
+	removeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mm.remove(removeCtx, f.Ticket()); err != nil {
+		// matched while removing
+		select {
+		case <-f.done:
+			return f.msg, f.err
+		default:
+		}
+		mm.conn.h.Errf("unable to remove matchmaker ticket %s: %v", f.Ticket(), err)
+	}
+	return nil, ctx.Err()
+}
+
+// FindMatch finds a match (see Find), and joins the matched match with the
+// match's token or id, returning a match handle. See MatchHandler for the
+// handlers that can be passed. The match is left when the context is closed.
+func (mm *Matchmaker) FindMatch(ctx context.Context, query string, minCount, maxCount int, props map[string]interface{}, handlers ...MatchHandler) (*MatchHandle, error) {
+	msg, err := mm.Find(ctx, query, minCount, maxCount, props)
+	if err != nil {
+		return nil, err
+	}
+	join := MatchJoin(msg.GetMatchId())
+	if token := msg.GetToken(); token != "" {
+		join = MatchJoinToken(token)
+	}
+	m, err := mm.conn.JoinMatch(ctx, join, handlers...)
+	if err != nil {
+		return nil, err
+	}
+	return m.WithLeaveOnCancel(ctx), nil
+}
+
+// add adds a matchmaker ticket, returning the ticket.
+func (mm *Matchmaker) add(ctx context.Context, query string, minCount, maxCount int, stringProps map[string]string, numericProps map[string]float64) (string, error) {
+	if mm.partyId != "" {
+		msg := PartyMatchmakerAdd(mm.partyId, query, minCount, maxCount).
+			WithStringProperties(stringProps).
+			WithNumericProperties(numericProps)
+		if mm.countMultiple != 0 {
+			msg = msg.WithCountMultiple(mm.countMultiple)
+		}
+		res, err := msg.Send(ctx, mm.conn)
+		if err != nil {
+			return "", err
+		}
+		return res.Ticket, nil
+	}
+	msg := MatchmakerAdd(query, minCount, maxCount).
+		WithStringProperties(stringProps).
+		WithNumericProperties(numericProps)
+	if mm.countMultiple != 0 {
+		msg = msg.WithCountMultiple(mm.countMultiple)
+	}
+	res, err := msg.Send(ctx, mm.conn)
+	if err != nil {
+		return "", err
+	}
+	return res.Ticket, nil
+}
+
+// remove removes a matchmaker ticket.
+func (mm *Matchmaker) remove(ctx context.Context, ticket string) error {
+	if mm.partyId != "" {
+		return PartyMatchmakerRemove(mm.partyId, ticket).Send(ctx, mm.conn)
+	}
+	return MatchmakerRemove(ticket).Send(ctx, mm.conn)
+}
+
+// matchmakerFind is the state of a Find call.
+type matchmakerFind struct {
+	ticket  string
+	matched map[string]*MatchmakerMatchedMsg
+	msg     *MatchmakerMatchedMsg
+	err     error
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+// Ticket returns the current ticket.
+func (f *matchmakerFind) Ticket() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ticket
+}
+
+// setTicket sets the ticket, finishing when the ticket was already matched.
+func (f *matchmakerFind) setTicket(ticket string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ticket = ticket
+	if msg, ok := f.matched[ticket]; ok {
+		f.finish(msg, nil)
+	}
+	f.matched = nil
+}
+
+// finish finishes the find with the matched message or error.
+func (f *matchmakerFind) finish(msg *MatchmakerMatchedMsg, err error) {
+	f.once.Do(func() {
+		f.msg, f.err = msg, err
+		close(f.done)
+	})
+}
+
+// notify handles a connection notification.
+func (f *matchmakerFind) notify(_ context.Context, env *Envelope) {
+	msg := env.GetMatchmakerMatched()
+	if msg == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch f.ticket {
+	case "":
+		f.matched[msg.Ticket] = msg
+	case msg.Ticket:
+		f.finish(msg, nil)
+	}
+}
+
+// reconnect handles a connection reconnect result, tracking the ticket
+// re-added after a reconnect, or failing when the ticket could not be
+// re-added.
+func (f *matchmakerFind) reconnect(_ context.Context, res *ReconnectResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if res.Type != ReconnectMatchmaker || res.Id == "" || res.Id != f.ticket {
+		return
+	}
+	if msg, ok := res.Res.(*MatchmakerTicketMsg); ok && res.State == ReconnectRejoined {
+		f.ticket = msg.Ticket
+		return
+	}
+	err := res.Err
+	if err == nil {
+		err = fmt.Errorf("matchmaker ticket %s %s", res.Id, res.State)
+	}
+	f.finish(nil, fmt.Errorf("unable to restore matchmaker ticket: %w", err))
+}
+
+// matchmakerProperties splits properties into string and numeric
+// properties.
+func matchmakerProperties(props map[string]interface{}) (map[string]string, map[string]float64, error) {
+	var stringProps map[string]string
+	var numericProps map[string]float64
+	for k, v := range props {
+		var f float64
+		switch x := v.(type) {
+		case string:
+			if stringProps == nil {
+				stringProps = make(map[string]string)
+			}
+			stringProps[k] = x
+			continue
+		case float64:
+			f = x
+		case float32:
+			f = float64(x)
+		case int:
+			f = float64(x)
+		case int32:
+			f = float64(x)
+		case int64:
+			f = float64(x)
+		case uint:
+			f = float64(x)
+		case uint32:
+			f = float64(x)
+		case uint64:
+			f = float64(x)
+		default:
+			return nil, nil, fmt.Errorf("matchmaker property %q has invalid type %T", k, v)
+		}
+		if numericProps == nil {
+			numericProps = make(map[string]float64)
+		}
+		numericProps[k] = f
+	}
+	return stringProps, numericProps, nil
+}
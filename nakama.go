@@ -2676,6 +2676,7 @@ type RpcRequest struct {
 	v       interface{}
 	httpKey string
 	proto   bool
+	codec   Codec
 	buf     []byte
 	mutex   sync.Mutex
 }
@@ -2713,6 +2714,15 @@ func (req *RpcRequest) WithProto(proto bool) *RpcRequest {
 	return req
 }
 
+// WithCodec sets the codec used to encode the payload and decode the response
+// on the request. Overrides the codec registered for the id.
+//
+// See: RegisterRpcCodec.
+func (req *RpcRequest) WithCodec(codec Codec) *RpcRequest {
+	req.codec = codec
+	return req
+}
+
 // Do executes the request against the context and client.
 func (req *RpcRequest) Do(ctx context.Context, cl *Client) error {
 	query := url.Values{}
@@ -2720,7 +2730,19 @@ func (req *RpcRequest) Do(ctx context.Context, cl *Client) error {
 	if req.httpKey != "" {
 		query.Set("http_key", req.httpKey)
 	}
-	return cl.Do(ctx, "POST", "v2/rpc/"+req.id, req.httpKey == "", query, req.payload, req.v)
+	if req.getCodec() == nil {
+		return cl.Do(ctx, "POST", "v2/rpc/"+req.id, req.httpKey == "", query, req.payload, req.v)
+	}
+	if err := req.marshal(); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := cl.Do(ctx, "POST", "v2/rpc/"+req.id, req.httpKey == "", query, bytes.NewReader(req.buf), buf); err != nil {
+		return err
+	}
+	return req.unmarshal(&RpcMsg{
+		Payload: buf.String(),
+	})
 }
 
 // Async executes the request against the context and client.
@@ -2758,6 +2780,15 @@ func (req *RpcRequest) marshal() error {
 	if req.buf != nil {
 		return nil
 	}
+	// codec encode
+	if codec := req.getCodec(); codec != nil {
+		buf, err := codec.Marshal(req.payload)
+		if err != nil {
+			return err
+		}
+		req.buf = buf
+		return nil
+	}
 	// protobuf encode
 	if req.proto {
 		msg, ok := req.payload.(proto.Message)
@@ -2781,11 +2812,27 @@ func (req *RpcRequest) marshal() error {
 	return nil
 }
 
+// getCodec returns the codec for the request, or nil when the request has no
+// codec and no codec is registered for the id.
+func (req *RpcRequest) getCodec() Codec {
+	if req.codec != nil {
+		return req.codec
+	}
+	return RpcCodec(req.id)
+}
+
 // unmarshal unmarshals the response.
 func (req *RpcRequest) unmarshal(msg *RpcMsg) error {
 	if msg.Payload == "" {
 		return nil
 	}
+	// codec decode
+	if codec := req.getCodec(); codec != nil {
+		if req.v == nil {
+			return nil
+		}
+		return codec.Unmarshal([]byte(msg.Payload), req.v)
+	}
 	// protobuf decode
 	if req.proto {
 		v, ok := req.v.(proto.Message)
@@ -3343,7 +3390,7 @@ func DeleteTournamentRecord(tournamentId string) *DeleteTournamentRecordRequest
 
 // Do executes the request against the context and client.
 func (req *DeleteTournamentRecordRequest) Do(ctx context.Context, cl *Client) error {
-	return cl.Do(ctx, "DELETE", "v2/tournanment/"+req.TournamentId, true, nil, req, nil)
+	return cl.Do(ctx, "DELETE", "v2/tournament/"+req.TournamentId, true, nil, req, nil)
 }
 
 // Async executes the request against the context and client.
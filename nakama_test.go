@@ -211,6 +211,77 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+func TestParty(t *testing.T) {
+	ctx, cancel, nk := nktest.WithCancel(context.Background(), t)
+	defer cancel()
+	cl1 := newClient(ctx, t, nk)
+	conn1 := createAccountAndConn(ctx, t, cl1, true)
+	defer conn1.Close()
+	presenceCh := make(chan *PartyPresenceEventMsg, 1)
+	conn1.PartyPresenceEventHandler = func(_ context.Context, msg *PartyPresenceEventMsg) {
+		presenceCh <- msg
+	}
+	p1, err := conn1.PartyCreate(ctx, true, 4)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case p1.PartyId == "":
+		t.Fatalf("expected non-empty p1.PartyId")
+	case p1.Leader == nil || p1.Leader.UserId != p1.Self.UserId:
+		t.Errorf("expected p1.Leader == p1.Self")
+	}
+	cl2 := newClient(ctx, t, nk)
+	conn2 := createAccountAndConn(ctx, t, cl2, true)
+	defer conn2.Close()
+	partyCh := make(chan *PartyMsg, 1)
+	conn2.PartyHandler = func(_ context.Context, msg *PartyMsg) {
+		partyCh <- msg
+	}
+	dataCh := make(chan *PartyDataMsg, 1)
+	conn2.PartyDataHandler = func(_ context.Context, msg *PartyDataMsg) {
+		dataCh <- msg
+	}
+	if err := conn2.PartyJoin(ctx, p1.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("context closed: %v", ctx.Err())
+	case <-time.After(1 * time.Minute):
+		t.Fatalf("did not receive party: timeout hit")
+	case msg := <-partyCh:
+		if msg.PartyId != p1.PartyId {
+			t.Errorf("expected msg.PartyId == %s, got: %s", p1.PartyId, msg.PartyId)
+		}
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("context closed: %v", ctx.Err())
+	case <-time.After(1 * time.Minute):
+		t.Fatalf("did not receive party presence event: timeout hit")
+	case msg := <-presenceCh:
+		if len(msg.Joins) != 1 {
+			t.Errorf("expected 1 join, got: %d", len(msg.Joins))
+		}
+	}
+	if err := conn1.PartyDataSend(ctx, p1.PartyId, 1, []byte(`hello world`), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("context closed: %v", ctx.Err())
+	case <-time.After(1 * time.Minute):
+		t.Fatalf("did not receive party data: timeout hit")
+	case msg := <-dataCh:
+		if s, exp := string(msg.Data), "hello world"; s != exp {
+			t.Errorf("expected %q, got: %q", exp, s)
+		}
+	}
+	if err := conn1.PartyClose(ctx, p1.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
 func TestRpcRealtime(t *testing.T) {
 	// TODO
 }
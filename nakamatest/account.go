@@ -0,0 +1,495 @@
+package nakamatest
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// account is a user account.
+type account struct {
+	user     *nakama.User
+	wallet   string
+	email    string
+	password string
+	customId string
+	devices  []string
+}
+
+// links returns the number of linked identifiers.
+func (a *account) links() int {
+	n := len(a.devices)
+	for _, s := range []string{
+		a.customId, a.email, a.user.AppleId, a.user.FacebookId, a.user.FacebookInstantGameId,
+		a.user.GamecenterId, a.user.GoogleId, a.user.SteamId,
+	} {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// set sets (or clears when id is empty) the provider identifier on the
+// account.
+func (a *account) set(provider, id, password string) {
+	switch provider {
+	case "apple":
+		a.user.AppleId = id
+	case "custom":
+		a.customId = id
+	case "email":
+		a.email, a.password = id, password
+	case "facebook":
+		a.user.FacebookId = id
+	case "facebookinstantgame":
+		a.user.FacebookInstantGameId = id
+	case "gamecenter":
+		a.user.GamecenterId = id
+	case "google":
+		a.user.GoogleId = id
+	case "steam":
+		a.user.SteamId = id
+	}
+}
+
+// credentials are decoded account provider credentials.
+type credentials struct {
+	provider string
+	id       string
+	password string
+	vars     map[string]string
+}
+
+// key returns the link key for the credentials.
+func (c *credentials) key() string {
+	return c.provider + ":" + c.id
+}
+
+// decodeCredentials decodes the provider credentials from the request body.
+func (req *request) decodeCredentials(provider string, create bool) (*credentials, error) {
+	c := &credentials{
+		provider: provider,
+	}
+	var msg proto.Message
+	var check func() error
+	switch provider {
+	case "apple":
+		v := new(nakama.AccountApple)
+		msg, check = v, func() error {
+			c.id, c.vars = v.Token, v.Vars
+			return required(c.id, "Apple ID token is required.")
+		}
+	case "custom":
+		v := new(nakama.AccountCustom)
+		msg, check = v, func() error {
+			c.id, c.vars = v.Id, v.Vars
+			return length(c.id, 6, 128, "Custom ID is required.", "Custom ID invalid, must be 6-128 bytes.")
+		}
+	case "device":
+		v := new(nakama.AccountDevice)
+		msg, check = v, func() error {
+			c.id, c.vars = v.Id, v.Vars
+			return length(c.id, 10, 128, "Device ID is required.", "Device ID invalid, must be 10-128 bytes.")
+		}
+	case "email":
+		v := new(nakama.AccountEmail)
+		msg, check = v, func() error {
+			c.id, c.password, c.vars = strings.ToLower(v.Email), v.Password, v.Vars
+			if err := length(c.id, 10, 255, "Email address is required.", "Invalid email address, must be 10-255 bytes."); err != nil {
+				return err
+			}
+			switch {
+			case !strings.Contains(c.id, "@"):
+				return errorf(nakama.CodeInvalidArgument, "Invalid email address format.")
+			case create && len(c.password) < 8:
+				return errorf(nakama.CodeInvalidArgument, "Password must be at least 8 characters long.")
+			}
+			return nil
+		}
+	case "facebook":
+		v := new(nakama.AccountFacebook)
+		msg, check = v, func() error {
+			c.id, c.vars = v.Token, v.Vars
+			return required(c.id, "Facebook access token is required.")
+		}
+	case "facebookinstantgame":
+		v := new(nakama.AccountFacebookInstantGame)
+		msg, check = v, func() error {
+			c.id, c.vars = v.SignedPlayerInfo, v.Vars
+			return required(c.id, "Signed player info for a Facebook Instant Game is required.")
+		}
+	case "gamecenter":
+		v := new(nakama.AccountGameCenter)
+		msg, check = v, func() error {
+			c.id, c.vars = v.PlayerId, v.Vars
+			return required(c.id, "GameCenter credentials required.")
+		}
+	case "google":
+		v := new(nakama.AccountGoogle)
+		msg, check = v, func() error {
+			c.id, c.vars = v.Token, v.Vars
+			return required(c.id, "Google access token is required.")
+		}
+	case "steam":
+		v := new(nakama.AccountSteam)
+		msg, check = v, func() error {
+			c.id, c.vars = v.Token, v.Vars
+			return required(c.id, "Steam access token is required.")
+		}
+	default:
+		return nil, errorf(nakama.CodeNotFound, "Not Found")
+	}
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	if err := check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// authenticate handles the authenticate requests.
+func (s *Server) authenticate(req *request) (interface{}, error) {
+	create, err := req.queryBool("create")
+	if err != nil {
+		return nil, err
+	}
+	if create == nil {
+		b := true
+		create = &b
+	}
+	c, err := req.decodeCredentials(req.param("provider"), *create)
+	if err != nil {
+		return nil, err
+	}
+	username := req.query("username")
+	if username != "" {
+		if err := checkUsername(username); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// existing
+	if userId, ok := s.links[c.key()]; ok {
+		a := s.accounts[userId]
+		if c.provider == "email" && a.password != c.password {
+			return nil, errorf(nakama.CodeUnauthenticated, "Invalid credentials.")
+		}
+		return s.issue(a, c.vars, false)
+	}
+	if !*create {
+		return nil, errorf(nakama.CodeNotFound, "User account not found.")
+	}
+	// create
+	switch {
+	case username == "":
+		for username = randomUsername(); s.usernames[strings.ToLower(username)] != ""; username = randomUsername() {
+		}
+	case s.usernames[strings.ToLower(username)] != "":
+		return nil, errorf(nakama.CodeAlreadyExists, "Username is already in use.")
+	}
+	now := timestamppb.New(time.Now())
+	a := &account{
+		user: &nakama.User{
+			Id:         uuid.New().String(),
+			Username:   username,
+			Metadata:   "{}",
+			CreateTime: now,
+			UpdateTime: now,
+		},
+		wallet: "{}",
+	}
+	s.accounts[a.user.Id] = a
+	s.usernames[strings.ToLower(username)] = a.user.Id
+	s.linkAccount(a, c)
+	return s.issue(a, c.vars, true)
+}
+
+// linkAccount links the credentials to the account. Must be called with the
+// lock held.
+func (s *Server) linkAccount(a *account, c *credentials) {
+	if c.provider == "device" {
+		a.devices = append(a.devices, c.id)
+	} else {
+		if prev := a.get(c.provider); prev != "" {
+			delete(s.links, c.provider+":"+prev)
+		}
+		a.set(c.provider, c.id, c.password)
+	}
+	s.links[c.key()] = a.user.Id
+}
+
+// get returns the linked identifier for the provider on the account.
+func (a *account) get(provider string) string {
+	switch provider {
+	case "apple":
+		return a.user.AppleId
+	case "custom":
+		return a.customId
+	case "email":
+		return a.email
+	case "facebook":
+		return a.user.FacebookId
+	case "facebookinstantgame":
+		return a.user.FacebookInstantGameId
+	case "gamecenter":
+		return a.user.GamecenterId
+	case "google":
+		return a.user.GoogleId
+	case "steam":
+		return a.user.SteamId
+	}
+	return ""
+}
+
+// link handles the link requests.
+func (s *Server) link(req *request) (interface{}, error) {
+	c, err := req.decodeCredentials(req.param("provider"), true)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[req.userId]
+	switch userId, ok := s.links[c.key()]; {
+	case ok && userId == a.user.Id:
+		if c.provider == "email" {
+			a.password = c.password
+		}
+		return nil, nil
+	case ok:
+		return nil, errorf(nakama.CodeAlreadyExists, "Identifier already in use by another account.")
+	}
+	s.linkAccount(a, c)
+	a.user.UpdateTime = timestamppb.New(time.Now())
+	return nil, nil
+}
+
+// unlink handles the unlink requests.
+func (s *Server) unlink(req *request) (interface{}, error) {
+	c, err := req.decodeCredentials(req.param("provider"), false)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[req.userId]
+	if userId := s.links[c.key()]; userId != a.user.Id || a.links() < 2 {
+		return nil, errorf(nakama.CodePermissionDenied, "Cannot unlink last account identifier. Check profile exists and is not last link.")
+	}
+	delete(s.links, c.key())
+	if c.provider == "device" {
+		for i, id := range a.devices {
+			if id == c.id {
+				a.devices = append(a.devices[:i], a.devices[i+1:]...)
+				break
+			}
+		}
+	} else {
+		a.set(c.provider, "", "")
+	}
+	a.user.UpdateTime = timestamppb.New(time.Now())
+	return nil, nil
+}
+
+// getAccount handles a get account request.
+func (s *Server) getAccount(req *request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[req.userId]
+	res := &nakama.AccountResponse{
+		User:     s.userMsg(a),
+		Wallet:   a.wallet,
+		Email:    a.email,
+		CustomId: a.customId,
+	}
+	for _, id := range a.devices {
+		res.Devices = append(res.Devices, &nakama.AccountDevice{
+			Id: id,
+		})
+	}
+	return res, nil
+}
+
+// updateAccount handles an update account request.
+func (s *Server) updateAccount(req *request) (interface{}, error) {
+	msg := new(nakama.UpdateAccountRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	if msg.Username != nil {
+		if err := checkUsername(msg.Username.Value); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[req.userId]
+	if msg.Username != nil && !strings.EqualFold(msg.Username.Value, a.user.Username) {
+		username := strings.ToLower(msg.Username.Value)
+		if s.usernames[username] != "" {
+			return nil, errorf(nakama.CodeAlreadyExists, "Username is already in use.")
+		}
+		delete(s.usernames, strings.ToLower(a.user.Username))
+		s.usernames[username] = a.user.Id
+	}
+	if msg.Username != nil {
+		a.user.Username = msg.Username.Value
+	}
+	if msg.DisplayName != nil {
+		a.user.DisplayName = msg.DisplayName.Value
+	}
+	if msg.AvatarUrl != nil {
+		a.user.AvatarUrl = msg.AvatarUrl.Value
+	}
+	if msg.LangTag != nil {
+		a.user.LangTag = msg.LangTag.Value
+	}
+	if msg.Location != nil {
+		a.user.Location = msg.Location.Value
+	}
+	if msg.Timezone != nil {
+		a.user.Timezone = msg.Timezone.Value
+	}
+	a.user.UpdateTime = timestamppb.New(time.Now())
+	return nil, nil
+}
+
+// getUsers handles a get users request.
+func (s *Server) getUsers(req *request) (interface{}, error) {
+	ids, usernames, facebookIds := req.queryList("ids"), req.queryList("usernames"), req.queryList("facebookIds")
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, errorf(nakama.CodeInvalidArgument, "ID '%s' is not a valid system ID.", id)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, seen := new(nakama.UsersResponse), make(map[string]bool)
+	add := func(a *account) {
+		if a != nil && !seen[a.user.Id] {
+			seen[a.user.Id] = true
+			res.Users = append(res.Users, s.userMsg(a))
+		}
+	}
+	for _, id := range ids {
+		add(s.accounts[id])
+	}
+	for _, username := range usernames {
+		add(s.accounts[s.usernames[strings.ToLower(username)]])
+	}
+	for _, id := range facebookIds {
+		add(s.accounts[s.links["facebook:"+id]])
+	}
+	return res, nil
+}
+
+// sessionRefresh handles a session refresh request.
+func (s *Server) sessionRefresh(req *request) (interface{}, error) {
+	msg := new(nakama.SessionRefreshRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	if msg.Token == "" {
+		return nil, errorf(nakama.CodeInvalidArgument, "Refresh token is required.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.verifyLocked(msg.Token, true)
+	if err != nil {
+		return nil, err
+	}
+	vars := c.Vars
+	if msg.Vars != nil {
+		vars = msg.Vars
+	}
+	token, err := s.sign(s.accounts[c.UserId], vars, false)
+	if err != nil {
+		return nil, err
+	}
+	return &nakama.SessionResponse{
+		Token:        token,
+		RefreshToken: msg.Token,
+	}, nil
+}
+
+// sessionLogout handles a session logout request.
+func (s *Server) sessionLogout(req *request) (interface{}, error) {
+	msg := new(nakama.SessionLogoutRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Token == "" && msg.RefreshToken == "" {
+		for _, m := range []map[string]string{s.sessionTokens, s.refreshTokens} {
+			for tokenId, userId := range m {
+				if userId == req.userId {
+					delete(m, tokenId)
+				}
+			}
+		}
+		return nil, nil
+	}
+	s.revoke(msg.Token, false)
+	s.revoke(msg.RefreshToken, true)
+	return nil, nil
+}
+
+// userMsg returns the user message for the account. Must be called with the
+// lock held.
+func (s *Server) userMsg(a *account) *nakama.User {
+	u := proto.Clone(a.user).(*nakama.User)
+	u.Online = s.online(a.user.Id)
+	for _, e := range s.edges[a.user.Id] {
+		if e.state == int32(nakama.FriendState_FRIEND) {
+			u.EdgeCount++
+		}
+	}
+	return u
+}
+
+// user returns the user message for the user id, or nil if the user does not
+// exist. Must be called with the lock held.
+func (s *Server) user(userId string) *nakama.User {
+	if a, ok := s.accounts[userId]; ok {
+		return s.userMsg(a)
+	}
+	return nil
+}
+
+// checkUsername checks that the username is valid.
+func checkUsername(username string) error {
+	if username == "" || 128 < len(username) || strings.IndexFunc(username, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) != -1 {
+		return errorf(nakama.CodeInvalidArgument, "Username invalid, no spaces or control characters allowed.")
+	}
+	return nil
+}
+
+// required checks that s is not empty.
+func required(s, msg string) error {
+	if s == "" {
+		return errorf(nakama.CodeInvalidArgument, msg)
+	}
+	return nil
+}
+
+// length checks that s is not empty and has a length between min and max.
+func length(s string, min, max int, requiredMsg, lengthMsg string) error {
+	switch {
+	case s == "":
+		return errorf(nakama.CodeInvalidArgument, requiredMsg)
+	case len(s) < min || max < len(s):
+		return errorf(nakama.CodeInvalidArgument, lengthMsg)
+	}
+	return nil
+}
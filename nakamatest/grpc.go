@@ -0,0 +1,200 @@
+package nakamatest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/ascii8/nakama-go/internal/grpcapi"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// grpcRoute maps a gRPC method to its v2 api route.
+type grpcRoute struct {
+	grpcapi.Route
+	typ protoreflect.MessageType
+}
+
+// grpcRoutes are the gRPC methods served, keyed by name.
+var grpcRoutes = func() map[string]grpcRoute {
+	routes := make(map[string]grpcRoute, len(grpcapi.Routes))
+	for _, rt := range grpcapi.Routes {
+		typ, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(grpcapi.Package + "." + rt.Message))
+		if err != nil {
+			panic(fmt.Sprintf("invalid grpc route %s: %v", rt.Name, err))
+		}
+		routes[rt.Name] = grpcRoute{rt, typ}
+	}
+	return routes
+}()
+
+// serveGrpc serves a gRPC request, translating the call to its v2 api route.
+func (s *Server) serveGrpc(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/"+grpcapi.Service+"/")
+	rt, ok := grpcRoutes[name]
+	if !ok {
+		s.writeGrpcErr(w, errorf(nakama.CodeUnimplemented, "unknown method %s", name))
+		return
+	}
+	buf, err := grpcapi.ReadMessage(r.Body)
+	if err != nil {
+		s.writeGrpcErr(w, errorf(nakama.CodeInvalidArgument, "%v", err))
+		return
+	}
+	msg := rt.typ.New()
+	if err := proto.Unmarshal(buf, msg.Interface()); err != nil {
+		s.writeGrpcErr(w, errorf(nakama.CodeInvalidArgument, "unable to decode request: %v", err))
+		return
+	}
+	var res interface{}
+	if name != "Healthcheck" {
+		req, path, body, err := s.grpcRequest(r, rt, msg)
+		if err != nil {
+			s.writeGrpcErr(w, err)
+			return
+		}
+		if res, err = s.handleApi(req, path, body); err != nil {
+			s.writeGrpcErr(w, err)
+			return
+		}
+	}
+	switch x := res.(type) {
+	case nil:
+		buf = nil
+	case rawResponse:
+		buf, err = proto.Marshal(&nakama.RpcMsg{
+			Id:      msg.Get(msg.Descriptor().Fields().ByName("id")).String(),
+			Payload: string(x),
+		})
+	case proto.Message:
+		buf, err = proto.Marshal(x)
+	}
+	if err != nil {
+		s.writeGrpcErr(w, errorf(nakama.CodeInternal, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	_ = grpcapi.WriteMessage(w, buf)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+// grpcRequest builds the v2 api request for the gRPC request message, as the
+// grpc-gateway would.
+func (s *Server) grpcRequest(r *http.Request, rt grpcRoute, msg protoreflect.Message) (*http.Request, []string, []byte, error) {
+	fields := msg.Descriptor().Fields()
+	used := make(map[protoreflect.Name]bool)
+	// path parameters
+	path := strings.Split(strings.TrimPrefix(rt.Pattern, "v2/"), "/")
+	for i, p := range path {
+		if !strings.HasPrefix(p, "{") {
+			continue
+		}
+		fd := fields.ByName(protoreflect.Name(strings.Trim(p, "{}")))
+		path[i], used[fd.Name()] = msg.Get(fd).String(), true
+	}
+	// body
+	query := url.Values{}
+	var body []byte
+	var err error
+	switch rt.Body {
+	case "":
+	case "*":
+		body, err = s.marshaler.Marshal(msg.Interface())
+	case "payload":
+		body = []byte(msg.Get(fields.ByName("payload")).String())
+		query.Set("unwrap", "true")
+		if key := msg.Get(fields.ByName("http_key")).String(); key != "" {
+			query.Set("http_key", key)
+		}
+		used["payload"], used["http_key"] = true, true
+	default:
+		fd := fields.ByName(protoreflect.Name(rt.Body))
+		used[fd.Name()] = true
+		if msg.Has(fd) {
+			body, err = s.marshaler.Marshal(msg.Get(fd).Message().Interface())
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, errorf(nakama.CodeInternal, err.Error())
+	}
+	// query
+	if rt.Body != "*" {
+		msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			if used[fd.Name()] {
+				return true
+			}
+			switch {
+			case fd.IsList():
+				for i := 0; i < v.List().Len(); i++ {
+					query.Add(fd.JSONName(), grpcQueryValue(fd, v.List().Get(i)))
+				}
+			case fd.Message() != nil:
+				inner := v.Message()
+				if vfd := inner.Descriptor().Fields().ByName("value"); vfd != nil {
+					query.Set(fd.JSONName(), grpcQueryValue(vfd, inner.Get(vfd)))
+				}
+			default:
+				query.Set(fd.JSONName(), grpcQueryValue(fd, v))
+			}
+			return true
+		})
+	}
+	urlstr := s.url + "/v2/" + strings.Join(path, "/")
+	if len(query) != 0 {
+		urlstr += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(r.Context(), rt.Method, urlstr, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, nil, errorf(nakama.CodeInternal, err.Error())
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req, path, body, nil
+}
+
+// grpcQueryValue formats the field value as a url query value.
+func grpcQueryValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	case protoreflect.EnumKind:
+		return fmt.Sprint(int32(v.Enum()))
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// writeGrpcErr writes a trailers-only gRPC error response.
+func (s *Server) writeGrpcErr(w http.ResponseWriter, err error) {
+	code, msg := nakama.CodeInternal, err.Error()
+	var e *nakama.ClientError
+	if errors.As(err, &e) {
+		code, msg = e.Code, e.Message
+	}
+	s.Logf("grpc error: %v: %s", code, msg)
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", fmt.Sprint(int(code)))
+	w.Header().Set("Grpc-Message", grpcEncode(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEncode percent-encodes a grpc-message.
+func grpcEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || 0x7e < c || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
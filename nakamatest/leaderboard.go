@@ -0,0 +1,442 @@
+package nakamatest
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Leaderboard sort orders.
+const (
+	SortOrderAscending  uint32 = 0
+	SortOrderDescending uint32 = 1
+)
+
+// board is a leaderboard or tournament.
+type board struct {
+	id            string
+	sortOrder     uint32
+	operator      nakama.OpType
+	authoritative bool
+	lb            *nakama.Leaderboard
+	t             *nakama.Tournament
+	joinRequired  bool
+	joined        map[string]bool
+	records       map[string]*nakama.LeaderboardRecord
+}
+
+// sorted returns the board's records in rank order, with their rank set.
+func (b *board) sorted() []*nakama.LeaderboardRecord {
+	var v []*nakama.LeaderboardRecord
+	for _, r := range b.records {
+		v = append(v, r)
+	}
+	desc := b.sortOrder == SortOrderDescending
+	sort.Slice(v, func(i, j int) bool {
+		switch {
+		case v[i].Score != v[j].Score:
+			return (v[i].Score > v[j].Score) == desc
+		case v[i].Subscore != v[j].Subscore:
+			return (v[i].Subscore > v[j].Subscore) == desc
+		}
+		return v[i].UpdateTime.AsTime().Before(v[j].UpdateTime.AsTime())
+	})
+	for i, r := range v {
+		r.Rank = int64(i + 1)
+	}
+	return v
+}
+
+// active returns true when the tournament is active.
+func (b *board) active(now time.Time) bool {
+	if b.t == nil {
+		return true
+	}
+	return !now.Before(b.t.StartTime.AsTime()) && (b.t.EndTime == nil || now.Before(b.t.EndTime.AsTime()))
+}
+
+// size returns the number of tournament participants.
+func (b *board) size() uint32 {
+	if b.joinRequired {
+		return uint32(len(b.joined))
+	}
+	return uint32(len(b.records))
+}
+
+// tournament returns the tournament message.
+func (b *board) tournament(now time.Time) *nakama.Tournament {
+	t := proto.Clone(b.t).(*nakama.Tournament)
+	t.Size = b.size()
+	t.CanEnter = b.active(now) && (t.MaxSize == 0 || t.Size < t.MaxSize)
+	return t
+}
+
+// CreateLeaderboard creates a leaderboard, as a server runtime would. When the
+// leaderboard's operator is not set, best is used.
+func (s *Server) CreateLeaderboard(lb *nakama.Leaderboard) error {
+	if lb.Id == "" {
+		return errorf(nakama.CodeInvalidArgument, "Leaderboard ID must be set.")
+	}
+	lb = proto.Clone(lb).(*nakama.Leaderboard)
+	if lb.Operator == nakama.OpType_NO_OVERRIDE {
+		lb.Operator = nakama.OpType_BEST
+	}
+	if lb.Metadata == "" {
+		lb.Metadata = "{}"
+	}
+	lb.CreateTime = timestamppb.New(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.boards[lb.Id]; ok {
+		return errorf(nakama.CodeAlreadyExists, "Leaderboard ID already in use.")
+	}
+	s.boards[lb.Id] = &board{
+		id:            lb.Id,
+		sortOrder:     lb.SortOrder,
+		operator:      lb.Operator,
+		authoritative: lb.Authoritative,
+		lb:            lb,
+		records:       make(map[string]*nakama.LeaderboardRecord),
+	}
+	return nil
+}
+
+// CreateTournament creates a tournament, as a server runtime would. When the
+// tournament's start time is not set, the tournament starts immediately. When
+// joinRequired is true, users must join the tournament before writing records.
+func (s *Server) CreateTournament(t *nakama.Tournament, joinRequired bool) error {
+	if t.Id == "" {
+		return errorf(nakama.CodeInvalidArgument, "Tournament ID must be set.")
+	}
+	now := time.Now()
+	t = proto.Clone(t).(*nakama.Tournament)
+	if t.Operator == nakama.OpType_NO_OVERRIDE {
+		t.Operator = nakama.OpType_BEST
+	}
+	if t.Metadata == "" {
+		t.Metadata = "{}"
+	}
+	if t.StartTime == nil {
+		t.StartTime = timestamppb.New(now)
+	}
+	t.CreateTime = timestamppb.New(now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.boards[t.Id]; ok {
+		return errorf(nakama.CodeAlreadyExists, "Tournament ID already in use.")
+	}
+	s.boards[t.Id] = &board{
+		id:            t.Id,
+		sortOrder:     t.SortOrder,
+		operator:      t.Operator,
+		authoritative: t.Authoritative,
+		t:             t,
+		joinRequired:  joinRequired,
+		joined:        make(map[string]bool),
+		records:       make(map[string]*nakama.LeaderboardRecord),
+	}
+	return nil
+}
+
+// getBoard returns the leaderboard or tournament for the request. Must be
+// called with the lock held.
+func (s *Server) getBoard(req *request) (*board, error) {
+	id, msg := req.param("leaderboardId"), "Leaderboard not found."
+	if id == "" {
+		id, msg = req.param("tournamentId"), "Tournament not found."
+	}
+	b, ok := s.boards[id]
+	if !ok || (b.t == nil && msg == "Tournament not found.") {
+		return nil, errorf(nakama.CodeNotFound, msg)
+	}
+	return b, nil
+}
+
+// listLeaderboardRecords handles the list leaderboard and tournament records
+// requests.
+func (s *Server) listLeaderboardRecords(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 10000)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	ownerIds := req.queryList("ownerIds")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.getBoard(req)
+	if err != nil {
+		return nil, err
+	}
+	records := b.sorted()
+	start, end, cursor := page(len(records), offset, limit)
+	res := &nakama.LeaderboardRecordsResponse{
+		NextCursor: cursor,
+		PrevCursor: prevCursor(start, limit),
+	}
+	for _, r := range records[start:end] {
+		res.Records = append(res.Records, proto.Clone(r).(*nakama.LeaderboardRecord))
+	}
+	for _, id := range ownerIds {
+		if r, ok := b.records[id]; ok {
+			res.OwnerRecords = append(res.OwnerRecords, proto.Clone(r).(*nakama.LeaderboardRecord))
+		}
+	}
+	return recordsResponse(b, res), nil
+}
+
+// listLeaderboardRecordsAroundOwner handles the list leaderboard and
+// tournament records around owner requests.
+func (s *Server) listLeaderboardRecordsAroundOwner(req *request) (interface{}, error) {
+	limit, err := req.limit(10, 100)
+	if err != nil {
+		return nil, err
+	}
+	ownerId := req.param("ownerId")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.getBoard(req)
+	if err != nil {
+		return nil, err
+	}
+	res := new(nakama.LeaderboardRecordsResponse)
+	if _, ok := b.records[ownerId]; !ok {
+		return recordsResponse(b, res), nil
+	}
+	records := b.sorted()
+	i := 0
+	for ; records[i].OwnerId != ownerId; i++ {
+	}
+	start := i - limit/2
+	if len(records)-limit < start {
+		start = len(records) - limit
+	}
+	if start < 0 {
+		start = 0
+	}
+	start, end, cursor := page(len(records), start, limit)
+	res.NextCursor, res.PrevCursor = cursor, prevCursor(start, limit)
+	for _, r := range records[start:end] {
+		res.Records = append(res.Records, proto.Clone(r).(*nakama.LeaderboardRecord))
+	}
+	return recordsResponse(b, res), nil
+}
+
+// writeLeaderboardRecord handles a write leaderboard record request.
+func (s *Server) writeLeaderboardRecord(req *request) (interface{}, error) {
+	msg := new(nakama.LeaderboardRecordWrite)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.getBoard(req)
+	switch {
+	case err != nil:
+		return nil, err
+	case b.authoritative:
+		return nil, errorf(nakama.CodePermissionDenied, "Write to authoritative leaderboard not allowed.")
+	}
+	return s.writeRecord(b, req, msg.Score, msg.Subscore, msg.Metadata, msg.Operator)
+}
+
+// writeTournamentRecord handles a write tournament record request.
+func (s *Server) writeTournamentRecord(req *request) (interface{}, error) {
+	msg := new(nakama.TournamentRecordWrite)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.getBoard(req)
+	if err != nil {
+		return nil, err
+	}
+	_, exists := b.records[req.userId]
+	switch {
+	case b.authoritative:
+		return nil, errorf(nakama.CodePermissionDenied, "Write to authoritative tournament not allowed.")
+	case !b.active(time.Now()):
+		return nil, errorf(nakama.CodeInvalidArgument, "Tournament is not active and cannot accept new scores.")
+	case b.joinRequired && !b.joined[req.userId]:
+		return nil, errorf(nakama.CodeInvalidArgument, "Must join tournament before attempting to write value.")
+	case !exists && !b.joinRequired && b.t.MaxSize != 0 && b.t.MaxSize <= b.size():
+		return nil, errorf(nakama.CodeInvalidArgument, "Tournament is full.")
+	case exists && b.t.MaxNumScore != 0 && b.t.MaxNumScore <= uint32(b.records[req.userId].NumScore):
+		return nil, errorf(nakama.CodeInvalidArgument, "Maximum number of score attempts reached.")
+	}
+	return s.writeRecord(b, req, msg.Score, msg.Subscore, msg.Metadata, msg.Operator)
+}
+
+// writeRecord writes a leaderboard or tournament record. Must be called with
+// the lock held.
+func (s *Server) writeRecord(b *board, req *request, score, subscore int64, metadata string, op nakama.OpType) (*nakama.LeaderboardRecord, error) {
+	if metadata == "" {
+		metadata = "{}"
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata), &v); err != nil || v == nil {
+		return nil, errorf(nakama.CodeInvalidArgument, "Metadata value must be JSON, if provided.")
+	}
+	if op == nakama.OpType_NO_OVERRIDE {
+		op = b.operator
+	}
+	now := timestamppb.New(time.Now())
+	r, ok := b.records[req.userId]
+	if !ok {
+		r = &nakama.LeaderboardRecord{
+			LeaderboardId: b.id,
+			OwnerId:       req.userId,
+			Score:         score,
+			Subscore:      subscore,
+			CreateTime:    now,
+		}
+		if b.t != nil {
+			r.MaxNumScore = b.t.MaxNumScore
+		}
+		b.records[req.userId] = r
+	} else {
+		switch op {
+		case nakama.OpType_BEST:
+			better := score > r.Score || (score == r.Score && subscore > r.Subscore)
+			if b.sortOrder == SortOrderAscending {
+				better = score < r.Score || (score == r.Score && subscore < r.Subscore)
+			}
+			if better {
+				r.Score, r.Subscore = score, subscore
+			}
+		case nakama.OpType_SET:
+			r.Score, r.Subscore = score, subscore
+		case nakama.OpType_INCREMENT:
+			r.Score, r.Subscore = r.Score+score, r.Subscore+subscore
+		case nakama.OpType_DECREMENT:
+			r.Score, r.Subscore = r.Score-score, r.Subscore-subscore
+		}
+	}
+	r.Username = wrapperspb.String(req.username)
+	r.Metadata = metadata
+	r.NumScore++
+	r.UpdateTime = now
+	b.sorted()
+	return proto.Clone(r).(*nakama.LeaderboardRecord), nil
+}
+
+// deleteLeaderboardRecord handles the delete leaderboard and tournament
+// record requests.
+func (s *Server) deleteLeaderboardRecord(req *request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.getBoard(req)
+	switch {
+	case err != nil:
+		return nil, err
+	case b.authoritative:
+		return nil, errorf(nakama.CodePermissionDenied, "Delete from authoritative leaderboard not allowed.")
+	}
+	delete(b.records, req.userId)
+	return nil, nil
+}
+
+// listTournaments handles a list tournaments request.
+func (s *Server) listTournaments(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 100)
+	if err != nil {
+		return nil, err
+	}
+	categoryStart, err := req.queryInt("categoryStart", 0)
+	if err != nil {
+		return nil, err
+	}
+	categoryEnd, err := req.queryInt("categoryEnd", 127)
+	if err != nil {
+		return nil, err
+	}
+	startTime, err := req.queryInt("startTime", 0)
+	if err != nil {
+		return nil, err
+	}
+	endTime, err := req.queryInt("endTime", 0)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var boards []*board
+	for _, b := range s.boards {
+		switch {
+		case b.t == nil,
+			int64(b.t.Category) < categoryStart || categoryEnd < int64(b.t.Category),
+			startTime != 0 && b.t.StartTime.AsTime().Unix() < startTime,
+			endTime != 0 && (b.t.EndTime == nil || endTime < b.t.EndTime.AsTime().Unix()):
+			continue
+		}
+		boards = append(boards, b)
+	}
+	sort.Slice(boards, func(i, j int) bool {
+		return boards[i].id < boards[j].id
+	})
+	start, end, cursor := page(len(boards), offset, limit)
+	res := &nakama.TournamentsResponse{
+		Cursor: cursor,
+	}
+	now := time.Now()
+	for _, b := range boards[start:end] {
+		res.Tournaments = append(res.Tournaments, b.tournament(now))
+	}
+	return res, nil
+}
+
+// joinTournament handles a join tournament request.
+func (s *Server) joinTournament(req *request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.getBoard(req)
+	switch {
+	case err != nil:
+		return nil, err
+	case !b.joinRequired || b.joined[req.userId]:
+		return nil, nil
+	case !b.active(time.Now()):
+		return nil, errorf(nakama.CodeInvalidArgument, "Tournament is not active and cannot accept new joins.")
+	case b.t.MaxSize != 0 && b.t.MaxSize <= b.size():
+		return nil, errorf(nakama.CodeInvalidArgument, "Tournament is full.")
+	}
+	b.joined[req.userId] = true
+	return nil, nil
+}
+
+// recordsResponse converts the response to a tournament records response,
+// when the board is a tournament.
+func recordsResponse(b *board, res *nakama.LeaderboardRecordsResponse) interface{} {
+	if b.t == nil {
+		return res
+	}
+	return &nakama.TournamentRecordsResponse{
+		Records:      res.Records,
+		OwnerRecords: res.OwnerRecords,
+		NextCursor:   res.NextCursor,
+		PrevCursor:   res.PrevCursor,
+	}
+}
+
+// prevCursor returns the previous cursor for a page starting at start.
+func prevCursor(start, limit int) string {
+	if start == 0 {
+		return ""
+	}
+	if start -= limit; start < 0 {
+		start = 0
+	}
+	return encodeCursor(start)
+}
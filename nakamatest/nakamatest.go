@@ -0,0 +1,978 @@
+// Package nakamatest provides an in-process fake Nakama server for hermetic
+// tests of code built on the nakama client package.
+//
+// The fake serves the v2 HTTP routes used by the request builders in the
+// nakama package, and the realtime websocket endpoint (speaking both the
+// protobuf and JSON envelope formats), backed by in-memory accounts, storage,
+// friends, groups, leaderboards, tournaments, notifications, matches, parties
+// and chat. No network listener is opened: connections are made over
+// in-memory pipes via the transport returned by Transport.
+//
+// Requests made over gRPC (see nakama.WithGrpc and GrpcClientOptions) are
+// served as cleartext HTTP/2, and are translated to their equivalent v2 HTTP
+// route, as the grpc-gateway would.
+//
+// Social and provider tokens (Apple, Facebook, Google, Steam, etc) are not
+// verified, instead the token is used as the provider's user id.
+package nakamatest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultURL is the default url for the fake server.
+var DefaultURL = "http://nakamatest"
+
+// RpcFunc is a remote procedure call handler. The userId is empty when the
+// call was made using the http key.
+type RpcFunc func(ctx context.Context, userId, payload string) (string, error)
+
+// Server is an in-process fake Nakama server.
+type Server struct {
+	url           string
+	serverKey     string
+	httpKey       string
+	encryptionKey []byte
+	refreshKey    []byte
+	tokenExpiry   time.Duration
+	refreshExpiry time.Duration
+	logf          func(string, ...interface{})
+
+	ln     *pipeListener
+	srv    *http.Server
+	routes []route
+
+	marshaler   *protojson.MarshalOptions
+	unmarshaler *protojson.UnmarshalOptions
+
+	accounts      map[string]*account
+	usernames     map[string]string
+	links         map[string]string
+	sessionTokens map[string]string
+	refreshTokens map[string]string
+	storage       map[storageKey]*nakama.StorageObject
+	edges         map[string]map[string]*edge
+	groups        map[string]*group
+	boards        map[string]*board
+	notifications map[string][]*notification
+	events        []*nakama.EventRequest
+	rpcs          map[string]RpcFunc
+	sessions      map[string]*session
+	channels      map[string]*channel
+	matches       map[string]*match
+	matchTokens   map[string]string
+	parties       map[string]*party
+	tickets       []*ticket
+	seq           int64
+	faults        []fault
+
+	mu sync.Mutex
+}
+
+// New creates and starts a new fake Nakama server.
+func New(opts ...Option) *Server {
+	s := &Server{
+		url:           DefaultURL,
+		serverKey:     "defaultkey",
+		httpKey:       "defaulthttpkey",
+		encryptionKey: []byte("defaultencryptionkey"),
+		refreshKey:    []byte("defaultrefreshencryptionkey"),
+		tokenExpiry:   60 * time.Second,
+		refreshExpiry: 3600 * time.Second,
+		ln:            newPipeListener(),
+		marshaler: &protojson.MarshalOptions{
+			UseProtoNames:  true,
+			UseEnumNumbers: true,
+		},
+		unmarshaler: &protojson.UnmarshalOptions{
+			DiscardUnknown: true,
+		},
+		accounts:      make(map[string]*account),
+		usernames:     make(map[string]string),
+		links:         make(map[string]string),
+		sessionTokens: make(map[string]string),
+		refreshTokens: make(map[string]string),
+		storage:       make(map[storageKey]*nakama.StorageObject),
+		edges:         make(map[string]map[string]*edge),
+		groups:        make(map[string]*group),
+		boards:        make(map[string]*board),
+		notifications: make(map[string][]*notification),
+		rpcs:          make(map[string]RpcFunc),
+		sessions:      make(map[string]*session),
+		channels:      make(map[string]*channel),
+		matches:       make(map[string]*match),
+		matchTokens:   make(map[string]string),
+		parties:       make(map[string]*party),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	s.url = strings.TrimSuffix(s.url, "/")
+	s.routes = s.buildRoutes()
+	s.srv = &http.Server{
+		Handler: h2c.NewHandler(s, new(http2.Server)),
+	}
+	go func() {
+		_ = s.srv.Serve(s.ln)
+	}()
+	return s
+}
+
+// Close closes the server and all its connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		sess.cancel()
+	}
+	s.mu.Unlock()
+	return s.srv.Close()
+}
+
+// URL returns the url for the server.
+func (s *Server) URL() string {
+	return s.url
+}
+
+// ServerKey returns the server key.
+func (s *Server) ServerKey() string {
+	return s.serverKey
+}
+
+// HttpKey returns the http key.
+func (s *Server) HttpKey() string {
+	return s.httpKey
+}
+
+// Transport returns a http transport that connects to the server over an
+// in-memory pipe.
+func (s *Server) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:        s.ln.DialContext,
+		DisableCompression: true,
+	}
+}
+
+// ClientOptions returns the nakama client options to use the server.
+func (s *Server) ClientOptions() []nakama.Option {
+	return []nakama.Option{
+		nakama.WithURL(s.url),
+		nakama.WithServerKey(s.serverKey),
+		nakama.WithTransport(s.Transport()),
+	}
+}
+
+// GrpcTransport returns a cleartext HTTP/2 transport that connects to the
+// server over an in-memory pipe, for use with nakama.WithGrpc.
+func (s *Server) GrpcTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return s.ln.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// GrpcClientOptions returns the nakama client options to use the server,
+// executing requests over gRPC.
+func (s *Server) GrpcClientOptions() []nakama.Option {
+	return append(s.ClientOptions(), nakama.WithGrpc(s.url, s.GrpcTransport()))
+}
+
+// Client creates a new nakama client for the server.
+func (s *Server) Client(opts ...nakama.Option) *nakama.Client {
+	return nakama.New(append(s.ClientOptions(), opts...)...)
+}
+
+// RegisterRpc registers a remote procedure call handler.
+func (s *Server) RegisterRpc(id string, f RpcFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rpcs[id] = f
+}
+
+// Events returns the events received by the server.
+func (s *Server) Events() []*nakama.EventRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*nakama.EventRequest(nil), s.events...)
+}
+
+// FailRequests makes the next n http requests fail with the status code and
+// a plain text body, as a load balancer or proxy in front of the server
+// would. Realtime and gRPC requests are not failed.
+func (s *Server) FailRequests(n, statusCode int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults = append(s.faults, fault{
+			statusCode: statusCode,
+			body:       body,
+		})
+	}
+}
+
+// fault is a failure injected by FailRequests.
+type fault struct {
+	statusCode int
+	body       string
+}
+
+// fail writes the next injected failure, returning true when written.
+func (s *Server) fail(w http.ResponseWriter) bool {
+	s.mu.Lock()
+	if len(s.faults) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	f := s.faults[0]
+	s.faults = s.faults[1:]
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(f.statusCode)
+	_, _ = io.WriteString(w, f.body)
+	return true
+}
+
+// Logf logs a message to the server's logger.
+func (s *Server) Logf(str string, v ...interface{}) {
+	if s.logf != nil {
+		s.logf(str, v...)
+	}
+}
+
+// ServeHTTP satisfies the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Logf("%s %s", req.Method, req.URL.Path)
+	switch p := strings.Trim(req.URL.Path, "/"); {
+	case req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc"):
+		s.serveGrpc(w, req)
+	case p != strings.Trim(nakama.DefaultWsPath, "/") && s.fail(w):
+	case p == "healthcheck":
+		s.write(w, nil)
+	case p == strings.Trim(nakama.DefaultWsPath, "/"):
+		s.serveWs(w, req)
+	case strings.HasPrefix(p, "v2/"):
+		s.serveApi(w, req, strings.Split(strings.TrimPrefix(p, "v2/"), "/"))
+	default:
+		s.writeErr(w, errorf(nakama.CodeNotFound, "Not Found"))
+	}
+}
+
+// serveApi serves the v2 api routes.
+func (s *Server) serveApi(w http.ResponseWriter, r *http.Request, path []string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeErr(w, errorf(nakama.CodeInvalidArgument, "Unable to read request body."))
+		return
+	}
+	res, err := s.handleApi(r, path, body)
+	if err != nil {
+		s.writeErr(w, err)
+		return
+	}
+	s.write(w, res)
+}
+
+// handleApi authorizes and handles a v2 api request for the path (without the
+// v2 prefix).
+func (s *Server) handleApi(r *http.Request, path []string, body []byte) (interface{}, error) {
+	for _, rt := range s.routes {
+		params, ok := rt.match(r.Method, path)
+		if !ok {
+			continue
+		}
+		req := &request{
+			s:      s,
+			r:      r,
+			params: params,
+			body:   body,
+		}
+		if err := s.authorize(req, rt.auth); err != nil {
+			return nil, err
+		}
+		return rt.f(req)
+	}
+	return nil, errorf(nakama.CodeNotFound, "Not Found")
+}
+
+// authorize authorizes the request.
+func (s *Server) authorize(req *request, auth authType) error {
+	switch auth {
+	case authServerKey:
+		username, _, ok := req.r.BasicAuth()
+		switch {
+		case !ok:
+			return errorf(nakama.CodeUnauthenticated, "Server key required")
+		case username != s.serverKey:
+			return errorf(nakama.CodeUnauthenticated, "Server key invalid")
+		}
+		return nil
+	case authHttpKey:
+		if key := req.r.URL.Query().Get("http_key"); key != "" {
+			if key != s.httpKey {
+				return errorf(nakama.CodeUnauthenticated, "HTTP key invalid")
+			}
+			return nil
+		}
+	}
+	if auth == authNone {
+		return nil
+	}
+	header := req.r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if !strings.HasPrefix(header, "Bearer ") || token == "" {
+		return errorf(nakama.CodeUnauthenticated, "Auth token required")
+	}
+	c, err := s.verify(token, false)
+	if err != nil {
+		return err
+	}
+	req.userId, req.username, req.vars = c.UserId, c.Username, c.Vars
+	return nil
+}
+
+// write writes a response.
+func (s *Server) write(w http.ResponseWriter, v interface{}) {
+	var buf []byte
+	switch x := v.(type) {
+	case nil:
+		buf = []byte("{}")
+	case rawResponse:
+		buf = []byte(x)
+	case proto.Message:
+		var err error
+		if buf, err = s.marshaler.Marshal(x); err != nil {
+			s.writeErr(w, errorf(nakama.CodeInternal, err.Error()))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf)
+}
+
+// writeErr writes an error response.
+func (s *Server) writeErr(w http.ResponseWriter, err error) {
+	code, msg := nakama.CodeInternal, err.Error()
+	var e *nakama.ClientError
+	if errors.As(err, &e) {
+		code, msg = e.Code, e.Message
+	}
+	s.Logf("error: %v: %s", code, msg)
+	buf, _ := json.Marshal(map[string]interface{}{
+		"code":    code,
+		"error":   msg,
+		"message": msg,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(code))
+	_, _ = w.Write(buf)
+}
+
+// claims are the claims of a session or refresh token.
+type claims struct {
+	TokenId   string            `json:"tid"`
+	UserId    string            `json:"uid"`
+	Username  string            `json:"usn"`
+	Vars      map[string]string `json:"vrs,omitempty"`
+	ExpiresAt int64             `json:"exp"`
+	IssuedAt  int64             `json:"iat"`
+}
+
+// issue issues a session for the user. Must be called with the lock held.
+func (s *Server) issue(a *account, vars map[string]string, created bool) (*nakama.SessionResponse, error) {
+	token, err := s.sign(a, vars, false)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := s.sign(a, vars, true)
+	if err != nil {
+		return nil, err
+	}
+	return &nakama.SessionResponse{
+		Created:      created,
+		Token:        token,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// sign creates a signed token for the account. Must be called with the lock
+// held.
+func (s *Server) sign(a *account, vars map[string]string, refresh bool) (string, error) {
+	key, expiry, m := s.encryptionKey, s.tokenExpiry, s.sessionTokens
+	if refresh {
+		key, expiry, m = s.refreshKey, s.refreshExpiry, s.refreshTokens
+	}
+	now := time.Now()
+	c := claims{
+		TokenId:   uuid.New().String(),
+		UserId:    a.user.Id,
+		Username:  a.user.Username,
+		Vars:      vars,
+		ExpiresAt: now.Add(expiry).Unix(),
+		IssuedAt:  now.Unix(),
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	str := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(str))
+	m[c.TokenId] = a.user.Id
+	return str + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify verifies a session or refresh token, returning its claims.
+func (s *Server) verify(token string, refresh bool) (*claims, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.verifyLocked(token, refresh)
+}
+
+// verifyLocked verifies a token. Must be called with the lock held.
+func (s *Server) verifyLocked(token string, refresh bool) (*claims, error) {
+	key, m, typ := s.encryptionKey, s.sessionTokens, "Auth"
+	if refresh {
+		key, m, typ = s.refreshKey, s.refreshTokens, "Refresh"
+	}
+	invalid := errorf(nakama.CodeUnauthenticated, typ+" token invalid")
+	v := strings.Split(token, ".")
+	if len(v) != 3 {
+		return nil, invalid
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(v[0] + "." + v[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(v[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, invalid
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(v[1])
+	if err != nil {
+		return nil, invalid
+	}
+	c := new(claims)
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, invalid
+	}
+	switch userId, ok := m[c.TokenId]; {
+	case !ok || userId != c.UserId || s.accounts[c.UserId] == nil:
+		return nil, invalid
+	case time.Now().Unix() >= c.ExpiresAt:
+		delete(m, c.TokenId)
+		return nil, invalid
+	}
+	return c, nil
+}
+
+// revoke revokes a token. Must be called with the lock held.
+func (s *Server) revoke(token string, refresh bool) {
+	if c, err := s.verifyLocked(token, refresh); err == nil {
+		if refresh {
+			delete(s.refreshTokens, c.TokenId)
+		} else {
+			delete(s.sessionTokens, c.TokenId)
+		}
+	}
+}
+
+// nextSeq returns the next sequence number. Must be called with the lock
+// held.
+func (s *Server) nextSeq() int64 {
+	s.seq++
+	return s.seq
+}
+
+// Option is a fake server option.
+type Option func(*Server)
+
+// WithURL is a fake server option to set the url used by clients.
+func WithURL(urlstr string) Option {
+	return func(s *Server) {
+		s.url = urlstr
+	}
+}
+
+// WithServerKey is a fake server option to set the server key.
+func WithServerKey(serverKey string) Option {
+	return func(s *Server) {
+		s.serverKey = serverKey
+	}
+}
+
+// WithHttpKey is a fake server option to set the http key.
+func WithHttpKey(httpKey string) Option {
+	return func(s *Server) {
+		s.httpKey = httpKey
+	}
+}
+
+// WithTokenExpiry is a fake server option to set the session token expiry.
+func WithTokenExpiry(tokenExpiry time.Duration) Option {
+	return func(s *Server) {
+		s.tokenExpiry = tokenExpiry
+	}
+}
+
+// WithRefreshTokenExpiry is a fake server option to set the refresh token
+// expiry.
+func WithRefreshTokenExpiry(refreshExpiry time.Duration) Option {
+	return func(s *Server) {
+		s.refreshExpiry = refreshExpiry
+	}
+}
+
+// WithRpc is a fake server option to register a remote procedure call
+// handler.
+func WithRpc(id string, f RpcFunc) Option {
+	return func(s *Server) {
+		s.rpcs[id] = f
+	}
+}
+
+// WithLogger is a fake server option to set a logger.
+func WithLogger(f func(string, ...interface{})) Option {
+	return func(s *Server) {
+		s.logf = f
+	}
+}
+
+// authType is a route's authorization type.
+type authType int
+
+// Authorization types.
+const (
+	authNone authType = iota
+	authServerKey
+	authBearer
+	authHttpKey
+)
+
+// route is a v2 api route.
+type route struct {
+	method string
+	path   []string
+	auth   authType
+	f      func(*request) (interface{}, error)
+}
+
+// newRoute creates a route. Path segments starting with ':' are parameters.
+func newRoute(method, path string, auth authType, f func(*request) (interface{}, error)) route {
+	return route{
+		method: method,
+		path:   strings.Split(path, "/"),
+		auth:   auth,
+		f:      f,
+	}
+}
+
+// match matches the method and path against the route.
+func (rt route) match(method string, path []string) (map[string]string, bool) {
+	if rt.method != method || len(rt.path) != len(path) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, p := range rt.path {
+		switch {
+		case strings.HasPrefix(p, ":"):
+			params[p[1:]] = path[i]
+		case p != path[i]:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// buildRoutes builds the v2 api routes.
+func (s *Server) buildRoutes() []route {
+	return []route{
+		newRoute("GET", "account", authBearer, s.getAccount),
+		newRoute("PUT", "account", authBearer, s.updateAccount),
+		newRoute("POST", "account/authenticate/:provider", authServerKey, s.authenticate),
+		newRoute("POST", "account/link/:provider", authBearer, s.link),
+		newRoute("POST", "account/unlink/:provider", authBearer, s.unlink),
+		newRoute("POST", "account/session/refresh", authServerKey, s.sessionRefresh),
+		newRoute("POST", "session/logout", authBearer, s.sessionLogout),
+		newRoute("GET", "user", authBearer, s.getUsers),
+		newRoute("GET", "user/:userId/group", authBearer, s.listUserGroups),
+		newRoute("GET", "channel/:channelId", authBearer, s.listChannelMessages),
+		newRoute("POST", "event", authBearer, s.event),
+		newRoute("GET", "friend", authBearer, s.listFriends),
+		newRoute("POST", "friend", authBearer, s.addFriends),
+		newRoute("DELETE", "friend", authBearer, s.deleteFriends),
+		newRoute("POST", "friend/block", authBearer, s.blockFriends),
+		newRoute("POST", "friend/facebook", authBearer, s.unimplemented),
+		newRoute("POST", "friend/steam", authBearer, s.unimplemented),
+		newRoute("GET", "group", authBearer, s.listGroups),
+		newRoute("POST", "group", authBearer, s.createGroup),
+		newRoute("DELETE", "group/:groupId", authBearer, s.deleteGroup),
+		newRoute("PUT", "group/:groupId", authBearer, s.updateGroup),
+		newRoute("POST", "group/:groupId/add", authBearer, s.addGroupUsers),
+		newRoute("POST", "group/:groupId/ban", authBearer, s.banGroupUsers),
+		newRoute("POST", "group/:groupId/demote", authBearer, s.demoteGroupUsers),
+		newRoute("POST", "group/:groupId/join", authBearer, s.joinGroup),
+		newRoute("POST", "group/:groupId/kick", authBearer, s.kickGroupUsers),
+		newRoute("POST", "group/:groupId/leave", authBearer, s.leaveGroup),
+		newRoute("POST", "group/:groupId/promote", authBearer, s.promoteGroupUsers),
+		newRoute("GET", "group/:groupId/user", authBearer, s.listGroupUsers),
+		newRoute("POST", "iap/purchase/:store", authBearer, s.validateIap),
+		newRoute("POST", "iap/subscription/:store", authBearer, s.validateIap),
+		newRoute("GET", "iap/subscription", authBearer, s.listSubscriptions),
+		newRoute("GET", "iap/subscription/:productId", authBearer, s.getSubscription),
+		newRoute("GET", "leaderboard/:leaderboardId", authBearer, s.listLeaderboardRecords),
+		newRoute("POST", "leaderboard/:leaderboardId", authBearer, s.writeLeaderboardRecord),
+		newRoute("DELETE", "leaderboard/:leaderboardId", authBearer, s.deleteLeaderboardRecord),
+		newRoute("GET", "leaderboard/:leaderboardId/owner/:ownerId", authBearer, s.listLeaderboardRecordsAroundOwner),
+		newRoute("GET", "match", authBearer, s.listMatches),
+		newRoute("GET", "notification", authBearer, s.listNotifications),
+		newRoute("DELETE", "notification", authBearer, s.deleteNotifications),
+		newRoute("POST", "rpc/:id", authHttpKey, s.rpc),
+		newRoute("GET", "rpc/:id", authHttpKey, s.rpc),
+		newRoute("POST", "storage", authBearer, s.readStorageObjects),
+		newRoute("PUT", "storage", authBearer, s.writeStorageObjects),
+		newRoute("PUT", "storage/delete", authBearer, s.deleteStorageObjects),
+		newRoute("GET", "storage/:collection", authBearer, s.listStorageObjects),
+		newRoute("GET", "tournament", authBearer, s.listTournaments),
+		newRoute("GET", "tournament/:tournamentId", authBearer, s.listLeaderboardRecords),
+		newRoute("POST", "tournament/:tournamentId", authBearer, s.writeTournamentRecord),
+		newRoute("PUT", "tournament/:tournamentId", authBearer, s.writeTournamentRecord),
+		newRoute("DELETE", "tournament/:tournamentId", authBearer, s.deleteLeaderboardRecord),
+		newRoute("POST", "tournament/:tournamentId/join", authBearer, s.joinTournament),
+		newRoute("GET", "tournament/:tournamentId/owner/:ownerId", authBearer, s.listLeaderboardRecordsAroundOwner),
+	}
+}
+
+// request is a v2 api request.
+type request struct {
+	s        *Server
+	r        *http.Request
+	params   map[string]string
+	body     []byte
+	userId   string
+	username string
+	vars     map[string]string
+}
+
+// decode decodes the request body to msg.
+func (req *request) decode(msg proto.Message) error {
+	if len(req.body) == 0 {
+		return nil
+	}
+	if err := req.s.unmarshaler.Unmarshal(req.body, msg); err != nil {
+		return errorf(nakama.CodeInvalidArgument, "Unable to decode request body: %v", err)
+	}
+	return nil
+}
+
+// param returns the named path parameter.
+func (req *request) param(name string) string {
+	return req.params[name]
+}
+
+// query returns the query value.
+func (req *request) query(name string) string {
+	return req.r.URL.Query().Get(name)
+}
+
+// queryList returns the query values, splitting comma separated values.
+func (req *request) queryList(name string) []string {
+	var v []string
+	for _, s := range req.r.URL.Query()[name] {
+		for _, x := range strings.Split(s, ",") {
+			if x != "" {
+				v = append(v, x)
+			}
+		}
+	}
+	return v
+}
+
+// queryInt returns the query value as an int, or def when not set.
+func (req *request) queryInt(name string, def int64) (int64, error) {
+	str := req.query(name)
+	if str == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, errorf(nakama.CodeInvalidArgument, "Invalid %s value.", name)
+	}
+	return i, nil
+}
+
+// queryBool returns the query value as a bool, or nil when not set.
+func (req *request) queryBool(name string) (*bool, error) {
+	str := req.query(name)
+	if str == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(str)
+	if err != nil {
+		return nil, errorf(nakama.CodeInvalidArgument, "Invalid %s value.", name)
+	}
+	return &b, nil
+}
+
+// limit returns the limit query value, checked against the max.
+func (req *request) limit(def, max int64) (int, error) {
+	limit, err := req.queryInt("limit", def)
+	switch {
+	case err != nil:
+		return 0, err
+	case limit < 1 || max < limit:
+		return 0, errorf(nakama.CodeInvalidArgument, "Invalid limit - limit must be between 1 and %d.", max)
+	}
+	return int(limit), nil
+}
+
+// rawResponse is a raw (unwrapped) response.
+type rawResponse string
+
+// unimplemented is the handler for unimplemented routes.
+func (s *Server) unimplemented(*request) (interface{}, error) {
+	return nil, errorf(nakama.CodeUnimplemented, "Not implemented.")
+}
+
+// event handles an event request.
+func (s *Server) event(req *request) (interface{}, error) {
+	msg := new(nakama.EventRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, msg)
+	return nil, nil
+}
+
+// validateIap handles in-app purchase validation requests.
+func (s *Server) validateIap(req *request) (interface{}, error) {
+	return nil, errorf(nakama.CodeFailedPrecondition, "%s IAP is not configured.", req.param("store"))
+}
+
+// listSubscriptions handles a list subscriptions request.
+func (s *Server) listSubscriptions(req *request) (interface{}, error) {
+	return new(nakama.SubscriptionsResponse), nil
+}
+
+// getSubscription handles a get subscription request.
+func (s *Server) getSubscription(req *request) (interface{}, error) {
+	return nil, errorf(nakama.CodeNotFound, "Subscription not found.")
+}
+
+// rpc handles a remote procedure call request.
+func (s *Server) rpc(req *request) (interface{}, error) {
+	id := req.param("id")
+	s.mu.Lock()
+	f, ok := s.rpcs[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errorf(nakama.CodeNotFound, "RPC function not found")
+	}
+	unwrap := req.r.URL.Query().Has("unwrap")
+	payload := string(req.body)
+	if !unwrap && len(req.body) != 0 {
+		if err := json.Unmarshal(req.body, &payload); err != nil {
+			return nil, errorf(nakama.CodeInvalidArgument, "Unable to decode request body: %v", err)
+		}
+	}
+	res, err := f(req.r.Context(), req.userId, payload)
+	switch {
+	case err != nil:
+		var e *nakama.ClientError
+		if errors.As(err, &e) {
+			return nil, e
+		}
+		return nil, errorf(nakama.CodeInternal, err.Error())
+	case unwrap:
+		return rawResponse(res), nil
+	}
+	return &nakama.RpcMsg{
+		Id:      id,
+		Payload: res,
+	}, nil
+}
+
+// errorf creates a client error.
+func errorf(code nakama.Code, s string, v ...interface{}) error {
+	if len(v) != 0 {
+		s = fmt.Sprintf(s, v...)
+	}
+	return nakama.NewClientError(0, code, s)
+}
+
+// httpStatus returns the http status code for the code, as mapped by the
+// grpc-gateway.
+func httpStatus(code nakama.Code) int {
+	switch code {
+	case nakama.CodeOK:
+		return http.StatusOK
+	case nakama.CodeCanceled:
+		return 499
+	case nakama.CodeInvalidArgument, nakama.CodeFailedPrecondition, nakama.CodeOutOfRange:
+		return http.StatusBadRequest
+	case nakama.CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case nakama.CodeNotFound:
+		return http.StatusNotFound
+	case nakama.CodeAlreadyExists, nakama.CodeAborted:
+		return http.StatusConflict
+	case nakama.CodePermissionDenied:
+		return http.StatusForbidden
+	case nakama.CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case nakama.CodeResourceExhausted:
+		return http.StatusTooManyRequests
+	case nakama.CodeUnimplemented:
+		return http.StatusNotImplemented
+	case nakama.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// encodeCursor encodes a cursor.
+func encodeCursor(v ...interface{}) string {
+	var s []string
+	for _, x := range v {
+		s = append(s, fmt.Sprint(x))
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(s, ":")))
+}
+
+// decodeCursor decodes a cursor.
+func decodeCursor(cursor string) ([]string, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errorf(nakama.CodeInvalidArgument, "Malformed cursor was used.")
+	}
+	return strings.Split(string(buf), ":"), nil
+}
+
+// decodeOffset decodes an offset cursor.
+func decodeOffset(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	v, err := decodeCursor(cursor)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(v[0])
+	if err != nil || i < 0 {
+		return 0, errorf(nakama.CodeInvalidArgument, "Malformed cursor was used.")
+	}
+	return i, nil
+}
+
+// page returns the start and end of a page of n items, and the next cursor.
+func page(n, offset, limit int) (int, int, string) {
+	if offset > n {
+		offset = n
+	}
+	end, cursor := offset+limit, ""
+	if end < n {
+		cursor = encodeCursor(end)
+	} else {
+		end = n
+	}
+	return offset, end, cursor
+}
+
+// randomUsername generates a random username.
+func randomUsername() string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	buf := make([]byte, 10)
+	_, _ = rand.Read(buf)
+	for i, b := range buf {
+		buf[i] = chars[int(b)%len(chars)]
+	}
+	return string(buf)
+}
+
+// pipeListener is a net.Listener for in-memory pipe connections.
+type pipeListener struct {
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+// newPipeListener creates a new pipe listener.
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+// Accept satisfies the net.Listener interface.
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.ch:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close satisfies the net.Listener interface.
+func (ln *pipeListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.done)
+	})
+	return nil
+}
+
+// Addr satisfies the net.Listener interface.
+func (ln *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// DialContext dials the listener.
+func (ln *pipeListener) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ln.done:
+		return nil, net.ErrClosed
+	case ln.ch <- server:
+	}
+	return client, nil
+}
+
+// pipeAddr is a pipe address.
+type pipeAddr struct{}
+
+// Network satisfies the net.Addr interface.
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+// String satisfies the net.Addr interface.
+func (pipeAddr) String() string {
+	return "pipe"
+}
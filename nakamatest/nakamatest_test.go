@@ -0,0 +1,3203 @@
+package nakamatest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/ascii8/nakama-go/internal/grpcapi"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+func TestHealthcheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	if err := s.Client().Healthcheck(ctx); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl := s.Client()
+	if err := cl.AuthenticateDevice(ctx, "short", true, ""); !isCode(err, nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", err)
+	}
+	deviceId := uuid.New().String()
+	if err := cl.AuthenticateDevice(ctx, deviceId, false, ""); !isCode(err, nakama.CodeNotFound) {
+		t.Errorf("expected not found error, got: %v", err)
+	}
+	if err := cl.AuthenticateDevice(ctx, deviceId, true, "alice"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !cl.SessionWasCreated() {
+		t.Errorf("expected session to have been created")
+	}
+	if cl.SessionExpiry().Before(time.Now()) {
+		t.Errorf("expected expiry in the future, got: %s", cl.SessionExpiry())
+	}
+	if err := cl.LinkEmail(ctx, "alice@example.com", "password1234"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := cl.UpdateAccount(ctx, nakama.UpdateAccount().WithDisplayName("Alice")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	res, err := cl.Account(ctx)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case res.User.Username != "alice":
+		t.Errorf("expected username alice, got: %q", res.User.Username)
+	case res.User.DisplayName != "Alice":
+		t.Errorf("expected display name Alice, got: %q", res.User.DisplayName)
+	case res.Email != "alice@example.com":
+		t.Errorf("expected email alice@example.com, got: %q", res.Email)
+	case len(res.Devices) != 1 || res.Devices[0].Id != deviceId:
+		t.Errorf("expected device %s, got: %v", deviceId, res.Devices)
+	}
+	other := s.Client()
+	if err := other.AuthenticateEmail(ctx, "alice@example.com", "wrongpassword", false, ""); !isCode(err, nakama.CodeUnauthenticated) {
+		t.Errorf("expected unauthenticated error, got: %v", err)
+	}
+	if err := other.AuthenticateEmail(ctx, "alice@example.com", "password1234", false, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	session, err := nakama.SessionRefresh(other.SessionRefreshToken()).Do(ctx, other)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case session.Token == other.SessionToken():
+		t.Errorf("expected new session token")
+	}
+	if err := other.SessionLogout(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := cl.Account(ctx); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestParseTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	// jwt payloads are base64url encoded, find a payload using - or _
+	var payload string
+	for i := 0; !strings.ContainsAny(payload, "-_"); i++ {
+		payload = base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d,"usn":"%s~~~"}`, exp, strings.Repeat("a", i))))
+	}
+	expiry, _, err := nakama.ParseTokenExpiry("e30."+payload+".c2ln", "session", 0)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case expiry.Unix() != exp:
+		t.Errorf("expected expiry %d, got: %d", exp, expiry.Unix())
+	}
+}
+
+func TestStorage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl := newClient(ctx, t, s)
+	res, err := cl.WriteStorageObjects(ctx, nakama.WriteStorageObjects().WithObject(&nakama.WriteStorageObject{
+		Collection: "saves",
+		Key:        "slot1",
+		Value:      `{"level":1}`,
+	}))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.Acks) != 1 || res.Acks[0].Version == "":
+		t.Fatalf("expected 1 ack with a version, got: %v", res.Acks)
+	}
+	version := res.Acks[0].Version
+	_, err = cl.WriteStorageObjects(ctx, nakama.WriteStorageObjects().WithObject(&nakama.WriteStorageObject{
+		Collection: "saves",
+		Key:        "slot1",
+		Value:      `{"level":2}`,
+		Version:    "*",
+	}))
+	if !isCode(err, nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", err)
+	}
+	if _, err := cl.WriteStorageObjects(ctx, nakama.WriteStorageObjects().WithObject(&nakama.WriteStorageObject{
+		Collection: "saves",
+		Key:        "slot1",
+		Value:      `{"level":2}`,
+		Version:    version,
+	})); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	userId := accountId(ctx, t, cl)
+	read, err := cl.ReadStorageObjects(ctx, nakama.ReadStorageObjects().WithObjectId("saves", "slot1", userId))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(read.Objects) != 1:
+		t.Fatalf("expected 1 object, got: %d", len(read.Objects))
+	case read.Objects[0].Value != `{"level":2}`:
+		t.Errorf("expected updated value, got: %s", read.Objects[0].Value)
+	}
+	other := newClient(ctx, t, s)
+	read, err = other.ReadStorageObjects(ctx, nakama.ReadStorageObjects().WithObjectId("saves", "slot1", userId))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(read.Objects) != 0:
+		t.Errorf("expected owner read object to not be readable by other user")
+	}
+}
+
+func TestCollection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	type save struct {
+		Level int    `json:"level"`
+		Name  string `json:"name"`
+	}
+	cl := newClient(ctx, t, s)
+	saves := nakama.NewCollection[save](cl, "saves").WithPermission(nakama.PermissionPublicRead, nakama.PermissionOwnerWrite)
+	switch _, ok, err := saves.Get(ctx, "slot1"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case ok:
+		t.Fatalf("expected slot1 to not exist")
+	case saves.Version("slot1") != "*":
+		t.Errorf("expected version *, got: %q", saves.Version("slot1"))
+	}
+	if err := saves.Put(ctx, "slot1", save{1, "start"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// a second writer
+	other := nakama.NewCollection[save](cl, "saves")
+	if _, err := other.Update(ctx, "slot1", func(v *save) error {
+		v.Level++
+		return nil
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// stale version
+	if err := saves.Put(ctx, "slot1", save{5, "stale"}); !nakama.IsVersionConflict(err) {
+		t.Errorf("expected version conflict, got: %v", err)
+	}
+	calls := 0
+	switch v, err := saves.Update(ctx, "slot1", func(v *save) error {
+		calls++
+		if calls == 1 {
+			// concurrent write between the read and the write
+			if _, err := other.Update(ctx, "slot1", func(v *save) error {
+				v.Name = "other"
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		v.Level++
+		return nil
+	}); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case calls != 2 || v != (save{3, "other"}):
+		t.Errorf("expected {3 other} after 2 calls, got: %v after %d", v, calls)
+	}
+	// public read by another user
+	public := nakama.NewCollection[save](newClient(ctx, t, s), "saves").WithUserId(cl.SessionUserId())
+	switch obj, err := public.GetObject(ctx, "slot1"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case obj == nil || obj.Value != (save{3, "other"}) || obj.Read != nakama.PermissionPublicRead:
+		t.Errorf("expected public object, got: %v", obj)
+	}
+	// versions of objects of different users are tracked separately
+	if err := public.WithUserId("").Put(ctx, "slot1", save{1, "mine"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := public.WithUserId(cl.SessionUserId()).Version("slot1"); v != saves.Version("slot1") {
+		t.Errorf("expected version %q, got: %q", saves.Version("slot1"), v)
+	}
+	// proto values
+	devices := nakama.NewCollection[*nakama.AccountDevice](cl, "devices")
+	for _, id := range []string{"a", "b", "c"} {
+		if err := devices.Put(ctx, id, &nakama.AccountDevice{Id: id}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	objects, err := devices.List(ctx, 2).All(0)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(objects) != 3 || objects[2].Value.Id != "c" || objects[2].Version != devices.Version("c"):
+		t.Errorf("expected 3 devices, got: %v", objects)
+	}
+	if err := devices.Delete(ctx, "b"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok, err := devices.Get(ctx, "b"); err != nil || ok {
+		t.Errorf("expected b to be deleted, got: %t %v", ok, err)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var offline int32
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&offline) != 0 {
+			return nil, errors.New("network is unreachable")
+		}
+		return tr.RoundTrip(req)
+	})
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithRetryPolicy(nil))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	level := func(value string) int {
+		var v struct {
+			Level int `json:"level"`
+		}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		return v.Level
+	}
+	// merge keeps the highest level
+	var merges int32
+	merge := func(_ context.Context, local, server *nakama.StorageObject) (*nakama.StorageObject, error) {
+		atomic.AddInt32(&merges, 1)
+		if local == nil || server == nil || level(server.Value) > level(local.Value) {
+			return server, nil
+		}
+		return local, nil
+	}
+	path := filepath.Join(t.TempDir(), "nakama", "replica.json")
+	r := nakama.NewReplica(cl, nakama.NewFileReplicaStore(path)).WithMerge(merge)
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot1", Value: `{"level":1}`}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// writes are queued while offline
+	atomic.StoreInt32(&offline, 1)
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot1", Value: `{"level":3}`}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot2", Value: `{"level":1}`}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch obj, err := r.Read(ctx, "saves", "slot1"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case obj == nil || level(obj.Value) != 3:
+		t.Errorf("expected level 3, got: %v", obj)
+	}
+	if _, err := r.Read(ctx, "saves", "slot3"); err == nil {
+		t.Errorf("expected error reading unreplicated object offline")
+	}
+	if err := r.Sync(ctx); err == nil {
+		t.Errorf("expected error syncing offline")
+	}
+	// the server copy changes underneath
+	other := nakama.NewCollection[map[string]int](cl, "saves")
+	atomic.StoreInt32(&offline, 0)
+	if err := other.Put(ctx, "slot1", map[string]int{"level": 2}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// replicas persist across restarts
+	r = nakama.NewReplica(cl, nakama.NewFileReplicaStore(path)).WithMerge(merge)
+	switch pending, err := r.Pending(); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(pending) != 2 || pending[0].Key != "slot1" || pending[1].Key != "slot2":
+		t.Fatalf("expected 2 pending objects, got: %v", pending)
+	}
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt32(&merges); n != 1 {
+		t.Errorf("expected 1 merge, got: %d", n)
+	}
+	switch v, ok, err := other.Get(ctx, "slot1"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case !ok || v["level"] != 3:
+		t.Errorf("expected level 3, got: %v", v)
+	}
+	// a merge keeping the server copy
+	if err := other.Put(ctx, "slot2", map[string]int{"level": 4}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot2", Value: `{"level":2}`}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch obj, err := r.Read(ctx, "saves", "slot2"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case obj == nil || level(obj.Value) != 4 || obj.Version != other.Version("slot2"):
+		t.Errorf("expected server copy, got: %v", obj)
+	}
+	// deletes are queued while offline
+	atomic.StoreInt32(&offline, 1)
+	if err := r.Delete(ctx, "saves", "slot1"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if obj, err := r.Read(ctx, "saves", "slot1"); err != nil || obj != nil {
+		t.Errorf("expected slot1 to be deleted, got: %v %v", obj, err)
+	}
+	atomic.StoreInt32(&offline, 0)
+	// queued deletes are synced once attached to a connection, alongside the
+	// connection's own connect handler
+	connectCh := make(chan bool, 1)
+	conn := newConn(ctx, t, cl, nakama.WithConnHandler(connectHandler(func(context.Context) {
+		connectCh <- true
+	})))
+	defer conn.Close()
+	r.Attach(conn)
+	recv(ctx, t, connectCh)
+	waitFor(ctx, t, func() bool {
+		_, ok, err := other.Get(ctx, "slot1")
+		return err == nil && !ok
+	})
+	switch objects, err := r.List("saves"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(objects) != 1 || objects[0].Key != "slot2":
+		t.Errorf("expected slot2, got: %v", objects)
+	}
+	if _, ok, err := other.Get(ctx, "slot1"); err != nil || ok {
+		t.Errorf("expected slot1 to be deleted, got: %t %v", ok, err)
+	}
+}
+
+func TestReplicaSyncErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var offline int32
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&offline) != 0 {
+			return nil, errors.New("network is unreachable")
+		}
+		return tr.RoundTrip(req)
+	})
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithRetryPolicy(nil))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	r := nakama.NewReplica(cl, nil)
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot0", Value: `{"level":1}`}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// the server rejects the first pending object
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot1", Value: `not json`}); !isCode(err, nakama.CodeInvalidArgument) {
+		t.Fatalf("expected invalid argument error, got: %v", err)
+	}
+	atomic.StoreInt32(&offline, 1)
+	if err := r.Write(ctx, &nakama.WriteStorageObject{Collection: "saves", Key: "slot2", Value: `{"level":2}`}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := r.Sync(ctx); err == nil || errors.As(err, new(nakama.ReplicaSyncError)) {
+		t.Errorf("expected offline error, got: %v", err)
+	}
+	atomic.StoreInt32(&offline, 0)
+	other := nakama.NewCollection[map[string]int](cl, "saves")
+	if err := other.Put(ctx, "slot0", map[string]int{"level": 5}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// the rejected object does not stop the remaining objects syncing
+	var errs nakama.ReplicaSyncError
+	switch err := r.Sync(ctx); {
+	case !errors.As(err, &errs):
+		t.Fatalf("expected replica sync error, got: %v", err)
+	case len(errs) != 1 || !isCode(errs[0], nakama.CodeInvalidArgument):
+		t.Errorf("expected 1 invalid argument error, got: %v", errs)
+	}
+	switch pending, err := r.Pending(); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(pending) != 1 || pending[0].Key != "slot1":
+		t.Errorf("expected slot1 pending, got: %v", pending)
+	}
+	if v, ok, err := other.Get(ctx, "slot2"); err != nil || !ok || v["level"] != 2 {
+		t.Errorf("expected level 2, got: %v %t %v", v, ok, err)
+	}
+	switch obj, err := r.Read(ctx, "saves", "slot0"); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case obj == nil || obj.Value != `{"level":5}`:
+		t.Errorf("expected refreshed slot0, got: %v", obj)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	if err := s.CreateLeaderboard(&nakama.Leaderboard{
+		Id:        "weekly",
+		SortOrder: SortOrderDescending,
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var offline int32
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&offline) != 0 {
+			return nil, errors.New("network is unreachable")
+		}
+		return tr.RoundTrip(req)
+	})
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithRetryPolicy(nil))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// requests are journaled while offline
+	atomic.StoreInt32(&offline, 1)
+	path := filepath.Join(t.TempDir(), "nakama", "outbox.json")
+	ob := nakama.NewOutbox(cl, nakama.NewFileOutboxJournal(path))
+	for _, req := range []proto.Message{
+		nakama.WriteLeaderboardRecord("weekly").WithScore(100),
+		nakama.Event("level_complete").WithProperties(map[string]string{"level": "1"}),
+		nakama.WriteLeaderboardRecord("missing").WithScore(1),
+		nakama.UpdateAccount().WithDisplayName("offline"),
+	} {
+		if _, err := ob.Add(req); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if _, err := ob.Add(&nakama.AccountDevice{}); err == nil {
+		t.Errorf("expected error adding unsupported request")
+	}
+	// outboxes persist across restarts
+	results := make(chan *nakama.OutboxResult, 4)
+	ob = nakama.NewOutbox(cl, nakama.NewFileOutboxJournal(path)).
+		WithBackoff(time.Millisecond, 5*time.Millisecond).
+		WithHandler(func(res *nakama.OutboxResult) {
+			results <- res
+		})
+	if n, err := ob.Len(); err != nil || n != 4 {
+		t.Fatalf("expected 4 entries, got: %d %v", n, err)
+	}
+	runCtx, runCancel := context.WithCancel(ctx)
+	defer runCancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- ob.Run(runCtx)
+	}()
+	select {
+	case res := <-results:
+		t.Fatalf("expected no result while offline, got: %v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt32(&offline, 0)
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected result, got: %v", ctx.Err())
+		case res := <-results:
+			ids = append(ids, res.Id)
+			switch {
+			case i == 0 && (res.Err != nil || res.Response.(*nakama.LeaderboardRecord).Score != 100):
+				t.Errorf("expected record, got: %v %v", res.Response, res.Err)
+			case i == 2 && res.Err == nil:
+				t.Errorf("expected permanent failure")
+			case i != 2 && res.Err != nil:
+				t.Errorf("expected no error, got: %v", res.Err)
+			}
+		}
+	}
+	if fmt.Sprint(ids) != "[1 2 3 4]" {
+		t.Errorf("expected results in order, got: %v", ids)
+	}
+	if events := s.Events(); len(events) != 1 || events[0].Name != "level_complete" {
+		t.Errorf("expected level_complete event, got: %v", events)
+	}
+	switch res, err := cl.Account(ctx); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case res.User.DisplayName != "offline":
+		t.Errorf("expected display name offline, got: %q", res.User.DisplayName)
+	}
+	// requests added while running are replayed
+	id, err := ob.Add(nakama.WriteLeaderboardRecord("weekly").WithScore(200))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("expected result, got: %v", ctx.Err())
+	case res := <-results:
+		if res.Id != id || res.Err != nil {
+			t.Errorf("expected entry %d, got: %d %v", id, res.Id, res.Err)
+		}
+	}
+	runCancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if n, err := nakama.NewOutbox(cl, nakama.NewFileOutboxJournal(path)).Len(); err != nil || n != 0 {
+		t.Errorf("expected empty outbox, got: %d %v", n, err)
+	}
+}
+
+func TestOutboxPaused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl := s.Client(nakama.WithRetryPolicy(nil))
+	results := make(chan *nakama.OutboxResult, 2)
+	ob := nakama.NewOutbox(cl, nil).
+		WithBackoff(time.Millisecond, 5*time.Millisecond).
+		WithHandler(func(res *nakama.OutboxResult) {
+			results <- res
+		})
+	runCtx, runCancel := context.WithCancel(ctx)
+	defer runCancel()
+	go func() {
+		_ = ob.Run(runCtx)
+	}()
+	next := func() *nakama.OutboxResult {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected result, got: %v", ctx.Err())
+		case res := <-results:
+			return res
+		}
+		return nil
+	}
+	// requests wait for the client to authenticate
+	id, err := ob.Add(nakama.Event("unauthenticated"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case res := <-results:
+		t.Fatalf("expected no result while unauthenticated, got: %v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res := next(); res.Id != id || res.Err != nil {
+		t.Errorf("expected entry %d, got: %d %v", id, res.Id, res.Err)
+	}
+	// server errors without a nakama error body are retried
+	s.FailRequests(3, http.StatusBadGateway, "Bad Gateway")
+	if id, err = ob.Add(nakama.Event("bad_gateway")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res := next(); res.Id != id || res.Err != nil {
+		t.Errorf("expected entry %d, got: %d %v", id, res.Id, res.Err)
+	}
+	// other server errors are failed permanently
+	s.FailRequests(1, http.StatusInternalServerError, `{"code":13,"message":"before hook failed"}`)
+	if id, err = ob.Add(nakama.Event("internal")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res := next(); res.Id != id || !isCode(res.Err, nakama.CodeInternal) {
+		t.Errorf("expected entry %d to fail with internal error, got: %d %v", id, res.Id, res.Err)
+	}
+	if events := s.Events(); len(events) != 2 || events[0].Name != "unauthenticated" || events[1].Name != "bad_gateway" {
+		t.Errorf("expected 2 events, got: %v", events)
+	}
+	if n, err := ob.Len(); err != nil || n != 0 {
+		t.Errorf("expected empty outbox, got: %d %v", n, err)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl := newClient(ctx, t, s)
+	userId := accountId(ctx, t, cl)
+	req := nakama.WriteStorageObjects()
+	for i := 0; i < 5; i++ {
+		req.WithObject(&nakama.WriteStorageObject{
+			Collection: "items",
+			Key:        fmt.Sprintf("item%d", i),
+			Value:      "{}",
+		})
+	}
+	if _, err := cl.WriteStorageObjects(ctx, req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	objects, err := nakama.StorageObjects("items").WithUserId(userId).WithLimit(2).Iter(ctx, cl).All(0)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(objects) != 5:
+		t.Errorf("expected 5 objects, got: %d", len(objects))
+	}
+	objects, err = nakama.StorageObjects("items").WithUserId(userId).WithLimit(2).Iter(ctx, cl).All(3)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(objects) != 3 || objects[2].Key != "item2":
+		t.Errorf("expected 3 objects, got: %v", objects)
+	}
+	it := nakama.StorageObjects("items").WithUserId(userId).WithLimit(10000).Iter(ctx, cl)
+	if it.Next() || !isCode(it.Err(), nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", it.Err())
+	}
+	// backward paging
+	if err := s.CreateLeaderboard(&nakama.Leaderboard{
+		Id:        "weekly",
+		SortOrder: SortOrderDescending,
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := newClient(ctx, t, s).WriteLeaderboardRecord(ctx, nakama.WriteLeaderboardRecord("weekly").WithScore(int64(i))); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	it2 := nakama.LeaderboardRecords("weekly").WithLimit(2).Iter(ctx, cl)
+	var scores []int64
+	for it2.Next() {
+		scores = append(scores, it2.Value().Score)
+		if len(scores) == 4 {
+			break
+		}
+	}
+	cursor := it2.Cursor()
+	it2.Close()
+	if exp := "[4 3 2 1]"; fmt.Sprint(scores) != exp {
+		t.Errorf("expected %s, got: %v", exp, scores)
+	}
+	records, err := nakama.LeaderboardRecords("weekly").WithLimit(2).WithCursor(cursor).IterPrev(ctx, cl).All(0)
+	scores = nil
+	for _, r := range records {
+		scores = append(scores, r.Score)
+	}
+	switch exp := "[0 2 1 4 3]"; {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case fmt.Sprint(scores) != exp:
+		t.Errorf("expected %s, got: %v", exp, scores)
+	}
+}
+
+func TestFriends(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	id1, id2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	conn2, err := cl2.NewConn(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer conn2.Close()
+	notifyCh := make(chan *nakama.NotificationsMsg, 1)
+	conn2.NotificationsHandler = func(_ context.Context, msg *nakama.NotificationsMsg) {
+		notifyCh <- msg
+	}
+	if err := cl1.AddFriends(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive notification: %v", ctx.Err())
+	case msg := <-notifyCh:
+		if len(msg.Notifications) != 1 || msg.Notifications[0].Code != nakama.NotificationFriendRequest {
+			t.Errorf("expected friend request notification, got: %v", msg.Notifications)
+		}
+	}
+	checkFriend(ctx, t, cl1, id2, nakama.FriendState_INVITE_SENT)
+	checkFriend(ctx, t, cl2, id1, nakama.FriendState_INVITE_RECEIVED)
+	if err := cl2.AddFriends(ctx, id1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkFriend(ctx, t, cl1, id2, nakama.FriendState_FRIEND)
+	checkFriend(ctx, t, cl2, id1, nakama.FriendState_FRIEND)
+	res, err := cl1.Notifications(ctx, nakama.Notifications())
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.Notifications) != 1 || res.Notifications[0].Code != nakama.NotificationFriendAccept:
+		t.Errorf("expected friend accept notification, got: %v", res.Notifications)
+	}
+	if err := cl1.BlockFriends(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkFriend(ctx, t, cl1, id2, nakama.FriendState_BLOCKED)
+	if friends, err := cl2.Friends(ctx, nakama.Friends()); err != nil || len(friends.Friends) != 0 {
+		t.Errorf("expected no friends, got: %v %v", friends, err)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl := newClient(ctx, t, s)
+	id := accountId(ctx, t, cl)
+	for _, subject := range []string{"a", "b"} {
+		if err := s.SendNotification(id, subject, `{}`, 1, "", true); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "nakama", "inbox.json")
+	notifyCh := make(chan *nakama.Notification, 8)
+	inbox := nakama.NewInbox(cl, nakama.NewFileInboxStore(path)).
+		WithBatchDelay(10 * time.Millisecond).
+		WithHandler(func(_ context.Context, n *nakama.Notification) {
+			notifyCh <- n
+		})
+	// missed notifications are retrieved on connect
+	conn := newConn(ctx, t, cl)
+	defer conn.Close()
+	inbox.Attach(conn)
+	for _, subject := range []string{"a", "b"} {
+		if n := recv(ctx, t, notifyCh); n.Subject != subject {
+			t.Errorf("expected notification %s, got: %v", subject, n)
+		}
+	}
+	// live notifications are de-duplicated against retrieved notifications
+	if err := s.SendNotification(id, "c", `{}`, 1, "", true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := recv(ctx, t, notifyCh); n.Subject != "c" {
+		t.Errorf("expected notification c, got: %v", n)
+	}
+	if err := inbox.Sync(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case n := <-notifyCh:
+		t.Errorf("expected no notification, got: %v", n)
+	default:
+	}
+	notifications := inbox.Notifications()
+	if len(notifications) != 3 || notifications[0].Subject != "c" {
+		t.Fatalf("expected 3 notifications, got: %v", notifications)
+	}
+	if err := inbox.MarkRead(notifications[0].Id); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := inbox.UnreadCount(); n != 2 || !inbox.IsRead(notifications[0].Id) {
+		t.Errorf("expected 2 unread notifications, got: %d", n)
+	}
+	// deletes are batched
+	if err := inbox.Delete(notifications[1].Id, notifications[2].Id); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for {
+		res, err := cl.Notifications(ctx, nakama.Notifications())
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(res.Notifications) == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected notifications to be deleted, got: %v", res.Notifications)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// inboxes persist across restarts
+	inbox = nakama.NewInbox(cl, nakama.NewFileInboxStore(path)).
+		WithHandler(func(_ context.Context, n *nakama.Notification) {
+			notifyCh <- n
+		})
+	if err := inbox.Sync(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch notifications := inbox.Notifications(); {
+	case len(notifications) != 1 || notifications[0].Subject != "c":
+		t.Errorf("expected notification c, got: %v", notifications)
+	case !inbox.IsRead(notifications[0].Id) || inbox.UnreadCount() != 0:
+		t.Errorf("expected notification c to be read")
+	}
+	if err := s.SendNotification(id, "d", `{}`, 1, "", true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := inbox.Sync(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := recv(ctx, t, notifyCh); n.Subject != "d" {
+		t.Errorf("expected notification d, got: %v", n)
+	}
+	// handlers are called in the order notifications are added, even when
+	// slower for earlier notifications
+	subjects, orderCh := []string{"e", "f", "g", "h", "i"}, make(chan *nakama.Notification, 8)
+	nakama.NewInbox(cl, nil).WithHandler(func(_ context.Context, n *nakama.Notification) {
+		for i, subject := range subjects {
+			if n.Subject == subject {
+				time.Sleep(time.Duration(len(subjects)-i) * 5 * time.Millisecond)
+				orderCh <- n
+			}
+		}
+	}).Attach(conn)
+	for _, subject := range subjects {
+		if err := s.SendNotification(id, subject, `{}`, 1, "", true); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	for _, subject := range subjects {
+		if n := recv(ctx, t, orderCh); n.Subject != subject {
+			t.Errorf("expected notification %s, got: %v", subject, n)
+		}
+	}
+}
+
+func TestNotificationRouter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	id1, id2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	type reward struct {
+		Coins int `json:"coins"`
+	}
+	friendCh, rewardCh := make(chan string, 1), make(chan int, 1)
+	fallbackCh, errCh := make(chan int32, 1), make(chan error, 1)
+	r := nakama.NewNotificationRouter().
+		WithFallbackHandler(func(_ context.Context, n *nakama.Notification) {
+			fallbackCh <- n.Code
+		}).
+		WithErrorHandler(func(_ context.Context, _ *nakama.Notification, err error) {
+			errCh <- err
+		})
+	nakama.HandleNotification(r, nakama.NotificationFriendRequest, func(_ context.Context, n *nakama.Notification, v map[string]string) {
+		if n.SenderId != id2 {
+			t.Errorf("expected sender %s, got: %s", id2, n.SenderId)
+		}
+		friendCh <- v["username"]
+	})
+	nakama.HandleNotification(r, 100, func(_ context.Context, _ *nakama.Notification, v *reward) {
+		rewardCh <- v.Coins
+	})
+	if codes := r.Codes(); fmt.Sprint(codes) != "[-2 100]" {
+		t.Errorf("expected codes [-2 100], got: %v", codes)
+	}
+	conn := newConn(ctx, t, cl1)
+	defer conn.Close()
+	r.Attach(conn)
+	if err := cl2.AddFriends(ctx, id1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	res, err := cl2.Account(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if username := recv(ctx, t, friendCh); username != res.User.Username {
+		t.Errorf("expected username %s, got: %s", res.User.Username, username)
+	}
+	if err := s.SendNotification(id1, "reward", `{"coins":5}`, 100, "", false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if coins := recv(ctx, t, rewardCh); coins != 5 {
+		t.Errorf("expected 5 coins, got: %d", coins)
+	}
+	// content that cannot be decoded is passed to the error handler
+	if err := s.SendNotification(id1, "reward", `{"coins":"five"}`, 100, "", false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := recv(ctx, t, errCh); err == nil {
+		t.Errorf("expected error")
+	}
+	// unregistered codes are passed to the fallback handler
+	if err := s.SendNotification(id1, "other", `{}`, 200, "", false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if code := recv(ctx, t, fallbackCh); code != 200 {
+		t.Errorf("expected code 200, got: %d", code)
+	}
+	// notifications are routed in the order received, even when a handler is
+	// slower for earlier notifications
+	orderCh := make(chan int, 5)
+	nakama.HandleNotification(r, 300, func(_ context.Context, _ *nakama.Notification, v *reward) {
+		time.Sleep(time.Duration(5-v.Coins) * 5 * time.Millisecond)
+		orderCh <- v.Coins
+	})
+	for i := 0; i < 5; i++ {
+		if err := s.SendNotification(id1, "order", fmt.Sprintf(`{"coins":%d}`, i), 300, "", false); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if n := recv(ctx, t, orderCh); n != i {
+			t.Errorf("expected %d, got: %d", i, n)
+		}
+	}
+}
+
+func TestNotificationListeners(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	id1, id2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	conn := newConn(ctx, t, cl2)
+	defer conn.Close()
+	// an inbox, social graph and router share the connection
+	inboxCh, routerCh := make(chan int32, 2), make(chan int32, 2)
+	inbox := nakama.NewInbox(cl2, nil).WithHandler(func(_ context.Context, n *nakama.Notification) {
+		inboxCh <- n.Code
+	})
+	detach := inbox.Attach(conn)
+	g := nakama.NewSocialGraph(cl2)
+	g.Attach(conn)
+	nakama.NewNotificationRouter().WithFallbackHandler(func(_ context.Context, n *nakama.Notification) {
+		routerCh <- n.Code
+	}).Attach(conn)
+	if err := cl1.AddFriends(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if code := recv(ctx, t, inboxCh); code != nakama.NotificationFriendRequest {
+		t.Errorf("expected friend request, got: %d", code)
+	}
+	if code := recv(ctx, t, routerCh); code != nakama.NotificationFriendRequest {
+		t.Errorf("expected friend request, got: %d", code)
+	}
+	waitFor(ctx, t, func() bool {
+		state, _ := g.State(id1)
+		return state == nakama.FriendState_INVITE_RECEIVED
+	})
+	// detached listeners no longer receive notifications
+	detach()
+	if err := s.SendNotification(id2, "reward", `{}`, 100, "", false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if code := recv(ctx, t, routerCh); code != 100 {
+		t.Errorf("expected code 100, got: %d", code)
+	}
+	select {
+	case code := <-inboxCh:
+		t.Errorf("expected no inbox notification, got: %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSocialGraph(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	id1, id2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	g1, g2 := nakama.NewSocialGraph(cl1), nakama.NewSocialGraph(cl2)
+	conn1 := newConn(ctx, t, cl1)
+	defer conn1.Close()
+	g1.Attach(conn1)
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	g2.Attach(conn2)
+	if err := g1.Load(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// requests are tracked by both users
+	if err := g1.SendRequest(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if friends := g1.InvitesSent(); len(friends) != 1 || friends[0].User.Username == "" {
+		t.Errorf("expected 1 sent invite with a username, got: %v", friends)
+	}
+	waitFor(ctx, t, func() bool {
+		return len(g2.InvitesReceived()) != 0
+	})
+	if friends := g2.InvitesReceived(); len(friends) != 1 || friends[0].User.Id != id1 {
+		t.Errorf("expected 1 received invite from %s, got: %v", id1, friends)
+	}
+	if err := g2.Accept(ctx, id1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	waitFor(ctx, t, func() bool {
+		return len(g1.Mutual()) != 0
+	})
+	if len(g1.Mutual()) != 1 || len(g2.Mutual()) != 1 {
+		t.Errorf("expected mutual friends, got: %v %v", g1.Mutual(), g2.Mutual())
+	}
+	if err := g1.Load(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if state, ok := g1.State(id2); !ok || state != nakama.FriendState_FRIEND {
+		t.Errorf("expected friend, got: %v %t", state, ok)
+	}
+	// failed actions are rolled back
+	canceled, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	if err := g1.Remove(canceled, id2); err == nil {
+		t.Errorf("expected error")
+	}
+	if state, ok := g1.State(id2); !ok || state != nakama.FriendState_FRIEND {
+		t.Errorf("expected friend, got: %v %t", state, ok)
+	}
+	if err := g1.Block(ctx, "invalid"); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, ok := g1.State("invalid"); ok {
+		t.Errorf("expected invalid user to be removed")
+	}
+	if err := g1.Block(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := g2.Load(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(g1.Blocked()) != 1 || len(g2.Mutual()) != 0 {
+		t.Errorf("expected blocked, got: %v %v", g1.Blocked(), g2.Mutual())
+	}
+	// only received requests are accepted
+	if err := g1.Accept(ctx, id2); !errors.Is(err, nakama.ErrFriendRequestNotReceived) {
+		t.Errorf("expected friend request not received error, got: %v", err)
+	}
+	if state, ok := g1.State(id2); !ok || state != nakama.FriendState_BLOCKED {
+		t.Errorf("expected blocked, got: %v %t", state, ok)
+	}
+	// rollbacks keep updates received while the request was in flight
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/v2/friend" {
+			started <- struct{}{}
+			<-release
+			return nil, errors.New("network is unreachable")
+		}
+		return tr.RoundTrip(req)
+	})
+	cl3 := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithRetryPolicy(nil))...)
+	if err := cl3.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	id3 := accountId(ctx, t, cl3)
+	g3 := nakama.NewSocialGraph(cl3)
+	conn3 := newConn(ctx, t, cl3)
+	defer conn3.Close()
+	g3.Attach(conn3)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- g3.SendRequest(ctx, id1)
+	}()
+	<-started
+	if err := cl1.AddFriends(ctx, id3); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	waitFor(ctx, t, func() bool {
+		state, _ := g3.State(id1)
+		return state == nakama.FriendState_INVITE_RECEIVED
+	})
+	close(release)
+	if err := recv(ctx, t, errCh); err == nil {
+		t.Errorf("expected error")
+	}
+	if state, ok := g3.State(id1); !ok || state != nakama.FriendState_INVITE_RECEIVED {
+		t.Errorf("expected invite received, got: %v %t", state, ok)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	id2 := accountId(ctx, t, cl2)
+	g, err := cl1.CreateGroup(ctx, nakama.CreateGroup().WithName("knights").WithOpen(false))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := cl2.CreateGroup(ctx, nakama.CreateGroup().WithName("Knights")); !isCode(err, nakama.CodeAlreadyExists) {
+		t.Errorf("expected already exists error, got: %v", err)
+	}
+	if err := cl2.JoinGroup(ctx, g.Id); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkGroupUser(ctx, t, cl1, g.Id, id2, nakama.UserRoleState_JOIN_REQUEST)
+	if err := cl2.AddGroupUsers(ctx, g.Id, id2); !isCode(err, nakama.CodePermissionDenied) {
+		t.Errorf("expected permission denied error, got: %v", err)
+	}
+	if err := cl1.AddGroupUsers(ctx, g.Id, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkGroupUser(ctx, t, cl1, g.Id, id2, nakama.UserRoleState_MEMBER)
+	if err := cl1.PromoteGroupUsers(ctx, g.Id, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkGroupUser(ctx, t, cl1, g.Id, id2, nakama.UserRoleState_ADMIN)
+	res, err := cl2.UserGroups(ctx, id2)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.UserGroups) != 1 || res.UserGroups[0].Group.EdgeCount != 2:
+		t.Errorf("expected 1 group with 2 members, got: %v", res.UserGroups)
+	}
+	if err := cl1.LeaveGroup(ctx, g.Id); !isCode(err, nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", err)
+	}
+	if err := cl1.DeleteGroup(ctx, g.Id); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	groups, err := cl1.Groups(ctx, nakama.Groups())
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(groups.Groups) != 0:
+		t.Errorf("expected no groups, got: %d", len(groups.Groups))
+	}
+}
+
+func TestGroupHandle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	id1, id2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	g1, err := cl1.CreateGroupHandle(ctx, nakama.CreateGroup().WithName("knights").WithOpen(false))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if role, ok := g1.SelfRole(); !ok || role != nakama.UserRoleState_SUPERADMIN {
+		t.Errorf("expected superadmin, got: %v %t", role, ok)
+	}
+	// join requests are tracked and accepted
+	g2 := nakama.NewGroupHandle(cl2, g1.Group())
+	if err := g2.Join(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if role, ok := g2.SelfRole(); !ok || role != nakama.UserRoleState_JOIN_REQUEST {
+		t.Errorf("expected join request, got: %v %t", role, ok)
+	}
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	if _, err := g2.JoinChannel(ctx, conn2); !errors.Is(err, nakama.ErrGroupNotMember) {
+		t.Errorf("expected not member error, got: %v", err)
+	}
+	if err := g1.Load(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if requests := g1.Requests(); len(requests) != 1 || requests[0].User.Id != id2 {
+		t.Errorf("expected request from %s, got: %v", id2, requests)
+	}
+	if err := g1.Accept(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if members := g1.Members(); len(members) != 2 || len(g1.Requests()) != 0 {
+		t.Errorf("expected 2 members, got: %v", members)
+	}
+	// updates are applied to the cached group
+	if err := g1.Update(ctx, nakama.UpdateGroup("").WithDescription("round table").WithOpen(true)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if group := g1.Group(); group.Name != "knights" || group.Description != "round table" || !group.Open.GetValue() {
+		t.Errorf("expected updated group, got: %v", group)
+	}
+	// roles are checked before moderating
+	if err := g2.Load(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := g2.Kick(ctx, id1); !errors.Is(err, nakama.ErrGroupPermissionDenied) {
+		t.Errorf("expected permission denied error, got: %v", err)
+	}
+	if err := g1.Promote(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkGroupUser(ctx, t, cl1, g1.Id(), id2, nakama.UserRoleState_ADMIN)
+	if err := g2.Load(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := g2.Kick(ctx, id1); !errors.Is(err, nakama.ErrGroupPermissionDenied) {
+		t.Errorf("expected permission denied error, got: %v", err)
+	}
+	if err := g2.Delete(ctx); !errors.Is(err, nakama.ErrGroupPermissionDenied) {
+		t.Errorf("expected permission denied error, got: %v", err)
+	}
+	// members can join the group channel
+	ch, err := g2.JoinChannel(ctx, conn2)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case ch.GroupId() != g1.Id():
+		t.Errorf("expected group channel %s, got: %s", g1.Id(), ch.GroupId())
+	}
+	if err := g1.Demote(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if role, _ := g1.Role(id2); role != nakama.UserRoleState_MEMBER {
+		t.Errorf("expected member, got: %v", role)
+	}
+	if err := g1.Kick(ctx, id2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if members := g1.Members(); len(members) != 1 {
+		t.Errorf("expected 1 member, got: %v", members)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	if err := s.CreateLeaderboard(&nakama.Leaderboard{
+		Id:        "weekly",
+		SortOrder: SortOrderDescending,
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var ids []string
+	for i, score := range []int64{10, 30, 20} {
+		cl := newClient(ctx, t, s)
+		ids = append(ids, accountId(ctx, t, cl))
+		if _, err := cl.WriteLeaderboardRecord(ctx, nakama.WriteLeaderboardRecord("weekly").WithScore(score)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if i != 0 {
+			continue
+		}
+		// best operator keeps the best score
+		rec, err := cl.WriteLeaderboardRecord(ctx, nakama.WriteLeaderboardRecord("weekly").WithScore(5))
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case rec.Score != score || rec.NumScore != 2:
+			t.Errorf("expected score %d with 2 submissions, got: %d %d", score, rec.Score, rec.NumScore)
+		}
+	}
+	cl := newClient(ctx, t, s)
+	res, err := cl.LeaderboardRecords(ctx, nakama.LeaderboardRecords("weekly").WithLimit(2).WithOwnerIds(ids[0]))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.Records) != 2:
+		t.Fatalf("expected 2 records, got: %d", len(res.Records))
+	case res.Records[0].OwnerId != ids[1] || res.Records[0].Rank != 1:
+		t.Errorf("expected %s ranked first, got: %s (%d)", ids[1], res.Records[0].OwnerId, res.Records[0].Rank)
+	case res.NextCursor == "":
+		t.Errorf("expected non-empty next cursor")
+	case len(res.OwnerRecords) != 1 || res.OwnerRecords[0].Rank != 3:
+		t.Errorf("expected owner record ranked 3, got: %v", res.OwnerRecords)
+	}
+	res, err = cl.LeaderboardRecords(ctx, nakama.LeaderboardRecords("weekly").WithLimit(2).WithCursor(res.NextCursor))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.Records) != 1 || res.Records[0].OwnerId != ids[0]:
+		t.Errorf("expected last record to be %s, got: %v", ids[0], res.Records)
+	}
+	if err := s.CreateTournament(&nakama.Tournament{
+		Id:        "cup",
+		SortOrder: SortOrderDescending,
+		MaxSize:   1,
+	}, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := cl.WriteTournamentRecord(ctx, nakama.WriteTournamentRecord("cup").WithScore(1)); !isCode(err, nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", err)
+	}
+	if err := cl.JoinTournament(ctx, "cup"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := cl.WriteTournamentRecord(ctx, nakama.WriteTournamentRecord("cup").WithScore(1)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tournaments, err := cl.Tournaments(ctx, nakama.Tournaments())
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(tournaments.Tournaments) != 1 || tournaments.Tournaments[0].Size != 1 || tournaments.Tournaments[0].CanEnter:
+		t.Errorf("expected 1 full tournament, got: %v", tournaments.Tournaments)
+	}
+	if err := newClient(ctx, t, s).JoinTournament(ctx, "cup"); !isCode(err, nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", err)
+	}
+	if err := cl.DeleteTournamentRecord(ctx, "cup"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if records, err := cl.TournamentRecords(ctx, nakama.TournamentRecords("cup")); err != nil || len(records.Records) != 0 {
+		t.Errorf("expected no tournament records, got: %v %v", records, err)
+	}
+}
+
+func TestRpc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New(WithRpc("echo", func(_ context.Context, userId, payload string) (string, error) {
+		if userId == "" {
+			return "", errors.New("user required")
+		}
+		return payload, nil
+	}))
+	defer s.Close()
+	cl := newClient(ctx, t, s)
+	var res map[string]string
+	if err := cl.Rpc(ctx, "echo", map[string]string{"a": "b"}, &res); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res["a"] != "b" {
+		t.Errorf("expected a == b, got: %v", res)
+	}
+	if err := nakama.Rpc("echo", nil, nil).WithHttpKey(s.HttpKey()).Do(ctx, cl); !isCode(err, nakama.CodeInternal) {
+		t.Errorf("expected internal error, got: %v", err)
+	}
+	if err := cl.Rpc(ctx, "missing", nil, nil); !isCode(err, nakama.CodeNotFound) {
+		t.Errorf("expected not found error, got: %v", err)
+	}
+	conn, err := cl.NewConn(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer conn.Close()
+	res = nil
+	if err := conn.Rpc(ctx, "echo", map[string]string{"c": "d"}, &res); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res["c"] != "d" {
+		t.Errorf("expected c == d, got: %v", res)
+	}
+}
+
+func TestRpcCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var payloads []string
+	var mu sync.Mutex
+	s := New(WithRpc("echo", func(_ context.Context, userId, payload string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		payloads = append(payloads, payload)
+		return payload, nil
+	}))
+	defer s.Close()
+	type point struct {
+		X int `json:"x" msgpack:"x"`
+		Y int `json:"y" msgpack:"y"`
+	}
+	cl := newClient(ctx, t, s)
+	conn := newConn(ctx, t, cl)
+	defer conn.Close()
+	for _, codec := range []nakama.Codec{nakama.JsonCodec{}, nakama.MsgpackCodec{}} {
+		call := nakama.NewRpcCall[point, point]("echo", codec)
+		if res, err := call.Do(ctx, cl, point{1, 2}); err != nil || res != (point{1, 2}) {
+			t.Errorf("%T: expected {1 2} and no error, got: %v %v", codec, res, err)
+		}
+		if res, err := call.Send(ctx, conn, point{3, 4}); err != nil || res != (point{3, 4}) {
+			t.Errorf("%T: expected {3 4} and no error, got: %v %v", codec, res, err)
+		}
+	}
+	for _, codec := range []nakama.Codec{nakama.ProtojsonCodec{}, nakama.ProtoCodec{}} {
+		call := nakama.NewRpcCall[*nakama.AccountDevice, *nakama.AccountDevice]("echo", codec)
+		for _, res := range []func(*nakama.AccountDevice) (*nakama.AccountDevice, error){
+			func(req *nakama.AccountDevice) (*nakama.AccountDevice, error) { return call.Do(ctx, cl, req) },
+			func(req *nakama.AccountDevice) (*nakama.AccountDevice, error) { return call.Send(ctx, conn, req) },
+		} {
+			switch res, err := res(&nakama.AccountDevice{Id: "device"}); {
+			case err != nil:
+				t.Errorf("%T: expected no error, got: %v", codec, err)
+			case res.Id != "device":
+				t.Errorf("%T: expected device, got: %v", codec, res)
+			}
+		}
+	}
+	// registered codec applies to untyped calls
+	nakama.RegisterRpcCodec("echo", nakama.MsgpackCodec{})
+	defer nakama.RegisterRpcCodec("echo", nil)
+	var res point
+	if err := cl.Rpc(ctx, "echo", point{5, 6}, &res); err != nil || res != (point{5, 6}) {
+		t.Errorf("expected {5 6} and no error, got: %v %v", res, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if exp := []string{`{"x":1,"y":2}`, `{"x":3,"y":4}`}; fmt.Sprint(payloads[:2]) != fmt.Sprint(exp) {
+		t.Errorf("expected %v, got: %v", exp, payloads[:2])
+	}
+	if p := payloads[len(payloads)-1]; strings.HasPrefix(p, "{") {
+		t.Errorf("expected msgpack payload, got: %s", p)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	for _, format := range []string{"json", "protobuf"} {
+		t.Run(format, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			s := New()
+			defer s.Close()
+			cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+			conn1 := newConn(ctx, t, cl1, nakama.WithConnFormat(format))
+			defer conn1.Close()
+			conn2 := newConn(ctx, t, cl2, nakama.WithConnFormat(format))
+			defer conn2.Close()
+			recv := make(chan *nakama.ChannelMessage, 1)
+			conn2.ChannelMessageHandler = func(_ context.Context, msg *nakama.ChannelMessage) {
+				recv <- msg
+			}
+			ch1, err := conn1.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, true, false)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			ch2, err := conn2.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, true, false)
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case ch1.Id != ch2.Id:
+				t.Errorf("expected ch1.Id == ch2.Id")
+			case len(ch2.Presences) != 2:
+				t.Errorf("expected 2 presences, got: %d", len(ch2.Presences))
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := conn1.ChannelMessageSend(ctx, ch1.Id, map[string]int{"i": i}); err != nil {
+					t.Fatalf("expected no error, got: %v", err)
+				}
+				select {
+				case <-ctx.Done():
+					t.Fatalf("did not receive message: %v", ctx.Err())
+				case msg := <-recv:
+					if exp := fmt.Sprintf(`{"i":%d}`, i); msg.Content != exp {
+						t.Errorf("expected %s, got: %s", exp, msg.Content)
+					}
+				}
+			}
+			res, err := cl2.ChannelMessages(ctx, nakama.ChannelMessages(ch1.Id).WithLimit(2).WithForward(false))
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case len(res.Messages) != 2 || res.Messages[0].Content != `{"i":2}`:
+				t.Fatalf("expected 2 messages newest first, got: %v", res.Messages)
+			case res.NextCursor == "":
+				t.Fatalf("expected non-empty next cursor")
+			}
+			res, err = cl2.ChannelMessages(ctx, nakama.ChannelMessages(ch1.Id).WithLimit(2).WithCursor(res.NextCursor))
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case len(res.Messages) != 1 || res.Messages[0].Content != `{"i":0}`:
+				t.Errorf("expected oldest message, got: %v", res.Messages)
+			}
+			if _, err := conn1.ChannelMessageSend(ctx, "2...other", map[string]int{}); err == nil {
+				t.Errorf("expected error sending to unjoined channel")
+			}
+		})
+	}
+}
+
+func TestChannel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	conn1 := newConn(ctx, t, cl1, nakama.WithConnPersist(true), nakama.WithConnBackoff(200*time.Millisecond, time.Second, 1.5))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	other, err := conn2.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, true, false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var ids []string
+	for i := 1; i <= 2; i++ {
+		ack, err := conn2.ChannelMessageSend(ctx, other.Id, map[string]int{"n": i})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		ids = append(ids, ack.MessageId)
+	}
+	// history is retrieved when joined
+	rec := newChannelRecorder()
+	ch, err := conn1.JoinChannel(ctx, nakama.ChannelJoin("lobby", nakama.ChannelType_ROOM).WithPersistence(true), rec)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case ch.Id() != other.Id || ch.RoomName() != "lobby":
+		t.Errorf("expected channel %s, got: %s", other.Id, ch.Id())
+	case len(ch.Messages()) != 2 || ch.Messages()[0].MessageId != ids[0]:
+		t.Errorf("expected 2 messages, got: %v", ch.Messages())
+	case len(ch.Presences()) != 2:
+		t.Errorf("expected 2 presences, got: %v", ch.Presences())
+	}
+	// messages, updates and removals are applied in place
+	if _, err := conn2.ChannelMessageSend(ctx, other.Id, map[string]int{"n": 3}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, rec.msgs); msg.Content != `{"n":3}` {
+		t.Errorf("expected message 3, got: %s", msg.Content)
+	}
+	if _, err := conn2.ChannelMessageUpdate(ctx, other.Id, ids[0], map[string]int{"n": 10}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	recv(ctx, t, rec.updates)
+	if _, err := conn2.ChannelMessageRemove(ctx, other.Id, ids[1]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	recv(ctx, t, rec.removes)
+	if msgs := ch.Messages(); len(msgs) != 2 || msgs[0].Content != `{"n":10}` || msgs[1].Content != `{"n":3}` {
+		t.Errorf("expected updated messages, got: %v", msgs)
+	}
+	// presences are tracked
+	conn3 := newConn(ctx, t, newClient(ctx, t, s))
+	if _, err := conn3.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, true, false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if ev := recv(ctx, t, rec.presences); len(ev.Joins) != 1 {
+		t.Errorf("expected join, got: %v", ev)
+	}
+	conn3.Close()
+	if ev := recv(ctx, t, rec.presences); len(ev.Leaves) != 1 || len(ch.Presences()) != 2 {
+		t.Errorf("expected leave, got: %v %v", ev, ch.Presences())
+	}
+	// messages missed while disconnected are retrieved after a reconnect
+	s.DisconnectSessions(cl1.SessionUserId())
+	if _, err := conn2.ChannelMessageSend(ctx, other.Id, map[string]int{"n": 4}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, rec.msgs); msg.Content != `{"n":4}` {
+		t.Errorf("expected message 4, got: %s", msg.Content)
+	}
+	if msgs := ch.Messages(); len(msgs) != 3 || msgs[2].Content != `{"n":4}` {
+		t.Errorf("expected 3 messages, got: %v", msgs)
+	}
+	// closed channels no longer route messages
+	if err := ch.Close(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := conn2.ChannelMessageSend(ctx, other.Id, map[string]int{"n": 5}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case msg := <-rec.msgs:
+		t.Errorf("expected no message, got: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestChannelBackfill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	conn1 := newConn(ctx, t, cl1, nakama.WithConnPersist(true), nakama.WithConnBackoff(200*time.Millisecond, time.Second, 1.5))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	other, err := conn2.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, true, false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var ids []string
+	for i := 1; i <= 101; i++ {
+		ack, err := conn2.ChannelMessageSend(ctx, other.Id, map[string]int{"n": i})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		ids = append(ids, ack.MessageId)
+	}
+	// a page of history is retrieved when joined, and is not dispatched
+	rec := newChannelRecorder()
+	ch, err := conn1.JoinChannel(ctx, nakama.ChannelJoin("lobby", nakama.ChannelType_ROOM).WithPersistence(true), rec)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(ch.Messages()) != 100 || ch.Messages()[0].MessageId != ids[1]:
+		t.Errorf("expected 100 messages, got: %d", len(ch.Messages()))
+	}
+	select {
+	case msg := <-rec.msgs:
+		t.Errorf("expected no message, got: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// removing the known messages does not extend the backfill past them
+	for _, id := range ids[1:] {
+		if _, err := conn2.ChannelMessageRemove(ctx, other.Id, id); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		recv(ctx, t, rec.removes)
+	}
+	if msgs := ch.Messages(); len(msgs) != 0 {
+		t.Errorf("expected no messages, got: %v", msgs)
+	}
+	s.DisconnectSessions(cl1.SessionUserId())
+	if _, err := conn2.ChannelMessageSend(ctx, other.Id, map[string]int{"n": 102}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, rec.msgs); msg.Content != `{"n":102}` {
+		t.Errorf("expected message 102, got: %s", msg.Content)
+	}
+	select {
+	case msg := <-rec.msgs:
+		t.Errorf("expected no message, got: %s", msg.Content)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if msgs := ch.Messages(); len(msgs) != 1 {
+		t.Errorf("expected 1 message, got: %v", msgs)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	conn1 := newConn(ctx, t, cl1)
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	joinCh := make(chan *nakama.MatchPresenceEventMsg, 1)
+	conn1.MatchPresenceEventHandler = func(_ context.Context, msg *nakama.MatchPresenceEventMsg) {
+		joinCh <- msg
+	}
+	dataCh := make(chan *nakama.MatchDataMsg, 1)
+	conn2.MatchDataHandler = func(_ context.Context, msg *nakama.MatchDataMsg) {
+		dataCh <- msg
+	}
+	m1, err := conn1.MatchCreate(ctx, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m2, err := conn2.MatchJoin(ctx, m1.MatchId, nil)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case m2.Size != 2 || len(m2.Presences) != 1:
+		t.Errorf("expected size 2 with 1 other presence, got: %d %d", m2.Size, len(m2.Presences))
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive join: %v", ctx.Err())
+	case msg := <-joinCh:
+		if len(msg.Joins) != 1 || msg.Joins[0].SessionId != m2.Self.SessionId {
+			t.Errorf("expected join for %s, got: %v", m2.Self.SessionId, msg.Joins)
+		}
+	}
+	if err := conn1.MatchDataSend(ctx, m1.MatchId, 1, []byte("hello world"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive data: %v", ctx.Err())
+	case msg := <-dataCh:
+		if string(msg.Data) != "hello world" || msg.Presence.SessionId != m1.Self.SessionId {
+			t.Errorf("expected hello world from %s, got: %q %v", m1.Self.SessionId, msg.Data, msg.Presence)
+		}
+	}
+	if _, err := conn1.MatchJoin(ctx, uuid.New().String()+".", nil); err == nil {
+		t.Errorf("expected error joining missing match")
+	}
+	res, err := cl1.Matches(ctx, nakama.Matches().WithLimit(10))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.Matches) != 1 || res.Matches[0].Size != 2:
+		t.Errorf("expected 1 match of size 2, got: %v", res.Matches)
+	}
+}
+
+func TestMatchHandle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	conn1 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn2.Close()
+	rec1, rec2 := newMatchRecorder(), newMatchRecorder()
+	m1, err := conn1.CreateMatch(ctx, "", rec1)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+	m2, err := conn2.JoinMatch(ctx2, nakama.MatchJoin(m1.Id()), rec2)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case m2.Id() != m1.Id():
+		t.Errorf("expected match %s, got: %s", m1.Id(), m2.Id())
+	case len(m2.Presences()) != 2 || m2.Presence(m2.Self().SessionId) == nil:
+		t.Errorf("expected 2 presences including self, got: %v", m2.Presences())
+	}
+	// presences are tracked
+	if ev := recv(ctx, t, rec1.presences); len(ev.Joins) != 1 || len(m1.Presences()) != 2 {
+		t.Errorf("expected join, got: %v %v", ev, m1.Presences())
+	}
+	// data is routed to the match
+	if err := m1.Send(ctx, 1, []byte("hello"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, rec2.data); string(msg.Data) != "hello" || msg.Presence.SessionId != m1.Self().SessionId {
+		t.Errorf("expected hello from %s, got: %q %v", m1.Self().SessionId, msg.Data, msg.Presence)
+	}
+	if err := m2.SendTo(ctx, 2, []byte("world"), true, m1.Self()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, rec1.data); string(msg.Data) != "world" || msg.OpCode != 2 {
+		t.Errorf("expected world, got: %d %q", msg.OpCode, msg.Data)
+	}
+	// data for other matches is filtered
+	other, err := conn1.MatchCreate(ctx, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn1.MatchDataSend(ctx, other.MatchId, 3, []byte("other"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// the join context does not bound the match
+	cancel2()
+	select {
+	case <-m2.Done():
+		t.Fatalf("expected match to remain joined")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := len(m1.Presences()); n != 2 {
+		t.Errorf("expected 2 presences, got: %d", n)
+	}
+	// closing the leave context leaves the match
+	leaveCtx, leaveCancel := context.WithCancel(ctx)
+	m2.WithLeaveOnCancel(leaveCtx)
+	leaveCancel()
+	select {
+	case <-m2.Done():
+	case <-ctx.Done():
+		t.Fatalf("expected match to be closed")
+	}
+	if ev := recv(ctx, t, rec1.presences); len(ev.Leaves) != 1 || len(m1.Presences()) != 1 {
+		t.Errorf("expected leave, got: %v %v", ev, m1.Presences())
+	}
+	select {
+	case msg := <-rec1.data:
+		t.Errorf("expected no data, got: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// closing leaves the match
+	if err := m1.Close(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-m1.Done():
+	default:
+		t.Errorf("expected match to be closed")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	conn1 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn2.Close()
+	type move struct {
+		X, Y int
+	}
+	moveCh, presenceCh := make(chan move, 1), make(chan *nakama.UserPresenceMsg, 1)
+	unknownCh, errCh := make(chan int64, 1), make(chan error, 1)
+	r1, r2 := nakama.NewRouter(), nakama.NewRouter().
+		WithUnknownHandler(func(_ context.Context, msg *nakama.DataMsg) {
+			unknownCh <- msg.OpCode
+		}).
+		WithErrorHandler(func(_ context.Context, _ *nakama.DataMsg, err error) {
+			errCh <- err
+		})
+	moveOp := nakama.NewOp[move](r1, 1)
+	nakama.NewOp[move](r2, 1).Handle(func(_ context.Context, _ *nakama.DataMsg, v move) {
+		moveCh <- v
+	})
+	presenceOp := nakama.NewOp[*nakama.UserPresenceMsg](r1, 2).WithCodec(nakama.ProtoBinaryCodec{})
+	nakama.NewOp[*nakama.UserPresenceMsg](r2, 2).WithCodec(nakama.ProtoBinaryCodec{}).Handle(func(_ context.Context, _ *nakama.DataMsg, v *nakama.UserPresenceMsg) {
+		presenceCh <- v
+	})
+	m1, err := conn1.CreateMatch(ctx, "", r1)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := conn2.JoinMatch(ctx, nakama.MatchJoin(m1.Id()), r2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// json and protobuf payloads are decoded
+	if err := moveOp.SendMatch(ctx, conn1, m1.Id(), move{X: 1, Y: 2}, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := recv(ctx, t, moveCh); v.X != 1 || v.Y != 2 {
+		t.Errorf("expected move 1,2, got: %v", v)
+	}
+	if err := presenceOp.SendMatch(ctx, conn1, m1.Id(), &nakama.UserPresenceMsg{Username: "bob"}, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := recv(ctx, t, presenceCh); v.Username != "bob" {
+		t.Errorf("expected bob, got: %v", v)
+	}
+	// unknown op codes and invalid payloads are passed to the hooks
+	if err := m1.Send(ctx, 3, []byte("unknown"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if opCode := recv(ctx, t, unknownCh); opCode != 3 {
+		t.Errorf("expected op code 3, got: %d", opCode)
+	}
+	if err := m1.Send(ctx, 1, []byte("{"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	recv(ctx, t, errCh)
+	// metrics are recorded per op code
+	if stats := r1.Stats(1); stats.Sent != 1 || stats.SentBytes != uint64(len(`{"X":1,"Y":2}`)) {
+		t.Errorf("expected 1 sent, got: %+v", stats)
+	}
+	if stats := r2.Stats(1); stats.Received != 2 || stats.Errors != 1 {
+		t.Errorf("expected 2 received with 1 error, got: %+v", stats)
+	}
+	if stats := r2.Stats(3); stats.Received != 1 || stats.Unhandled != 1 {
+		t.Errorf("expected 1 unhandled, got: %+v", stats)
+	}
+	if opCodes := r2.OpCodes(); len(opCodes) != 2 || opCodes[0] != 1 || opCodes[1] != 2 {
+		t.Errorf("expected op codes 1 and 2, got: %v", opCodes)
+	}
+}
+
+func TestConnInterceptor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	xor := func(data []byte) []byte {
+		v := make([]byte, len(data))
+		for i, c := range data {
+			v[i] = c ^ 0x5a
+		}
+		return v
+	}
+	// encrypt sent match data, dropping op code 2
+	conn1 := newConn(ctx, t, newClient(ctx, t, s), nakama.WithConnInterceptor(
+		func(ctx context.Context, env *nakama.Envelope, next nakama.ConnInterceptorFunc) error {
+			if msg := env.GetMatchDataSend(); msg != nil {
+				if msg.OpCode == 2 {
+					return nil
+				}
+				msg.Data = xor(msg.Data)
+			}
+			return next(ctx, env)
+		},
+		nil,
+	))
+	defer conn1.Close()
+	// decrypt received match data
+	var raw []byte
+	conn2 := newConn(ctx, t, newClient(ctx, t, s), nakama.WithConnInterceptor(
+		nil,
+		func(ctx context.Context, env *nakama.Envelope, next nakama.ConnInterceptorFunc) error {
+			if msg := env.GetMatchData(); msg != nil {
+				raw, msg.Data = msg.Data, xor(msg.Data)
+			}
+			return next(ctx, env)
+		},
+	))
+	defer conn2.Close()
+	dataCh := make(chan *nakama.MatchDataMsg, 1)
+	conn2.MatchDataHandler = func(_ context.Context, msg *nakama.MatchDataMsg) {
+		dataCh <- msg
+	}
+	m, err := conn1.MatchCreate(ctx, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := conn2.MatchJoin(ctx, m.MatchId, nil); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn1.MatchDataSend(ctx, m.MatchId, 2, []byte("dropped"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn1.MatchDataSend(ctx, m.MatchId, 1, []byte("hello world"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive data: %v", ctx.Err())
+	case msg := <-dataCh:
+		switch {
+		case msg.OpCode != 1 || string(msg.Data) != "hello world":
+			t.Errorf("expected op code 1 with hello world, got: %d %q", msg.OpCode, msg.Data)
+		case string(raw) == "hello world":
+			t.Errorf("expected encrypted data")
+		}
+	}
+	// dropped requests and responses return an error
+	conn3 := newConn(ctx, t, newClient(ctx, t, s), nakama.WithConnInterceptor(
+		func(ctx context.Context, env *nakama.Envelope, next nakama.ConnInterceptorFunc) error {
+			if env.GetMatchCreate() != nil {
+				return nil
+			}
+			return next(ctx, env)
+		},
+		func(ctx context.Context, env *nakama.Envelope, next nakama.ConnInterceptorFunc) error {
+			if env.GetStatus() != nil {
+				return nil
+			}
+			return next(ctx, env)
+		},
+	))
+	defer conn3.Close()
+	if _, err := conn3.MatchCreate(ctx, ""); !errors.Is(err, nakama.ErrEnvelopeDropped) {
+		t.Errorf("expected envelope dropped error, got: %v", err)
+	}
+	if _, err := conn3.StatusFollow(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, nakama.ErrEnvelopeDropped) {
+		t.Errorf("expected envelope dropped error, got: %v", err)
+	}
+	if _, err := conn3.MatchJoin(ctx, m.MatchId, nil); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestMatchmaker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var conns []*nakama.Conn
+	matchedCh := make(chan *nakama.MatchmakerMatchedMsg, 2)
+	for i := 0; i < 2; i++ {
+		conn := newConn(ctx, t, newClient(ctx, t, s))
+		defer conn.Close()
+		conn.MatchmakerMatchedHandler = func(_ context.Context, msg *nakama.MatchmakerMatchedMsg) {
+			matchedCh <- msg
+		}
+		conns = append(conns, conn)
+		if _, err := conn.MatchmakerAdd(ctx, nakama.MatchmakerAdd("*", 2, 2)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	var token string
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("did not receive matched: %v", ctx.Err())
+		case msg := <-matchedCh:
+			if len(msg.Users) != 2 || msg.GetToken() == "" {
+				t.Fatalf("expected 2 users and a token, got: %v", msg)
+			}
+			token = msg.GetToken()
+		}
+	}
+	for _, conn := range conns {
+		if _, err := conn.MatchJoinToken(ctx, token, nil); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func TestMatchmakerFind(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	conn1 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn2.Close()
+	// tickets are removed when the context is closed
+	findCtx, findCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer findCancel()
+	if _, err := nakama.NewMatchmaker(conn1).Find(findCtx, "*", 2, 2, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+	// matched matches are joined, including as a party
+	p, err := conn2.PartyCreate(ctx, true, 2)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	idCh := make(chan string, 1)
+	go func() {
+		m, err := nakama.NewMatchmaker(conn2).WithParty(p.PartyId).FindMatch(ctx, "*", 2, 2, map[string]interface{}{"mode": "duel"})
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+			idCh <- ""
+			return
+		}
+		idCh <- m.Id()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	matchCtx, matchCancel := context.WithCancel(ctx)
+	defer matchCancel()
+	m, err := nakama.NewMatchmaker(conn1).FindMatch(matchCtx, "*", 2, 2, map[string]interface{}{"mode": "duel", "skill": 10})
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case m.Id() == "":
+		t.Errorf("expected match id")
+	}
+	if id := recv(ctx, t, idCh); id != m.Id() {
+		t.Errorf("expected match %s, got: %s", m.Id(), id)
+	}
+	// found matches are left when the context is closed
+	matchCancel()
+	select {
+	case <-m.Done():
+	case <-ctx.Done():
+		t.Fatalf("expected match to be closed")
+	}
+	if _, err := nakama.NewMatchmaker(conn1).Find(ctx, "*", 2, 2, map[string]interface{}{"invalid": true}); err == nil {
+		t.Errorf("expected error for invalid property")
+	}
+}
+
+func TestParty(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	conn1 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn2.Close()
+	requestCh := make(chan *nakama.PartyJoinRequestMsg, 1)
+	conn1.PartyJoinRequestHandler = func(_ context.Context, msg *nakama.PartyJoinRequestMsg) {
+		requestCh <- msg
+	}
+	partyCh := make(chan *nakama.PartyMsg, 1)
+	conn2.PartyHandler = func(_ context.Context, msg *nakama.PartyMsg) {
+		partyCh <- msg
+	}
+	dataCh := make(chan *nakama.PartyDataMsg, 1)
+	conn2.PartyDataHandler = func(_ context.Context, msg *nakama.PartyDataMsg) {
+		dataCh <- msg
+	}
+	closeCh := make(chan *nakama.PartyCloseMsg, 1)
+	conn2.PartyCloseHandler = func(_ context.Context, msg *nakama.PartyCloseMsg) {
+		closeCh <- msg
+	}
+	p, err := conn1.PartyCreate(ctx, false, 2)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn2.PartyJoin(ctx, p.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var req *nakama.PartyJoinRequestMsg
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive join request: %v", ctx.Err())
+	case req = <-requestCh:
+	}
+	if err := conn1.PartyAccept(ctx, p.PartyId, req.Presences[0]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive party: %v", ctx.Err())
+	case msg := <-partyCh:
+		if msg.PartyId != p.PartyId || len(msg.Presences) != 2 {
+			t.Errorf("expected party %s with 2 presences, got: %v", p.PartyId, msg)
+		}
+	}
+	if err := conn1.PartyDataSend(ctx, p.PartyId, 1, []byte("hello world"), true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatalf("did not receive party data: %v", ctx.Err())
+	case msg := <-dataCh:
+		if string(msg.Data) != "hello world" {
+			t.Errorf("expected hello world, got: %q", msg.Data)
+		}
+	}
+	if err := conn2.PartyClose(ctx, p.PartyId); err == nil {
+		t.Errorf("expected error closing party as non-leader")
+	}
+	if err := conn1.PartyClose(ctx, p.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, closeCh); msg.PartyId != p.PartyId {
+		t.Errorf("expected party %s to be closed, got: %s", p.PartyId, msg.PartyId)
+	}
+}
+
+func TestPartyHandle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	conn1 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, newClient(ctx, t, s))
+	defer conn2.Close()
+	rec1, rec2 := newPartyRecorder(), newPartyRecorder()
+	p1, err := conn1.CreateParty(ctx, false, 3, rec1)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case !p1.IsLeader() || len(p1.Members()) != 1:
+		t.Errorf("expected leader with 1 member, got: %v %v", p1.Leader(), p1.Members())
+	}
+	// join requests are tracked and accepted
+	type joined struct {
+		p   *nakama.PartyHandle
+		err error
+	}
+	joinedCh := make(chan joined, 1)
+	go func() {
+		p, err := conn2.JoinParty(ctx, p1.Id(), rec2)
+		joinedCh <- joined{p, err}
+	}()
+	req := recv(ctx, t, rec1.requests)
+	if len(p1.Requests()) != 1 {
+		t.Errorf("expected 1 request, got: %v", p1.Requests())
+	}
+	if err := p1.Accept(ctx, req.Presences[0]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	j := recv(ctx, t, joinedCh)
+	if j.err != nil {
+		t.Fatalf("expected no error, got: %v", j.err)
+	}
+	p2 := j.p
+	if ev := recv(ctx, t, rec1.presences); len(ev.Joins) != 1 || len(p1.Members()) != 2 || len(p1.Requests()) != 0 {
+		t.Errorf("expected join, got: %v %v", ev, p1.Members())
+	}
+	if len(p2.Members()) != 2 || p2.IsLeader() {
+		t.Errorf("expected non-leader with 2 members, got: %v", p2.Members())
+	}
+	// leadership is validated locally
+	if err := p2.Remove(ctx, p1.Self()); !errors.Is(err, nakama.ErrPartyNotLeader) {
+		t.Errorf("expected not leader error, got: %v", err)
+	}
+	if err := p1.Promote(ctx, &nakama.UserPresenceMsg{SessionId: "missing"}); !errors.Is(err, nakama.ErrPartyNotMember) {
+		t.Errorf("expected not member error, got: %v", err)
+	}
+	// data is routed to the party
+	if err := p1.SendData(ctx, 1, []byte("hello")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if msg := recv(ctx, t, rec2.data); string(msg.Data) != "hello" {
+		t.Errorf("expected hello, got: %q", msg.Data)
+	}
+	// leader changes are tracked
+	if err := p1.Promote(ctx, p2.Self()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	recv(ctx, t, rec1.leaders)
+	recv(ctx, t, rec2.leaders)
+	if p1.IsLeader() || !p2.IsLeader() {
+		t.Errorf("expected leader %s, got: %v", p2.Self().SessionId, p2.Leader())
+	}
+	if err := p1.Close(ctx); !errors.Is(err, nakama.ErrPartyNotLeader) {
+		t.Errorf("expected not leader error, got: %v", err)
+	}
+	// closing notifies members
+	if err := p2.Close(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	recv(ctx, t, rec1.closes)
+	select {
+	case <-ctx.Done():
+		t.Fatalf("expected party to be closed, got: %v", ctx.Err())
+	case <-p1.Done():
+	}
+	if err := p1.SendData(ctx, 1, nil); !errors.Is(err, nakama.ErrPartyClosed) {
+		t.Errorf("expected closed error, got: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	userId1, userId2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	conn1 := newConn(ctx, t, cl1, nakama.WithConnPersist(true), nakama.WithConnBackoff(10*time.Millisecond, 50*time.Millisecond, 1.5))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	resultCh := make(chan *nakama.ReconnectResult, 5)
+	conn1.ReconnectHandler = func(_ context.Context, res *nakama.ReconnectResult) {
+		resultCh <- res
+	}
+	ch, err := conn1.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, false, false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m, err := conn1.MatchCreate(ctx, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := conn1.StatusFollow(ctx, userId2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	p, err := conn2.PartyCreate(ctx, true, 4)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn1.PartyJoin(ctx, p.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ticket, err := conn1.MatchmakerAdd(ctx, nakama.MatchmakerAdd("*", 2, 2))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	s.DisconnectSessions(userId1)
+	results := make(map[nakama.ReconnectType]*nakama.ReconnectResult)
+	for len(results) < 5 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("did not receive reconnect results, got: %v", results)
+		case res := <-resultCh:
+			results[res.Type] = res
+		}
+	}
+	if res := results[nakama.ReconnectChannel]; res.Id != ch.Id || res.State != nakama.ReconnectRejoined {
+		t.Errorf("expected channel %s rejoined, got: %s %s %v", ch.Id, res.Id, res.State, res.Err)
+	}
+	if res := results[nakama.ReconnectMatch]; res.Id != m.MatchId || res.State != nakama.ReconnectExpired {
+		t.Errorf("expected match %s expired, got: %s %s %v", m.MatchId, res.Id, res.State, res.Err)
+	}
+	if res := results[nakama.ReconnectStatus]; res.State != nakama.ReconnectRejoined {
+		t.Errorf("expected status rejoined, got: %s %v", res.State, res.Err)
+	}
+	if res := results[nakama.ReconnectParty]; res.Id != p.PartyId || res.State != nakama.ReconnectRejoined {
+		t.Errorf("expected party %s rejoined, got: %s %s %v", p.PartyId, res.Id, res.State, res.Err)
+	}
+	switch res := results[nakama.ReconnectMatchmaker]; {
+	case res.Id != ticket.Ticket || res.State != nakama.ReconnectRejoined:
+		t.Errorf("expected ticket %s rejoined, got: %s %s %v", ticket.Ticket, res.Id, res.State, res.Err)
+	case res.Res.(*nakama.MatchmakerTicketMsg).Ticket == ticket.Ticket:
+		t.Errorf("expected new ticket")
+	}
+	// restored state is restored again on the next reconnect
+	s.DisconnectSessions(userId1)
+	for i := 0; i < 4; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("did not receive reconnect result: %v", ctx.Err())
+		case res := <-resultCh:
+			if res.State != nakama.ReconnectRejoined {
+				t.Errorf("expected %s rejoined, got: %s %v", res.Type, res.State, res.Err)
+			}
+		}
+	}
+}
+
+func TestReconnectPending(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var lookups int32
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodGet && req.URL.Path == "/v2/user" {
+			atomic.AddInt32(&lookups, 1)
+		}
+		return tr.RoundTrip(req)
+	})
+	cl1 := s.Client(nakama.WithTransport(transport))
+	if err := cl1.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl2, cl3 := newClient(ctx, t, s), newClient(ctx, t, s)
+	userId1, userId2, userId3 := accountId(ctx, t, cl1), accountId(ctx, t, cl2), accountId(ctx, t, cl3)
+	account, err := cl2.Account(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	account3, err := cl3.Account(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	conn1 := newConn(ctx, t, cl1, nakama.WithConnPersist(true), nakama.WithConnBackoff(10*time.Millisecond, 50*time.Millisecond, 1.5))
+	defer conn1.Close()
+	conn2 := newConn(ctx, t, cl2)
+	defer conn2.Close()
+	resultCh := make(chan *nakama.ReconnectResult, 5)
+	conn1.ReconnectHandler = func(_ context.Context, res *nakama.ReconnectResult) {
+		resultCh <- res
+	}
+	partyCh := make(chan *nakama.PartyMsg, 1)
+	conn1.PartyHandler = func(_ context.Context, msg *nakama.PartyMsg) {
+		partyCh <- msg
+	}
+	ch, err := conn1.ChannelJoin(ctx, "lobby", nakama.ChannelType_ROOM, false, false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// follows by username are removed by user id, including for offline
+	// users, whose user ids are only looked up when restoring
+	if _, err := nakama.StatusFollow().WithUsernames(account.User.Username, account3.User.Username).Send(ctx, conn1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn1.StatusUnfollow(ctx, userId2, userId3); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 0 {
+		t.Errorf("expected no user lookups, got: %d", n)
+	}
+	// join requests are not restored
+	p, err := conn2.PartyCreate(ctx, false, 4)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn1.PartyJoin(ctx, p.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	s.DisconnectSessions(userId1)
+	if res := recv(ctx, t, resultCh); res.Type != nakama.ReconnectChannel || res.Id != ch.Id {
+		t.Errorf("expected channel %s, got: %s %s", ch.Id, res.Type, res.Id)
+	}
+	select {
+	case res := <-resultCh:
+		t.Errorf("expected no other reconnect result, got: %s %s", res.Type, res.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// accepted join requests are restored
+	if err := conn1.PartyJoin(ctx, p.PartyId); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	requests, err := conn2.PartyJoinRequests(ctx, p.PartyId)
+	if err != nil || len(requests.Presences) != 1 {
+		t.Fatalf("expected 1 join request, got: %v %v", requests, err)
+	}
+	if err := conn2.PartyAccept(ctx, p.PartyId, requests.Presences[0]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	recv(ctx, t, partyCh)
+	s.DisconnectSessions(userId1)
+	results := make(map[nakama.ReconnectType]*nakama.ReconnectResult)
+	for len(results) < 2 {
+		res := recv(ctx, t, resultCh)
+		results[res.Type] = res
+	}
+	if res := results[nakama.ReconnectParty]; res == nil || res.Id != p.PartyId || res.State != nakama.ReconnectRejoined {
+		t.Errorf("expected party %s rejoined, got: %v", p.PartyId, res)
+	}
+}
+
+func TestPresenceTracker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	cl1, cl2 := newClient(ctx, t, s), newClient(ctx, t, s)
+	userId1, userId2 := accountId(ctx, t, cl1), accountId(ctx, t, cl2)
+	conn1 := newConn(ctx, t, cl1, nakama.WithConnPersist(true), nakama.WithConnBackoff(200*time.Millisecond, time.Second, 1.5))
+	defer conn1.Close()
+	changeCh := make(chan *nakama.PresenceChange, 10)
+	tracker := nakama.NewPresenceTracker(conn1).WithChangeHandler(func(_ context.Context, change *nakama.PresenceChange) {
+		changeCh <- change
+	})
+	if err := tracker.Follow(ctx, userId2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if tracker.Online(userId2) {
+		t.Errorf("expected %s offline", userId2)
+	}
+	// sessions are tracked
+	conn2 := newConn(ctx, t, cl2, nakama.WithConnCreateStatus(true))
+	defer conn2.Close()
+	if change := recv(ctx, t, changeCh); !change.Online || change.UserId != userId2 {
+		t.Errorf("expected %s online, got: %+v", userId2, change)
+	}
+	conn3 := newConn(ctx, t, cl2)
+	defer conn3.Close()
+	if err := conn3.StatusUpdate(ctx, "busy"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if change := recv(ctx, t, changeCh); change.Status != "busy" || len(change.Presences) != 2 {
+		t.Errorf("expected busy with 2 sessions, got: %+v", change)
+	}
+	if err := nakama.StatusUpdate().Send(ctx, conn2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := conn3.StatusUpdate(ctx, "away"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if change := recv(ctx, t, changeCh); change.Status != "away" || len(change.Presences) != 1 {
+		t.Errorf("expected away with 1 session, got: %+v", change)
+	}
+	if !tracker.Online(userId2) || tracker.Status(userId2) != "away" {
+		t.Errorf("expected %s online and away, got: %t %q", userId2, tracker.Online(userId2), tracker.Status(userId2))
+	}
+	// status is refreshed after a reconnect
+	s.DisconnectSessions(userId1)
+	conn3.Close()
+	if change := recv(ctx, t, changeCh); change.Online {
+		t.Errorf("expected %s offline, got: %+v", userId2, change)
+	}
+	if err := tracker.Close(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if ids := tracker.UserIds(); len(ids) != 0 {
+		t.Errorf("expected no followed users, got: %v", ids)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	for _, store := range []nakama.SessionStore{
+		nakama.NewMemorySessionStore(),
+		nakama.NewFileSessionStore(filepath.Join(t.TempDir(), "nakama", "session.json")),
+	} {
+		opts := append(s.ClientOptions(), nakama.WithSessionStore(store))
+		cl := nakama.New(opts...)
+		if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		restored := nakama.New(opts...)
+		switch {
+		case restored.SessionToken() != cl.SessionToken():
+			t.Errorf("expected restored session token")
+		case restored.SessionRefreshToken() != cl.SessionRefreshToken():
+			t.Errorf("expected restored session refresh token")
+		case !restored.SessionWasCreated():
+			t.Errorf("expected restored session to have been created")
+		}
+		if _, err := restored.Account(ctx); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := restored.SessionLogout(ctx); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		switch session, err := store.Load(); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case session != nil:
+			t.Errorf("expected no session after logout, got: %v", session)
+		}
+		if token := nakama.New(opts...).SessionToken(); token != "" {
+			t.Errorf("expected no session, got: %q", token)
+		}
+	}
+	// sessions with an expired token are refreshed on first use
+	expired := New(WithTokenExpiry(1 * time.Second))
+	defer expired.Close()
+	opts := append(expired.ClientOptions(), nakama.WithExpiryGrace(0), nakama.WithSessionStore(nakama.NewMemorySessionStore()))
+	// proactive refresh would save a new token to the store
+	cl := nakama.New(append(opts, nakama.WithRefreshAuto(false))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	restored := nakama.New(opts...)
+	if !restored.SessionExpired() || restored.SessionRefreshExpired() {
+		t.Fatalf("expected restored session with expired token")
+	}
+	if _, err := restored.Account(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if restored.SessionToken() == cl.SessionToken() {
+		t.Errorf("expected refreshed session token")
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New(WithTokenExpiry(1 * time.Second))
+	defer s.Close()
+	// concurrent refreshes share a single request
+	var count int32
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/v2/account/session/refresh" {
+			atomic.AddInt32(&count, 1)
+		}
+		return tr.RoundTrip(req)
+	})
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithExpiryGrace(0), nakama.WithRefreshAuto(false))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	token := cl.SessionToken()
+	time.Sleep(1100 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cl.SessionRefresh(ctx); err != nil {
+				t.Errorf("expected no error, got: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("expected 1 refresh request, got: %d", n)
+	}
+	if cl.SessionToken() == token {
+		t.Errorf("expected refreshed session token")
+	}
+	// a caller's cancellation does not fail the shared refresh
+	started, release := make(chan struct{}), make(chan struct{})
+	transport = roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/v2/account/session/refresh" {
+			close(started)
+			<-release
+		}
+		return tr.RoundTrip(req)
+	})
+	cl = nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithExpiryGrace(0), nakama.WithRefreshAuto(false))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	token = cl.SessionToken()
+	time.Sleep(1100 * time.Millisecond)
+	leaderCtx, leaderCancel := context.WithCancel(ctx)
+	leaderErr, waiterErr := make(chan error, 1), make(chan error, 1)
+	go func() {
+		leaderErr <- cl.SessionRefresh(leaderCtx)
+	}()
+	<-started
+	go func() {
+		waiterErr <- cl.SessionRefresh(ctx)
+	}()
+	leaderCancel()
+	if err := recv(ctx, t, leaderErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	close(release)
+	if err := recv(ctx, t, waiterErr); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if cl.SessionToken() == token {
+		t.Errorf("expected refreshed session token")
+	}
+	// sessions are refreshed in the background before expiry
+	cl = nakama.New(append(s.ClientOptions(), nakama.WithExpiryGrace(0))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	token = cl.SessionToken()
+	for cl.SessionToken() == token {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected session to be refreshed: %v", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if cl.SessionExpired() {
+		t.Errorf("expected session to not be expired")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var count, fail int32
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&count, 1)
+		switch n := atomic.AddInt32(&fail, -1); {
+		case n >= 2:
+			return nil, errors.New("connection reset")
+		case n >= 0:
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       io.NopCloser(strings.NewReader(`{"code":14,"message":"unavailable"}`)),
+			}, nil
+		}
+		return tr.RoundTrip(req)
+	})
+	policy := &nakama.RetryPolicy{
+		MaxAttempts:   3,
+		BackoffMin:    time.Millisecond,
+		BackoffMax:    5 * time.Millisecond,
+		BackoffFactor: 2.0,
+		Codes:         []nakama.Code{nakama.CodeUnavailable},
+	}
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithRetryPolicy(policy))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// unavailable errors are retried
+	atomic.StoreInt32(&count, 0)
+	atomic.StoreInt32(&fail, 2)
+	if _, err := cl.Account(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt32(&count); n != 3 {
+		t.Errorf("expected 3 attempts, got: %d", n)
+	}
+	// transport errors are retried, and the attempt count is set on the final
+	// error
+	atomic.StoreInt32(&count, 0)
+	atomic.StoreInt32(&fail, 3)
+	var e *nakama.ClientError
+	switch _, err := cl.Account(ctx); {
+	case !errors.As(err, &e) || e.Code != nakama.CodeUnavailable:
+		t.Fatalf("expected unavailable error, got: %v", err)
+	case e.Attempts != 3:
+		t.Errorf("expected 3 attempts, got: %d", e.Attempts)
+	}
+	// plain text 5xx responses are retried
+	atomic.StoreInt32(&count, 0)
+	s.FailRequests(2, http.StatusServiceUnavailable, "Service Unavailable")
+	if _, err := cl.Account(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt32(&count); n != 3 {
+		t.Errorf("expected 3 attempts, got: %d", n)
+	}
+	s.FailRequests(3, http.StatusBadGateway, "Bad Gateway")
+	switch _, err := cl.Account(ctx); {
+	case !errors.As(err, &e) || e.StatusCode != http.StatusBadGateway || e.Code != nakama.CodeUnknown:
+		t.Fatalf("expected bad gateway error, got: %v", err)
+	case e.Attempts != 3:
+		t.Errorf("expected 3 attempts, got: %d", e.Attempts)
+	}
+	// nakama internal and unimplemented errors are not retried
+	for _, statusCode := range []int{http.StatusInternalServerError, http.StatusNotImplemented} {
+		s.FailRequests(1, statusCode, `{"code":13,"message":"internal"}`)
+		switch _, err := cl.Account(ctx); {
+		case !errors.As(err, &e) || e.StatusCode != statusCode || e.Code != nakama.CodeInternal:
+			t.Fatalf("expected internal error, got: %v", err)
+		case e.Attempts != 1:
+			t.Errorf("expected 1 attempt, got: %d", e.Attempts)
+		}
+	}
+	// non-idempotent requests are not retried
+	atomic.StoreInt32(&count, 0)
+	atomic.StoreInt32(&fail, 1)
+	switch err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); {
+	case !errors.As(err, &e) || e.Code != nakama.CodeUnavailable:
+		t.Fatalf("expected unavailable error, got: %v", err)
+	case e.Attempts != 1:
+		t.Errorf("expected 1 attempt, got: %d", e.Attempts)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var traces []string
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		traces = append(traces, req.Header.Get("X-Trace"))
+		return tr.RoundTrip(req)
+	})
+	var typs []string
+	cl := nakama.New(append(
+		s.ClientOptions(),
+		nakama.WithTransport(transport),
+		nakama.WithInterceptor(
+			func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}, next nakama.InterceptorFunc) error {
+				typs = append(typs, typ)
+				return next(nakama.HeaderContext(ctx, http.Header{"X-Trace": []string{typ}}), method, typ, query, msg, v)
+			},
+			func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}, next nakama.InterceptorFunc) error {
+				if res, ok := v.(*nakama.AccountResponse); ok && typ == "v2/account" {
+					res.User = &nakama.User{Username: "cached"}
+					return nil
+				}
+				return next(ctx, method, typ, query, msg, v)
+			},
+		),
+	)...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch res, err := cl.Account(ctx); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case res.User.Username != "cached":
+		t.Errorf("expected short-circuited response, got: %v", res)
+	}
+	if exp := []string{"v2/account/authenticate/device", "v2/account"}; fmt.Sprint(typs) != fmt.Sprint(exp) {
+		t.Errorf("expected %v, got: %v", exp, typs)
+	}
+	if exp := []string{"v2/account/authenticate/device"}; fmt.Sprint(traces) != fmt.Sprint(exp) {
+		t.Errorf("expected %v, got: %v", exp, traces)
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		counts[req.Method+" "+req.URL.Path]++
+		mu.Unlock()
+		return tr.RoundTrip(req)
+	})
+	count := func(key string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[key]
+	}
+	cache := nakama.NewCache(time.Hour)
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithCache(cache))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// identical in-flight requests are coalesced
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cl.Account(ctx); err != nil {
+				t.Errorf("expected no error, got: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := count("GET /v2/account"); n != 1 {
+		t.Errorf("expected 1 request, got: %d", n)
+	}
+	// cached per query
+	userId := cl.SessionUserId()
+	for i := 0; i < 3; i++ {
+		if _, err := cl.Users(ctx, userId); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := cl.UsersUsernames(ctx, cl.SessionUsername()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if n := count("GET /v2/user"); n != 2 {
+		t.Errorf("expected 2 requests, got: %d", n)
+	}
+	// mutating requests invalidate
+	if err := cl.UpdateAccount(ctx, nakama.UpdateAccount().WithDisplayName("updated")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch res, err := cl.Account(ctx); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case res.User.DisplayName != "updated":
+		t.Errorf("expected updated display name, got: %q", res.User.DisplayName)
+	}
+	if n := count("GET /v2/account"); n != 2 {
+		t.Errorf("expected 2 requests, got: %d", n)
+	}
+	group, err := cl.CreateGroup(ctx, nakama.CreateGroup().WithName("cached").WithOpen(true))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	other := nakama.New(append(s.ClientOptions(), nakama.WithCache(nakama.NewCache(time.Hour)))...)
+	if err := other.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res, err := other.UserGroups(ctx, other.SessionUserId()); err != nil || len(res.UserGroups) != 0 {
+		t.Fatalf("expected no groups, got: %v %v", res, err)
+	}
+	if err := other.JoinGroup(ctx, group.Id); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res, err := other.UserGroups(ctx, other.SessionUserId()); err != nil || len(res.UserGroups) != 1 {
+		t.Errorf("expected 1 group, got: %v %v", res, err)
+	}
+	// expired responses are served stale while refreshed
+	cache.WithTTL("v2/account", time.Millisecond).WithStale(time.Hour)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := cl.Account(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for count("GET /v2/account") != 3 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected background refresh, got: %v", ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestCacheCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New()
+	defer s.Close()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	traces := make(chan string, 1)
+	tr := s.Transport()
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/v2/account" {
+			traces <- req.Header.Get("X-Trace")
+			started <- struct{}{}
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-release:
+			}
+		}
+		return tr.RoundTrip(req)
+	})
+	cl := nakama.New(append(s.ClientOptions(), nakama.WithTransport(transport), nakama.WithCache(nakama.NewCache(time.Hour)))...)
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// the first caller giving up does not fail the coalesced request, which
+	// keeps the first caller's headers
+	firstCtx, firstCancel := context.WithCancel(nakama.HeaderContext(ctx, http.Header{"X-Trace": []string{"first"}}))
+	first := make(chan error, 1)
+	go func() {
+		_, err := cl.Account(firstCtx)
+		first <- err
+	}()
+	<-started
+	second := make(chan error, 1)
+	go func() {
+		_, err := cl.Account(ctx)
+		second <- err
+	}()
+	firstCancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if trace := <-traces; trace != "first" {
+		t.Errorf("expected trace first, got: %q", trace)
+	}
+}
+
+func TestGrpc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := New(WithRpc("echo", func(_ context.Context, userId, payload string) (string, error) {
+		return payload, nil
+	}))
+	defer s.Close()
+	if err := s.CreateLeaderboard(&nakama.Leaderboard{
+		Id:        "weekly",
+		SortOrder: SortOrderDescending,
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var typs []string
+	transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unexpected http request %s", req.URL.Path)
+	})
+	cl := nakama.New(append(
+		s.GrpcClientOptions(),
+		nakama.WithTransport(transport),
+		nakama.WithInterceptor(func(ctx context.Context, method, typ string, query url.Values, msg, v interface{}, next nakama.InterceptorFunc) error {
+			typs = append(typs, typ)
+			return next(ctx, method, typ, query, msg, v)
+		}),
+	)...)
+	if err := cl.Healthcheck(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, "grpcuser"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	account, err := cl.Account(ctx)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case account.User.Username != "grpcuser" || len(account.Devices) != 1:
+		t.Errorf("expected grpcuser with 1 device, got: %v", account)
+	}
+	if _, err := cl.WriteStorageObjects(ctx, nakama.WriteStorageObjects().WithObject(&nakama.WriteStorageObject{
+		Collection: "saves",
+		Key:        "slot1",
+		Value:      `{"level":1}`,
+	})); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	list, err := cl.StorageObjects(ctx, nakama.StorageObjects("saves").WithUserId(account.User.Id).WithLimit(10))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(list.Objects) != 1 || list.Objects[0].Value != `{"level":1}`:
+		t.Errorf("expected 1 object, got: %v", list.Objects)
+	}
+	if _, err := cl.WriteLeaderboardRecord(ctx, nakama.WriteLeaderboardRecord("weekly").WithScore(10)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	records, err := cl.LeaderboardRecords(ctx, nakama.LeaderboardRecords("weekly").WithLimit(1).WithOwnerIds(account.User.Id))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(records.Records) != 1 || records.Records[0].Score != 10 || len(records.OwnerRecords) != 1:
+		t.Errorf("expected 1 record with score 10, got: %v", records)
+	}
+	var res map[string]string
+	switch err := cl.Rpc(ctx, "echo", map[string]string{"a": "b"}, &res); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case res["a"] != "b":
+		t.Errorf("expected a == b, got: %v", res)
+	}
+	if err := cl.Rpc(ctx, "missing", nil, nil); !isCode(err, nakama.CodeNotFound) {
+		t.Errorf("expected not found error, got: %v", err)
+	}
+	if err := cl.DeleteNotifications(ctx, uuid.New().String()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if _, err := cl.LeaderboardRecords(ctx, nakama.LeaderboardRecords("weekly").WithLimit(100000)); !isCode(err, nakama.CodeInvalidArgument) {
+		t.Errorf("expected invalid argument error, got: %v", err)
+	}
+	if exp := "healthcheck v2/account/authenticate/device v2/account v2/storage"; !strings.HasPrefix(strings.Join(typs, " "), exp) {
+		t.Errorf("expected %s, got: %v", exp, typs)
+	}
+}
+
+func TestGrpcRoutes(t *testing.T) {
+	buf, err := os.ReadFile(filepath.Join("testdata", "grpc_routes.golden"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	golden := make(map[string]string)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			golden[strings.Fields(line)[0]] = line
+		}
+	}
+	for _, rt := range grpcapi.Routes {
+		body := rt.Body
+		if body == "" {
+			body = "-"
+		}
+		line := strings.Join([]string{rt.Name, rt.Message, rt.Method, "/" + rt.Pattern, body}, " ")
+		switch exp, ok := golden[rt.Name]; {
+		case !ok:
+			t.Errorf("expected golden definition for %s", rt.Name)
+		case line != exp:
+			t.Errorf("expected %s, got: %s", exp, line)
+		}
+		delete(golden, rt.Name)
+		typ, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(grpcapi.Package + "." + rt.Message))
+		if err != nil {
+			t.Errorf("expected %s message type, got: %v", rt.Name, err)
+			continue
+		}
+		fields := typ.Descriptor().Fields()
+		for _, p := range strings.Split(rt.Pattern, "/") {
+			if name := strings.Trim(p, "{}"); name != p && fields.ByName(protoreflect.Name(name)) == nil {
+				t.Errorf("expected %s to have path parameter field %s", rt.Message, name)
+			}
+		}
+		if rt.Body != "" && rt.Body != "*" && fields.ByName(protoreflect.Name(rt.Body)) == nil {
+			t.Errorf("expected %s to have body field %s", rt.Message, rt.Body)
+		}
+	}
+	for name := range golden {
+		t.Errorf("expected route for %s", name)
+	}
+}
+
+func newClient(ctx context.Context, t *testing.T, s *Server) *nakama.Client {
+	cl := s.Client()
+	if err := cl.AuthenticateDevice(ctx, uuid.New().String(), true, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return cl
+}
+
+func newConn(ctx context.Context, t *testing.T, cl *nakama.Client, opts ...nakama.ConnOption) *nakama.Conn {
+	conn, err := cl.NewConn(ctx, opts...)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return conn
+}
+
+func accountId(ctx context.Context, t *testing.T, cl *nakama.Client) string {
+	res, err := cl.Account(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return res.User.Id
+}
+
+func checkFriend(ctx context.Context, t *testing.T, cl *nakama.Client, userId string, state nakama.FriendState) {
+	t.Helper()
+	res, err := cl.Friends(ctx, nakama.Friends())
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case len(res.Friends) != 1 || res.Friends[0].User.Id != userId:
+		t.Fatalf("expected friend %s, got: %v", userId, res.Friends)
+	case res.Friends[0].State.GetValue() != int32(state):
+		t.Errorf("expected state %v, got: %d", state, res.Friends[0].State.GetValue())
+	}
+}
+
+func checkGroupUser(ctx context.Context, t *testing.T, cl *nakama.Client, groupId, userId string, state nakama.UserRoleState) {
+	t.Helper()
+	res, err := cl.GroupUsers(ctx, nakama.GroupUsers(groupId))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, u := range res.GroupUsers {
+		if u.User.Id == userId {
+			if u.State.GetValue() != int32(state) {
+				t.Errorf("expected state %v, got: %d", state, u.State.GetValue())
+			}
+			return
+		}
+	}
+	t.Errorf("expected group user %s", userId)
+}
+
+func isCode(err error, code nakama.Code) bool {
+	var e *nakama.ClientError
+	return errors.As(err, &e) && e.Code == code
+}
+
+type connectHandler func(context.Context)
+
+func (f connectHandler) ConnectHandler(ctx context.Context) {
+	f(ctx)
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type channelRecorder struct {
+	msgs      chan *nakama.ChannelMessage
+	updates   chan *nakama.ChannelMessage
+	removes   chan *nakama.ChannelMessage
+	presences chan *nakama.ChannelPresenceEventMsg
+}
+
+func newChannelRecorder() *channelRecorder {
+	return &channelRecorder{
+		msgs:      make(chan *nakama.ChannelMessage, 10),
+		updates:   make(chan *nakama.ChannelMessage, 10),
+		removes:   make(chan *nakama.ChannelMessage, 10),
+		presences: make(chan *nakama.ChannelPresenceEventMsg, 10),
+	}
+}
+
+func (rec *channelRecorder) ChannelMessageHandler(_ context.Context, msg *nakama.ChannelMessage) {
+	rec.msgs <- msg
+}
+
+func (rec *channelRecorder) ChannelMessageUpdateHandler(_ context.Context, msg *nakama.ChannelMessage) {
+	rec.updates <- msg
+}
+
+func (rec *channelRecorder) ChannelMessageRemoveHandler(_ context.Context, msg *nakama.ChannelMessage) {
+	rec.removes <- msg
+}
+
+func (rec *channelRecorder) ChannelPresenceEventHandler(_ context.Context, ev *nakama.ChannelPresenceEventMsg) {
+	rec.presences <- ev
+}
+
+type matchRecorder struct {
+	data      chan *nakama.MatchDataMsg
+	presences chan *nakama.MatchPresenceEventMsg
+}
+
+func newMatchRecorder() *matchRecorder {
+	return &matchRecorder{
+		data:      make(chan *nakama.MatchDataMsg, 10),
+		presences: make(chan *nakama.MatchPresenceEventMsg, 10),
+	}
+}
+
+func (rec *matchRecorder) MatchDataHandler(_ context.Context, msg *nakama.MatchDataMsg) {
+	rec.data <- msg
+}
+
+func (rec *matchRecorder) MatchPresenceEventHandler(_ context.Context, ev *nakama.MatchPresenceEventMsg) {
+	rec.presences <- ev
+}
+
+type partyRecorder struct {
+	presences chan *nakama.PartyPresenceEventMsg
+	leaders   chan *nakama.PartyLeaderMsg
+	requests  chan *nakama.PartyJoinRequestMsg
+	data      chan *nakama.PartyDataMsg
+	closes    chan *nakama.PartyCloseMsg
+}
+
+func newPartyRecorder() *partyRecorder {
+	return &partyRecorder{
+		presences: make(chan *nakama.PartyPresenceEventMsg, 10),
+		leaders:   make(chan *nakama.PartyLeaderMsg, 10),
+		requests:  make(chan *nakama.PartyJoinRequestMsg, 10),
+		data:      make(chan *nakama.PartyDataMsg, 10),
+		closes:    make(chan *nakama.PartyCloseMsg, 10),
+	}
+}
+
+func (rec *partyRecorder) PartyPresenceEventHandler(_ context.Context, ev *nakama.PartyPresenceEventMsg) {
+	rec.presences <- ev
+}
+
+func (rec *partyRecorder) PartyLeaderHandler(_ context.Context, msg *nakama.PartyLeaderMsg) {
+	rec.leaders <- msg
+}
+
+func (rec *partyRecorder) PartyJoinRequestHandler(_ context.Context, msg *nakama.PartyJoinRequestMsg) {
+	rec.requests <- msg
+}
+
+func (rec *partyRecorder) PartyDataHandler(_ context.Context, msg *nakama.PartyDataMsg) {
+	rec.data <- msg
+}
+
+func (rec *partyRecorder) PartyCloseHandler(_ context.Context, msg *nakama.PartyCloseMsg) {
+	rec.closes <- msg
+}
+
+func waitFor(ctx context.Context, t *testing.T, f func() bool) {
+	t.Helper()
+	for !f() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected condition, got: %v", ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func recv[T any](ctx context.Context, t *testing.T, ch chan T) T {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+		t.Fatalf("expected value, got: %v", ctx.Err())
+	case v := <-ch:
+		return v
+	}
+	var zero T
+	return zero
+}
@@ -0,0 +1,124 @@
+package nakamatest
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// notification is a stored notification.
+type notification struct {
+	seq int64
+	n   *nakama.Notification
+}
+
+// SendNotification sends a notification to the user, as a server runtime
+// would. The content must be a JSON object.
+func (s *Server) SendNotification(userId, subject, content string, code int32, senderId string, persistent bool) error {
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &v); err != nil || v == nil {
+		return errorf(nakama.CodeInvalidArgument, "Notification content must be a JSON object.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[userId]; !ok {
+		return errorf(nakama.CodeNotFound, "User not found.")
+	}
+	s.notify(userId, subject, content, code, senderId, persistent)
+	return nil
+}
+
+// notify stores (when persistent) and delivers a notification to the user's
+// realtime sessions. Must be called with the lock held.
+func (s *Server) notify(userId, subject, content string, code int32, senderId string, persistent bool) {
+	n := &nakama.Notification{
+		Id:         uuid.New().String(),
+		Subject:    subject,
+		Content:    content,
+		Code:       code,
+		SenderId:   senderId,
+		CreateTime: timestamppb.New(time.Now()),
+		Persistent: persistent,
+	}
+	if persistent {
+		s.notifications[userId] = append(s.notifications[userId], &notification{
+			seq: s.nextSeq(),
+			n:   n,
+		})
+	}
+	s.sendUser(userId, &nakama.Envelope{
+		Message: &nakama.Envelope_Notifications{
+			Notifications: &nakama.NotificationsMsg{
+				Notifications: []*nakama.Notification{n},
+			},
+		},
+	})
+}
+
+// notifyJSON sends a notification with the content encoded as JSON. Must be
+// called with the lock held.
+func (s *Server) notifyJSON(userId, subject string, content map[string]string, code int32, senderId string) {
+	buf, _ := json.Marshal(content)
+	s.notify(userId, subject, string(buf), code, senderId, true)
+}
+
+// listNotifications handles a list notifications request.
+func (s *Server) listNotifications(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 1000)
+	if err != nil {
+		return nil, err
+	}
+	var seq int64
+	if cursor := req.query("cacheableCursor"); cursor != "" {
+		v, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if seq, err = strconv.ParseInt(v[0], 10, 64); err != nil {
+			return nil, errorf(nakama.CodeInvalidArgument, "Malformed cursor was used.")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := new(nakama.NotificationsResponse)
+	for _, n := range s.notifications[req.userId] {
+		if len(res.Notifications) == limit {
+			break
+		}
+		if seq < n.seq {
+			res.Notifications = append(res.Notifications, proto.Clone(n.n).(*nakama.Notification))
+			seq = n.seq
+		}
+	}
+	if seq != 0 {
+		res.CacheableCursor = encodeCursor(seq)
+	}
+	return res, nil
+}
+
+// deleteNotifications handles a delete notifications request.
+func (s *Server) deleteNotifications(req *request) (interface{}, error) {
+	msg := new(nakama.DeleteNotificationsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, id := range append(req.queryList("ids"), msg.Ids...) {
+		ids[id] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var v []*notification
+	for _, n := range s.notifications[req.userId] {
+		if !ids[n.n.Id] {
+			v = append(v, n)
+		}
+	}
+	s.notifications[req.userId] = v
+	return nil, nil
+}
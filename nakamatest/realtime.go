@@ -0,0 +1,1518 @@
+package nakamatest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"nhooyr.io/websocket"
+)
+
+// session is a realtime session.
+type session struct {
+	id       string
+	userId   string
+	username string
+	binary   bool
+	appear   bool
+	status   string
+	follows  map[string]bool
+	out      chan *nakama.Envelope
+	ctx      context.Context
+	cancel   func()
+}
+
+// presence returns the session's user presence.
+func (sess *session) presence(persistence bool) *nakama.UserPresenceMsg {
+	return &nakama.UserPresenceMsg{
+		UserId:      sess.userId,
+		SessionId:   sess.id,
+		Username:    sess.username,
+		Persistence: persistence,
+	}
+}
+
+// statusPresence returns the session's status presence.
+func (sess *session) statusPresence() *nakama.UserPresenceMsg {
+	p := sess.presence(false)
+	p.Status = wrapperspb.String(sess.status)
+	return p
+}
+
+// serveWs serves the realtime websocket endpoint.
+func (s *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	token := query.Get("token")
+	if token == "" {
+		s.writeErr(w, errorf(nakama.CodeUnauthenticated, "Auth token required"))
+		return
+	}
+	c, err := s.verify(token, false)
+	if err != nil {
+		s.writeErr(w, err)
+		return
+	}
+	binary := false
+	switch query.Get("format") {
+	case "", "json":
+	case "protobuf":
+		binary = true
+	default:
+		s.writeErr(w, errorf(nakama.CodeInvalidArgument, "Invalid format."))
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sess := &session{
+		id:       uuid.New().String(),
+		userId:   c.UserId,
+		username: c.Username,
+		binary:   binary,
+		appear:   query.Get("status") == "true",
+		follows:  make(map[string]bool),
+		out:      make(chan *nakama.Envelope, 256),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	s.mu.Lock()
+	s.sessions[sess.id] = sess
+	if sess.appear {
+		s.statusEvent(sess, []*nakama.UserPresenceMsg{sess.statusPresence()}, nil)
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closeSession(sess)
+	}()
+	// the session is registered before accepting, so that messages sent once
+	// the client has connected are not missed
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		s.Logf("unable to accept websocket: %v", err)
+		return
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	// outgoing
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case env := <-sess.out:
+				typ, buf, err := s.marshalEnvelope(sess, env)
+				if err != nil {
+					s.Logf("unable to marshal envelope: %v", err)
+					continue
+				}
+				if err := ws.Write(ctx, typ, buf); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	// incoming
+	for {
+		_, buf, err := ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		env := new(nakama.Envelope)
+		if sess.binary {
+			err = proto.Unmarshal(buf, env)
+		} else {
+			err = s.unmarshaler.Unmarshal(buf, env)
+		}
+		if err != nil {
+			s.Logf("unable to unmarshal envelope: %v", err)
+			return
+		}
+		s.dispatch(sess, env)
+	}
+}
+
+// marshalEnvelope marshals the envelope for the session.
+func (s *Server) marshalEnvelope(sess *session, env *nakama.Envelope) (websocket.MessageType, []byte, error) {
+	if sess.binary {
+		buf, err := proto.Marshal(env)
+		return websocket.MessageBinary, buf, err
+	}
+	buf, err := s.marshaler.Marshal(env)
+	return websocket.MessageText, buf, err
+}
+
+// dispatch dispatches a received envelope, sending the response.
+func (s *Server) dispatch(sess *session, env *nakama.Envelope) {
+	var res *nakama.Envelope
+	var err error
+	rpc, isRpc := env.Message.(*nakama.Envelope_Rpc)
+	if isRpc {
+		// rpcs are called without the lock held
+		res, err = s.rpcMsg(sess, rpc.Rpc)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !isRpc {
+		res, err = s.handle(sess, env)
+	}
+	switch _, ok := env.Message.(*nakama.Envelope_MatchDataSend); {
+	case err != nil:
+		s.Logf("realtime error: %v", err)
+		var e *nakama.ErrorMsg
+		if !errors.As(err, &e) {
+			e = rtErrorf(nakama.ErrorCode_RUNTIME_EXCEPTION, err.Error())
+		}
+		res = &nakama.Envelope{
+			Message: &nakama.Envelope_Error{
+				Error: e,
+			},
+		}
+	case res == nil && ok:
+		// match data is not acknowledged
+		return
+	case res == nil:
+		res = new(nakama.Envelope)
+	}
+	if env.Cid != "" {
+		res.Cid = env.Cid
+		s.send(sess, res)
+	}
+	s.matchmake()
+}
+
+// handle handles a received envelope. Must be called with the lock held.
+func (s *Server) handle(sess *session, env *nakama.Envelope) (*nakama.Envelope, error) {
+	switch v := env.Message.(type) {
+	case nil:
+		return nil, rtErrorf(nakama.ErrorCode_MISSING_PAYLOAD, "Missing message.")
+	case *nakama.Envelope_ChannelJoin:
+		return s.channelJoin(sess, v.ChannelJoin)
+	case *nakama.Envelope_ChannelLeave:
+		return nil, s.channelLeave(sess, v.ChannelLeave.ChannelId)
+	case *nakama.Envelope_ChannelMessageSend:
+		return s.channelMessageSend(sess, v.ChannelMessageSend)
+	case *nakama.Envelope_ChannelMessageUpdate:
+		return s.channelMessageUpdate(sess, v.ChannelMessageUpdate)
+	case *nakama.Envelope_ChannelMessageRemove:
+		return s.channelMessageRemove(sess, v.ChannelMessageRemove)
+	case *nakama.Envelope_MatchCreate:
+		return s.matchCreate(sess, v.MatchCreate)
+	case *nakama.Envelope_MatchJoin:
+		return s.matchJoin(sess, v.MatchJoin)
+	case *nakama.Envelope_MatchLeave:
+		return nil, s.matchLeave(sess, v.MatchLeave.MatchId)
+	case *nakama.Envelope_MatchDataSend:
+		return nil, s.matchDataSend(sess, v.MatchDataSend)
+	case *nakama.Envelope_MatchmakerAdd:
+		return s.matchmakerAdd(sess, v.MatchmakerAdd)
+	case *nakama.Envelope_MatchmakerRemove:
+		return nil, s.matchmakerRemove(sess, v.MatchmakerRemove)
+	case *nakama.Envelope_PartyCreate:
+		return s.partyCreate(sess, v.PartyCreate)
+	case *nakama.Envelope_PartyJoin:
+		return nil, s.partyJoin(sess, v.PartyJoin)
+	case *nakama.Envelope_PartyLeave:
+		return nil, s.partyLeave(sess, v.PartyLeave.PartyId)
+	case *nakama.Envelope_PartyPromote:
+		return s.partyPromote(sess, v.PartyPromote)
+	case *nakama.Envelope_PartyAccept:
+		return nil, s.partyAccept(sess, v.PartyAccept)
+	case *nakama.Envelope_PartyRemove:
+		return nil, s.partyRemove(sess, v.PartyRemove)
+	case *nakama.Envelope_PartyClose:
+		return nil, s.partyClose(sess, v.PartyClose)
+	case *nakama.Envelope_PartyJoinRequestList:
+		return s.partyJoinRequests(sess, v.PartyJoinRequestList)
+	case *nakama.Envelope_PartyMatchmakerAdd:
+		return s.partyMatchmakerAdd(sess, v.PartyMatchmakerAdd)
+	case *nakama.Envelope_PartyMatchmakerRemove:
+		return nil, s.partyMatchmakerRemove(sess, v.PartyMatchmakerRemove)
+	case *nakama.Envelope_PartyDataSend:
+		return nil, s.partyDataSend(sess, v.PartyDataSend)
+	case *nakama.Envelope_StatusFollow:
+		return s.statusFollow(sess, v.StatusFollow)
+	case *nakama.Envelope_StatusUnfollow:
+		for _, id := range v.StatusUnfollow.UserIds {
+			delete(sess.follows, id)
+		}
+		return nil, nil
+	case *nakama.Envelope_StatusUpdate:
+		s.statusUpdate(sess, v.StatusUpdate)
+		return nil, nil
+	case *nakama.Envelope_Ping:
+		return &nakama.Envelope{
+			Message: &nakama.Envelope_Pong{
+				Pong: new(nakama.PongMsg),
+			},
+		}, nil
+	}
+	return nil, rtErrorf(nakama.ErrorCode_UNRECOGNIZED_PAYLOAD, "Unrecognized message.")
+}
+
+// send sends the envelope to the session. When the session's buffer is full,
+// the session is closed. Must be called with the lock held.
+func (s *Server) send(sess *session, env *nakama.Envelope) {
+	select {
+	case sess.out <- env:
+	default:
+		s.Logf("session %s buffer full, closing", sess.id)
+		sess.cancel()
+	}
+}
+
+// sendPresences sends the envelope to the sessions of the presences, except
+// for the excluded session. Must be called with the lock held.
+func (s *Server) sendPresences(presences []*nakama.UserPresenceMsg, exclude string, env *nakama.Envelope) {
+	for _, p := range presences {
+		if sess, ok := s.sessions[p.SessionId]; ok && p.SessionId != exclude {
+			s.send(sess, env)
+		}
+	}
+}
+
+// sendUser sends the envelope to all of the user's sessions. Must be called
+// with the lock held.
+func (s *Server) sendUser(userId string, env *nakama.Envelope) {
+	for _, sess := range s.sessions {
+		if sess.userId == userId {
+			s.send(sess, env)
+		}
+	}
+}
+
+// online returns true when the user has a session appearing online. Must be
+// called with the lock held.
+func (s *Server) online(userId string) bool {
+	for _, sess := range s.sessions {
+		if sess.userId == userId && sess.appear {
+			return true
+		}
+	}
+	return false
+}
+
+// DisconnectSessions disconnects all of the user's realtime sessions. The
+// sessions' presences and matchmaker tickets are removed before returning.
+func (s *Server) DisconnectSessions(userId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.userId == userId {
+			s.closeSession(sess)
+			sess.cancel()
+		}
+	}
+}
+
+// closeSession removes the session's presences. Must be called with the lock
+// held.
+func (s *Server) closeSession(sess *session) {
+	for _, ch := range s.channels {
+		_ = s.channelLeave(sess, ch.id)
+	}
+	for _, m := range s.matches {
+		_ = s.matchLeave(sess, m.id)
+	}
+	for _, p := range s.parties {
+		_ = s.partyLeave(sess, p.id)
+		p.requests = removePresence(p.requests, sess.id)
+	}
+	var tickets []*ticket
+	for _, t := range s.tickets {
+		if t.sessionId != sess.id {
+			tickets = append(tickets, t)
+		}
+	}
+	s.tickets = tickets
+	if _, ok := s.sessions[sess.id]; ok && sess.appear {
+		s.statusEvent(sess, nil, []*nakama.UserPresenceMsg{sess.statusPresence()})
+	}
+	delete(s.sessions, sess.id)
+}
+
+// rpcMsg handles a realtime remote procedure call.
+func (s *Server) rpcMsg(sess *session, msg *nakama.RpcMsg) (*nakama.Envelope, error) {
+	s.mu.Lock()
+	f, ok := s.rpcs[msg.Id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, rtErrorf(nakama.ErrorCode_RUNTIME_FUNCTION_NOT_FOUND, "RPC function not found")
+	}
+	res, err := f(sess.ctx, sess.userId, msg.Payload)
+	if err != nil {
+		var e *nakama.ClientError
+		if errors.As(err, &e) {
+			return nil, rtErrorf(nakama.ErrorCode_RUNTIME_FUNCTION_EXCEPTION, e.Message)
+		}
+		return nil, rtErrorf(nakama.ErrorCode_RUNTIME_FUNCTION_EXCEPTION, err.Error())
+	}
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_Rpc{
+			Rpc: &nakama.RpcMsg{
+				Id:      msg.Id,
+				Payload: res,
+			},
+		},
+	}, nil
+}
+
+// channel is a chat channel.
+type channel struct {
+	id        string
+	roomName  string
+	groupId   string
+	userIdOne string
+	userIdTwo string
+	presences []*channelPresence
+	messages  []*channelMessage
+}
+
+// channelPresence is a chat channel presence.
+type channelPresence struct {
+	p      *nakama.UserPresenceMsg
+	hidden bool
+}
+
+// channelMessage is a stored chat channel message.
+type channelMessage struct {
+	seq int64
+	m   *nakama.ChannelMessage
+}
+
+// presence returns the session's presence in the channel.
+func (ch *channel) presence(sessionId string) *channelPresence {
+	for _, p := range ch.presences {
+		if p.p.SessionId == sessionId {
+			return p
+		}
+	}
+	return nil
+}
+
+// visible returns the channel's visible presences.
+func (ch *channel) visible() []*nakama.UserPresenceMsg {
+	var v []*nakama.UserPresenceMsg
+	for _, p := range ch.presences {
+		if !p.hidden {
+			v = append(v, p.p)
+		}
+	}
+	return v
+}
+
+// all returns all of the channel's presences.
+func (ch *channel) all() []*nakama.UserPresenceMsg {
+	var v []*nakama.UserPresenceMsg
+	for _, p := range ch.presences {
+		v = append(v, p.p)
+	}
+	return v
+}
+
+// presenceEvent returns a channel presence event envelope.
+func (ch *channel) presenceEvent(joins, leaves []*nakama.UserPresenceMsg) *nakama.Envelope {
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_ChannelPresenceEvent{
+			ChannelPresenceEvent: &nakama.ChannelPresenceEventMsg{
+				ChannelId: ch.id,
+				Joins:     joins,
+				Leaves:    leaves,
+				RoomName:  ch.roomName,
+				GroupId:   ch.groupId,
+				UserIdOne: ch.userIdOne,
+				UserIdTwo: ch.userIdTwo,
+			},
+		},
+	}
+}
+
+// channelJoin handles a channel join message. Must be called with the lock
+// held.
+func (s *Server) channelJoin(sess *session, msg *nakama.ChannelJoinMsg) (*nakama.Envelope, error) {
+	ch := new(channel)
+	switch nakama.ChannelType(msg.Type) {
+	case nakama.ChannelType_ROOM:
+		if msg.Target == "" {
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid room name.")
+		}
+		ch.id, ch.roomName = "2..."+msg.Target, msg.Target
+	case nakama.ChannelType_DIRECT_MESSAGE:
+		switch _, err := uuid.Parse(msg.Target); {
+		case err != nil, s.accounts[msg.Target] == nil:
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid user ID.")
+		case msg.Target == sess.userId:
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Cannot open a direct message channel with self.")
+		}
+		ch.userIdOne, ch.userIdTwo = sess.userId, msg.Target
+		if ch.userIdTwo < ch.userIdOne {
+			ch.userIdOne, ch.userIdTwo = ch.userIdTwo, ch.userIdOne
+		}
+		ch.id = "4." + ch.userIdOne + "." + ch.userIdTwo + "."
+	case nakama.ChannelType_GROUP:
+		g, ok := s.groups[msg.Target]
+		if !ok {
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid group ID.")
+		}
+		if state, ok := g.state(sess.userId); !ok || state == stateJoinRequest {
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Not a member of the group.")
+		}
+		ch.id, ch.groupId = "3."+msg.Target+"..", msg.Target
+	default:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Unrecognized channel type.")
+	}
+	if prev, ok := s.channels[ch.id]; ok {
+		ch = prev
+	} else {
+		s.channels[ch.id] = ch
+	}
+	if ch.presence(sess.id) == nil {
+		p := &channelPresence{
+			p:      sess.presence(msg.Persistence == nil || msg.Persistence.Value),
+			hidden: msg.Hidden.GetValue(),
+		}
+		ch.presences = append(ch.presences, p)
+		if !p.hidden {
+			s.sendPresences(ch.all(), sess.id, ch.presenceEvent([]*nakama.UserPresenceMsg{p.p}, nil))
+		}
+		if nakama.ChannelType(msg.Type) == nakama.ChannelType_DIRECT_MESSAGE && !s.joined(ch, msg.Target) {
+			s.notifyJSON(msg.Target, sess.username+" wants to chat", map[string]string{
+				"username": sess.username,
+			}, nakama.NotificationDmRequest, sess.userId)
+		}
+	}
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_Channel{
+			Channel: &nakama.ChannelMsg{
+				Id:        ch.id,
+				Presences: ch.visible(),
+				Self:      ch.presence(sess.id).p,
+				RoomName:  ch.roomName,
+				GroupId:   ch.groupId,
+				UserIdOne: ch.userIdOne,
+				UserIdTwo: ch.userIdTwo,
+			},
+		},
+	}, nil
+}
+
+// joined returns true when the user has a presence in the channel.
+func (s *Server) joined(ch *channel, userId string) bool {
+	for _, p := range ch.presences {
+		if p.p.UserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// channelLeave handles a channel leave message. Must be called with the lock
+// held.
+func (s *Server) channelLeave(sess *session, channelId string) error {
+	ch, ok := s.channels[channelId]
+	if !ok {
+		return nil
+	}
+	p := ch.presence(sess.id)
+	if p == nil {
+		return nil
+	}
+	var presences []*channelPresence
+	for _, x := range ch.presences {
+		if x != p {
+			presences = append(presences, x)
+		}
+	}
+	ch.presences = presences
+	if !p.hidden {
+		s.sendPresences(ch.all(), "", ch.presenceEvent(nil, []*nakama.UserPresenceMsg{p.p}))
+	}
+	return nil
+}
+
+// channelMessage sends a channel message with the code to the channel's
+// presences, returning the ack. Must be called with the lock held.
+func (s *Server) channelMessage(ch *channel, m *nakama.ChannelMessage, code int32) *nakama.Envelope {
+	m = proto.Clone(m).(*nakama.ChannelMessage)
+	m.Code = wrapperspb.Int32(code)
+	s.sendPresences(ch.all(), "", &nakama.Envelope{
+		Message: &nakama.Envelope_ChannelMessage{
+			ChannelMessage: m,
+		},
+	})
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_ChannelMessageAck{
+			ChannelMessageAck: &nakama.ChannelMessageAckMsg{
+				ChannelId:  m.ChannelId,
+				MessageId:  m.MessageId,
+				Code:       m.Code,
+				Username:   m.Username,
+				CreateTime: m.CreateTime,
+				UpdateTime: m.UpdateTime,
+				Persistent: m.Persistent,
+				RoomName:   m.RoomName,
+				GroupId:    m.GroupId,
+				UserIdOne:  m.UserIdOne,
+				UserIdTwo:  m.UserIdTwo,
+			},
+		},
+	}
+}
+
+// joinedChannel returns the channel and the session's presence, checking the
+// session has joined the channel. Must be called with the lock held.
+func (s *Server) joinedChannel(sess *session, channelId string) (*channel, *channelPresence, error) {
+	ch, ok := s.channels[channelId]
+	if !ok || ch.presence(sess.id) == nil {
+		return nil, nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Must join channel before sending messages.")
+	}
+	return ch, ch.presence(sess.id), nil
+}
+
+// channelMessageSend handles a channel message send message. Must be called
+// with the lock held.
+func (s *Server) channelMessageSend(sess *session, msg *nakama.ChannelMessageSendMsg) (*nakama.Envelope, error) {
+	ch, p, err := s.joinedChannel(sess, msg.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+	if !isJSONObject(msg.Content) {
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Message content must be a valid JSON object.")
+	}
+	now := timestamppb.New(time.Now())
+	m := &nakama.ChannelMessage{
+		ChannelId:  ch.id,
+		MessageId:  uuid.New().String(),
+		SenderId:   sess.userId,
+		Username:   sess.username,
+		Content:    msg.Content,
+		CreateTime: now,
+		UpdateTime: now,
+		Persistent: wrapperspb.Bool(p.p.Persistence),
+		RoomName:   ch.roomName,
+		GroupId:    ch.groupId,
+		UserIdOne:  ch.userIdOne,
+		UserIdTwo:  ch.userIdTwo,
+	}
+	if p.p.Persistence {
+		ch.messages = append(ch.messages, &channelMessage{
+			seq: s.nextSeq(),
+			m:   m,
+		})
+	}
+	return s.channelMessage(ch, m, 0), nil
+}
+
+// sentMessage returns the message, checking that the message was sent by the
+// session's user.
+func (ch *channel) sentMessage(sess *session, messageId string) (int, error) {
+	for i, m := range ch.messages {
+		if m.m.MessageId != messageId {
+			continue
+		}
+		if m.m.SenderId != sess.userId {
+			return 0, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Message sent by another user.")
+		}
+		return i, nil
+	}
+	return 0, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Could not find message to update in channel history.")
+}
+
+// channelMessageUpdate handles a channel message update message. Must be
+// called with the lock held.
+func (s *Server) channelMessageUpdate(sess *session, msg *nakama.ChannelMessageUpdateMsg) (*nakama.Envelope, error) {
+	ch, _, err := s.joinedChannel(sess, msg.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+	if !isJSONObject(msg.Content) {
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Message content must be a valid JSON object.")
+	}
+	i, err := ch.sentMessage(sess, msg.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	m := ch.messages[i].m
+	m.Content, m.UpdateTime = msg.Content, timestamppb.New(time.Now())
+	return s.channelMessage(ch, m, 1), nil
+}
+
+// channelMessageRemove handles a channel message remove message. Must be
+// called with the lock held.
+func (s *Server) channelMessageRemove(sess *session, msg *nakama.ChannelMessageRemoveMsg) (*nakama.Envelope, error) {
+	ch, _, err := s.joinedChannel(sess, msg.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+	i, err := ch.sentMessage(sess, msg.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	m := ch.messages[i].m
+	ch.messages = append(ch.messages[:i], ch.messages[i+1:]...)
+	m.Content, m.UpdateTime = "{}", timestamppb.New(time.Now())
+	return s.channelMessage(ch, m, 2), nil
+}
+
+// listChannelMessages handles a list channel messages request.
+func (s *Server) listChannelMessages(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 100)
+	if err != nil {
+		return nil, err
+	}
+	forward := true
+	if v, err := req.queryBool("forward"); err != nil {
+		return nil, err
+	} else if v != nil {
+		forward = *v
+	}
+	var after int64
+	var cursor bool
+	if str := req.query("cursor"); str != "" {
+		v, err := decodeCursor(str)
+		if err != nil {
+			return nil, err
+		}
+		if len(v) != 2 {
+			return nil, errorf(nakama.CodeInvalidArgument, "Malformed cursor was used.")
+		}
+		if after, err = strconv.ParseInt(v[1], 10, 64); err != nil {
+			return nil, errorf(nakama.CodeInvalidArgument, "Malformed cursor was used.")
+		}
+		forward, cursor = v[0] == "1", true
+	}
+	if !forward && !cursor {
+		after = math.MaxInt64
+	}
+	channelId := req.param("channelId")
+	if len(strings.Split(channelId, ".")) != 4 {
+		return nil, errorf(nakama.CodeInvalidArgument, "Invalid channel ID.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := new(nakama.ChannelMessagesResponse)
+	ch, ok := s.channels[channelId]
+	if !ok {
+		return res, nil
+	}
+	if g, ok := s.groups[ch.groupId]; ok {
+		if state, ok := g.state(req.userId); !ok || state == stateJoinRequest {
+			return nil, errorf(nakama.CodePermissionDenied, "Not a member of the group.")
+		}
+	}
+	var msgs []*channelMessage
+	for i := range ch.messages {
+		m := ch.messages[i]
+		if !forward {
+			m = ch.messages[len(ch.messages)-1-i]
+		}
+		if (forward && after < m.seq) || (!forward && m.seq < after) {
+			msgs = append(msgs, m)
+		}
+	}
+	dir := map[bool]string{true: "1", false: "0"}
+	if limit < len(msgs) {
+		msgs = msgs[:limit]
+		res.NextCursor = encodeCursor(dir[forward], msgs[limit-1].seq)
+	}
+	for _, m := range msgs {
+		res.Messages = append(res.Messages, proto.Clone(m.m).(*nakama.ChannelMessage))
+	}
+	if len(msgs) != 0 {
+		if cursor {
+			res.PrevCursor = encodeCursor(dir[!forward], msgs[0].seq)
+		}
+		if forward {
+			res.CacheableCursor = encodeCursor(dir[true], msgs[len(msgs)-1].seq)
+		}
+	}
+	return res, nil
+}
+
+// match is a relayed multiplayer match.
+type match struct {
+	id        string
+	presences []*nakama.UserPresenceMsg
+}
+
+// msg returns the match message for the session.
+func (m *match) msg(sessionId string) *nakama.MatchMsg {
+	res := &nakama.MatchMsg{
+		MatchId: m.id,
+		Size:    int32(len(m.presences)),
+	}
+	for _, p := range m.presences {
+		if p.SessionId == sessionId {
+			res.Self = p
+		} else {
+			res.Presences = append(res.Presences, p)
+		}
+	}
+	return res
+}
+
+// presenceEvent returns a match presence event envelope.
+func (m *match) presenceEvent(joins, leaves []*nakama.UserPresenceMsg) *nakama.Envelope {
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_MatchPresenceEvent{
+			MatchPresenceEvent: &nakama.MatchPresenceEventMsg{
+				MatchId: m.id,
+				Joins:   joins,
+				Leaves:  leaves,
+			},
+		},
+	}
+}
+
+// matchCreate handles a match create message. Must be called with the lock
+// held.
+func (s *Server) matchCreate(sess *session, msg *nakama.MatchCreateMsg) (*nakama.Envelope, error) {
+	id := uuid.New().String() + "."
+	if msg.Name != "" {
+		id = uuid.NewSHA1(uuid.NameSpaceDNS, []byte(msg.Name)).String() + "."
+	}
+	return s.joinMatch(sess, id, true)
+}
+
+// matchJoin handles a match join message. Must be called with the lock held.
+func (s *Server) matchJoin(sess *session, msg *nakama.MatchJoinMsg) (*nakama.Envelope, error) {
+	var id string
+	create := false
+	switch v := msg.Id.(type) {
+	case *nakama.MatchJoinMsg_MatchId:
+		id = v.MatchId
+	case *nakama.MatchJoinMsg_Token:
+		var ok bool
+		if id, ok = s.matchTokens[v.Token]; !ok {
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid match token.")
+		}
+		create = true
+	default:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Match ID or token must be set.")
+	}
+	return s.joinMatch(sess, id, create)
+}
+
+// joinMatch joins the session to the match, creating the match when create
+// is true. Must be called with the lock held.
+func (s *Server) joinMatch(sess *session, id string, create bool) (*nakama.Envelope, error) {
+	m, ok := s.matches[id]
+	switch {
+	case !ok && !create:
+		return nil, rtErrorf(nakama.ErrorCode_MATCH_NOT_FOUND, "Match not found.")
+	case !ok:
+		m = &match{
+			id: id,
+		}
+		s.matches[id] = m
+	}
+	if presenceIndex(m.presences, sess.id) == -1 {
+		p := sess.presence(false)
+		m.presences = append(m.presences, p)
+		s.sendPresences(m.presences, sess.id, m.presenceEvent([]*nakama.UserPresenceMsg{p}, nil))
+	}
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_Match{
+			Match: m.msg(sess.id),
+		},
+	}, nil
+}
+
+// matchLeave handles a match leave message. Must be called with the lock
+// held.
+func (s *Server) matchLeave(sess *session, matchId string) error {
+	m, ok := s.matches[matchId]
+	if !ok {
+		return nil
+	}
+	i := presenceIndex(m.presences, sess.id)
+	if i == -1 {
+		return nil
+	}
+	p := m.presences[i]
+	m.presences = removePresence(m.presences, sess.id)
+	if len(m.presences) == 0 {
+		delete(s.matches, m.id)
+		return nil
+	}
+	s.sendPresences(m.presences, "", m.presenceEvent(nil, []*nakama.UserPresenceMsg{p}))
+	return nil
+}
+
+// matchDataSend handles a match data send message. Must be called with the
+// lock held.
+func (s *Server) matchDataSend(sess *session, msg *nakama.MatchDataSendMsg) error {
+	m, ok := s.matches[msg.MatchId]
+	if !ok {
+		return nil
+	}
+	i := presenceIndex(m.presences, sess.id)
+	if i == -1 {
+		return nil
+	}
+	presences := m.presences
+	if len(msg.Presences) != 0 {
+		presences = nil
+		for _, p := range msg.Presences {
+			if j := presenceIndex(m.presences, p.SessionId); j != -1 {
+				presences = append(presences, m.presences[j])
+			}
+		}
+	}
+	s.sendPresences(presences, sess.id, &nakama.Envelope{
+		Message: &nakama.Envelope_MatchData{
+			MatchData: &nakama.MatchDataMsg{
+				MatchId:  m.id,
+				Presence: m.presences[i],
+				OpCode:   msg.OpCode,
+				Data:     msg.Data,
+				Reliable: msg.Reliable,
+			},
+		},
+	})
+	return nil
+}
+
+// listMatches handles a list matches request.
+func (s *Server) listMatches(req *request) (interface{}, error) {
+	limit, err := req.limit(1, 100)
+	if err != nil {
+		return nil, err
+	}
+	authoritative, err := req.queryBool("authoritative")
+	if err != nil {
+		return nil, err
+	}
+	minSize, err := req.queryInt("minSize", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := req.queryInt("maxSize", math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	res := new(nakama.MatchesResponse)
+	// relayed matches have no label, and are never authoritative
+	if (authoritative != nil && *authoritative) || req.query("label") != "" || req.query("query") != "" {
+		return res, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, m := range s.matches {
+		if size := int64(len(m.presences)); minSize <= size && size <= maxSize {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if len(res.Matches) == limit {
+			break
+		}
+		res.Matches = append(res.Matches, &nakama.Match{
+			MatchId: id,
+			Size:    int32(len(s.matches[id].presences)),
+		})
+	}
+	return res, nil
+}
+
+// ticket is a matchmaker ticket.
+type ticket struct {
+	ticket      string
+	sessionId   string
+	partyId     string
+	presences   []*nakama.UserPresenceMsg
+	minCount    int32
+	maxCount    int32
+	query       string
+	stringProps map[string]string
+	numberProps map[string]float64
+}
+
+// newTicket creates a matchmaker ticket, checking the counts and query.
+func newTicket(minCount, maxCount int32, query string) (*ticket, error) {
+	switch {
+	case minCount < 2:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid minimum count, must be >= 2.")
+	case maxCount < minCount:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid maximum count, must be >= minimum count.")
+	case query == "":
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid matchmaker query.")
+	}
+	return &ticket{
+		ticket:   uuid.New().String(),
+		minCount: minCount,
+		maxCount: maxCount,
+		query:    query,
+	}, nil
+}
+
+// matchmakerAdd handles a matchmaker add message. Must be called with the
+// lock held.
+func (s *Server) matchmakerAdd(sess *session, msg *nakama.MatchmakerAddMsg) (*nakama.Envelope, error) {
+	t, err := newTicket(msg.MinCount, msg.MaxCount, msg.Query)
+	if err != nil {
+		return nil, err
+	}
+	t.sessionId, t.presences = sess.id, []*nakama.UserPresenceMsg{sess.presence(false)}
+	t.stringProps, t.numberProps = msg.StringProperties, msg.NumericProperties
+	s.tickets = append(s.tickets, t)
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_MatchmakerTicket{
+			MatchmakerTicket: &nakama.MatchmakerTicketMsg{
+				Ticket: t.ticket,
+			},
+		},
+	}, nil
+}
+
+// matchmakerRemove handles a matchmaker remove message. Must be called with
+// the lock held.
+func (s *Server) matchmakerRemove(sess *session, msg *nakama.MatchmakerRemoveMsg) error {
+	return s.removeTicket(msg.Ticket, func(t *ticket) bool {
+		return t.sessionId == sess.id && t.partyId == ""
+	})
+}
+
+// removeTicket removes the ticket when f returns true. Must be called with
+// the lock held.
+func (s *Server) removeTicket(id string, f func(*ticket) bool) error {
+	for i, t := range s.tickets {
+		if t.ticket == id && f(t) {
+			s.tickets = append(s.tickets[:i], s.tickets[i+1:]...)
+			return nil
+		}
+	}
+	return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Matchmaker ticket not found.")
+}
+
+// matchmake matches waiting tickets with identical queries, in the order they
+// were added. A match is made as soon as the number of matched users satisfies
+// the minimum and maximum counts of all matched tickets. Must be called with
+// the lock held.
+func (s *Server) matchmake() {
+	for i := 0; i < len(s.tickets); i++ {
+		matched := []*ticket{s.tickets[i]}
+		sessions := make(map[string]bool)
+		for _, p := range s.tickets[i].presences {
+			sessions[p.SessionId] = true
+		}
+		lo, hi, count := s.tickets[i].minCount, s.tickets[i].maxCount, int32(len(s.tickets[i].presences))
+		for _, t := range s.tickets[i+1:] {
+			if lo <= count {
+				break
+			}
+			n := int32(len(t.presences))
+			if t.query != s.tickets[i].query || hi < count+n || t.maxCount < count+n || overlaps(sessions, t.presences) {
+				continue
+			}
+			matched = append(matched, t)
+			for _, p := range t.presences {
+				sessions[p.SessionId] = true
+			}
+			count += n
+			if lo < t.minCount {
+				lo = t.minCount
+			}
+			if t.maxCount < hi {
+				hi = t.maxCount
+			}
+		}
+		if count < lo {
+			continue
+		}
+		s.matched(matched)
+		i = -1
+	}
+}
+
+// matched removes the matched tickets, and sends the matchmaker matched
+// message to the matched users. Must be called with the lock held.
+func (s *Server) matched(matched []*ticket) {
+	token := uuid.New().String()
+	s.matchTokens[token] = uuid.New().String() + "."
+	var users []*nakama.MatchmakerUserMsg
+	for _, t := range matched {
+		for _, p := range t.presences {
+			users = append(users, &nakama.MatchmakerUserMsg{
+				Presence:          p,
+				PartyId:           t.partyId,
+				StringProperties:  t.stringProps,
+				NumericProperties: t.numberProps,
+			})
+		}
+	}
+	for _, t := range matched {
+		_ = s.removeTicket(t.ticket, func(*ticket) bool { return true })
+	}
+	for _, u := range users {
+		sess, ok := s.sessions[u.Presence.SessionId]
+		if !ok {
+			continue
+		}
+		var id string
+		for _, t := range matched {
+			if presenceIndex(t.presences, sess.id) != -1 {
+				id = t.ticket
+			}
+		}
+		s.send(sess, &nakama.Envelope{
+			Message: &nakama.Envelope_MatchmakerMatched{
+				MatchmakerMatched: &nakama.MatchmakerMatchedMsg{
+					Ticket: id,
+					Id: &nakama.MatchmakerMatchedMsg_Token{
+						Token: token,
+					},
+					Users: users,
+					Self:  u,
+				},
+			},
+		})
+	}
+}
+
+// overlaps returns true when any of the presences are in sessions.
+func overlaps(sessions map[string]bool, presences []*nakama.UserPresenceMsg) bool {
+	for _, p := range presences {
+		if sessions[p.SessionId] {
+			return true
+		}
+	}
+	return false
+}
+
+// party is a realtime party.
+type party struct {
+	id       string
+	open     bool
+	maxSize  int32
+	leader   *nakama.UserPresenceMsg
+	members  []*nakama.UserPresenceMsg
+	requests []*nakama.UserPresenceMsg
+}
+
+// msg returns the party message for the session.
+func (p *party) msg(self *nakama.UserPresenceMsg) *nakama.Envelope {
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_Party{
+			Party: &nakama.PartyMsg{
+				PartyId:   p.id,
+				Open:      p.open,
+				MaxSize:   p.maxSize,
+				Self:      self,
+				Leader:    p.leader,
+				Presences: p.members,
+			},
+		},
+	}
+}
+
+// presenceEvent returns a party presence event envelope.
+func (p *party) presenceEvent(joins, leaves []*nakama.UserPresenceMsg) *nakama.Envelope {
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_PartyPresenceEvent{
+			PartyPresenceEvent: &nakama.PartyPresenceEventMsg{
+				PartyId: p.id,
+				Joins:   joins,
+				Leaves:  leaves,
+			},
+		},
+	}
+}
+
+// getParty returns the party, checking that the session is a member (or the
+// leader, when leader is true). Must be called with the lock held.
+func (s *Server) getParty(sess *session, partyId string, leader bool) (*party, error) {
+	p, ok := s.parties[partyId]
+	switch {
+	case !ok:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Party not found.")
+	case leader && p.leader.SessionId != sess.id:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Must be the party leader.")
+	case presenceIndex(p.members, sess.id) == -1:
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Must be a party member.")
+	}
+	return p, nil
+}
+
+// partyCreate handles a party create message. Must be called with the lock
+// held.
+func (s *Server) partyCreate(sess *session, msg *nakama.PartyCreateMsg) (*nakama.Envelope, error) {
+	if msg.MaxSize < 1 || 256 < msg.MaxSize {
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid party max size, must be 1-256.")
+	}
+	self := sess.presence(false)
+	p := &party{
+		id:      uuid.New().String() + ".",
+		open:    msg.Open,
+		maxSize: msg.MaxSize,
+		leader:  self,
+		members: []*nakama.UserPresenceMsg{self},
+	}
+	s.parties[p.id] = p
+	return p.msg(self), nil
+}
+
+// partyJoin handles a party join message. Must be called with the lock held.
+func (s *Server) partyJoin(sess *session, msg *nakama.PartyJoinMsg) error {
+	p, ok := s.parties[msg.PartyId]
+	switch {
+	case !ok:
+		return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Party not found.")
+	case presenceIndex(p.members, sess.id) != -1:
+		return nil
+	case int32(len(p.members)) >= p.maxSize:
+		return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Party is full.")
+	case !p.open:
+		if presenceIndex(p.requests, sess.id) == -1 {
+			self := sess.presence(false)
+			p.requests = append(p.requests, self)
+			s.sendPresences([]*nakama.UserPresenceMsg{p.leader}, "", &nakama.Envelope{
+				Message: &nakama.Envelope_PartyJoinRequest{
+					PartyJoinRequest: &nakama.PartyJoinRequestMsg{
+						PartyId:   p.id,
+						Presences: []*nakama.UserPresenceMsg{self},
+					},
+				},
+			})
+		}
+		return nil
+	}
+	s.addPartyMember(p, sess.presence(false))
+	return nil
+}
+
+// addPartyMember adds the member to the party. Must be called with the lock
+// held.
+func (s *Server) addPartyMember(p *party, self *nakama.UserPresenceMsg) {
+	s.sendPresences(p.members, "", p.presenceEvent([]*nakama.UserPresenceMsg{self}, nil))
+	p.members = append(p.members, self)
+	s.sendPresences([]*nakama.UserPresenceMsg{self}, "", p.msg(self))
+}
+
+// partyLeave handles a party leave message. Must be called with the lock
+// held.
+func (s *Server) partyLeave(sess *session, partyId string) error {
+	p, ok := s.parties[partyId]
+	if !ok {
+		return nil
+	}
+	i := presenceIndex(p.members, sess.id)
+	if i == -1 {
+		return nil
+	}
+	self := p.members[i]
+	p.members = removePresence(p.members, sess.id)
+	if len(p.members) == 0 {
+		s.deleteParty(p)
+		return nil
+	}
+	s.sendPresences(p.members, "", p.presenceEvent(nil, []*nakama.UserPresenceMsg{self}))
+	if p.leader.SessionId == sess.id {
+		p.leader = p.members[0]
+		s.sendPresences(p.members, "", partyLeader(p))
+	}
+	return nil
+}
+
+// deleteParty deletes the party and its matchmaker tickets. Must be called
+// with the lock held.
+func (s *Server) deleteParty(p *party) {
+	delete(s.parties, p.id)
+	var tickets []*ticket
+	for _, t := range s.tickets {
+		if t.partyId != p.id {
+			tickets = append(tickets, t)
+		}
+	}
+	s.tickets = tickets
+}
+
+// partyPromote handles a party promote message. Must be called with the lock
+// held.
+func (s *Server) partyPromote(sess *session, msg *nakama.PartyPromoteMsg) (*nakama.Envelope, error) {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return nil, err
+	}
+	i := presenceIndex(p.members, msg.Presence.GetSessionId())
+	if i == -1 {
+		return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Presence is not a party member.")
+	}
+	p.leader = p.members[i]
+	s.sendPresences(p.members, sess.id, partyLeader(p))
+	return partyLeader(p), nil
+}
+
+// partyLeader returns a party leader envelope.
+func partyLeader(p *party) *nakama.Envelope {
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_PartyLeader{
+			PartyLeader: &nakama.PartyLeaderMsg{
+				PartyId:  p.id,
+				Presence: p.leader,
+			},
+		},
+	}
+}
+
+// partyAccept handles a party accept message. Must be called with the lock
+// held.
+func (s *Server) partyAccept(sess *session, msg *nakama.PartyAcceptMsg) error {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return err
+	}
+	i := presenceIndex(p.requests, msg.Presence.GetSessionId())
+	switch {
+	case i == -1:
+		return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Presence has not requested to join the party.")
+	case int32(len(p.members)) >= p.maxSize:
+		return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Party is full.")
+	}
+	self := p.requests[i]
+	p.requests = removePresence(p.requests, self.SessionId)
+	s.addPartyMember(p, self)
+	return nil
+}
+
+// partyRemove handles a party remove message. Must be called with the lock
+// held.
+func (s *Server) partyRemove(sess *session, msg *nakama.PartyRemoveMsg) error {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return err
+	}
+	id := msg.Presence.GetSessionId()
+	if i := presenceIndex(p.requests, id); i != -1 {
+		p.requests = removePresence(p.requests, id)
+		return nil
+	}
+	i := presenceIndex(p.members, id)
+	switch {
+	case i == -1:
+		return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Presence is not a party member.")
+	case id == sess.id:
+		return rtErrorf(nakama.ErrorCode_BAD_INPUT, "Cannot remove self from the party.")
+	}
+	env := p.presenceEvent(nil, []*nakama.UserPresenceMsg{p.members[i]})
+	s.sendPresences(p.members, "", env)
+	p.members = removePresence(p.members, id)
+	return nil
+}
+
+// partyClose handles a party close message. Must be called with the lock
+// held.
+func (s *Server) partyClose(sess *session, msg *nakama.PartyCloseMsg) error {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return err
+	}
+	s.sendPresences(p.members, sess.id, &nakama.Envelope{
+		Message: &nakama.Envelope_PartyClose{
+			PartyClose: &nakama.PartyCloseMsg{
+				PartyId: p.id,
+			},
+		},
+	})
+	s.deleteParty(p)
+	return nil
+}
+
+// partyJoinRequests handles a party join request list message. Must be
+// called with the lock held.
+func (s *Server) partyJoinRequests(sess *session, msg *nakama.PartyJoinRequestsMsg) (*nakama.Envelope, error) {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return nil, err
+	}
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_PartyJoinRequest{
+			PartyJoinRequest: &nakama.PartyJoinRequestMsg{
+				PartyId:   p.id,
+				Presences: p.requests,
+			},
+		},
+	}, nil
+}
+
+// partyMatchmakerAdd handles a party matchmaker add message. Must be called
+// with the lock held.
+func (s *Server) partyMatchmakerAdd(sess *session, msg *nakama.PartyMatchmakerAddMsg) (*nakama.Envelope, error) {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTicket(msg.MinCount, msg.MaxCount, msg.Query)
+	if err != nil {
+		return nil, err
+	}
+	t.sessionId, t.partyId = sess.id, p.id
+	t.presences = append([]*nakama.UserPresenceMsg(nil), p.members...)
+	t.stringProps, t.numberProps = msg.StringProperties, msg.NumericProperties
+	s.tickets = append(s.tickets, t)
+	env := &nakama.Envelope{
+		Message: &nakama.Envelope_PartyMatchmakerTicket{
+			PartyMatchmakerTicket: &nakama.PartyMatchmakerTicketMsg{
+				PartyId: p.id,
+				Ticket:  t.ticket,
+			},
+		},
+	}
+	// the response is assigned the request's cid, so send a copy
+	s.sendPresences(p.members, sess.id, proto.Clone(env).(*nakama.Envelope))
+	return env, nil
+}
+
+// partyMatchmakerRemove handles a party matchmaker remove message. Must be
+// called with the lock held.
+func (s *Server) partyMatchmakerRemove(sess *session, msg *nakama.PartyMatchmakerRemoveMsg) error {
+	p, err := s.getParty(sess, msg.PartyId, true)
+	if err != nil {
+		return err
+	}
+	return s.removeTicket(msg.Ticket, func(t *ticket) bool {
+		return t.partyId == p.id
+	})
+}
+
+// partyDataSend handles a party data send message. Must be called with the
+// lock held.
+func (s *Server) partyDataSend(sess *session, msg *nakama.PartyDataSendMsg) error {
+	p, err := s.getParty(sess, msg.PartyId, false)
+	if err != nil {
+		return err
+	}
+	s.sendPresences(p.members, sess.id, &nakama.Envelope{
+		Message: &nakama.Envelope_PartyData{
+			PartyData: &nakama.PartyDataMsg{
+				PartyId:  p.id,
+				Presence: p.members[presenceIndex(p.members, sess.id)],
+				OpCode:   msg.OpCode,
+				Data:     msg.Data,
+			},
+		},
+	})
+	return nil
+}
+
+// statusFollow handles a status follow message. Must be called with the lock
+// held.
+func (s *Server) statusFollow(sess *session, msg *nakama.StatusFollowMsg) (*nakama.Envelope, error) {
+	ids := append([]string(nil), msg.UserIds...)
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, rtErrorf(nakama.ErrorCode_BAD_INPUT, "Invalid user ID.")
+		}
+	}
+	for _, username := range msg.Usernames {
+		if id, ok := s.usernames[strings.ToLower(username)]; ok {
+			ids = append(ids, id)
+		}
+	}
+	res := new(nakama.StatusMsg)
+	for _, id := range ids {
+		if id == sess.userId || sess.follows[id] || s.accounts[id] == nil {
+			continue
+		}
+		sess.follows[id] = true
+		for _, other := range s.sessions {
+			if other.userId == id && other.appear {
+				res.Presences = append(res.Presences, other.statusPresence())
+			}
+		}
+	}
+	return &nakama.Envelope{
+		Message: &nakama.Envelope_Status{
+			Status: res,
+		},
+	}, nil
+}
+
+// statusUpdate handles a status update message. Must be called with the lock
+// held.
+func (s *Server) statusUpdate(sess *session, msg *nakama.StatusUpdateMsg) {
+	var joins, leaves []*nakama.UserPresenceMsg
+	if sess.appear {
+		leaves = append(leaves, sess.statusPresence())
+	}
+	sess.appear = msg.Status != nil
+	if sess.appear {
+		sess.status = msg.Status.Value
+		joins = append(joins, sess.statusPresence())
+	}
+	if len(joins) != 0 || len(leaves) != 0 {
+		s.statusEvent(sess, joins, leaves)
+	}
+}
+
+// statusEvent sends a status presence event to the followers of the
+// session's user. Must be called with the lock held.
+func (s *Server) statusEvent(sess *session, joins, leaves []*nakama.UserPresenceMsg) {
+	env := &nakama.Envelope{
+		Message: &nakama.Envelope_StatusPresenceEvent{
+			StatusPresenceEvent: &nakama.StatusPresenceEventMsg{
+				Joins:  joins,
+				Leaves: leaves,
+			},
+		},
+	}
+	for _, other := range s.sessions {
+		if other.follows[sess.userId] && other.userId != sess.userId {
+			s.send(other, env)
+		}
+	}
+}
+
+// presenceIndex returns the index of the session's presence, or -1.
+func presenceIndex(presences []*nakama.UserPresenceMsg, sessionId string) int {
+	for i, p := range presences {
+		if p.SessionId == sessionId {
+			return i
+		}
+	}
+	return -1
+}
+
+// removePresence returns the presences without the session's presence.
+func removePresence(presences []*nakama.UserPresenceMsg, sessionId string) []*nakama.UserPresenceMsg {
+	var v []*nakama.UserPresenceMsg
+	for _, p := range presences {
+		if p.SessionId != sessionId {
+			v = append(v, p)
+		}
+	}
+	return v
+}
+
+// isJSONObject returns true when the string is a JSON object.
+func isJSONObject(s string) bool {
+	var v map[string]interface{}
+	return json.Unmarshal([]byte(s), &v) == nil && v != nil
+}
+
+// rtErrorf creates a realtime error.
+func rtErrorf(code nakama.ErrorCode, s string, v ...interface{}) *nakama.ErrorMsg {
+	if len(v) != 0 {
+		s = fmt.Sprintf(s, v...)
+	}
+	return &nakama.ErrorMsg{
+		Code:    int32(code),
+		Message: s,
+	}
+}
@@ -0,0 +1,699 @@
+package nakamatest
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Friend states.
+const (
+	stateFriend         = int32(nakama.FriendState_FRIEND)
+	stateInviteSent     = int32(nakama.FriendState_INVITE_SENT)
+	stateInviteReceived = int32(nakama.FriendState_INVITE_RECEIVED)
+	stateBlocked        = int32(nakama.FriendState_BLOCKED)
+)
+
+// Group user states.
+const (
+	stateSuperadmin  = int32(nakama.UserRoleState_SUPERADMIN)
+	stateAdmin       = int32(nakama.UserRoleState_ADMIN)
+	stateMember      = int32(nakama.UserRoleState_MEMBER)
+	stateJoinRequest = int32(nakama.UserRoleState_JOIN_REQUEST)
+)
+
+// edge is a friend edge.
+type edge struct {
+	state      int32
+	seq        int64
+	updateTime time.Time
+}
+
+// setEdge sets the edge state from a to b. Must be called with the lock held.
+func (s *Server) setEdge(a, b string, state int32) {
+	m, ok := s.edges[a]
+	if !ok {
+		m = make(map[string]*edge)
+		s.edges[a] = m
+	}
+	m[b] = &edge{
+		state:      state,
+		seq:        s.nextSeq(),
+		updateTime: time.Now(),
+	}
+}
+
+// edgeState returns the edge state from a to b.
+func (s *Server) edgeState(a, b string) (int32, bool) {
+	if e, ok := s.edges[a][b]; ok {
+		return e.state, true
+	}
+	return 0, false
+}
+
+// friendIds returns the user ids from the request query and the ids and
+// usernames, resolving usernames. Must be called with the lock held.
+func (s *Server) friendIds(req *request, ids, usernames []string, self string) ([]string, error) {
+	ids, usernames = append(req.queryList("ids"), ids...), append(req.queryList("usernames"), usernames...)
+	if len(ids) == 0 && len(usernames) == 0 {
+		return nil, nil
+	}
+	var v []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, errorf(nakama.CodeInvalidArgument, "Invalid user ID '%s'.", id)
+		}
+	}
+	for _, username := range usernames {
+		if id := s.usernames[strings.ToLower(username)]; id != "" {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		switch {
+		case id == req.userId:
+			return nil, errorf(nakama.CodeInvalidArgument, self)
+		case seen[id] || s.accounts[id] == nil:
+			continue
+		}
+		seen[id] = true
+		v = append(v, id)
+	}
+	return v, nil
+}
+
+// addFriends handles an add friends request.
+func (s *Server) addFriends(req *request) (interface{}, error) {
+	msg := new(nakama.AddFriendsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.friendIds(req, msg.Ids, msg.Usernames, "Cannot add self as friend.")
+	if err != nil {
+		return nil, err
+	}
+	content := map[string]string{
+		"username": req.username,
+	}
+	for _, id := range ids {
+		mine, _ := s.edgeState(req.userId, id)
+		theirs, ok := s.edgeState(id, req.userId)
+		switch {
+		case theirs == stateBlocked && ok:
+		case mine == stateInviteReceived:
+			s.setEdge(req.userId, id, stateFriend)
+			s.setEdge(id, req.userId, stateFriend)
+			s.notifyJSON(id, req.username+" accepted your friend request", content, nakama.NotificationFriendAccept, req.userId)
+		case !ok || mine == stateBlocked:
+			s.setEdge(req.userId, id, stateInviteSent)
+			s.setEdge(id, req.userId, stateInviteReceived)
+			s.notifyJSON(id, req.username+" wants to add you as a friend", content, nakama.NotificationFriendRequest, req.userId)
+		}
+	}
+	return nil, nil
+}
+
+// deleteFriends handles a delete friends request.
+func (s *Server) deleteFriends(req *request) (interface{}, error) {
+	msg := new(nakama.DeleteFriendsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.friendIds(req, msg.Ids, msg.Usernames, "Cannot delete self.")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		delete(s.edges[req.userId], id)
+		if state, _ := s.edgeState(id, req.userId); state != stateBlocked {
+			delete(s.edges[id], req.userId)
+		}
+	}
+	return nil, nil
+}
+
+// blockFriends handles a block friends request.
+func (s *Server) blockFriends(req *request) (interface{}, error) {
+	msg := new(nakama.BlockFriendsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.friendIds(req, msg.Ids, msg.Usernames, "Cannot block self.")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.setEdge(req.userId, id, stateBlocked)
+		if state, _ := s.edgeState(id, req.userId); state != stateBlocked {
+			delete(s.edges[id], req.userId)
+		}
+	}
+	return nil, nil
+}
+
+// listFriends handles a list friends request.
+func (s *Server) listFriends(req *request) (interface{}, error) {
+	limit, err := req.limit(1000, 1000)
+	if err != nil {
+		return nil, err
+	}
+	state, err := req.queryInt("state", -1)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type friend struct {
+		id string
+		e  *edge
+	}
+	var friends []friend
+	for id, e := range s.edges[req.userId] {
+		if state == -1 || int64(e.state) == state {
+			friends = append(friends, friend{id, e})
+		}
+	}
+	sort.Slice(friends, func(i, j int) bool {
+		if friends[i].e.state != friends[j].e.state {
+			return friends[i].e.state < friends[j].e.state
+		}
+		return friends[i].e.seq < friends[j].e.seq
+	})
+	start, end, cursor := page(len(friends), offset, limit)
+	res := &nakama.FriendsResponse{
+		Cursor: cursor,
+	}
+	for _, f := range friends[start:end] {
+		res.Friends = append(res.Friends, &nakama.Friend{
+			User:       s.user(f.id),
+			State:      wrapperspb.Int32(f.e.state),
+			UpdateTime: timestamppb.New(f.e.updateTime),
+		})
+	}
+	return res, nil
+}
+
+// group is a user group.
+type group struct {
+	g       *nakama.Group
+	seq     int64
+	members map[string]*groupMember
+	banned  map[string]bool
+}
+
+// groupMember is a group member.
+type groupMember struct {
+	state int32
+	seq   int64
+}
+
+// state returns the user's state in the group.
+func (g *group) state(userId string) (int32, bool) {
+	if m, ok := g.members[userId]; ok {
+		return m.state, true
+	}
+	return 0, false
+}
+
+// count returns the number of group members, excluding join requests.
+func (g *group) count() int32 {
+	var n int32
+	for _, m := range g.members {
+		if m.state != stateJoinRequest {
+			n++
+		}
+	}
+	return n
+}
+
+// superadmins returns the number of group superadmins.
+func (g *group) superadmins() int {
+	n := 0
+	for _, m := range g.members {
+		if m.state == stateSuperadmin {
+			n++
+		}
+	}
+	return n
+}
+
+// msg returns the group message.
+func (g *group) msg() *nakama.Group {
+	v := proto.Clone(g.g).(*nakama.Group)
+	v.EdgeCount = g.count()
+	return v
+}
+
+// getGroup returns the group. Must be called with the lock held.
+func (s *Server) getGroup(groupId string) (*group, error) {
+	g, ok := s.groups[groupId]
+	if !ok {
+		return nil, errorf(nakama.CodeNotFound, "Group not found.")
+	}
+	return g, nil
+}
+
+// getGroupAdmin returns the group, checking that the user is a group admin
+// or superadmin. Must be called with the lock held.
+func (s *Server) getGroupAdmin(groupId, userId, msg string) (*group, int32, error) {
+	g, err := s.getGroup(groupId)
+	if err != nil {
+		return nil, 0, err
+	}
+	state, ok := g.state(userId)
+	if !ok || stateAdmin < state {
+		return nil, 0, errorf(nakama.CodePermissionDenied, msg)
+	}
+	return g, state, nil
+}
+
+// setMember sets the user's state in the group. Must be called with the lock
+// held.
+func (s *Server) setMember(g *group, userId string, state int32) {
+	if m, ok := g.members[userId]; ok {
+		m.state = state
+		return
+	}
+	g.members[userId] = &groupMember{
+		state: state,
+		seq:   s.nextSeq(),
+	}
+}
+
+// addMember adds the user as a member of the group, notifying the user. Must
+// be called with the lock held.
+func (s *Server) addMember(g *group, userId, senderId string) error {
+	if g.count() >= g.g.MaxCount {
+		return errorf(nakama.CodeInvalidArgument, "Group is full.")
+	}
+	s.setMember(g, userId, stateMember)
+	s.notifyJSON(userId, "You've been added to group "+g.g.Name, map[string]string{
+		"group_id": g.g.Id,
+		"name":     g.g.Name,
+	}, nakama.NotificationGroupAdd, senderId)
+	return nil
+}
+
+// createGroup handles a create group request.
+func (s *Server) createGroup(req *request) (interface{}, error) {
+	msg := new(nakama.CreateGroupRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.Name == "":
+		return nil, errorf(nakama.CodeInvalidArgument, "Group name must be set.")
+	case msg.MaxCount < 0:
+		return nil, errorf(nakama.CodeInvalidArgument, "Group max count must be >= 1 when set.")
+	}
+	if msg.MaxCount == 0 {
+		msg.MaxCount = 100
+	}
+	if msg.LangTag == "" {
+		msg.LangTag = "en"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.groupByName(msg.Name) != nil {
+		return nil, errorf(nakama.CodeAlreadyExists, "Group name is in use.")
+	}
+	now := timestamppb.New(time.Now())
+	g := &group{
+		g: &nakama.Group{
+			Id:          uuid.New().String(),
+			CreatorId:   req.userId,
+			Name:        msg.Name,
+			Description: msg.Description,
+			LangTag:     msg.LangTag,
+			Metadata:    "{}",
+			AvatarUrl:   msg.AvatarUrl,
+			Open:        wrapperspb.Bool(msg.Open),
+			MaxCount:    msg.MaxCount,
+			CreateTime:  now,
+			UpdateTime:  now,
+		},
+		seq:     s.nextSeq(),
+		members: make(map[string]*groupMember),
+		banned:  make(map[string]bool),
+	}
+	s.setMember(g, req.userId, stateSuperadmin)
+	s.groups[g.g.Id] = g
+	return g.msg(), nil
+}
+
+// groupByName returns the group with the name. Must be called with the lock
+// held.
+func (s *Server) groupByName(name string) *group {
+	for _, g := range s.groups {
+		if strings.EqualFold(g.g.Name, name) {
+			return g
+		}
+	}
+	return nil
+}
+
+// updateGroup handles an update group request.
+func (s *Server) updateGroup(req *request) (interface{}, error) {
+	msg := new(nakama.UpdateGroupRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, _, err := s.getGroupAdmin(req.param("groupId"), req.userId, "User does not have permission to update group.")
+	if err != nil {
+		return nil, err
+	}
+	if msg.Name != nil {
+		switch other := s.groupByName(msg.Name.Value); {
+		case msg.Name.Value == "":
+			return nil, errorf(nakama.CodeInvalidArgument, "Group name cannot be empty.")
+		case other != nil && other != g:
+			return nil, errorf(nakama.CodeAlreadyExists, "Group name is in use.")
+		}
+		g.g.Name = msg.Name.Value
+	}
+	if msg.Description != nil {
+		g.g.Description = msg.Description.Value
+	}
+	if msg.LangTag != nil {
+		g.g.LangTag = msg.LangTag.Value
+	}
+	if msg.AvatarUrl != nil {
+		g.g.AvatarUrl = msg.AvatarUrl.Value
+	}
+	if msg.Open != nil {
+		g.g.Open = wrapperspb.Bool(msg.Open.Value)
+	}
+	g.g.UpdateTime = timestamppb.New(time.Now())
+	return nil, nil
+}
+
+// deleteGroup handles a delete group request.
+func (s *Server) deleteGroup(req *request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.getGroup(req.param("groupId"))
+	if err != nil {
+		return nil, err
+	}
+	if state, ok := g.state(req.userId); !ok || state != stateSuperadmin {
+		return nil, errorf(nakama.CodePermissionDenied, "User does not have permission to delete group.")
+	}
+	delete(s.groups, g.g.Id)
+	return nil, nil
+}
+
+// joinGroup handles a join group request.
+func (s *Server) joinGroup(req *request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.getGroup(req.param("groupId"))
+	if err != nil {
+		return nil, err
+	}
+	switch _, ok := g.state(req.userId); {
+	case ok:
+		return nil, nil
+	case g.banned[req.userId]:
+		return nil, errorf(nakama.CodePermissionDenied, "User is banned from the group.")
+	case g.g.Open.GetValue():
+		if g.count() >= g.g.MaxCount {
+			return nil, errorf(nakama.CodeInvalidArgument, "Group is full.")
+		}
+		s.setMember(g, req.userId, stateMember)
+		return nil, nil
+	}
+	s.setMember(g, req.userId, stateJoinRequest)
+	for id, m := range g.members {
+		if m.state <= stateAdmin {
+			s.notifyJSON(id, "User "+req.username+" wants to join your group", map[string]string{
+				"group_id": g.g.Id,
+				"username": req.username,
+			}, nakama.NotificationGroupJoinRequest, req.userId)
+		}
+	}
+	return nil, nil
+}
+
+// leaveGroup handles a leave group request.
+func (s *Server) leaveGroup(req *request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.getGroup(req.param("groupId"))
+	if err != nil {
+		return nil, err
+	}
+	switch state, ok := g.state(req.userId); {
+	case !ok:
+		return nil, nil
+	case state == stateSuperadmin && g.superadmins() == 1:
+		return nil, errorf(nakama.CodeInvalidArgument, "Cannot leave group when you are the last superadmin.")
+	}
+	delete(g.members, req.userId)
+	return nil, nil
+}
+
+// groupUsersRequest is the common request for the add, ban, demote, kick, and
+// promote group users requests.
+type groupUsersRequest interface {
+	proto.Message
+	GetUserIds() []string
+}
+
+// groupUsers decodes the request and calls f for each of the users in the
+// request, when the requesting user is a group admin or superadmin.
+func (s *Server) groupUsers(req *request, msg groupUsersRequest, f func(g *group, state int32, userId string) error) (interface{}, error) {
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	for _, id := range msg.GetUserIds() {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, errorf(nakama.CodeInvalidArgument, "Invalid user ID '%s'.", id)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, state, err := s.getGroupAdmin(req.param("groupId"), req.userId, "User does not have permission to modify group users.")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range msg.GetUserIds() {
+		if id == req.userId || s.accounts[id] == nil {
+			continue
+		}
+		if err := f(g, state, id); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// addGroupUsers handles an add group users request.
+func (s *Server) addGroupUsers(req *request) (interface{}, error) {
+	return s.groupUsers(req, new(nakama.AddGroupUsersRequest), func(g *group, _ int32, userId string) error {
+		if state, ok := g.state(userId); ok && state != stateJoinRequest {
+			return nil
+		}
+		delete(g.banned, userId)
+		return s.addMember(g, userId, req.userId)
+	})
+}
+
+// banGroupUsers handles a ban group users request.
+func (s *Server) banGroupUsers(req *request) (interface{}, error) {
+	return s.groupUsers(req, new(nakama.BanGroupUsersRequest), func(g *group, state int32, userId string) error {
+		if other, ok := g.state(userId); ok && other <= state {
+			return nil
+		}
+		delete(g.members, userId)
+		g.banned[userId] = true
+		return nil
+	})
+}
+
+// kickGroupUsers handles a kick group users request.
+func (s *Server) kickGroupUsers(req *request) (interface{}, error) {
+	return s.groupUsers(req, new(nakama.KickGroupUsersRequest), func(g *group, state int32, userId string) error {
+		if other, ok := g.state(userId); ok && state < other {
+			delete(g.members, userId)
+		}
+		return nil
+	})
+}
+
+// promoteGroupUsers handles a promote group users request.
+func (s *Server) promoteGroupUsers(req *request) (interface{}, error) {
+	return s.groupUsers(req, new(nakama.PromoteGroupUsersRequest), func(g *group, state int32, userId string) error {
+		switch other, ok := g.state(userId); {
+		case !ok || other < state || other == stateSuperadmin:
+		case other == stateJoinRequest:
+			return s.addMember(g, userId, req.userId)
+		default:
+			s.setMember(g, userId, other-1)
+		}
+		return nil
+	})
+}
+
+// demoteGroupUsers handles a demote group users request.
+func (s *Server) demoteGroupUsers(req *request) (interface{}, error) {
+	return s.groupUsers(req, new(nakama.DemoteGroupUsersRequest), func(g *group, state int32, userId string) error {
+		switch other, ok := g.state(userId); {
+		case !ok || other < state || other >= stateMember:
+		case other == stateSuperadmin && g.superadmins() == 1:
+			return errorf(nakama.CodeInvalidArgument, "Cannot demote the last superadmin.")
+		default:
+			s.setMember(g, userId, other+1)
+		}
+		return nil
+	})
+}
+
+// listGroupUsers handles a list group users request.
+func (s *Server) listGroupUsers(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 100)
+	if err != nil {
+		return nil, err
+	}
+	state, err := req.queryInt("state", -1)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.getGroup(req.param("groupId"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id, m := range g.members {
+		if state == -1 || int64(m.state) == state {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := g.members[ids[i]], g.members[ids[j]]
+		if a.state != b.state {
+			return a.state < b.state
+		}
+		return a.seq < b.seq
+	})
+	start, end, cursor := page(len(ids), offset, limit)
+	res := &nakama.GroupUsersResponse{
+		Cursor: cursor,
+	}
+	for _, id := range ids[start:end] {
+		res.GroupUsers = append(res.GroupUsers, &nakama.GroupUser{
+			User:  s.user(id),
+			State: wrapperspb.Int32(g.members[id].state),
+		})
+	}
+	return res, nil
+}
+
+// listUserGroups handles a list user groups request.
+func (s *Server) listUserGroups(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 100)
+	if err != nil {
+		return nil, err
+	}
+	state, err := req.queryInt("state", -1)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	userId := req.param("userId")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var groups []*group
+	for _, g := range s.groups {
+		if m, ok := g.members[userId]; ok && (state == -1 || int64(m.state) == state) {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].seq < groups[j].seq
+	})
+	start, end, cursor := page(len(groups), offset, limit)
+	res := &nakama.UserGroupsResponse{
+		Cursor: cursor,
+	}
+	for _, g := range groups[start:end] {
+		res.UserGroups = append(res.UserGroups, &nakama.UserGroup{
+			Group: g.msg(),
+			State: wrapperspb.Int32(g.members[userId].state),
+		})
+	}
+	return res, nil
+}
+
+// listGroups handles a list groups request.
+func (s *Server) listGroups(req *request) (interface{}, error) {
+	limit, err := req.limit(100, 100)
+	if err != nil {
+		return nil, err
+	}
+	members, err := req.queryInt("members", -1)
+	if err != nil {
+		return nil, err
+	}
+	open, err := req.queryBool("open")
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	name, langTag := strings.ToLower(req.query("name")), req.query("langTag")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var groups []*group
+	for _, g := range s.groups {
+		switch n := strings.ToLower(g.g.Name); {
+		case strings.HasSuffix(name, "%") && !strings.HasPrefix(n, strings.TrimSuffix(name, "%")),
+			name != "" && !strings.HasSuffix(name, "%") && n != name,
+			langTag != "" && g.g.LangTag != langTag,
+			members != -1 && int64(g.count()) > members,
+			open != nil && g.g.Open.GetValue() != *open:
+			continue
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return strings.ToLower(groups[i].g.Name) < strings.ToLower(groups[j].g.Name)
+	})
+	start, end, cursor := page(len(groups), offset, limit)
+	res := &nakama.GroupsResponse{
+		Cursor: cursor,
+	}
+	for _, g := range groups[start:end] {
+		res.Groups = append(res.Groups, g.msg())
+	}
+	return res, nil
+}
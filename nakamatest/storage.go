@@ -0,0 +1,231 @@
+package nakamatest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/ascii8/nakama-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Storage permissions.
+const (
+	permissionNoRead     int32 = 0
+	permissionOwnerRead  int32 = 1
+	permissionPublicRead int32 = 2
+	permissionNoWrite    int32 = 0
+	permissionOwnerWrite int32 = 1
+)
+
+// storageKey is a storage object key.
+type storageKey struct {
+	collection string
+	key        string
+	userId     string
+}
+
+// WriteStorageObject writes a storage object directly to the server's storage,
+// bypassing permission and version checks (as a server runtime would). An
+// empty userId writes a system owned object.
+func (s *Server) WriteStorageObject(userId string, obj *nakama.WriteStorageObject) (*nakama.StorageObjectAck, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := checkStorageObject(obj); err != nil {
+		return nil, err
+	}
+	return s.writeStorageObject(userId, obj), nil
+}
+
+// readStorageObjects handles a read storage objects request.
+func (s *Server) readStorageObjects(req *request) (interface{}, error) {
+	msg := new(nakama.ReadStorageObjectsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	for _, id := range msg.ObjectIds {
+		if id.Collection == "" || id.Key == "" {
+			return nil, errorf(nakama.CodeInvalidArgument, "Invalid collection or key value supplied.")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := new(nakama.ReadStorageObjectsResponse)
+	for _, id := range msg.ObjectIds {
+		obj, ok := s.storage[storageKey{id.Collection, id.Key, id.UserId}]
+		if ok && canRead(obj, req.userId) {
+			res.Objects = append(res.Objects, proto.Clone(obj).(*nakama.StorageObject))
+		}
+	}
+	return res, nil
+}
+
+// writeStorageObjects handles a write storage objects request.
+func (s *Server) writeStorageObjects(req *request) (interface{}, error) {
+	msg := new(nakama.WriteStorageObjectsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	for _, obj := range msg.Objects {
+		if err := checkStorageObject(obj); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// check all before writing any
+	for _, obj := range msg.Objects {
+		prev, ok := s.storage[storageKey{obj.Collection, obj.Key, req.userId}]
+		switch {
+		case ok && prev.PermissionWrite == permissionNoWrite:
+			return nil, errorf(nakama.CodeInvalidArgument, "Storage write rejected - permission denied.")
+		case obj.Version == "*" && ok,
+			obj.Version != "" && obj.Version != "*" && (!ok || prev.Version != obj.Version):
+			return nil, errorf(nakama.CodeInvalidArgument, "Storage write rejected - version check failed.")
+		}
+	}
+	res := new(nakama.WriteStorageObjectsResponse)
+	for _, obj := range msg.Objects {
+		res.Acks = append(res.Acks, s.writeStorageObject(req.userId, obj))
+	}
+	return res, nil
+}
+
+// writeStorageObject writes the storage object. Must be called with the lock
+// held.
+func (s *Server) writeStorageObject(userId string, obj *nakama.WriteStorageObject) *nakama.StorageObjectAck {
+	k := storageKey{obj.Collection, obj.Key, userId}
+	now := timestamppb.New(time.Now())
+	v := &nakama.StorageObject{
+		Collection:      obj.Collection,
+		Key:             obj.Key,
+		UserId:          userId,
+		Value:           obj.Value,
+		Version:         storageVersion(obj.Value),
+		PermissionRead:  permissionOwnerRead,
+		PermissionWrite: permissionOwnerWrite,
+		CreateTime:      now,
+		UpdateTime:      now,
+	}
+	if obj.PermissionRead != nil {
+		v.PermissionRead = obj.PermissionRead.Value
+	}
+	if obj.PermissionWrite != nil {
+		v.PermissionWrite = obj.PermissionWrite.Value
+	}
+	if prev, ok := s.storage[k]; ok {
+		v.CreateTime = prev.CreateTime
+	}
+	s.storage[k] = v
+	return &nakama.StorageObjectAck{
+		Collection: v.Collection,
+		Key:        v.Key,
+		Version:    v.Version,
+		UserId:     v.UserId,
+	}
+}
+
+// deleteStorageObjects handles a delete storage objects request.
+func (s *Server) deleteStorageObjects(req *request) (interface{}, error) {
+	msg := new(nakama.DeleteStorageObjectsRequest)
+	if err := req.decode(msg); err != nil {
+		return nil, err
+	}
+	for _, id := range msg.ObjectIds {
+		if id.Collection == "" || id.Key == "" {
+			return nil, errorf(nakama.CodeInvalidArgument, "Invalid collection or key value supplied.")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// check all before deleting any
+	for _, id := range msg.ObjectIds {
+		prev, ok := s.storage[storageKey{id.Collection, id.Key, req.userId}]
+		switch {
+		case ok && prev.PermissionWrite == permissionNoWrite:
+			return nil, errorf(nakama.CodeInvalidArgument, "Storage delete rejected - permission denied.")
+		case id.Version != "" && (!ok || prev.Version != id.Version):
+			return nil, errorf(nakama.CodeInvalidArgument, "Storage delete rejected - version check failed.")
+		}
+	}
+	for _, id := range msg.ObjectIds {
+		delete(s.storage, storageKey{id.Collection, id.Key, req.userId})
+	}
+	return nil, nil
+}
+
+// listStorageObjects handles a list storage objects request.
+func (s *Server) listStorageObjects(req *request) (interface{}, error) {
+	collection, userId := req.param("collection"), req.query("userId")
+	limit, err := req.limit(100, 100)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffset(req.query("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objs []*nakama.StorageObject
+	for k, obj := range s.storage {
+		switch {
+		case k.collection != collection,
+			userId != "" && k.userId != userId,
+			userId == "" && obj.PermissionRead != permissionPublicRead,
+			!canRead(obj, req.userId):
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		if objs[i].UserId != objs[j].UserId {
+			return objs[i].UserId < objs[j].UserId
+		}
+		return objs[i].Key < objs[j].Key
+	})
+	start, end, cursor := page(len(objs), offset, limit)
+	res := &nakama.StorageObjectsResponse{
+		Cursor: cursor,
+	}
+	for _, obj := range objs[start:end] {
+		res.Objects = append(res.Objects, proto.Clone(obj).(*nakama.StorageObject))
+	}
+	return res, nil
+}
+
+// canRead returns true when the user can read the storage object.
+func canRead(obj *nakama.StorageObject, userId string) bool {
+	switch obj.PermissionRead {
+	case permissionPublicRead:
+		return true
+	case permissionOwnerRead:
+		return obj.UserId != "" && obj.UserId == userId
+	}
+	return false
+}
+
+// checkStorageObject checks that the storage object write is valid.
+func checkStorageObject(obj *nakama.WriteStorageObject) error {
+	var v map[string]interface{}
+	switch {
+	case obj.Collection == "" || obj.Key == "":
+		return errorf(nakama.CodeInvalidArgument, "Invalid collection or key value supplied.")
+	case json.Unmarshal([]byte(obj.Value), &v) != nil || v == nil:
+		return errorf(nakama.CodeInvalidArgument, "Value must be a JSON object.")
+	case obj.PermissionRead != nil && (obj.PermissionRead.Value < permissionNoRead || permissionPublicRead < obj.PermissionRead.Value):
+		return errorf(nakama.CodeInvalidArgument, "Invalid read permission supplied. It must be either 0, 1 or 2.")
+	case obj.PermissionWrite != nil && (obj.PermissionWrite.Value < permissionNoWrite || permissionOwnerWrite < obj.PermissionWrite.Value):
+		return errorf(nakama.CodeInvalidArgument, "Invalid write permission supplied. It must be either 0 or 1.")
+	}
+	return nil
+}
+
+// storageVersion returns the version for the storage object value.
+func storageVersion(value string) string {
+	sum := md5.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
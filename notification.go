@@ -0,0 +1,211 @@
+package nakama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Reserved notification codes, used by the Nakama server for system
+// notifications. Codes for application notifications must be positive.
+const (
+	// NotificationDmRequest is the code for a notification that a user wants
+	// to chat in a direct message channel.
+	NotificationDmRequest int32 = -1
+	// NotificationFriendRequest is the code for a notification that a user
+	// sent a friend request.
+	NotificationFriendRequest int32 = -2
+	// NotificationFriendAccept is the code for a notification that a user
+	// accepted a friend request.
+	NotificationFriendAccept int32 = -3
+	// NotificationGroupAdd is the code for a notification that the user was
+	// added to a group.
+	NotificationGroupAdd int32 = -4
+	// NotificationGroupJoinRequest is the code for a notification that a user
+	// wants to join a group.
+	NotificationGroupJoinRequest int32 = -5
+	// NotificationFriendJoinGame is the code for a notification that a friend
+	// joined the game.
+	NotificationFriendJoinGame int32 = -6
+	// NotificationSingleSocket is the code for a notification that the
+	// session's socket was closed because another socket was opened, when
+	// the server only allows a single socket per user.
+	NotificationSingleSocket int32 = -7
+	// NotificationUserBanned is the code for a notification that the user was
+	// banned.
+	NotificationUserBanned int32 = -8
+)
+
+// NotificationRouter routes notifications to handlers registered per
+// notification code, decoding the notification's JSON content (see
+// HandleNotification).
+//
+// A notification router routes a connection's live notifications once
+// attached to the connection (see Attach), one at a time in the order
+// received. Several routers, inboxes and social graphs can be attached to
+// the same connection.
+type NotificationRouter struct {
+	handlers        map[int32]func(context.Context, *Notification) error
+	fallbackHandler func(context.Context, *Notification)
+	errorHandler    func(context.Context, *Notification, error)
+	queue           dispatcher
+	rw              sync.RWMutex
+}
+
+// NewNotificationRouter creates a notification router.
+func NewNotificationRouter() *NotificationRouter {
+	return &NotificationRouter{
+		handlers: make(map[int32]func(context.Context, *Notification) error),
+	}
+}
+
+// WithFallbackHandler sets a handler for notifications with a code without a
+// registered handler.
+func (r *NotificationRouter) WithFallbackHandler(f func(context.Context, *Notification)) *NotificationRouter {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.fallbackHandler = f
+	return r
+}
+
+// WithErrorHandler sets a handler for notifications whose content could not
+// be decoded.
+func (r *NotificationRouter) WithErrorHandler(f func(context.Context, *Notification, error)) *NotificationRouter {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.errorHandler = f
+	return r
+}
+
+// Handle registers a handler for notifications with the code, replacing any
+// previously registered handler.
+func (r *NotificationRouter) Handle(code int32, f func(context.Context, *Notification)) *NotificationRouter {
+	return r.handle(code, func(ctx context.Context, n *Notification) error {
+		f(ctx, n)
+		return nil
+	})
+}
+
+// handle registers a handler for the code.
+func (r *NotificationRouter) handle(code int32, f func(context.Context, *Notification) error) *NotificationRouter {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.handlers[code] = f
+	return r
+}
+
+// Codes returns the notification codes with registered handlers, in order.
+func (r *NotificationRouter) Codes() []int32 {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	codes := make([]int32, 0, len(r.handlers))
+	for code := range r.handlers {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+	return codes
+}
+
+// Attach attaches the router to the connection, routing the connection's
+// live notifications. Returns a func that detaches the router from the
+// connection.
+func (r *NotificationRouter) Attach(conn *Conn) func() {
+	return conn.listen(&connListener{
+		notify: r.notify,
+	})
+}
+
+// notify handles a connection notification, queuing each of the
+// notifications to be routed in the order received.
+func (r *NotificationRouter) notify(ctx context.Context, env *Envelope) {
+	msg := env.GetNotifications()
+	if msg == nil {
+		return
+	}
+	r.queue.push(func() {
+		for _, n := range msg.Notifications {
+			r.Route(ctx, n)
+		}
+	})
+}
+
+// Route routes the notification to the handler registered for its code.
+func (r *NotificationRouter) Route(ctx context.Context, n *Notification) {
+	r.rw.RLock()
+	f, ok := r.handlers[n.Code]
+	fallbackHandler, errorHandler := r.fallbackHandler, r.errorHandler
+	r.rw.RUnlock()
+	switch {
+	case !ok && fallbackHandler != nil:
+		fallbackHandler(ctx, n)
+	case ok:
+		if err := f(ctx, n); err != nil && errorHandler != nil {
+			errorHandler(ctx, n, err)
+		}
+	}
+}
+
+// HandleNotification registers a handler on the router for notifications
+// with the code, with the notification's JSON content decoded as T.
+// Notifications whose content cannot be decoded are passed to the router's
+// error handler.
+func HandleNotification[T any](r *NotificationRouter, code int32, f func(context.Context, *Notification, T)) *NotificationRouter {
+	return r.handle(code, func(ctx context.Context, n *Notification) error {
+		v, err := NotificationContent[T](n)
+		if err != nil {
+			return err
+		}
+		f(ctx, n, v)
+		return nil
+	})
+}
+
+// NotificationContent decodes the notification's JSON content as T. Unknown
+// fields in the content are ignored.
+func NotificationContent[T any](n *Notification) (T, error) {
+	res, v := newTarget[T]()
+	if err := json.Unmarshal([]byte(n.Content), v); err != nil {
+		var zero T
+		return zero, fmt.Errorf("unable to decode notification %d content: %w", n.Code, err)
+	}
+	return fromTarget[T](res, v), nil
+}
+
+// dispatcher calls queued funcs in a separate goroutine, one at a time, in
+// the order pushed.
+type dispatcher struct {
+	funcs   []func()
+	running bool
+	mu      sync.Mutex
+}
+
+// push queues the func, starting the dispatch goroutine when not running.
+func (d *dispatcher) push(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcs = append(d.funcs, f)
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+// run calls the queued funcs until the queue is empty.
+func (d *dispatcher) run() {
+	for {
+		d.mu.Lock()
+		if len(d.funcs) == 0 {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		f := d.funcs[0]
+		d.funcs[0], d.funcs = nil, d.funcs[1:]
+		d.mu.Unlock()
+		f()
+	}
+}
@@ -0,0 +1,461 @@
+package nakama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// OutboxEntry is a request queued in an outbox.
+type OutboxEntry struct {
+	// Id is the id of the entry, increasing in the order entries were added.
+	Id uint64 `json:"id"`
+	// Type is the full name of the request's Protobuf message type.
+	Type string `json:"type"`
+	// Request is the request, encoded as Protobuf JSON.
+	Request json.RawMessage `json:"request"`
+	// Created is when the entry was added.
+	Created time.Time `json:"created"`
+}
+
+// request decodes the entry's request.
+func (entry *OutboxEntry) request() (proto.Message, error) {
+	typ, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(entry.Type))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode outbox entry %d: %w", entry.Id, err)
+	}
+	msg := typ.New().Interface()
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(entry.Request, msg); err != nil {
+		return nil, fmt.Errorf("unable to decode outbox entry %d: %w", entry.Id, err)
+	}
+	return msg, nil
+}
+
+// OutboxResult is the result of replaying an outbox entry.
+type OutboxResult struct {
+	// Id is the id of the entry.
+	Id uint64
+	// Request is the entry's request.
+	Request proto.Message
+	// Response is the response to the request, if the request has one.
+	Response proto.Message
+	// Err is the error when the request failed permanently.
+	Err error
+}
+
+// OutboxJournal is the interface for outbox journals, used to persist the
+// requests queued in an outbox.
+//
+// Entries returns the entries ordered by id.
+type OutboxJournal interface {
+	Append(*OutboxEntry) error
+	Remove(id uint64) error
+	Entries() ([]*OutboxEntry, error)
+}
+
+// outboxEntries are the entries held by an outbox journal, ordered by id.
+type outboxEntries []OutboxEntry
+
+// append returns the entries with a copy of the entry, keeping the entries
+// ordered by id.
+func (v outboxEntries) append(entry *OutboxEntry) outboxEntries {
+	v = append(v, *entry)
+	sort.SliceStable(v, func(i, j int) bool {
+		return v[i].Id < v[j].Id
+	})
+	return v
+}
+
+// remove returns the entries without the entry with the id.
+func (v outboxEntries) remove(id uint64) outboxEntries {
+	var entries outboxEntries
+	for _, entry := range v {
+		if entry.Id != id {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// list returns copies of the entries.
+func (v outboxEntries) list() []*OutboxEntry {
+	entries := make([]*OutboxEntry, len(v))
+	for i := range v {
+		entry := v[i]
+		entries[i] = &entry
+	}
+	return entries
+}
+
+// MemoryOutboxJournal is an in-memory outbox journal.
+type MemoryOutboxJournal struct {
+	entries outboxEntries
+	rw      sync.RWMutex
+}
+
+// NewMemoryOutboxJournal creates a new in-memory outbox journal.
+func NewMemoryOutboxJournal() *MemoryOutboxJournal {
+	return new(MemoryOutboxJournal)
+}
+
+// Append satisfies the OutboxJournal interface.
+func (journal *MemoryOutboxJournal) Append(entry *OutboxEntry) error {
+	journal.rw.Lock()
+	defer journal.rw.Unlock()
+	journal.entries = journal.entries.append(entry)
+	return nil
+}
+
+// Remove satisfies the OutboxJournal interface.
+func (journal *MemoryOutboxJournal) Remove(id uint64) error {
+	journal.rw.Lock()
+	defer journal.rw.Unlock()
+	journal.entries = journal.entries.remove(id)
+	return nil
+}
+
+// Entries satisfies the OutboxJournal interface.
+func (journal *MemoryOutboxJournal) Entries() ([]*OutboxEntry, error) {
+	journal.rw.RLock()
+	defer journal.rw.RUnlock()
+	return journal.entries.list(), nil
+}
+
+// FileOutboxJournal is a file-backed outbox journal. Entries are held in
+// memory, and written as JSON to the file after each change, readable only by
+// the current user.
+type FileOutboxJournal struct {
+	path    string
+	entries outboxEntries
+	loaded  bool
+	mu      sync.Mutex
+}
+
+// NewFileOutboxJournal creates a new file-backed outbox journal, saving the
+// entries to the file at path.
+func NewFileOutboxJournal(path string) *FileOutboxJournal {
+	return &FileOutboxJournal{
+		path: path,
+	}
+}
+
+// load loads the entries from the file, when not already loaded.
+func (journal *FileOutboxJournal) load() error {
+	if journal.loaded {
+		return nil
+	}
+	buf, err := os.ReadFile(journal.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		journal.loaded = true
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to load outbox: %w", err)
+	}
+	var v []*OutboxEntry
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return fmt.Errorf("unable to load outbox: %w", err)
+	}
+	var entries outboxEntries
+	for _, entry := range v {
+		entries = entries.append(entry)
+	}
+	journal.entries, journal.loaded = entries, true
+	return nil
+}
+
+// save saves the entries to the file.
+func (journal *FileOutboxJournal) save(entries outboxEntries) error {
+	buf, err := json.Marshal(entries.list())
+	if err != nil {
+		return fmt.Errorf("unable to save outbox: %w", err)
+	}
+	if err := writeFile(journal.path, buf); err != nil {
+		return fmt.Errorf("unable to save outbox: %w", err)
+	}
+	journal.entries = entries
+	return nil
+}
+
+// Append satisfies the OutboxJournal interface.
+func (journal *FileOutboxJournal) Append(entry *OutboxEntry) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if err := journal.load(); err != nil {
+		return err
+	}
+	entries := append(outboxEntries(nil), journal.entries...)
+	return journal.save(entries.append(entry))
+}
+
+// Remove satisfies the OutboxJournal interface.
+func (journal *FileOutboxJournal) Remove(id uint64) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if err := journal.load(); err != nil {
+		return err
+	}
+	return journal.save(journal.entries.remove(id))
+}
+
+// Entries satisfies the OutboxJournal interface.
+func (journal *FileOutboxJournal) Entries() ([]*OutboxEntry, error) {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if err := journal.load(); err != nil {
+		return nil, err
+	}
+	return journal.entries.list(), nil
+}
+
+// Outbox is a durable outbox of requests, persisted in an outbox journal, for
+// requests that must not be lost when the server is unreachable (for example,
+// WriteLeaderboardRecord, WriteTournamentRecord, Event or UpdateAccount).
+//
+// Requests are replayed in order by Run. When the server is unreachable, or
+// responds with a bad gateway, service unavailable or gateway timeout status,
+// replay is paused until a healthcheck succeeds, checking with exponential
+// backoff. When the request is not
+// authenticated, replay is paused until the client's session changes. A
+// request that fails with any other error is failed permanently, and removed
+// from the outbox. The outbox's handler is called with the result of each
+// replayed request.
+type Outbox struct {
+	cl         *Client
+	journal    OutboxJournal
+	handler    func(*OutboxResult)
+	backoffMin time.Duration
+	backoffMax time.Duration
+	next       uint64
+	wake       chan struct{}
+	mu         sync.Mutex
+}
+
+// NewOutbox creates a durable outbox of requests, persisted in the journal.
+// Uses an in-memory outbox journal when journal is nil.
+func NewOutbox(cl *Client, journal OutboxJournal) *Outbox {
+	if journal == nil {
+		journal = NewMemoryOutboxJournal()
+	}
+	return &Outbox{
+		cl:         cl,
+		journal:    journal,
+		backoffMin: 500 * time.Millisecond,
+		backoffMax: 30 * time.Second,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// WithHandler sets the handler called with the result of each replayed
+// request.
+func (ob *Outbox) WithHandler(handler func(*OutboxResult)) *Outbox {
+	ob.handler = handler
+	return ob
+}
+
+// WithBackoff sets the minimum and maximum backoff between checks while
+// replay is paused.
+func (ob *Outbox) WithBackoff(min, max time.Duration) *Outbox {
+	ob.backoffMin, ob.backoffMax = min, max
+	return ob
+}
+
+// Add adds the request to the outbox, returning the id of its entry. The
+// request must be a request whose Do method takes only a context and client,
+// such as WriteLeaderboardRecordRequest or EventRequest.
+func (ob *Outbox) Add(req proto.Message) (uint64, error) {
+	if outboxFunc(req) == nil {
+		return 0, fmt.Errorf("unsupported outbox request type %T", req)
+	}
+	buf, err := protojson.Marshal(req)
+	if err != nil {
+		return 0, fmt.Errorf("unable to add outbox entry: %w", err)
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.next == 0 {
+		entries, err := ob.journal.Entries()
+		if err != nil {
+			return 0, err
+		}
+		ob.next = 1
+		if n := len(entries); n != 0 {
+			ob.next = entries[n-1].Id + 1
+		}
+	}
+	entry := &OutboxEntry{
+		Id:      ob.next,
+		Type:    string(req.ProtoReflect().Descriptor().FullName()),
+		Request: buf,
+		Created: time.Now(),
+	}
+	if err := ob.journal.Append(entry); err != nil {
+		return 0, err
+	}
+	ob.next++
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+	return entry.Id, nil
+}
+
+// Len returns the number of requests in the outbox.
+func (ob *Outbox) Len() (int, error) {
+	entries, err := ob.journal.Entries()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// Run replays the requests in the outbox in order, waiting for requests to
+// be added when the outbox is empty. Returns when the context is closed, or
+// when the journal fails.
+func (ob *Outbox) Run(ctx context.Context) error {
+	for {
+		entries, err := ob.journal.Entries()
+		switch {
+		case err != nil:
+			return err
+		case len(entries) == 0:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ob.wake:
+			}
+			continue
+		}
+		token := ob.cl.SessionToken()
+		res := ob.replay(ctx, entries[0])
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case res.Err != nil && isUnreachable(res.Err):
+			if err := ob.await(ctx, func() bool {
+				return ob.cl.Healthcheck(ctx) == nil
+			}); err != nil {
+				return err
+			}
+			continue
+		case res.Err != nil && isUnauthenticated(res.Err):
+			if err := ob.await(ctx, func() bool {
+				s := ob.cl.SessionToken()
+				return s != "" && s != token
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ob.journal.Remove(res.Id); err != nil {
+			return err
+		}
+		if ob.handler != nil {
+			ob.handler(res)
+		}
+	}
+}
+
+// replay replays the entry's request.
+func (ob *Outbox) replay(ctx context.Context, entry *OutboxEntry) *OutboxResult {
+	res := &OutboxResult{
+		Id: entry.Id,
+	}
+	if res.Request, res.Err = entry.request(); res.Err != nil {
+		return res
+	}
+	f := outboxFunc(res.Request)
+	if f == nil {
+		res.Err = fmt.Errorf("unsupported outbox request type %T", res.Request)
+		return res
+	}
+	res.Response, res.Err = f(ctx, ob.cl)
+	return res
+}
+
+// await waits until ready returns true, checking with exponential backoff.
+func (ob *Outbox) await(ctx context.Context, ready func() bool) error {
+	for d := ob.backoffMin; ; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+		if ready() {
+			return nil
+		}
+		if d *= 2; ob.backoffMax < d {
+			d = ob.backoffMax
+		}
+	}
+}
+
+// isUnreachable returns true when err indicates the server is unreachable, as
+// a transport error, an unavailable client error, or a bad gateway, service
+// unavailable or gateway timeout response.
+func isUnreachable(err error) bool {
+	var e *ClientError
+	if errors.As(err, &e) {
+		switch e.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return isOffline(err)
+}
+
+// isUnauthenticated returns true when err is an unauthenticated client error,
+// as when the client has no session or the session could not be refreshed.
+func isUnauthenticated(err error) bool {
+	var e *ClientError
+	return errors.As(err, &e) && e.Code == CodeUnauthenticated
+}
+
+// outboxFunc returns the func to execute an outbox request, or nil when the
+// request is not supported.
+func outboxFunc(req proto.Message) func(context.Context, *Client) (proto.Message, error) {
+	switch r := req.(type) {
+	case *WriteLeaderboardRecordRequest:
+		return func(ctx context.Context, cl *Client) (proto.Message, error) {
+			res, err := r.Do(ctx, cl)
+			if err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+	case *WriteTournamentRecordRequest:
+		return func(ctx context.Context, cl *Client) (proto.Message, error) {
+			res, err := r.Do(ctx, cl)
+			if err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+	case *WriteStorageObjectsRequest:
+		return func(ctx context.Context, cl *Client) (proto.Message, error) {
+			res, err := r.Do(ctx, cl)
+			if err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+	case interface {
+		Do(context.Context, *Client) error
+	}:
+		return func(ctx context.Context, cl *Client) (proto.Message, error) {
+			return nil, r.Do(ctx, cl)
+		}
+	}
+	return nil
+}
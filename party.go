@@ -0,0 +1,464 @@
+package nakama
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// PartyEventHandler is an empty interface for party handlers, as used by
+// Conn.CreateParty and Conn.JoinParty. A type that supports any of the
+// following smuggled interfaces:
+//
+//	PartyPresenceEventHandler(context.Context, *nakama.PartyPresenceEventMsg)
+//	PartyLeaderHandler(context.Context, *nakama.PartyLeaderMsg)
+//	PartyJoinRequestHandler(context.Context, *nakama.PartyJoinRequestMsg)
+//	PartyDataHandler(context.Context, *nakama.PartyDataMsg)
+//	PartyCloseHandler(context.Context, *nakama.PartyCloseMsg)
+//
+// Will have its methods called for the party's membership changes, leader
+// changes, join requests, data, and close, respectively.
+type PartyEventHandler interface{}
+
+// PartyHandle is a handle to a joined party, created with Conn.CreateParty or
+// Conn.JoinParty.
+//
+// A party handle tracks the party's leader, members, and pending join
+// requests, routing only the party's events to its handlers. Leader only
+// operations are validated locally before being sent.
+type PartyHandle struct {
+	conn     *Conn
+	id       string
+	open     bool
+	maxSize  int
+	self     *UserPresenceMsg
+	leader   *UserPresenceMsg
+	members  map[string]*UserPresenceMsg
+	requests map[string]*UserPresenceMsg
+	joined   chan struct{}
+	remove   func()
+	done     chan struct{}
+	once     sync.Once
+	joinOnce sync.Once
+
+	presenceHandlers []func(context.Context, *PartyPresenceEventMsg)
+	leaderHandlers   []func(context.Context, *PartyLeaderMsg)
+	requestHandlers  []func(context.Context, *PartyJoinRequestMsg)
+	dataHandlers     []func(context.Context, *PartyDataMsg)
+	closeHandlers    []func(context.Context, *PartyCloseMsg)
+
+	rw sync.RWMutex
+}
+
+// CreateParty creates a party, returning a party handle. See
+// PartyEventHandler for the handlers that can be passed.
+func (conn *Conn) CreateParty(ctx context.Context, open bool, maxSize int, handlers ...PartyEventHandler) (*PartyHandle, error) {
+	p := newPartyHandle(conn, "", handlers)
+	res, err := PartyCreate(open, maxSize).Send(ctx, conn)
+	if err != nil {
+		p.remove()
+		return nil, err
+	}
+	p.rw.Lock()
+	p.id = res.PartyId
+	p.rw.Unlock()
+	p.setParty(res)
+	return p, nil
+}
+
+// JoinParty joins a party, returning a party handle once the party has been
+// joined. For closed parties, JoinParty blocks until the party leader accepts
+// the join request. See PartyEventHandler for the handlers that can be
+// passed.
+func (conn *Conn) JoinParty(ctx context.Context, partyId string, handlers ...PartyEventHandler) (*PartyHandle, error) {
+	p := newPartyHandle(conn, partyId, handlers)
+	if err := PartyJoin(partyId).Send(ctx, conn); err != nil {
+		p.remove()
+		return nil, err
+	}
+	select {
+	case <-p.joined:
+		return p, nil
+	case <-p.done:
+		return nil, ErrPartyClosed
+	case <-ctx.Done():
+	}
+	p.remove()
+	return nil, ctx.Err()
+}
+
+// newPartyHandle creates a party handle, listening for the party's events.
+func newPartyHandle(conn *Conn, partyId string, handlers []PartyEventHandler) *PartyHandle {
+	p := &PartyHandle{
+		conn:     conn,
+		id:       partyId,
+		members:  make(map[string]*UserPresenceMsg),
+		requests: make(map[string]*UserPresenceMsg),
+		joined:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, handler := range handlers {
+		p.addHandler(handler)
+	}
+	p.remove = conn.listen(&connListener{
+		notify:    p.notify,
+		reconnect: p.reconnect,
+	})
+	return p
+}
+
+// addHandler adds the handler's smuggled interfaces.
+func (p *PartyHandle) addHandler(handler PartyEventHandler) {
+	if x, ok := handler.(interface {
+		PartyPresenceEventHandler(context.Context, *PartyPresenceEventMsg)
+	}); ok {
+		p.presenceHandlers = append(p.presenceHandlers, x.PartyPresenceEventHandler)
+	}
+	if x, ok := handler.(interface {
+		PartyLeaderHandler(context.Context, *PartyLeaderMsg)
+	}); ok {
+		p.leaderHandlers = append(p.leaderHandlers, x.PartyLeaderHandler)
+	}
+	if x, ok := handler.(interface {
+		PartyJoinRequestHandler(context.Context, *PartyJoinRequestMsg)
+	}); ok {
+		p.requestHandlers = append(p.requestHandlers, x.PartyJoinRequestHandler)
+	}
+	if x, ok := handler.(interface {
+		PartyDataHandler(context.Context, *PartyDataMsg)
+	}); ok {
+		p.dataHandlers = append(p.dataHandlers, x.PartyDataHandler)
+	}
+	if x, ok := handler.(interface {
+		PartyCloseHandler(context.Context, *PartyCloseMsg)
+	}); ok {
+		p.closeHandlers = append(p.closeHandlers, x.PartyCloseHandler)
+	}
+}
+
+// Id returns the party id.
+func (p *PartyHandle) Id() string {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.id
+}
+
+// Open returns true when the party is open.
+func (p *PartyHandle) Open() bool {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.open
+}
+
+// MaxSize returns the party's max size.
+func (p *PartyHandle) MaxSize() int {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.maxSize
+}
+
+// Self returns the user's presence in the party.
+func (p *PartyHandle) Self() *UserPresenceMsg {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.self
+}
+
+// Leader returns the party leader's presence.
+func (p *PartyHandle) Leader() *UserPresenceMsg {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.leader
+}
+
+// IsLeader returns true when the user is the party leader.
+func (p *PartyHandle) IsLeader() bool {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.isLeader()
+}
+
+// isLeader returns true when the user is the party leader. Must be called
+// with the lock held.
+func (p *PartyHandle) isLeader() bool {
+	return p.self != nil && p.leader != nil && p.self.SessionId == p.leader.SessionId
+}
+
+// Members returns the party's members, ordered by user id and session id.
+func (p *PartyHandle) Members() []*UserPresenceMsg {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return sortPresences(p.members)
+}
+
+// Requests returns the party's pending join requests, ordered by user id and
+// session id. Join requests are only sent to the party leader.
+func (p *PartyHandle) Requests() []*UserPresenceMsg {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return sortPresences(p.requests)
+}
+
+// Done returns a channel that is closed when the party is closed, left, or
+// the user is removed from the party.
+func (p *PartyHandle) Done() <-chan struct{} {
+	return p.done
+}
+
+// Accept accepts the presence's join request. The user must be the party
+// leader.
+func (p *PartyHandle) Accept(ctx context.Context, presence *UserPresenceMsg) error {
+	if err := p.check(true); err != nil {
+		return err
+	}
+	if err := PartyAccept(p.Id(), presence).Send(ctx, p.conn); err != nil {
+		return err
+	}
+	p.rw.Lock()
+	delete(p.requests, presence.SessionId)
+	p.rw.Unlock()
+	return nil
+}
+
+// Remove removes the presence from the party, or declines the presence's
+// join request. The user must be the party leader.
+func (p *PartyHandle) Remove(ctx context.Context, presence *UserPresenceMsg) error {
+	if err := p.check(true); err != nil {
+		return err
+	}
+	p.rw.RLock()
+	_, member := p.members[presence.SessionId]
+	_, request := p.requests[presence.SessionId]
+	p.rw.RUnlock()
+	if !member && !request {
+		return ErrPartyNotMember
+	}
+	if err := PartyRemove(p.Id(), presence).Send(ctx, p.conn); err != nil {
+		return err
+	}
+	p.rw.Lock()
+	delete(p.requests, presence.SessionId)
+	p.rw.Unlock()
+	return nil
+}
+
+// Promote promotes the party member to party leader. The user must be the
+// party leader.
+func (p *PartyHandle) Promote(ctx context.Context, presence *UserPresenceMsg) error {
+	if err := p.check(true); err != nil {
+		return err
+	}
+	p.rw.RLock()
+	_, member := p.members[presence.SessionId]
+	p.rw.RUnlock()
+	if !member {
+		return ErrPartyNotMember
+	}
+	res, err := PartyPromote(p.Id(), presence).Send(ctx, p.conn)
+	if err != nil {
+		return err
+	}
+	p.setLeader(ctx, res)
+	return nil
+}
+
+// JoinRequests refreshes and returns the party's pending join requests. The
+// user must be the party leader.
+func (p *PartyHandle) JoinRequests(ctx context.Context) ([]*UserPresenceMsg, error) {
+	if err := p.check(true); err != nil {
+		return nil, err
+	}
+	res, err := PartyJoinRequests(p.Id()).Send(ctx, p.conn)
+	if err != nil {
+		return nil, err
+	}
+	p.rw.Lock()
+	p.requests = make(map[string]*UserPresenceMsg)
+	for _, presence := range res.Presences {
+		p.requests[presence.SessionId] = presence
+	}
+	p.rw.Unlock()
+	return p.Requests(), nil
+}
+
+// SendData sends data to the party.
+func (p *PartyHandle) SendData(ctx context.Context, opCode int64, data []byte) error {
+	if err := p.check(false); err != nil {
+		return err
+	}
+	msg := &PartyDataSendMsg{
+		PartyId: p.Id(),
+		OpCode:  opCode,
+		Data:    data,
+	}
+	return msg.Send(ctx, p.conn)
+}
+
+// Close closes the party. The user must be the party leader.
+func (p *PartyHandle) Close(ctx context.Context) error {
+	if err := p.check(true); err != nil {
+		return err
+	}
+	if err := PartyClose(p.Id()).Send(ctx, p.conn); err != nil {
+		return err
+	}
+	p.close()
+	return nil
+}
+
+// Leave leaves the party. When the user is the party leader, the server
+// promotes another member to party leader.
+func (p *PartyHandle) Leave(ctx context.Context) error {
+	if err := p.check(false); err != nil {
+		return err
+	}
+	if err := PartyLeave(p.Id()).Send(ctx, p.conn); err != nil {
+		return err
+	}
+	p.close()
+	return nil
+}
+
+// check returns an error when the party is closed, or when leader is true
+// and the user is not the party leader.
+func (p *PartyHandle) check(leader bool) error {
+	select {
+	case <-p.done:
+		return ErrPartyClosed
+	default:
+	}
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	if leader && !p.isLeader() {
+		return ErrPartyNotLeader
+	}
+	return nil
+}
+
+// close stops routing the party's events.
+func (p *PartyHandle) close() {
+	p.once.Do(func() {
+		p.remove()
+		close(p.done)
+	})
+}
+
+// setParty sets the party state.
+func (p *PartyHandle) setParty(msg *PartyMsg) {
+	p.rw.Lock()
+	p.open, p.maxSize = msg.Open, int(msg.MaxSize)
+	p.self, p.leader = msg.Self, msg.Leader
+	p.members = make(map[string]*UserPresenceMsg)
+	for _, presence := range msg.Presences {
+		p.members[presence.SessionId] = presence
+	}
+	if msg.Self != nil {
+		p.members[msg.Self.SessionId] = msg.Self
+	}
+	p.rw.Unlock()
+	p.joinOnce.Do(func() {
+		close(p.joined)
+	})
+}
+
+// setLeader sets the party leader.
+func (p *PartyHandle) setLeader(ctx context.Context, msg *PartyLeaderMsg) {
+	p.rw.Lock()
+	changed := p.leader.GetSessionId() != msg.Presence.GetSessionId()
+	p.leader = msg.Presence
+	p.rw.Unlock()
+	if !changed {
+		return
+	}
+	for _, f := range p.leaderHandlers {
+		go f(ctx, msg)
+	}
+}
+
+// notify handles a connection notification.
+func (p *PartyHandle) notify(ctx context.Context, env *Envelope) {
+	id := p.Id()
+	switch v := env.Message.(type) {
+	case *Envelope_Party:
+		if v.Party.PartyId == id {
+			p.setParty(v.Party)
+		}
+	case *Envelope_PartyPresenceEvent:
+		if v.PartyPresenceEvent.PartyId != id {
+			return
+		}
+		p.rw.Lock()
+		var removed bool
+		for _, presence := range v.PartyPresenceEvent.Leaves {
+			delete(p.members, presence.SessionId)
+			removed = removed || presence.SessionId == p.self.GetSessionId()
+		}
+		for _, presence := range v.PartyPresenceEvent.Joins {
+			delete(p.requests, presence.SessionId)
+			p.members[presence.SessionId] = presence
+		}
+		p.rw.Unlock()
+		for _, f := range p.presenceHandlers {
+			go f(ctx, v.PartyPresenceEvent)
+		}
+		if removed {
+			p.close()
+		}
+	case *Envelope_PartyLeader:
+		if v.PartyLeader.PartyId == id {
+			p.setLeader(ctx, v.PartyLeader)
+		}
+	case *Envelope_PartyJoinRequest:
+		if v.PartyJoinRequest.PartyId != id {
+			return
+		}
+		p.rw.Lock()
+		for _, presence := range v.PartyJoinRequest.Presences {
+			p.requests[presence.SessionId] = presence
+		}
+		p.rw.Unlock()
+		for _, f := range p.requestHandlers {
+			go f(ctx, v.PartyJoinRequest)
+		}
+	case *Envelope_PartyData:
+		if v.PartyData.PartyId != id {
+			return
+		}
+		for _, f := range p.dataHandlers {
+			go f(ctx, v.PartyData)
+		}
+	case *Envelope_PartyClose:
+		if v.PartyClose.PartyId != id {
+			return
+		}
+		for _, f := range p.closeHandlers {
+			go f(ctx, v.PartyClose)
+		}
+		p.close()
+	}
+}
+
+// reconnect handles a connection reconnect result, closing the party when it
+// could not be rejoined. Rejoined parties are reset when the server sends the
+// party.
+func (p *PartyHandle) reconnect(_ context.Context, res *ReconnectResult) {
+	if res.Type != ReconnectParty || res.Id != p.Id() || res.State == ReconnectRejoined {
+		return
+	}
+	p.close()
+}
+
+// sortPresences returns the presences, ordered by user id and session id.
+func sortPresences(m map[string]*UserPresenceMsg) []*UserPresenceMsg {
+	presences := make([]*UserPresenceMsg, 0, len(m))
+	for _, presence := range m {
+		presences = append(presences, presence)
+	}
+	sort.Slice(presences, func(i, j int) bool {
+		if presences[i].UserId != presences[j].UserId {
+			return presences[i].UserId < presences[j].UserId
+		}
+		return presences[i].SessionId < presences[j].SessionId
+	})
+	return presences
+}
@@ -0,0 +1,264 @@
+package nakama
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// PresenceChange is a change to a followed user's online status.
+type PresenceChange struct {
+	// UserId is the user's id.
+	UserId string
+	// Online is true when the user has at least one online session.
+	Online bool
+	// Status is the user's status.
+	Status string
+	// Presences are the user's online sessions.
+	Presences []*UserPresenceMsg
+}
+
+// PresenceTracker tracks the online status of followed users, merging the
+// initial status snapshot with the subsequent status presence events.
+//
+// Users can be online with several sessions, each with its own status. A user
+// is online while at least one of their sessions is online, and the user's
+// status is the status of their most recently updated session.
+//
+// Followed users are followed again after a reconnect.
+type PresenceTracker struct {
+	conn     *Conn
+	follows  map[string]bool
+	sessions map[string][]*UserPresenceMsg
+	handlers []func(context.Context, *PresenceChange)
+	remove   func()
+	rw       sync.RWMutex
+}
+
+// NewPresenceTracker creates a presence tracker for the connection.
+func NewPresenceTracker(conn *Conn) *PresenceTracker {
+	t := &PresenceTracker{
+		conn:     conn,
+		follows:  make(map[string]bool),
+		sessions: make(map[string][]*UserPresenceMsg),
+	}
+	t.remove = conn.listen(&connListener{
+		notify:    t.notify,
+		reconnect: t.reconnect,
+	})
+	return t
+}
+
+// WithChangeHandler adds a handler for changes to a followed user's online
+// status.
+func (t *PresenceTracker) WithChangeHandler(f func(context.Context, *PresenceChange)) *PresenceTracker {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	t.handlers = append(t.handlers, f)
+	return t
+}
+
+// Follow follows the users' online status.
+func (t *PresenceTracker) Follow(ctx context.Context, userIds ...string) error {
+	t.rw.Lock()
+	var ids []string
+	for _, id := range userIds {
+		if !t.follows[id] {
+			t.follows[id] = true
+			ids = append(ids, id)
+		}
+	}
+	t.rw.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	res, err := StatusFollow(ids...).Send(ctx, t.conn)
+	if err != nil {
+		t.rw.Lock()
+		for _, id := range ids {
+			delete(t.follows, id)
+		}
+		t.rw.Unlock()
+		return err
+	}
+	t.reset(ctx, ids, res.Presences)
+	return nil
+}
+
+// Unfollow unfollows the users' online status.
+func (t *PresenceTracker) Unfollow(ctx context.Context, userIds ...string) error {
+	if err := StatusUnfollow(userIds...).Send(ctx, t.conn); err != nil {
+		return err
+	}
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	for _, id := range userIds {
+		delete(t.follows, id)
+		delete(t.sessions, id)
+	}
+	return nil
+}
+
+// Close unfollows all followed users, and stops tracking their online status.
+func (t *PresenceTracker) Close(ctx context.Context) error {
+	t.remove()
+	if userIds := t.UserIds(); len(userIds) != 0 {
+		return t.Unfollow(ctx, userIds...)
+	}
+	return nil
+}
+
+// UserIds returns the followed user ids, in order.
+func (t *PresenceTracker) UserIds() []string {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return sortedKeys(t.follows)
+}
+
+// Online returns true when the user has at least one online session.
+func (t *PresenceTracker) Online(userId string) bool {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return len(t.sessions[userId]) != 0
+}
+
+// Status returns the status of the user's most recently updated session.
+func (t *PresenceTracker) Status(userId string) string {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return t.status(userId)
+}
+
+// status returns the user's status. Must be called with the lock held.
+func (t *PresenceTracker) status(userId string) string {
+	if sessions := t.sessions[userId]; len(sessions) != 0 {
+		return sessions[len(sessions)-1].Status.GetValue()
+	}
+	return ""
+}
+
+// Presences returns the user's online sessions.
+func (t *PresenceTracker) Presences(userId string) []*UserPresenceMsg {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return append([]*UserPresenceMsg(nil), t.sessions[userId]...)
+}
+
+// notify handles a connection notification.
+func (t *PresenceTracker) notify(ctx context.Context, env *Envelope) {
+	ev := env.GetStatusPresenceEvent()
+	if ev == nil {
+		return
+	}
+	t.rw.Lock()
+	prev := make(map[string]*PresenceChange)
+	for _, p := range ev.Leaves {
+		if t.follows[p.UserId] {
+			t.snapshot(prev, p.UserId)
+			t.sessions[p.UserId] = removePresence(t.sessions[p.UserId], p.SessionId)
+		}
+	}
+	for _, p := range ev.Joins {
+		if t.follows[p.UserId] {
+			t.snapshot(prev, p.UserId)
+			t.sessions[p.UserId] = append(removePresence(t.sessions[p.UserId], p.SessionId), p)
+		}
+	}
+	t.rw.Unlock()
+	t.changed(ctx, prev)
+}
+
+// reconnect handles a connection reconnect result, resetting the followed
+// users' status when the follows were restored, or following the users again
+// when not.
+func (t *PresenceTracker) reconnect(ctx context.Context, res *ReconnectResult) {
+	if res.Type != ReconnectStatus {
+		return
+	}
+	userIds := t.UserIds()
+	if msg, ok := res.Res.(*StatusMsg); ok && res.State == ReconnectRejoined {
+		t.reset(ctx, userIds, msg.Presences)
+		return
+	}
+	go func() {
+		t.rw.Lock()
+		for _, id := range userIds {
+			delete(t.follows, id)
+		}
+		t.rw.Unlock()
+		if err := t.Follow(ctx, userIds...); err != nil {
+			t.conn.h.Errf("unable to follow users: %v", err)
+		}
+	}()
+}
+
+// reset resets the users' sessions to the presences.
+func (t *PresenceTracker) reset(ctx context.Context, userIds []string, presences []*UserPresenceMsg) {
+	t.rw.Lock()
+	prev := make(map[string]*PresenceChange)
+	for _, id := range userIds {
+		if t.follows[id] {
+			t.snapshot(prev, id)
+			delete(t.sessions, id)
+		}
+	}
+	for _, p := range presences {
+		if _, ok := prev[p.UserId]; ok {
+			t.sessions[p.UserId] = append(removePresence(t.sessions[p.UserId], p.SessionId), p)
+		}
+	}
+	t.rw.Unlock()
+	t.changed(ctx, prev)
+}
+
+// snapshot records the user's current status in prev, when not already
+// recorded. Must be called with the lock held.
+func (t *PresenceTracker) snapshot(prev map[string]*PresenceChange, userId string) {
+	if _, ok := prev[userId]; ok {
+		return
+	}
+	prev[userId] = &PresenceChange{
+		UserId: userId,
+		Online: len(t.sessions[userId]) != 0,
+		Status: t.status(userId),
+	}
+}
+
+// changed sends change events for the users whose online status changed
+// from prev.
+func (t *PresenceTracker) changed(ctx context.Context, prev map[string]*PresenceChange) {
+	t.rw.RLock()
+	var changes []*PresenceChange
+	for id, p := range prev {
+		change := &PresenceChange{
+			UserId:    id,
+			Online:    len(t.sessions[id]) != 0,
+			Status:    t.status(id),
+			Presences: append([]*UserPresenceMsg(nil), t.sessions[id]...),
+		}
+		if change.Online != p.Online || change.Status != p.Status {
+			changes = append(changes, change)
+		}
+	}
+	handlers := t.handlers
+	t.rw.RUnlock()
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].UserId < changes[j].UserId
+	})
+	for _, change := range changes {
+		for _, f := range handlers {
+			go f(ctx, change)
+		}
+	}
+}
+
+// removePresence returns the presences without the session's presence.
+func removePresence(presences []*UserPresenceMsg, sessionId string) []*UserPresenceMsg {
+	var v []*UserPresenceMsg
+	for _, p := range presences {
+		if p.SessionId != sessionId {
+			v = append(v, p)
+		}
+	}
+	return v
+}
@@ -707,6 +707,15 @@ func (msg *PartyCreateMsg) Async(ctx context.Context, conn *Conn, f func(*PartyM
 	}()
 }
 
+// BuildEnvelope satisfies the EnvelopeBuilder interface.
+func (msg *PartyDataMsg) BuildEnvelope() *Envelope {
+	return &Envelope{
+		Message: &Envelope_PartyData{
+			PartyData: msg,
+		},
+	}
+}
+
 // PartyDataSend creates a realtime message to send data to a party.
 func PartyDataSend(partyId string, opCode OpType, data []byte) *PartyDataSendMsg {
 	return &PartyDataSendMsg{
@@ -946,6 +955,15 @@ func (msg *PartyMatchmakerTicketMsg) BuildEnvelope() *Envelope {
 	}
 }
 
+// BuildEnvelope satisfies the EnvelopeBuilder interface.
+func (msg *PartyPresenceEventMsg) BuildEnvelope() *Envelope {
+	return &Envelope{
+		Message: &Envelope_PartyPresenceEvent{
+			PartyPresenceEvent: msg,
+		},
+	}
+}
+
 // PartyPromote creates a realtime message to promote a new party leader.
 func PartyPromote(partyId string, presence *UserPresenceMsg) *PartyPromoteMsg {
 	return &PartyPromoteMsg{
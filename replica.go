@@ -0,0 +1,747 @@
+package nakama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ReplicaObject is a storage object held by a replica.
+type ReplicaObject struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	UserId     string `json:"userId,omitempty"`
+	Value      string `json:"value,omitempty"`
+	// Version is the version of the server copy the object is based on. "*"
+	// when the object did not exist on the server, or empty when unknown.
+	Version         string `json:"version,omitempty"`
+	PermissionRead  int32  `json:"permissionRead"`
+	PermissionWrite int32  `json:"permissionWrite"`
+	// Pending is true when the object has a local write or delete that has
+	// not been synced to the server.
+	Pending bool `json:"pending,omitempty"`
+	// Deleted is true when the object was deleted locally.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// storageObject returns the object as a storage object.
+func (obj *ReplicaObject) storageObject() *StorageObject {
+	return &StorageObject{
+		Collection:      obj.Collection,
+		Key:             obj.Key,
+		UserId:          obj.UserId,
+		Value:           obj.Value,
+		Version:         obj.Version,
+		PermissionRead:  obj.PermissionRead,
+		PermissionWrite: obj.PermissionWrite,
+	}
+}
+
+// changed returns true when the local write or delete of the object differs
+// from other.
+func (obj *ReplicaObject) changed(other *ReplicaObject) bool {
+	return obj.Value != other.Value ||
+		obj.Deleted != other.Deleted ||
+		obj.PermissionRead != other.PermissionRead ||
+		obj.PermissionWrite != other.PermissionWrite
+}
+
+// ReplicaStore is the interface for replica stores, used to persist the
+// storage objects held by a replica, including writes not yet synced.
+//
+// Get returns a nil object and no error when the object is not held. List
+// returns the objects ordered by collection and key.
+type ReplicaStore interface {
+	Get(collection, key string) (*ReplicaObject, error)
+	Put(*ReplicaObject) error
+	Delete(collection, key string) error
+	List() ([]*ReplicaObject, error)
+}
+
+// replicaKey is the key of an object held by a replica store.
+type replicaKey struct {
+	collection string
+	key        string
+}
+
+// replicaObjects are the objects held by a replica store.
+type replicaObjects map[replicaKey]ReplicaObject
+
+// get returns a copy of the object.
+func (m replicaObjects) get(collection, key string) *ReplicaObject {
+	obj, ok := m[replicaKey{collection, key}]
+	if !ok {
+		return nil
+	}
+	return &obj
+}
+
+// put puts a copy of the object.
+func (m replicaObjects) put(obj *ReplicaObject) {
+	m[replicaKey{obj.Collection, obj.Key}] = *obj
+}
+
+// delete deletes the object.
+func (m replicaObjects) delete(collection, key string) {
+	delete(m, replicaKey{collection, key})
+}
+
+// list returns copies of the objects, ordered by collection and key.
+func (m replicaObjects) list() []*ReplicaObject {
+	objects := make([]*ReplicaObject, 0, len(m))
+	for _, obj := range m {
+		obj := obj
+		objects = append(objects, &obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Collection != objects[j].Collection {
+			return objects[i].Collection < objects[j].Collection
+		}
+		return objects[i].Key < objects[j].Key
+	})
+	return objects
+}
+
+// MemoryReplicaStore is an in-memory replica store.
+type MemoryReplicaStore struct {
+	objects replicaObjects
+	rw      sync.RWMutex
+}
+
+// NewMemoryReplicaStore creates a new in-memory replica store.
+func NewMemoryReplicaStore() *MemoryReplicaStore {
+	return &MemoryReplicaStore{
+		objects: make(replicaObjects),
+	}
+}
+
+// Get satisfies the ReplicaStore interface.
+func (store *MemoryReplicaStore) Get(collection, key string) (*ReplicaObject, error) {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	return store.objects.get(collection, key), nil
+}
+
+// Put satisfies the ReplicaStore interface.
+func (store *MemoryReplicaStore) Put(obj *ReplicaObject) error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	store.objects.put(obj)
+	return nil
+}
+
+// Delete satisfies the ReplicaStore interface.
+func (store *MemoryReplicaStore) Delete(collection, key string) error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	store.objects.delete(collection, key)
+	return nil
+}
+
+// List satisfies the ReplicaStore interface.
+func (store *MemoryReplicaStore) List() ([]*ReplicaObject, error) {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	return store.objects.list(), nil
+}
+
+// FileReplicaStore is a file-backed replica store. Objects are held in
+// memory, and written as JSON to the file after each change, readable only by
+// the current user.
+type FileReplicaStore struct {
+	path    string
+	objects replicaObjects
+	mu      sync.Mutex
+}
+
+// NewFileReplicaStore creates a new file-backed replica store, saving the
+// objects to the file at path.
+func NewFileReplicaStore(path string) *FileReplicaStore {
+	return &FileReplicaStore{
+		path: path,
+	}
+}
+
+// load loads the objects from the file, when not already loaded.
+func (store *FileReplicaStore) load() error {
+	if store.objects != nil {
+		return nil
+	}
+	objects := make(replicaObjects)
+	buf, err := os.ReadFile(store.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		store.objects = objects
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to load replica: %w", err)
+	}
+	var v []*ReplicaObject
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return fmt.Errorf("unable to load replica: %w", err)
+	}
+	for _, obj := range v {
+		objects.put(obj)
+	}
+	store.objects = objects
+	return nil
+}
+
+// save saves the objects to the file.
+func (store *FileReplicaStore) save() error {
+	buf, err := json.Marshal(store.objects.list())
+	if err != nil {
+		return fmt.Errorf("unable to save replica: %w", err)
+	}
+	if err := writeFile(store.path, buf); err != nil {
+		return fmt.Errorf("unable to save replica: %w", err)
+	}
+	return nil
+}
+
+// Get satisfies the ReplicaStore interface.
+func (store *FileReplicaStore) Get(collection, key string) (*ReplicaObject, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store.objects.get(collection, key), nil
+}
+
+// Put satisfies the ReplicaStore interface.
+func (store *FileReplicaStore) Put(obj *ReplicaObject) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(); err != nil {
+		return err
+	}
+	prev := store.objects.get(obj.Collection, obj.Key)
+	store.objects.put(obj)
+	if err := store.save(); err != nil {
+		if prev != nil {
+			store.objects.put(prev)
+		} else {
+			store.objects.delete(obj.Collection, obj.Key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete satisfies the ReplicaStore interface.
+func (store *FileReplicaStore) Delete(collection, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(); err != nil {
+		return err
+	}
+	prev := store.objects.get(collection, key)
+	if prev == nil {
+		return nil
+	}
+	store.objects.delete(collection, key)
+	if err := store.save(); err != nil {
+		store.objects.put(prev)
+		return err
+	}
+	return nil
+}
+
+// List satisfies the ReplicaStore interface.
+func (store *FileReplicaStore) List() ([]*ReplicaObject, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store.objects.list(), nil
+}
+
+// MergeFunc merges a local object with the server copy of the object, when
+// the server copy changed since the local object was last synced. Local is
+// nil when the object was deleted locally, and server is nil when the object
+// was deleted on the server. The returned object's value and permissions are
+// written to the server, or the object is deleted when nil is returned.
+type MergeFunc func(ctx context.Context, local, server *StorageObject) (*StorageObject, error)
+
+// Replica is an offline-first local replica of the session user's storage
+// objects, held in a replica store.
+//
+// Reads are served from the store, and only read from the server when the
+// object is not held. Writes and deletes are made to the store, and then
+// synced to the server. When the server is unreachable, writes and deletes are
+// queued in the store until the next sync.
+//
+// Writes and deletes are synced using the version of the server copy the
+// object is based on. When the server copy was changed by another writer, the
+// replica's merge func is called with the local and server copies, and the
+// merged object is written. The local copy is written when no merge func is
+// set.
+//
+// A Replica can be attached to a Conn (see Attach), to sync queued writes and
+// deletes each time the connection is established.
+type Replica struct {
+	cl      *Client
+	store   ReplicaStore
+	merge   MergeFunc
+	retries int
+	mu      sync.Mutex
+	syncMu  sync.Mutex
+}
+
+// NewReplica creates a local replica of the session user's storage objects,
+// held in the store. Uses an in-memory replica store when store is nil.
+func NewReplica(cl *Client, store ReplicaStore) *Replica {
+	if store == nil {
+		store = NewMemoryReplicaStore()
+	}
+	return &Replica{
+		cl:      cl,
+		store:   store,
+		retries: 5,
+	}
+}
+
+// WithMerge sets the merge func used when a write or delete conflicts with
+// the server copy of an object.
+func (r *Replica) WithMerge(merge MergeFunc) *Replica {
+	r.merge = merge
+	return r
+}
+
+// WithRetries sets the number of retries made when syncing an object
+// conflicts with the server copy of the object.
+func (r *Replica) WithRetries(retries int) *Replica {
+	r.retries = retries
+	return r
+}
+
+// Read reads the object with the collection and key. The object is read
+// from the server only when not held by the replica. Returns nil when the
+// object does not exist.
+func (r *Replica) Read(ctx context.Context, collection, key string) (*StorageObject, error) {
+	obj, err := r.get(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		server, err := r.fetch(ctx, collection, key)
+		if err != nil {
+			return nil, err
+		}
+		if obj, err = r.pull(collection, key, server); err != nil {
+			return nil, err
+		}
+	}
+	if obj == nil || obj.Deleted {
+		return nil, nil
+	}
+	return obj.storageObject(), nil
+}
+
+// List lists the objects in the collection held by the replica.
+func (r *Replica) List(collection string) ([]*StorageObject, error) {
+	objects, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+	var v []*StorageObject
+	for _, obj := range objects {
+		if obj.Collection == collection && !obj.Deleted {
+			v = append(v, obj.storageObject())
+		}
+	}
+	return v, nil
+}
+
+// Write writes the object to the replica, and syncs it to the server. When
+// the object's version is empty, the version of the held object is used. When
+// the object's permissions are not set, the permissions of the held object
+// are used, or owner read and write for a new object.
+//
+// The write is queued when the server is unreachable, and no error is
+// returned.
+func (r *Replica) Write(ctx context.Context, obj *WriteStorageObject) error {
+	if err := r.write(obj); err != nil {
+		return err
+	}
+	return r.syncObject(ctx, obj.Collection, obj.Key)
+}
+
+// write writes the object to the store.
+func (r *Replica) write(obj *WriteStorageObject) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev, err := r.store.Get(obj.Collection, obj.Key)
+	if err != nil {
+		return err
+	}
+	o := &ReplicaObject{
+		Collection:      obj.Collection,
+		Key:             obj.Key,
+		UserId:          r.cl.SessionUserId(),
+		Value:           obj.Value,
+		Version:         "*",
+		PermissionRead:  int32(PermissionOwnerRead),
+		PermissionWrite: int32(PermissionOwnerWrite),
+		Pending:         true,
+	}
+	if prev != nil {
+		o.Version, o.PermissionRead, o.PermissionWrite = prev.Version, prev.PermissionRead, prev.PermissionWrite
+	}
+	if obj.Version != "" {
+		o.Version = obj.Version
+	}
+	if obj.PermissionRead != nil {
+		o.PermissionRead = obj.PermissionRead.Value
+	}
+	if obj.PermissionWrite != nil {
+		o.PermissionWrite = obj.PermissionWrite.Value
+	}
+	return r.store.Put(o)
+}
+
+// Delete deletes the object with the collection and key from the replica,
+// and syncs the delete to the server.
+//
+// The delete is queued when the server is unreachable, and no error is
+// returned.
+func (r *Replica) Delete(ctx context.Context, collection, key string) error {
+	if err := r.delete(collection, key); err != nil {
+		return err
+	}
+	return r.syncObject(ctx, collection, key)
+}
+
+// delete marks the object deleted in the store.
+func (r *Replica) delete(collection, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	obj, err := r.store.Get(collection, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		obj = &ReplicaObject{
+			Collection: collection,
+			Key:        key,
+			UserId:     r.cl.SessionUserId(),
+		}
+	}
+	obj.Value, obj.Pending, obj.Deleted = "", true, true
+	return r.store.Put(obj)
+}
+
+// Pending returns the objects with writes or deletes not yet synced to the
+// server.
+func (r *Replica) Pending() ([]*ReplicaObject, error) {
+	objects, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+	var v []*ReplicaObject
+	for _, obj := range objects {
+		if obj.Pending {
+			v = append(v, obj)
+		}
+	}
+	return v, nil
+}
+
+// Sync syncs queued writes and deletes to the server, and then refreshes the
+// other objects held by the replica from the server. Objects that cannot be
+// synced remain pending, and their errors are returned as a
+// ReplicaSyncError. Stops at the first object that cannot be synced because
+// the server is unreachable.
+func (r *Replica) Sync(ctx context.Context) error {
+	objects, err := r.store.List()
+	if err != nil {
+		return err
+	}
+	var errs ReplicaSyncError
+	var ids []*ReadStorageObjectId
+	for _, obj := range objects {
+		if !obj.Pending {
+			ids = append(ids, &ReadStorageObjectId{
+				Collection: obj.Collection,
+				Key:        obj.Key,
+				UserId:     obj.UserId,
+			})
+			continue
+		}
+		if err := r.push(ctx, obj.Collection, obj.Key); err != nil {
+			err = fmt.Errorf("unable to sync %s/%s: %w", obj.Collection, obj.Key, err)
+			if ctx.Err() != nil || isOffline(err) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	for i := 0; i < len(ids); i += 100 {
+		j := i + 100
+		if len(ids) < j {
+			j = len(ids)
+		}
+		if err := r.refresh(ctx, ids[i:j]); err != nil {
+			if ctx.Err() != nil || isOffline(err) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// Attach attaches the replica to the connection, syncing the replica when
+// attached to an open connection and each time the connection is
+// established. Returns a func that detaches the replica from the connection.
+func (r *Replica) Attach(conn *Conn) func() {
+	return conn.listen(&connListener{
+		connect: r.connect,
+	})
+}
+
+// connect syncs the replica when the connection is established.
+func (r *Replica) connect(ctx context.Context) {
+	if err := r.Sync(ctx); err != nil {
+		r.cl.Errf("unable to sync replica: %v", err)
+	}
+}
+
+// ReplicaSyncError is the error returned by Sync when objects could not be
+// synced, containing the error for each object.
+type ReplicaSyncError []error
+
+// Error satisfies the error interface.
+func (err ReplicaSyncError) Error() string {
+	s := make([]string, len(err))
+	for i, e := range err {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// syncObject syncs the object to the server, returning no error when the
+// server is unreachable.
+func (r *Replica) syncObject(ctx context.Context, collection, key string) error {
+	if err := r.push(ctx, collection, key); err != nil && (ctx.Err() != nil || !isOffline(err)) {
+		return err
+	}
+	return nil
+}
+
+// push pushes the object's pending write or delete to the server, merging
+// the object with the server copy on a version conflict.
+func (r *Replica) push(ctx context.Context, collection, key string) error {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	var err error
+	for i := 0; i <= r.retries; i++ {
+		var obj *ReplicaObject
+		switch obj, err = r.get(collection, key); {
+		case err != nil:
+			return err
+		case obj == nil || !obj.Pending:
+			return nil
+		}
+		var version string
+		switch version, err = r.send(ctx, obj); {
+		case err == nil:
+			return r.synced(obj, version)
+		case !IsVersionConflict(err):
+			return err
+		}
+		var server *StorageObject
+		if server, err = r.fetch(ctx, collection, key); err != nil {
+			return err
+		}
+		if err = r.resolve(ctx, obj, server); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// send sends the object's write or delete to the server, returning the
+// version of the written object.
+func (r *Replica) send(ctx context.Context, obj *ReplicaObject) (string, error) {
+	if obj.Deleted {
+		if obj.Version == "*" {
+			return "", nil
+		}
+		return "", DeleteStorageObjects().WithObjectId(obj.Collection, obj.Key, obj.Version).Do(ctx, r.cl)
+	}
+	res, err := WriteStorageObjects().WithObject(&WriteStorageObject{
+		Collection:      obj.Collection,
+		Key:             obj.Key,
+		Value:           obj.Value,
+		Version:         obj.Version,
+		PermissionRead:  wrapperspb.Int32(obj.PermissionRead),
+		PermissionWrite: wrapperspb.Int32(obj.PermissionWrite),
+	}).Do(ctx, r.cl)
+	if err != nil {
+		return "", err
+	}
+	for _, ack := range res.Acks {
+		if ack.Collection == obj.Collection && ack.Key == obj.Key {
+			return ack.Version, nil
+		}
+	}
+	return "", nil
+}
+
+// synced updates the store after the object was synced to the server. When
+// the object was changed locally while being synced, the object remains
+// pending, based on the synced version.
+func (r *Replica) synced(obj *ReplicaObject, version string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, err := r.store.Get(obj.Collection, obj.Key)
+	switch {
+	case err != nil:
+		return err
+	case cur == nil:
+		return nil
+	case cur.changed(obj):
+		cur.Version = version
+		if obj.Deleted {
+			cur.Version = "*"
+		}
+		return r.store.Put(cur)
+	case obj.Deleted:
+		return r.store.Delete(obj.Collection, obj.Key)
+	}
+	cur.Version, cur.Pending = version, false
+	return r.store.Put(cur)
+}
+
+// resolve merges the object with the server copy of the object, storing the
+// merged object based on the server copy's version.
+func (r *Replica) resolve(ctx context.Context, obj *ReplicaObject, server *StorageObject) error {
+	local := obj.storageObject()
+	if obj.Deleted {
+		local = nil
+	}
+	merged := local
+	if r.merge != nil {
+		var err error
+		if merged, err = r.merge(ctx, local, server); err != nil {
+			return fmt.Errorf("unable to merge %s/%s: %w", obj.Collection, obj.Key, err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o := &ReplicaObject{
+		Collection: obj.Collection,
+		Key:        obj.Key,
+		UserId:     obj.UserId,
+		Version:    "*",
+		Pending:    true,
+		Deleted:    merged == nil,
+	}
+	if server != nil {
+		o.UserId, o.Version = server.UserId, server.Version
+	}
+	switch {
+	case merged == nil && server == nil:
+		return r.store.Delete(obj.Collection, obj.Key)
+	case merged != nil:
+		o.Value, o.PermissionRead, o.PermissionWrite = merged.Value, merged.PermissionRead, merged.PermissionWrite
+		if server != nil && o.Value == server.Value && o.PermissionRead == server.PermissionRead && o.PermissionWrite == server.PermissionWrite {
+			o.Pending = false
+		}
+	}
+	return r.store.Put(o)
+}
+
+// refresh refreshes the objects from the server, removing objects no longer
+// on the server. Objects with pending writes or deletes are not changed.
+func (r *Replica) refresh(ctx context.Context, ids []*ReadStorageObjectId) error {
+	req := ReadStorageObjects()
+	req.ObjectIds = ids
+	res, err := req.Do(ctx, r.cl)
+	if err != nil {
+		return err
+	}
+	found := make(map[replicaKey]*StorageObject)
+	for _, obj := range res.Objects {
+		found[replicaKey{obj.Collection, obj.Key}] = obj
+	}
+	for _, id := range ids {
+		if _, err := r.pull(id.Collection, id.Key, found[replicaKey{id.Collection, id.Key}]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch reads the server copy of the object, returning nil when the object
+// does not exist.
+func (r *Replica) fetch(ctx context.Context, collection, key string) (*StorageObject, error) {
+	res, err := ReadStorageObjects().WithObjectId(collection, key, r.cl.SessionUserId()).Do(ctx, r.cl)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range res.Objects {
+		if obj.Collection == collection && obj.Key == key {
+			return obj, nil
+		}
+	}
+	return nil, nil
+}
+
+// pull stores the server copy of the object, unless the held object has a
+// pending write or delete. Returns the held object.
+func (r *Replica) pull(collection, key string, server *StorageObject) (*ReplicaObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, err := r.store.Get(collection, key)
+	switch {
+	case err != nil:
+		return nil, err
+	case cur != nil && cur.Pending:
+		return cur, nil
+	case server == nil:
+		return nil, r.store.Delete(collection, key)
+	}
+	obj := &ReplicaObject{
+		Collection:      server.Collection,
+		Key:             server.Key,
+		UserId:          server.UserId,
+		Value:           server.Value,
+		Version:         server.Version,
+		PermissionRead:  server.PermissionRead,
+		PermissionWrite: server.PermissionWrite,
+	}
+	return obj, r.store.Put(obj)
+}
+
+// get returns the held object.
+func (r *Replica) get(collection, key string) (*ReplicaObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.store.Get(collection, key)
+}
+
+// isOffline returns true when err indicates the server is unreachable, as a
+// transport error or an unavailable client error.
+func isOffline(err error) bool {
+	var e *ClientError
+	if errors.As(err, &e) {
+		return e.Code == CodeUnavailable
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
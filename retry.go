@@ -0,0 +1,144 @@
+package nakama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is a http request retry policy, used by Client.Do to retry
+// failed requests with exponential backoff. Transport errors, client errors
+// with one of the policy's codes, and client errors with a 429, 502, 503 or
+// 504 http status code (such as from a load balancer or proxy, whose response
+// body is not a Nakama error) are retried. Other errors, such as errors
+// building the request, are not retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts made for a request,
+	// including the first.
+	MaxAttempts int
+	// BackoffMin is the backoff before the first retry.
+	BackoffMin time.Duration
+	// BackoffMax is the maximum backoff between retries.
+	BackoffMax time.Duration
+	// BackoffFactor is the factor the backoff is multiplied by after each retry.
+	BackoffFactor float64
+	// BackoffRand is the source of the random jitter added to the backoff. No
+	// jitter is added when nil.
+	BackoffRand *rand.Rand
+	// Codes are the retryable client error codes.
+	Codes []Code
+	// NonIdempotent toggles retrying requests with non-idempotent methods
+	// (ie, POST).
+	NonIdempotent bool
+
+	mu sync.Mutex
+}
+
+// DefaultRetryPolicy returns a retry policy making at most 3 attempts,
+// retrying Unavailable, DeadlineExceeded and ResourceExhausted client errors
+// for idempotent methods.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:   3,
+		BackoffMin:    100 * time.Millisecond,
+		BackoffMax:    2 * time.Second,
+		BackoffFactor: 2.0,
+		BackoffRand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		Codes: []Code{
+			CodeUnavailable,
+			CodeDeadlineExceeded,
+			CodeResourceExhausted,
+		},
+	}
+}
+
+// do executes f, retrying failed attempts per the policy. A nil policy makes
+// a single attempt.
+func (policy *RetryPolicy) do(ctx context.Context, method string, f func() error) error {
+	d, jitter := time.Duration(0), time.Duration(0)
+	for attempts := 1; ; attempts++ {
+		err := f()
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil, !policy.retryable(method, attempts, err):
+			return attemptsErr(err, attempts)
+		}
+		d, jitter = policy.backoffDur(d)
+		select {
+		case <-ctx.Done():
+			return attemptsErr(err, attempts)
+		case <-time.After(d + jitter):
+		}
+	}
+}
+
+// retryable returns true when a failed attempt can be retried.
+func (policy *RetryPolicy) retryable(method string, attempts int, err error) bool {
+	if policy == nil || policy.MaxAttempts <= attempts || (!policy.NonIdempotent && !idempotent(method)) {
+		return false
+	}
+	var e *ClientError
+	if !errors.As(err, &e) {
+		var ue *url.Error
+		return errors.As(err, &ue) && !errors.Is(err, context.Canceled)
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	for _, code := range policy.Codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffDur calculates the backoff duration following a backoff of d.
+func (policy *RetryPolicy) backoffDur(d time.Duration) (time.Duration, time.Duration) {
+	switch {
+	case d == 0:
+		d = policy.BackoffMin
+	case policy.BackoffMax <= d:
+		d = policy.BackoffMax
+	default:
+		if d = time.Duration(float64(d) * policy.BackoffFactor); policy.BackoffMax < d {
+			d = policy.BackoffMax
+		}
+	}
+	jitter := time.Duration(0)
+	if policy.BackoffRand != nil && d > 0 {
+		policy.mu.Lock()
+		jitter = time.Duration(policy.BackoffRand.Int63n(int64(d)))
+		policy.mu.Unlock()
+	}
+	return d, jitter
+}
+
+// attemptsErr sets the attempt count on a client error, or wraps other
+// errors when more than one attempt was made.
+func attemptsErr(err error, attempts int) error {
+	var e *ClientError
+	switch {
+	case errors.As(err, &e):
+		e.Attempts = attempts
+	case attempts > 1:
+		return fmt.Errorf("unable to execute request after %d attempts: %w", attempts, err)
+	}
+	return err
+}
+
+// idempotent returns true when the http method is idempotent.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package nakama
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DataMsg is a match or party data message, as routed by a Router.
+type DataMsg struct {
+	// MatchId is the match id, when the message is match data.
+	MatchId string
+	// PartyId is the party id, when the message is party data.
+	PartyId string
+	// Presence is the presence that sent the data, if any.
+	Presence *UserPresenceMsg
+	// OpCode is the op code.
+	OpCode int64
+	// Data is the raw payload.
+	Data []byte
+	// Reliable is true when match data was delivered reliably.
+	Reliable bool
+}
+
+// OpStats are the statistics for an op code.
+type OpStats struct {
+	// Received is the count of messages received.
+	Received uint64
+	// ReceivedBytes is the total size of payloads received.
+	ReceivedBytes uint64
+	// Sent is the count of messages sent.
+	Sent uint64
+	// SentBytes is the total size of payloads sent.
+	SentBytes uint64
+	// Unhandled is the count of messages received without a registered
+	// handler.
+	Unhandled uint64
+	// Errors is the count of payloads that could not be decoded or encoded.
+	Errors uint64
+}
+
+// Router routes match and party data messages to handlers registered per op
+// code, decoding payloads with the op code's codec (see NewOp).
+//
+// A router satisfies the MatchDataHandler and PartyDataHandler smuggled
+// interfaces, and can be passed as a handler to Conn.JoinMatch or
+// Conn.CreateMatch, or registered on a connection with WithConnHandler.
+type Router struct {
+	handlers       map[int64]func(context.Context, *DataMsg) error
+	unknownHandler func(context.Context, *DataMsg)
+	errorHandler   func(context.Context, *DataMsg, error)
+	stats          map[int64]*OpStats
+	rw             sync.RWMutex
+}
+
+// NewRouter creates a match and party data router.
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[int64]func(context.Context, *DataMsg) error),
+		stats:    make(map[int64]*OpStats),
+	}
+}
+
+// WithUnknownHandler sets a handler for messages with an op code without a
+// registered handler.
+func (r *Router) WithUnknownHandler(f func(context.Context, *DataMsg)) *Router {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.unknownHandler = f
+	return r
+}
+
+// WithErrorHandler sets a handler for messages whose payloads could not be
+// decoded.
+func (r *Router) WithErrorHandler(f func(context.Context, *DataMsg, error)) *Router {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.errorHandler = f
+	return r
+}
+
+// Handle registers a handler for the raw payloads of the op code, replacing
+// any previously registered handler.
+func (r *Router) Handle(opCode int64, f func(context.Context, *DataMsg)) *Router {
+	return r.handle(opCode, func(ctx context.Context, msg *DataMsg) error {
+		f(ctx, msg)
+		return nil
+	})
+}
+
+// handle registers a handler for the op code.
+func (r *Router) handle(opCode int64, f func(context.Context, *DataMsg) error) *Router {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.handlers[opCode] = f
+	return r
+}
+
+// OpCodes returns the op codes with registered handlers, in order.
+func (r *Router) OpCodes() []int64 {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	opCodes := make([]int64, 0, len(r.handlers))
+	for opCode := range r.handlers {
+		opCodes = append(opCodes, opCode)
+	}
+	sort.Slice(opCodes, func(i, j int) bool {
+		return opCodes[i] < opCodes[j]
+	})
+	return opCodes
+}
+
+// Stats returns the statistics for the op code.
+func (r *Router) Stats(opCode int64) OpStats {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	if stats := r.stats[opCode]; stats != nil {
+		return *stats
+	}
+	return OpStats{}
+}
+
+// AllStats returns the statistics for all op codes sent or received.
+func (r *Router) AllStats() map[int64]OpStats {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	m := make(map[int64]OpStats, len(r.stats))
+	for opCode, stats := range r.stats {
+		m[opCode] = *stats
+	}
+	return m
+}
+
+// MatchDataHandler satisfies the MatchDataHandler smuggled interface.
+func (r *Router) MatchDataHandler(ctx context.Context, msg *MatchDataMsg) {
+	r.Route(ctx, &DataMsg{
+		MatchId:  msg.MatchId,
+		Presence: msg.Presence,
+		OpCode:   msg.OpCode,
+		Data:     msg.Data,
+		Reliable: msg.Reliable,
+	})
+}
+
+// PartyDataHandler satisfies the PartyDataHandler smuggled interface.
+func (r *Router) PartyDataHandler(ctx context.Context, msg *PartyDataMsg) {
+	r.Route(ctx, &DataMsg{
+		PartyId:  msg.PartyId,
+		Presence: msg.Presence,
+		OpCode:   msg.OpCode,
+		Data:     msg.Data,
+	})
+}
+
+// Route routes the message to the handler registered for its op code.
+func (r *Router) Route(ctx context.Context, msg *DataMsg) {
+	r.rw.Lock()
+	stats := r.opStats(msg.OpCode)
+	stats.Received++
+	stats.ReceivedBytes += uint64(len(msg.Data))
+	f, ok := r.handlers[msg.OpCode]
+	if !ok {
+		stats.Unhandled++
+	}
+	unknownHandler, errorHandler := r.unknownHandler, r.errorHandler
+	r.rw.Unlock()
+	switch {
+	case !ok && unknownHandler != nil:
+		unknownHandler(ctx, msg)
+	case ok:
+		if err := f(ctx, msg); err != nil {
+			r.rw.Lock()
+			r.opStats(msg.OpCode).Errors++
+			r.rw.Unlock()
+			if errorHandler != nil {
+				errorHandler(ctx, msg, err)
+			}
+		}
+	}
+}
+
+// sent records a sent payload for the op code.
+func (r *Router) sent(opCode int64, n int, err error) {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	stats := r.opStats(opCode)
+	if err != nil {
+		stats.Errors++
+		return
+	}
+	stats.Sent++
+	stats.SentBytes += uint64(n)
+}
+
+// opStats returns the statistics for the op code. Must be called with the lock
+// held.
+func (r *Router) opStats(opCode int64) *OpStats {
+	stats := r.stats[opCode]
+	if stats == nil {
+		stats = new(OpStats)
+		r.stats[opCode] = stats
+	}
+	return stats
+}
+
+// Op is a typed match and party data op code, with payloads of type T
+// encoded by its codec.
+type Op[T any] struct {
+	r      *Router
+	opCode int64
+	codec  Codec
+}
+
+// NewOp creates a typed op code for the router. Payloads are encoded with
+// JsonCodec, unless changed with WithCodec.
+func NewOp[T any](r *Router, opCode int64) Op[T] {
+	return Op[T]{
+		r:      r,
+		opCode: opCode,
+	}
+}
+
+// WithCodec sets the codec used to encode the op code's payloads. Match and
+// party data payloads are binary, so ProtoBinaryCodec is preferred over
+// ProtoCodec for proto.Message payloads.
+func (op Op[T]) WithCodec(codec Codec) Op[T] {
+	op.codec = codec
+	return op
+}
+
+// OpCode returns the op code.
+func (op Op[T]) OpCode() int64 {
+	return op.opCode
+}
+
+// Codec returns the codec used to encode the op code's payloads.
+func (op Op[T]) Codec() Codec {
+	if op.codec != nil {
+		return op.codec
+	}
+	return JsonCodec{}
+}
+
+// Handle registers a handler on the router for the op code's decoded
+// payloads. Payloads that cannot be decoded are passed to the router's error
+// handler.
+func (op Op[T]) Handle(f func(context.Context, *DataMsg, T)) Op[T] {
+	op.r.handle(op.opCode, func(ctx context.Context, msg *DataMsg) error {
+		v, err := op.Unmarshal(msg.Data)
+		if err != nil {
+			return err
+		}
+		f(ctx, msg, v)
+		return nil
+	})
+	return op
+}
+
+// Marshal encodes the payload.
+func (op Op[T]) Marshal(v T) ([]byte, error) {
+	buf, err := op.Codec().Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode op code %d: %w", op.opCode, err)
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes the payload.
+func (op Op[T]) Unmarshal(buf []byte) (T, error) {
+	res, v := newTarget[T]()
+	if err := op.Codec().Unmarshal(buf, v); err != nil {
+		var zero T
+		return zero, fmt.Errorf("unable to decode op code %d: %w", op.opCode, err)
+	}
+	return fromTarget[T](res, v), nil
+}
+
+// SendMatch encodes and sends the payload to the match. When presences are
+// provided, the payload is only sent to the presences.
+func (op Op[T]) SendMatch(ctx context.Context, conn *Conn, matchId string, v T, reliable bool, presences ...*UserPresenceMsg) error {
+	buf, err := op.Marshal(v)
+	if err != nil {
+		op.r.sent(op.opCode, 0, err)
+		return err
+	}
+	if err := MatchDataSend(matchId, op.opCode, buf).WithReliable(reliable).WithPresences(presences...).Send(ctx, conn); err != nil {
+		return err
+	}
+	op.r.sent(op.opCode, len(buf), nil)
+	return nil
+}
+
+// SendParty encodes and sends the payload to the party.
+func (op Op[T]) SendParty(ctx context.Context, conn *Conn, partyId string, v T) error {
+	buf, err := op.Marshal(v)
+	if err != nil {
+		op.r.sent(op.opCode, 0, err)
+		return err
+	}
+	msg := &PartyDataSendMsg{
+		PartyId: partyId,
+		OpCode:  op.opCode,
+		Data:    buf,
+	}
+	if err := msg.Send(ctx, conn); err != nil {
+		return err
+	}
+	op.r.sent(op.opCode, len(buf), nil)
+	return nil
+}
+
+// ProtoBinaryCodec is a codec using Protobuf's binary encoding, without
+// encoding to text. Values must be a proto.Message.
+type ProtoBinaryCodec struct{}
+
+// Marshal satisfies the Codec interface.
+func (ProtoBinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("payload type %T is not a proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+// Unmarshal satisfies the Codec interface.
+func (ProtoBinaryCodec) Unmarshal(buf []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("payload type %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(buf, msg)
+}
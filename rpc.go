@@ -0,0 +1,253 @@
+package nakama
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec is the interface for remote procedure call payload codecs. Payloads
+// are sent as strings, so codecs must encode to text. Codecs are also used for
+// match and party data payloads (see Op), which may be binary.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(buf []byte, v interface{}) error
+}
+
+// JsonCodec is a codec using Go's encoding/json package. Unknown fields are
+// disallowed when decoding.
+type JsonCodec struct{}
+
+// Marshal satisfies the Codec interface.
+func (JsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal satisfies the Codec interface.
+func (JsonCodec) Unmarshal(buf []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// ProtojsonCodec is a codec using Protobuf's
+// google.golang.org/protobuf/encoding/protojson package. Values must be a
+// proto.Message.
+type ProtojsonCodec struct {
+	MarshalOptions   protojson.MarshalOptions
+	UnmarshalOptions protojson.UnmarshalOptions
+}
+
+// Marshal satisfies the Codec interface.
+func (codec ProtojsonCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("payload type %T is not a proto.Message", v)
+	}
+	return codec.MarshalOptions.Marshal(msg)
+}
+
+// Unmarshal satisfies the Codec interface.
+func (codec ProtojsonCodec) Unmarshal(buf []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("payload type %T is not a proto.Message", v)
+	}
+	return codec.UnmarshalOptions.Unmarshal(buf, msg)
+}
+
+// ProtoCodec is a codec using Protobuf's binary encoding, encoded as standard
+// base64. Values must be a proto.Message.
+type ProtoCodec struct{}
+
+// Marshal satisfies the Codec interface.
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("payload type %T is not a proto.Message", v)
+	}
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return base64Encode(buf), nil
+}
+
+// Unmarshal satisfies the Codec interface.
+func (ProtoCodec) Unmarshal(buf []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("payload type %T is not a proto.Message", v)
+	}
+	b, err := base64Decode(buf)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, msg)
+}
+
+// MsgpackCodec is a codec using MessagePack, encoded as standard base64.
+type MsgpackCodec struct{}
+
+// Marshal satisfies the Codec interface.
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	buf, err := msgpack.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return base64Encode(buf), nil
+}
+
+// Unmarshal satisfies the Codec interface.
+func (MsgpackCodec) Unmarshal(buf []byte, v interface{}) error {
+	b, err := base64Decode(buf)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(b, v)
+}
+
+// base64Encode encodes buf as standard base64.
+func base64Encode(buf []byte) []byte {
+	b := make([]byte, base64.StdEncoding.EncodedLen(len(buf)))
+	base64.StdEncoding.Encode(b, buf)
+	return b
+}
+
+// base64Decode decodes standard base64 encoded buf.
+func base64Decode(buf []byte) ([]byte, error) {
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(buf)))
+	n, err := base64.StdEncoding.Decode(b, buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode payload: %w", err)
+	}
+	return b[:n], nil
+}
+
+// codecs are the registered remote procedure call codecs.
+var codecs = struct {
+	m  map[string]Codec
+	rw sync.RWMutex
+}{
+	m: make(map[string]Codec),
+}
+
+// RegisterRpcCodec registers the codec for the remote procedure call id.
+// Payloads for the remote procedure call are encoded with the codec, for both
+// http requests and realtime messages. A nil codec removes the registration.
+func RegisterRpcCodec(id string, codec Codec) {
+	codecs.rw.Lock()
+	defer codecs.rw.Unlock()
+	if codec == nil {
+		delete(codecs.m, id)
+		return
+	}
+	codecs.m[id] = codec
+}
+
+// RpcCodec returns the codec registered for the remote procedure call id, or
+// nil when no codec is registered.
+func RpcCodec(id string) Codec {
+	codecs.rw.RLock()
+	defer codecs.rw.RUnlock()
+	return codecs.m[id]
+}
+
+// RpcCall is a typed remote procedure call, with request payload type Req and
+// response payload type Res, usable with both a Client and a Conn.
+type RpcCall[Req, Res any] struct {
+	id    string
+	codec Codec
+}
+
+// NewRpcCall creates a typed remote procedure call. When codec is nil, the
+// codec registered for the id is used, or JsonCodec when none is registered.
+func NewRpcCall[Req, Res any](id string, codec Codec) RpcCall[Req, Res] {
+	return RpcCall[Req, Res]{
+		id:    id,
+		codec: codec,
+	}
+}
+
+// Id returns the remote procedure call id.
+func (call RpcCall[Req, Res]) Id() string {
+	return call.id
+}
+
+// Codec returns the codec used for the remote procedure call.
+func (call RpcCall[Req, Res]) Codec() Codec {
+	if call.codec != nil {
+		return call.codec
+	}
+	if codec := RpcCodec(call.id); codec != nil {
+		return codec
+	}
+	return JsonCodec{}
+}
+
+// Do executes the remote procedure call against the context and client.
+func (call RpcCall[Req, Res]) Do(ctx context.Context, cl *Client, req Req) (Res, error) {
+	res, v := newTarget[Res]()
+	if err := Rpc(call.id, req, v).WithCodec(call.Codec()).Do(ctx, cl); err != nil {
+		var zero Res
+		return zero, err
+	}
+	return fromTarget[Res](res, v), nil
+}
+
+// Async executes the remote procedure call against the context and client.
+func (call RpcCall[Req, Res]) Async(ctx context.Context, cl *Client, req Req, f func(Res, error)) {
+	go func() {
+		if res, err := call.Do(ctx, cl, req); f != nil {
+			f(res, err)
+		}
+	}()
+}
+
+// Send sends the remote procedure call on the connection.
+func (call RpcCall[Req, Res]) Send(ctx context.Context, conn *Conn, req Req) (Res, error) {
+	res, v := newTarget[Res]()
+	if err := Rpc(call.id, req, v).WithCodec(call.Codec()).Send(ctx, conn); err != nil {
+		var zero Res
+		return zero, err
+	}
+	return fromTarget[Res](res, v), nil
+}
+
+// SendAsync sends the remote procedure call on the connection.
+func (call RpcCall[Req, Res]) SendAsync(ctx context.Context, conn *Conn, req Req, f func(Res, error)) {
+	go func() {
+		if res, err := call.Send(ctx, conn, req); f != nil {
+			f(res, err)
+		}
+	}()
+}
+
+// newTarget returns the value to decode a value of type T to. Pointer types
+// are allocated and decoded to directly (so that a proto.Message can be
+// decoded), otherwise a pointer to a T is returned.
+func newTarget[T any]() (T, interface{}) {
+	var v T
+	if typ := reflect.TypeOf(v); typ != nil && typ.Kind() == reflect.Pointer {
+		v = reflect.New(typ.Elem()).Interface().(T)
+		return v, v
+	}
+	return v, &v
+}
+
+// fromTarget returns the decoded value from the values returned by
+// newTarget.
+func fromTarget[T any](v T, target interface{}) T {
+	if p, ok := target.(*T); ok {
+		return *p
+	}
+	return v
+}
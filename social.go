@@ -0,0 +1,275 @@
+package nakama
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// SocialGraph is a local cache of the user's friends, grouped by friend
+// state.
+//
+// The graph is loaded with Load, and is kept up to date by its actions and
+// by friend notifications. Attach the graph to a connection (see Attach) to
+// receive friend notifications.
+//
+// Actions update the graph optimistically before sending the request, and
+// roll back the update when the request fails.
+type SocialGraph struct {
+	cl      *Client
+	friends map[string]*Friend
+	rw      sync.RWMutex
+}
+
+// NewSocialGraph creates a social graph for the client.
+func NewSocialGraph(cl *Client) *SocialGraph {
+	return &SocialGraph{
+		cl:      cl,
+		friends: make(map[string]*Friend),
+	}
+}
+
+// Load loads all of the user's friends, replacing the graph.
+func (g *SocialGraph) Load(ctx context.Context) error {
+	friends, err := Friends().Iter(ctx, g.cl).All(0)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*Friend, len(friends))
+	for _, friend := range friends {
+		m[friend.User.GetId()] = friend
+	}
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	g.friends = m
+	return nil
+}
+
+// Friend returns the user's friend entry, or nil when the user is not in the
+// graph.
+func (g *SocialGraph) Friend(userId string) *Friend {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	return g.friends[userId]
+}
+
+// State returns the user's friend state, and whether the user is in the
+// graph.
+func (g *SocialGraph) State(userId string) (FriendState, bool) {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	if friend, ok := g.friends[userId]; ok {
+		return FriendState(friend.State.GetValue()), true
+	}
+	return 0, false
+}
+
+// Friends returns the friends with the state, ordered by username.
+func (g *SocialGraph) Friends(state FriendState) []*Friend {
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	var friends []*Friend
+	for _, friend := range g.friends {
+		if FriendState(friend.State.GetValue()) == state {
+			friends = append(friends, friend)
+		}
+	}
+	sort.Slice(friends, func(i, j int) bool {
+		if a, b := friends[i].User.GetUsername(), friends[j].User.GetUsername(); a != b {
+			return a < b
+		}
+		return friends[i].User.GetId() < friends[j].User.GetId()
+	})
+	return friends
+}
+
+// Mutual returns the mutual friends.
+func (g *SocialGraph) Mutual() []*Friend {
+	return g.Friends(FriendState_FRIEND)
+}
+
+// InvitesSent returns the users sent a friend request.
+func (g *SocialGraph) InvitesSent() []*Friend {
+	return g.Friends(FriendState_INVITE_SENT)
+}
+
+// InvitesReceived returns the users that sent a friend request.
+func (g *SocialGraph) InvitesReceived() []*Friend {
+	return g.Friends(FriendState_INVITE_RECEIVED)
+}
+
+// Blocked returns the blocked users.
+func (g *SocialGraph) Blocked() []*Friend {
+	return g.Friends(FriendState_BLOCKED)
+}
+
+// SendRequest sends a friend request to the user. When the user has sent a
+// friend request, the request is accepted.
+func (g *SocialGraph) SendRequest(ctx context.Context, userId string) error {
+	state := FriendState_INVITE_SENT
+	if s, ok := g.State(userId); ok && s == FriendState_INVITE_RECEIVED {
+		state = FriendState_FRIEND
+	}
+	return g.apply(ctx, userId, &state, AddFriends(userId).Do)
+}
+
+// Accept accepts the user's friend request. Returns
+// ErrFriendRequestNotReceived when the user has not sent a friend request.
+func (g *SocialGraph) Accept(ctx context.Context, userId string) error {
+	if s, ok := g.State(userId); !ok || s != FriendState_INVITE_RECEIVED {
+		return ErrFriendRequestNotReceived
+	}
+	state := FriendState_FRIEND
+	return g.apply(ctx, userId, &state, AddFriends(userId).Do)
+}
+
+// Decline declines the user's friend request.
+func (g *SocialGraph) Decline(ctx context.Context, userId string) error {
+	return g.Remove(ctx, userId)
+}
+
+// Remove removes the user as a friend, cancels a sent friend request, or
+// unblocks the user.
+func (g *SocialGraph) Remove(ctx context.Context, userId string) error {
+	return g.apply(ctx, userId, nil, DeleteFriends(userId).Do)
+}
+
+// Block blocks the user.
+func (g *SocialGraph) Block(ctx context.Context, userId string) error {
+	state := FriendState_BLOCKED
+	return g.apply(ctx, userId, &state, BlockFriends(userId).Do)
+}
+
+// apply sets the user's state (removing the user when nil), and executes the
+// request, restoring the user's previous state when the request fails. The
+// previous state is not restored when the user's entry was updated while the
+// request was in flight.
+func (g *SocialGraph) apply(ctx context.Context, userId string, state *FriendState, do func(context.Context, *Client) error) error {
+	g.rw.Lock()
+	prev, ok := g.friends[userId]
+	g.set(userId, nil, state)
+	cur := g.friends[userId]
+	g.rw.Unlock()
+	if err := do(ctx, g.cl); err != nil {
+		g.rw.Lock()
+		defer g.rw.Unlock()
+		switch {
+		case g.friends[userId] != cur:
+		case ok:
+			g.friends[userId] = prev
+		default:
+			delete(g.friends, userId)
+		}
+		return err
+	}
+	if state != nil && !ok {
+		g.fill(ctx, userId)
+	}
+	return nil
+}
+
+// set sets the user's state, removing the user when state is nil. Must be
+// called with the lock held.
+func (g *SocialGraph) set(userId string, user *User, state *FriendState) {
+	if state == nil {
+		delete(g.friends, userId)
+		return
+	}
+	friend := &Friend{
+		User: &User{
+			Id: userId,
+		},
+		State:      wrapperspb.Int32(int32(*state)),
+		UpdateTime: timestamppb.Now(),
+	}
+	if prev, ok := g.friends[userId]; ok {
+		friend.User = prev.User
+	}
+	if user != nil {
+		friend.User = user
+	}
+	g.friends[userId] = friend
+}
+
+// fill retrieves the user's details, for users added to the graph without
+// them.
+func (g *SocialGraph) fill(ctx context.Context, userId string) {
+	res, err := g.cl.Users(ctx, userId)
+	if err != nil || len(res.Users) == 0 {
+		return
+	}
+	g.rw.Lock()
+	defer g.rw.Unlock()
+	if friend, ok := g.friends[userId]; ok {
+		friend = proto.Clone(friend).(*Friend)
+		friend.User = res.Users[0]
+		g.friends[userId] = friend
+	}
+}
+
+// Attach attaches the graph to the connection, updating the graph from the
+// connection's friend notifications. Returns a func that detaches the graph
+// from the connection.
+func (g *SocialGraph) Attach(conn *Conn) func() {
+	return conn.listen(&connListener{
+		notify: g.notify,
+	})
+}
+
+// notify handles a connection notification, updating the graph from friend
+// notifications.
+func (g *SocialGraph) notify(ctx context.Context, env *Envelope) {
+	msg := env.GetNotifications()
+	if msg == nil {
+		return
+	}
+	for _, n := range msg.Notifications {
+		var state FriendState
+		switch n.Code {
+		case NotificationFriendRequest:
+			state = FriendState_INVITE_RECEIVED
+		case NotificationFriendAccept:
+			state = FriendState_FRIEND
+		default:
+			continue
+		}
+		var content struct {
+			Username string `json:"username"`
+		}
+		_ = json.Unmarshal([]byte(n.Content), &content)
+		g.rw.Lock()
+		prev, ok := g.friends[n.SenderId]
+		var user *User
+		if !ok {
+			user = &User{
+				Id:       n.SenderId,
+				Username: content.Username,
+			}
+		}
+		if !ok || FriendState(prev.State.GetValue()) != FriendState_BLOCKED {
+			g.set(n.SenderId, user, &state)
+		}
+		g.rw.Unlock()
+		if !ok {
+			go g.fill(ctx, n.SenderId)
+		}
+	}
+}
+
+// SocialGraphError is a social graph error.
+type SocialGraphError string
+
+const (
+	// ErrFriendRequestNotReceived is the friend request not received error.
+	ErrFriendRequestNotReceived SocialGraphError = "friend request not received"
+)
+
+// Error satisfies the error interface.
+func (err SocialGraphError) Error() string {
+	return string(err)
+}
@@ -0,0 +1,146 @@
+package nakama
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// SessionStore is the interface for session stores, used to persist a
+// client's session across process restarts.
+//
+// Load returns a nil session and no error when no session has been saved.
+type SessionStore interface {
+	Load() (*SessionResponse, error)
+	Save(*SessionResponse) error
+	Clear() error
+}
+
+// MemorySessionStore is an in-memory session store.
+type MemorySessionStore struct {
+	session *SessionResponse
+	rw      sync.RWMutex
+}
+
+// NewMemorySessionStore creates a new in-memory session store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return new(MemorySessionStore)
+}
+
+// Load satisfies the SessionStore interface.
+func (store *MemorySessionStore) Load() (*SessionResponse, error) {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	if store.session == nil {
+		return nil, nil
+	}
+	return proto.Clone(store.session).(*SessionResponse), nil
+}
+
+// Save satisfies the SessionStore interface.
+func (store *MemorySessionStore) Save(session *SessionResponse) error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	store.session = proto.Clone(session).(*SessionResponse)
+	return nil
+}
+
+// Clear satisfies the SessionStore interface.
+func (store *MemorySessionStore) Clear() error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	store.session = nil
+	return nil
+}
+
+// FileSessionStore is a file-backed session store. Sessions are written as
+// JSON, readable only by the current user.
+type FileSessionStore struct {
+	path string
+	rw   sync.RWMutex
+}
+
+// NewFileSessionStore creates a new file-backed session store, saving the
+// session to the file at path.
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{
+		path: path,
+	}
+}
+
+// Load satisfies the SessionStore interface.
+func (store *FileSessionStore) Load() (*SessionResponse, error) {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	buf, err := os.ReadFile(store.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to load session: %w", err)
+	}
+	return unmarshalSession(buf)
+}
+
+// Save satisfies the SessionStore interface. The session is written to a
+// temporary file that is then renamed, so that a partially written session is
+// never loaded.
+func (store *FileSessionStore) Save(session *SessionResponse) error {
+	buf, err := protojson.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("unable to save session: %w", err)
+	}
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	if err := writeFile(store.path, buf); err != nil {
+		return fmt.Errorf("unable to save session: %w", err)
+	}
+	return nil
+}
+
+// Clear satisfies the SessionStore interface.
+func (store *FileSessionStore) Clear() error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+	if err := os.Remove(store.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to clear session: %w", err)
+	}
+	return nil
+}
+
+// writeFile writes buf to a temporary file that is then renamed to path,
+// creating the parent directory when it does not exist. The file is readable
+// only by the current user.
+func writeFile(path string, buf []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// unmarshalSession unmarshals a session saved by a session store.
+func unmarshalSession(buf []byte) (*SessionResponse, error) {
+	session := new(SessionResponse)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(buf, session); err != nil {
+		return nil, fmt.Errorf("unable to load session: %w", err)
+	}
+	return session, nil
+}
@@ -0,0 +1,70 @@
+//go:build js
+
+package nakama
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// LocalStorageSessionStore is a session store using the browser's
+// localStorage.
+type LocalStorageSessionStore struct {
+	key string
+}
+
+// NewLocalStorageSessionStore creates a new localStorage session store,
+// saving the session under key.
+func NewLocalStorageSessionStore(key string) *LocalStorageSessionStore {
+	return &LocalStorageSessionStore{
+		key: key,
+	}
+}
+
+// Load satisfies the SessionStore interface.
+func (store *LocalStorageSessionStore) Load() (*SessionResponse, error) {
+	storage, err := localStorage()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load session: %w", err)
+	}
+	v := storage.Call("getItem", store.key)
+	if v.IsNull() || v.IsUndefined() {
+		return nil, nil
+	}
+	return unmarshalSession([]byte(v.String()))
+}
+
+// Save satisfies the SessionStore interface.
+func (store *LocalStorageSessionStore) Save(session *SessionResponse) error {
+	buf, err := protojson.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("unable to save session: %w", err)
+	}
+	storage, err := localStorage()
+	if err != nil {
+		return fmt.Errorf("unable to save session: %w", err)
+	}
+	storage.Call("setItem", store.key, string(buf))
+	return nil
+}
+
+// Clear satisfies the SessionStore interface.
+func (store *LocalStorageSessionStore) Clear() error {
+	storage, err := localStorage()
+	if err != nil {
+		return fmt.Errorf("unable to clear session: %w", err)
+	}
+	storage.Call("removeItem", store.key)
+	return nil
+}
+
+// localStorage returns the browser's localStorage.
+func localStorage() (js.Value, error) {
+	storage := js.Global().Get("localStorage")
+	if storage.IsNull() || storage.IsUndefined() {
+		return js.Value{}, fmt.Errorf("localStorage is not available")
+	}
+	return storage, nil
+}